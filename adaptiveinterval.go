@@ -0,0 +1,49 @@
+package dynsampler
+
+import (
+	"math"
+	"time"
+)
+
+// adaptiveInterval tracks the recalculation interval for samplers with
+// AdaptiveInterval set. It shortens the interval when the rate of traffic
+// changes sharply from one interval to the next, and lengthens it again while
+// traffic is stable. The zero value is ready to use. It is not safe for
+// concurrent use; callers are expected to hold the owning sampler's lock.
+type adaptiveInterval struct {
+	current  time.Duration
+	lastRate float64
+	haveLast bool
+}
+
+// next takes the number of events seen during the interval that just ended and
+// returns the interval to use next, between floor and ceiling. Traffic is
+// compared as a rate per second, so intervals of different lengths can be
+// compared. A change in rate of more than threshold (as a fraction of the
+// previous rate) halves the interval; anything less doubles it. Intervals with
+// no traffic leave it unchanged.
+func (a *adaptiveInterval) next(sum float64, floor, ceiling time.Duration, threshold float64) time.Duration {
+	if a.current == 0 {
+		a.current = ceiling
+	}
+	if sum > 0 {
+		rate := sum / a.current.Seconds()
+		if a.haveLast {
+			change := math.Abs(rate-a.lastRate) / math.Max(a.lastRate, 1)
+			if change > threshold {
+				a.current /= 2
+			} else {
+				a.current *= 2
+			}
+		}
+		a.lastRate = rate
+		a.haveLast = true
+	}
+	if a.current < floor {
+		a.current = floor
+	}
+	if a.current > ceiling {
+		a.current = ceiling
+	}
+	return a.current
+}
@@ -0,0 +1,58 @@
+package dynsampler
+
+// ageOutGrace counts the consecutive intervals that keys in an EMA have spent
+// below AgeOutValue, so that each can be given AgeOutGraceIntervals before it
+// is removed. The zero value is ready to use.
+type ageOutGrace struct {
+	below map[string]int
+}
+
+// keep records another interval in which key's average was below AgeOutValue
+// and reports whether the key is still within its grace period. A key that was
+// seen in the interval starts counting again.
+func (g *ageOutGrace) keep(key string, seen bool, intervals int) bool {
+	if intervals <= 1 {
+		return false
+	}
+	if g.below == nil {
+		g.below = make(map[string]int)
+	}
+	if seen {
+		g.below[key] = 0
+	} else {
+		g.below[key]++
+	}
+	if g.below[key] < intervals {
+		return true
+	}
+	delete(g.below, key)
+	return false
+}
+
+// forget stops counting for key, whose average is back at or above
+// AgeOutValue, or which has just been added to the EMA.
+func (g *ageOutGrace) forget(key string) {
+	delete(g.below, key)
+}
+
+// snapshot returns a copy of the counts, or nil if there are none.
+func (g *ageOutGrace) snapshot() map[string]int {
+	if len(g.below) == 0 {
+		return nil
+	}
+	return copyRates(g.below)
+}
+
+// clone returns a copy of g, which an EMA updates outside its lock and then
+// swaps in, while Snapshot may be reading the original.
+func (g *ageOutGrace) clone() ageOutGrace {
+	return ageOutGrace{below: g.snapshot()}
+}
+
+// restore replaces the counts with a copy of below.
+func (g *ageOutGrace) restore(below map[string]int) {
+	g.below = nil
+	if len(below) > 0 {
+		g.below = copyRates(below)
+	}
+}
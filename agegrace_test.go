@@ -0,0 +1,58 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMAThroughputAgeOutGrace(t *testing.T) {
+	e := &EMAThroughput{
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		AgeOutGraceIntervals: 2,
+		movingAverage:        map[string]float64{"intermittent": 0.8},
+	}
+	// one quiet interval dips below AgeOutValue, but the key survives it
+	e.updateEMA(map[string]float64{})
+	assert.Equal(t, 0.4, e.movingAverage["intermittent"])
+
+	// and it reappears
+	e.updateEMA(map[string]float64{"intermittent": 2})
+	assert.Equal(t, 1.2, e.movingAverage["intermittent"])
+
+	// two quiet intervals below AgeOutValue in a row remove it
+	e.updateEMA(map[string]float64{})
+	e.updateEMA(map[string]float64{})
+	assert.Contains(t, e.movingAverage, "intermittent")
+	e.updateEMA(map[string]float64{})
+	assert.NotContains(t, e.movingAverage, "intermittent")
+	assert.Empty(t, e.ageOutGrace.below)
+
+	// without a grace period it goes at once
+	e.AgeOutGraceIntervals = 0
+	e.movingAverage["intermittent"] = 0.8
+	e.updateEMA(map[string]float64{})
+	assert.NotContains(t, e.movingAverage, "intermittent")
+}
+
+func TestEMASampleRateAgeOutGrace(t *testing.T) {
+	e := &EMASampleRate{
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		AgeOutGraceIntervals: 3,
+		movingAverage:        map[string]float64{"intermittent": 0.8},
+	}
+	e.updateEMA(map[string]float64{})
+	e.updateEMA(map[string]float64{})
+	assert.Equal(t, 0.2, e.movingAverage["intermittent"])
+
+	// seen again, but not enough to lift it above AgeOutValue, so the grace
+	// period starts over
+	e.updateEMA(map[string]float64{"intermittent": 0.2})
+	e.updateEMA(map[string]float64{})
+	e.updateEMA(map[string]float64{})
+	assert.Contains(t, e.movingAverage, "intermittent")
+	e.updateEMA(map[string]float64{})
+	assert.NotContains(t, e.movingAverage, "intermittent")
+}
@@ -3,8 +3,7 @@ package dynsampler
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"math"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,16 +28,156 @@ type AvgSampleRate struct {
 	// If neither one is set, the default is 30s.
 	ClearFrequencyDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// GoalSampleRate is the average sample rate we're aiming for, across all
-	// events. Default 10
+	// events. Default 10. A GoalSampleRate of 1 keeps everything, as if KeepAll
+	// were set.
 	GoalSampleRate int
 
+	// TargetKeptPerInterval, if greater than 0, replaces GoalSampleRate with a
+	// number of events to keep each interval, however many arrive, for sinks
+	// with a fixed budget. Rates are calculated so that the last interval's
+	// traffic would have kept about that many events, or all of them if there
+	// were fewer. The target is per interval, not per second, so it is only a
+	// steady rate if intervals are: with NoBackgroundGoroutine and irregular
+	// calls to Update, a long interval keeps no more than a short one, and
+	// rates calculated over a short interval keep too much over a long one.
+	// GoalSampleRate is still used for ColdStartRate's default and KeepAll.
+	// Defaults to 0.
+	TargetKeptPerInterval int
+
+	// KeepAll, if true, makes the sampler return a sample rate of 1 for every
+	// key, passing all traffic through while still counting it for metrics.
+	// Sample rates are not calculated while KeepAll is in effect. Use SetKeepAll
+	// to change it on a running sampler.
+	KeepAll bool
+
+	// PinnedKeys lists keys that are important but intermittent. Normally a key
+	// that is quiet for an interval loses its calculated sample rate and is
+	// sampled at 1 when it comes back, until the next calculation. A pinned key
+	// instead keeps the last rate calculated for it until it has traffic again.
+	// This includes intervals with no traffic at all, which clear every other
+	// key's rate.
+	PinnedKeys []string
+
+	// ColdStartRate, if greater than 0, is the sample rate returned for all keys
+	// before the first set of sample rates has been calculated. Keys are still
+	// counted during this period, subject to MaxKeys. If unset, GoalSampleRate is
+	// used.
+	ColdStartRate int
+
+	// UnknownKeyRate, if greater than 0, is the sample rate returned for a key
+	// that has no calculated sample rate once the sampler has data: a key that
+	// is new, or that went quiet and lost its rate. The default of 1 keeps every
+	// event for such keys until rates are next calculated, which keeps traces
+	// through rare keys complete, but lets a brand new high-volume key through
+	// unsampled for up to an interval. A higher value, such as GoalSampleRate,
+	// guards against that flood at the cost of dropping events from rare keys,
+	// which can leave gaps in the traces they belong to.
+	UnknownKeyRate int
+
+	// KeyConstraints bounds the sample rates given to particular keys, in one
+	// place. The rate the sampler would otherwise give a listed key, whether
+	// calculated, ColdStartRate, or UnknownKeyRate, is raised to its Min or
+	// lowered to its Max. These samplers have no MinSampleRate or
+	// MaxSampleRate of their own, so per-key bounds are the only bounds, and
+	// KeepAll, which keeps everything, takes precedence over them. Keys are
+	// matched as GetSampleRate would count them, after MaxKeyLength is
+	// applied. Keys that aren't listed aren't constrained.
+	KeyConstraints map[string]KeyConstraint
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
 	// the sample rate map within the interval defined by `ClearFrequencyDuration`. Once
 	// MaxKeys is reached, new keys will not be included in the sample rate map, but
 	// existing keys will continue to be be counted.
 	MaxKeys int
 
+	// KeyOrder is the order in which keys are visited when dividing up the
+	// budget of events to keep, which decides which keys benefit from budget
+	// left unused by quiet keys. See KeyOrder for details. Defaults to
+	// KeyOrderLexical.
+	KeyOrder KeyOrder
+
+	// ExtraBudgetPolicy decides how budget left unused by quiet keys is shared
+	// among the keys visited after them. See ExtraBudgetPolicy for details.
+	// Defaults to ExtraBudgetEqual.
+	ExtraBudgetPolicy ExtraBudgetPolicy
+
+	// SnapToNiceRates, if true, rounds each calculated sample rate to the
+	// nearest of a set of round numbers, so that rates are easier for people
+	// to read. This moves throughput away from the goal. With the default 1,
+	// 2, 5 series, a key can keep up to about 60% more or 40% fewer events
+	// than its calculated rate would, though across many keys the differences
+	// largely cancel out. Defaults to false.
+	SnapToNiceRates bool
+
+	// NiceRates are the rates SnapToNiceRates rounds to. Defaults to the
+	// series 1, 2, 5, 10, 20, 50, 100, and so on.
+	NiceRates []int
+
+	// OnKeyRateChange, if set, is called at the end of an interval for each
+	// watched key whose sample rate changed, with its old and new rates. A key
+	// with no rate, because it is new or has gone quiet, has a rate of 0. It
+	// is called from the goroutine that recalculates rates, without the
+	// sampler's lock held, so it may call the sampler, but a slow callback
+	// delays the next interval's rates.
+	OnKeyRateChange func(key string, oldRate, newRate int)
+
+	// WatchKeys lists the keys OnKeyRateChange is called for. If it is empty,
+	// the callback is called for every key whose rate changed.
+	WatchKeys []string
+
+	// HeavySampleThreshold is the sample rate above which a key counts as
+	// heavily sampled in the keys_above_threshold metric. A rising number of
+	// such keys means the budget is being concentrated in fewer keys. Defaults
+	// to 100.
+	HeavySampleThreshold int
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// HierarchicalLookup, if true, changes what happens when a key has no
+	// calculated sample rate. Instead of getting a rate of 1, the key is
+	// treated as a path of segments divided by Separator, and the last segment
+	// is trimmed off repeatedly until a key with a rate is found. For example,
+	// with a Separator of "/", "route:/users/42" falls back to "route:/users"
+	// and then "route:". Each fallback costs an extra map lookup, so a key with
+	// many segments and no matching parent costs one lookup per segment.
+	HierarchicalLookup bool
+
+	// Separator divides the segments of a key for HierarchicalLookup.
+	// Default "/" when HierarchicalLookup is set.
+	Separator string
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]float64
 
@@ -48,22 +187,77 @@ type AvgSampleRate struct {
 	haveData bool
 	done     chan struct{}
 
+	// frozen stops updateMaps from calculating new rates. See Freeze.
+	frozen bool
+
+	// updating is set while updateMaps calculates new rates without the lock,
+	// and resetKeys holds the keys reset meanwhile, to forget once it's done
+	updating  bool
+	resetKeys []string
+
+	// lastCounts holds the counts of the last interval. See
+	// GetLastIntervalCounts.
+	lastCounts map[string]float64
+
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
-	requestCount int64
-	eventCount   int64
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	effectiveRate int64      // thousandths, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*AvgSampleRate)(nil)
 
-func (a *AvgSampleRate) Start() error {
-	// apply defaults
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (a *AvgSampleRate) Validate() error {
 	if a.ClearFrequencyDuration != 0 && a.ClearFrequencySec != 0 {
-		return fmt.Errorf("the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+		return newConfigError(ErrConflictingIntervalConfig, "the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	}
+	if a.ClearFrequencyDuration < 0 || a.ClearFrequencySec < 0 {
+		return newConfigError(ErrInvalidInterval, "the clear frequency must not be negative")
+	}
+	if a.GoalSampleRate < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalSampleRate %d must not be negative", a.GoalSampleRate)
+	}
+	if a.TargetKeptPerInterval < 0 {
+		return newConfigError(ErrInvalidGoal, "the TargetKeptPerInterval %d must not be negative", a.TargetKeptPerInterval)
+	}
+	if a.UnknownKeyRate < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the UnknownKeyRate %d must not be negative", a.UnknownKeyRate)
+	}
+	if a.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", a.HeavySampleThreshold)
+	}
+	if err := validateNiceRates(a.NiceRates); err != nil {
+		return err
+	}
+	if err := validateKeyConstraints(a.KeyConstraints); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *AvgSampleRate) Start() error {
+	if err := a.Validate(); err != nil {
+		return err
 	}
 
+	// apply defaults
 	if a.ClearFrequencyDuration == 0 && a.ClearFrequencySec == 0 {
 		a.ClearFrequencyDuration = 30 * time.Second
 	} else if a.ClearFrequencySec != 0 {
@@ -73,15 +267,26 @@ func (a *AvgSampleRate) Start() error {
 	if a.GoalSampleRate == 0 {
 		a.GoalSampleRate = 10
 	}
+	if a.HierarchicalLookup && a.Separator == "" {
+		a.Separator = "/"
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", a.ClearFrequencyDuration); err != nil {
+		return err
+	}
 
 	// initialize internal variables
 	// Create saved sample rate map if we're not loading from a previous state
 	if a.savedSampleRates == nil {
-		a.savedSampleRates = make(map[string]int)
+		a.savedSampleRates = make(map[string]int, a.ExpectedKeys)
 	}
-	a.currentCounts = make(map[string]float64)
+	a.currentCounts = make(map[string]float64, a.ExpectedKeys)
 	a.done = make(chan struct{})
 
+	if a.NoBackgroundGoroutine {
+		return nil
+	}
+
 	// spin up calculator
 	go func() {
 		ticker := time.NewTicker(a.ClearFrequencyDuration)
@@ -100,49 +305,203 @@ func (a *AvgSampleRate) Start() error {
 
 func (a *AvgSampleRate) Stop() error {
 	close(a.done)
+	exportRates(a.ExportOnStop, &a.lock, &a.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (a *AvgSampleRate) Update() {
+	a.updateMaps()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (a *AvgSampleRate) updateMaps() {
+	// rate changes are reported after the deferred unlocks below have run
+	var changes []rateChange
+	defer func() { notifyRateChanges(a.OnKeyRateChange, changes) }()
+
 	// make a local copy of the sample counters for calculation
 	a.lock.Lock()
 	tmpCounts := a.currentCounts
-	a.currentCounts = make(map[string]float64)
+	a.keyspace.observe(len(tmpCounts))
+	a.intervalCount++
+	a.currentCounts = make(map[string]float64, a.ExpectedKeys)
+	a.lastCounts = tmpCounts
+	if a.frozen {
+		// the counts are dropped so the saved rates stay as they are
+		a.lock.Unlock()
+		return
+	}
+	keepAll := a.keepAll()
+	a.updating = true
 	a.lock.Unlock()
+	// in keep-all mode every key gets a rate of 1, so there's nothing to calculate
+	if keepAll {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.keptFraction = 1e6
+		a.effectiveRate = 1e3
+		a.finishResets()
+		return
+	}
 	// short circuit if no traffic
 	numKeys := len(tmpCounts)
 	if numKeys == 0 {
 		// no traffic the last 30s. clear the result map
 		a.lock.Lock()
 		defer a.lock.Unlock()
-		a.savedSampleRates = make(map[string]int)
+		newSavedSampleRates := make(map[string]int)
+		heavy := newHeavyKeys(a.HeavySampleThreshold)
+		carryPinnedRates(a.PinnedKeys, a.savedSampleRates, newSavedSampleRates, heavy)
+		if a.OnKeyRateChange != nil {
+			changes = diffRates(a.WatchKeys, a.savedSampleRates, newSavedSampleRates)
+		}
+		a.savedSampleRates = newSavedSampleRates
+		a.heavyKeys = heavy
+		a.finishResets()
 		return
 	}
 
-	// Goal events to send this interval is the total count of received events
-	// divided by the desired average sample rate
-	var sumEvents float64
-	for _, count := range tmpCounts {
-		sumEvents += count
-	}
-	goalCount := sumEvents / float64(a.GoalSampleRate)
-	// goalRatio is the goalCount divided by the sum of all the log values - it
-	// determines what percentage of the total event space belongs to each key
-	var logSum float64
-	for _, count := range tmpCounts {
-		logSum += math.Log10(count)
-	}
-	goalRatio := goalCount / logSum
+	goalRatio, sumEvents := averageGoalRatio(tmpCounts, a.GoalSampleRate, a.TargetKeptPerInterval)
 
-	newSavedSampleRates := calculateSampleRates(goalRatio, tmpCounts)
+	heavy := newHeavyKeys(a.HeavySampleThreshold)
+	newSavedSampleRates, kept := calculateSampleRates(goalRatio, tmpCounts, a.KeyOrder, a.ExtraBudgetPolicy, heavy)
+	if a.SnapToNiceRates {
+		kept = snapToNiceRates(newSavedSampleRates, tmpCounts, a.NiceRates, heavy)
+	}
 	a.lock.Lock()
 	defer a.lock.Unlock()
+	carryPinnedRates(a.PinnedKeys, a.savedSampleRates, newSavedSampleRates, heavy)
+	if a.OnKeyRateChange != nil {
+		changes = diffRates(a.WatchKeys, a.savedSampleRates, newSavedSampleRates)
+	}
 	a.savedSampleRates = newSavedSampleRates
+	a.heavyKeys = heavy
+	a.finishResets()
+	a.keptFraction = keptFractionPPM(kept, sumEvents)
+	a.effectiveRate = effectiveRateMilli(kept, sumEvents)
 	a.haveData = true
 }
 
+// ResetKey forgets everything the sampler knows about key - its count in the
+// current interval and its sample rate - so that it is treated as a new key
+// the next time it is seen. Other keys are not affected. This is useful when a
+// key's rate has gone wrong and needs to start over. It is safe to call while
+// the sampler is running.
+func (a *AvgSampleRate) ResetKey(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.currentCounts, key)
+	if a.updating {
+		// new rates are being calculated from counts that may include the
+		// key right now, so it is forgotten once that's done
+		a.resetKeys = append(a.resetKeys, key)
+		return
+	}
+	a.heavyKeys.remove(a.savedSampleRates, key)
+}
+
+// finishResets forgets the keys reset while rates were being calculated,
+// removing them from the new saved rates, and marks the calculation done. The
+// caller must hold the lock.
+func (a *AvgSampleRate) finishResets() {
+	for _, key := range a.resetKeys {
+		a.heavyKeys.remove(a.savedSampleRates, key)
+	}
+	a.resetKeys = nil
+	a.updating = false
+}
+
+// AdjustCount corrects key's count in the current interval by delta, which
+// may be negative, so that a caller that counted events provisionally, such as
+// a batch that is about to be retried, can take them back. The count never goes
+// below zero. It is not a new request, so metrics are not affected. Keys are
+// matched as GetSampleRate would count them, after MaxKeyLength is applied. It
+// is safe to call while the sampler is running.
+func (a *AvgSampleRate) AdjustCount(key string, delta int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// a throwaway oversizeKeys, so the correction isn't counted as a new key
+	key, track := (&oversizeKeys{}).check(key, a.MaxKeyLength, a.OnOversizeKey)
+	if !track || a.currentCounts == nil {
+		return
+	}
+	adjustCount(a.currentCounts, key, float64(delta), a.MaxKeys)
+}
+
+// Project calculates the sample rates the sampler would use if counts were
+// the number of events seen for each key in an interval, and summarizes what
+// they would keep. It is a what-if for capacity planning: it uses the
+// sampler's configuration but not its traffic, and doesn't change anything.
+// PinnedKeys are not carried over, since they depend on earlier rates.
+func (a *AvgSampleRate) Project(counts map[string]float64) ProjectionResult {
+	a.lock.Lock()
+	keepAll := a.keepAll()
+	a.lock.Unlock()
+	goal := a.GoalSampleRate
+	if goal == 0 {
+		goal = 10
+	}
+	return projectSampleRates(goal, a.TargetKeptPerInterval, keepAll, counts, a.KeyOrder, a.ExtraBudgetPolicy)
+}
+
+// GetLastIntervalCounts returns the number of events seen for each key in the
+// last complete interval, the counts the current sample rates were calculated
+// from. While the sampler is frozen, they are still replaced at the end of
+// each interval, but the rates aren't, so they describe the traffic rather
+// than the rates. This is useful for building volume dashboards. The map is a
+// copy, so the caller may keep or change it.
+func (a *AvgSampleRate) GetLastIntervalCounts() map[string]float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return copyCounts(a.lastCounts)
+}
+
+// Freeze stops the sampler from calculating new sample rates until Unfreeze is
+// called, so that it keeps serving the rates it has now. This is useful during
+// an incident, when traffic is unusual and shouldn't change the rates. Traffic
+// is still counted for metrics, but the counts are thrown away at the end of
+// each interval rather than used. Keys without a rate get a rate of 1, as
+// usual. It is safe to call while the sampler is running.
+func (a *AvgSampleRate) Freeze() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.frozen = true
+}
+
+// Unfreeze undoes Freeze. New rates are calculated at the end of the next
+// interval from the traffic seen during it.
+func (a *AvgSampleRate) Unfreeze() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.frozen = false
+}
+
+// SetKeepAll turns pass-through mode on or off. It is safe to call while the
+// sampler is running.
+func (a *AvgSampleRate) SetKeepAll(keepAll bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.KeepAll = keepAll
+}
+
+// unknownKeyRate is the sample rate for a key with no calculated rate.
+func (a *AvgSampleRate) unknownKeyRate() int {
+	if a.UnknownKeyRate > 0 {
+		return a.UnknownKeyRate
+	}
+	return 1
+}
+
+// keepAll reports whether every key should get a sample rate of 1. The caller
+// must hold the lock.
+func (a *AvgSampleRate) keepAll() bool {
+	return a.KeepAll || a.GoalSampleRate == 1
+}
+
 // GetSampleRate takes a key and returns the appropriate sample rate for that
 // key.
 func (a *AvgSampleRate) GetSampleRate(key string) int {
@@ -152,49 +511,144 @@ func (a *AvgSampleRate) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (a *AvgSampleRate) GetSampleRateMulti(key string, count int) int {
+	return a.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (a *AvgSampleRate) GetSampleRateMulti64(key string, count int64) int {
+	return a.evaluate(key, count).Rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (a *AvgSampleRate) PeekSampleRate(key string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, a.MaxKeyLength, a.OnOversizeKey)
+	rate, _ := a.chooseRate(key)
+	return rate
+}
+
+// Evaluate is like GetSampleRateMulti, but returns a Result that explains the
+// sample rate as well as giving it.
+func (a *AvgSampleRate) Evaluate(key string, count int) Result {
+	return a.evaluate(key, int64(count))
+}
+
+func (a *AvgSampleRate) evaluate(key string, count int64) Result {
 	a.lock.Lock()
 	defer a.lock.Unlock()
+	if a.currentCounts == nil {
+		// not started yet
+		return newResult(1, SourceColdStart, count)
+	}
 
 	a.requestCount++
-	a.eventCount += int64(count)
+	a.eventCount += count
 
-	// Enforce MaxKeys limit on the size of the map
-	if a.MaxKeys > 0 {
-		// If a key already exists, increment it. If not, but we're under the limit, store a new key
-		if _, found := a.currentCounts[key]; found || len(a.currentCounts) < a.MaxKeys {
+	key, track := a.oversizeKeys.check(key, a.MaxKeyLength, a.OnOversizeKey)
+	counted := track
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if a.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := a.currentCounts[key]; found || len(a.currentCounts) < a.MaxKeys {
+				a.currentCounts[key] += float64(count)
+			} else {
+				a.droppedKeys.add(key)
+				counted = false
+			}
+		} else {
 			a.currentCounts[key] += float64(count)
 		}
-	} else {
-		a.currentCounts[key] += float64(count)
 	}
+	rate, source := a.chooseRate(key)
+	if !counted {
+		source = SourceRejected
+	}
+	return newResult(rate, source, count)
+}
+
+// chooseRate returns the sample rate for key and where it came from. The
+// caller must hold the lock.
+func (a *AvgSampleRate) chooseRate(key string) (int, RateSource) {
+	if a.keepAll() {
+		return 1, SourceOverride
+	}
+	rate, source := a.unconstrainedRate(key)
+	if c, found := a.KeyConstraints[key]; found {
+		return c.clamp(rate, source)
+	}
+	return rate, source
+}
+
+// unconstrainedRate returns the sample rate for key before KeyConstraints are
+// applied. The caller must hold the lock.
+func (a *AvgSampleRate) unconstrainedRate(key string) (int, RateSource) {
 	if !a.haveData {
-		return a.GoalSampleRate
+		if a.ColdStartRate > 0 {
+			return a.ColdStartRate, SourceColdStart
+		}
+		return a.GoalSampleRate, SourceColdStart
 	}
+	if rate, found := a.lookupRate(key); found {
+		return rate, SourceComputed
+	}
+	return a.unknownKeyRate(), SourceUnknownKey
+}
+
+// lookupRate finds the saved sample rate for key, falling back through its
+// parents if HierarchicalLookup is set.
+func (a *AvgSampleRate) lookupRate(key string) (int, bool) {
 	if rate, found := a.savedSampleRates[key]; found {
-		return rate
+		return rate, true
+	}
+	if !a.HierarchicalLookup || a.Separator == "" {
+		return 0, false
+	}
+	for {
+		i := strings.LastIndex(key, a.Separator)
+		if i < 0 {
+			return 0, false
+		}
+		key = key[:i]
+		if rate, found := a.savedSampleRates[key]; found {
+			return rate, true
+		}
 	}
-	return 1
 }
 
+// avgSampleRateState is what SaveState saves for an AvgSampleRate.
 type avgSampleRateState struct {
-	// This field is exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	// These fields are exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	Sampler          string         `json:"sampler,omitempty"`
 	SavedSampleRates map[string]int `json:"saved_sample_rates"`
 }
 
 // SaveState returns a byte array with a JSON representation of the sampler state
 func (a *AvgSampleRate) SaveState() ([]byte, error) {
+	// the rates are copied under the lock and marshaled after it is released,
+	// so sampling is only held up for the copy
 	a.lock.Lock()
-	defer a.lock.Unlock()
-
 	if a.savedSampleRates == nil {
+		a.lock.Unlock()
 		return nil, errors.New("saved sample rate map is nil")
 	}
-	s := &avgSampleRateState{SavedSampleRates: a.savedSampleRates}
+	s := &avgSampleRateState{Sampler: stateSamplerAvgSampleRate, SavedSampleRates: copyRates(a.savedSampleRates)}
+	a.lock.Unlock()
 	return json.Marshal(s)
 }
 
 // LoadState accepts a byte array with a JSON representation of a previous instance's
-// state
+// state. State that is truncated, contains impossible values, or was saved by a
+// different kind of sampler is rejected with an error, leaving the sampler
+// unchanged.
 func (a *AvgSampleRate) LoadState(state []byte) error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
@@ -204,22 +658,90 @@ func (a *AvgSampleRate) LoadState(state []byte) error {
 	if err != nil {
 		return err
 	}
+	if _, err := checkStateSampler(s.Sampler, stateSamplerAvgSampleRate, false); err != nil {
+		return err
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
 
 	// Load the previously calculated sample rates
 	a.savedSampleRates = s.SavedSampleRates
+	a.heavyKeys = countHeavyKeys(s.SavedSampleRates, a.HeavySampleThreshold)
 	// Allow GetSampleRate to return calculated sample rates from the loaded map
 	a.haveData = true
 
 	return nil
 }
 
+// SupportsState reports that SaveState returns the sampler's state, so it is
+// worth persisting.
+func (a *AvgSampleRate) SupportsState() bool {
+	return true
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (a *AvgSampleRate) DroppedKeySamples() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (a *AvgSampleRate) OversizeKeyError() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.oversizeKeys.takeErr()
+}
+
+// GetMetrics returns the sampler's metrics. Along with the metrics common to
+// all samplers, effective_sample_rate is the overall sample rate the last
+// interval's rates would give its traffic, in thousandths, so 10000 is a rate
+// of 10. It should stay close to GoalSampleRate.
 func (a *AvgSampleRate) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(a.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (a *AvgSampleRate) GetMetricsTyped(prefix string) map[string]Metric {
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": a.requestCount,
-		prefix + "event_count":   a.eventCount,
-		prefix + "keyspace_size": int64(len(a.currentCounts)),
+	mets := map[string]Metric{
+		prefix + "request_count":         counter(a.requestCount),
+		prefix + "event_count":           counter(a.eventCount),
+		prefix + "interval_count":        counter(a.intervalCount),
+		prefix + "keyspace_size":         gauge(a.keyspace.report(a.SmoothKeyspaceMetric, int64(len(a.currentCounts)))),
+		prefix + "oversize_key_count":    counter(a.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":         gauge(a.keptFraction),
+		prefix + "effective_sample_rate": gauge(a.effectiveRate),
+		prefix + "keys_above_threshold":  gauge(a.heavyKeys.value()),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (a *AvgSampleRate) GetMetricsSummary(prefix string) map[string]int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return summarizeRates(prefix, a.savedSampleRates, a.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (a *AvgSampleRate) GetAllSampleRates() map[string]int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return copyRates(a.savedSampleRates)
+}
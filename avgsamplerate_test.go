@@ -2,6 +2,7 @@ package dynsampler
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	mrand "math/rand"
@@ -286,6 +287,9 @@ func TestAvgSampleRateMaxKeys(t *testing.T) {
 	a.GetSampleRate("one")
 	assert.Equal(t, 3, len(a.currentCounts))
 	assert.Equal(t, 2., a.currentCounts["one"])
+	// The rejected key should be available as a sample, and reading clears it
+	assert.Equal(t, []string{"four"}, a.DroppedKeySamples())
+	assert.Equal(t, []string{}, a.DroppedKeySamples())
 }
 
 func TestAvgSampleRateSaveState(t *testing.T) {
@@ -434,6 +438,9 @@ func TestAvgSampleRate_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("AvgSampleRate error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("AvgSampleRate error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.ClearFrequencyDuration {
@@ -443,3 +450,429 @@ func TestAvgSampleRate_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestAvgSampleRate_GetMetrics(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate:       10,
+		HeavySampleThreshold: 5,
+	}
+	a.currentCounts = map[string]float64{}
+	a.GetSampleRateMulti("one", 1)
+	a.GetSampleRateMulti("big", 1000)
+
+	mets := a.GetMetrics("a_")
+	assert.Equal(t, int64(2), mets["a_request_count"])
+	assert.Equal(t, int64(1001), mets["a_event_count"])
+	assert.Equal(t, int64(2), mets["a_keyspace_size"])
+	assert.Equal(t, int64(0), mets["a_kept_fraction"])
+	assert.Equal(t, int64(0), mets["a_effective_sample_rate"])
+	assert.Equal(t, int64(0), mets["a_interval_count"])
+	assert.Equal(t, int64(0), mets["a_keys_above_threshold"])
+
+	a.updateMaps()
+	mets = a.GetMetrics("a_")
+	assert.Equal(t, int64(0), mets["a_keyspace_size"])
+	assert.Equal(t, int64(1), mets["a_interval_count"])
+	// "big" gets a rate of 10 and "one" a rate of 1, so 101 of 1001 events are kept
+	assert.Equal(t, int64(100899), mets["a_kept_fraction"])
+	// an overall rate of 1001/101
+	assert.Equal(t, int64(9911), mets["a_effective_sample_rate"])
+	assert.Equal(t, int64(1), mets["a_keys_above_threshold"])
+}
+
+func TestAvgSampleRateKeepAll(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		KeepAll:        true,
+	}
+	a.currentCounts = map[string]float64{}
+	a.savedSampleRates = map[string]int{}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 1, a.GetSampleRateMulti("one", 1000))
+		assert.Equal(t, 1, a.GetSampleRateMulti("two", 1))
+		a.updateMaps()
+		// no rates are computed while keeping everything
+		assert.Equal(t, 0, len(a.savedSampleRates))
+	}
+	mets := a.GetMetrics("")
+	assert.Equal(t, int64(6), mets["request_count"])
+	assert.Equal(t, int64(3003), mets["event_count"])
+	assert.Equal(t, int64(1e6), mets["kept_fraction"])
+	assert.Equal(t, int64(1e3), mets["effective_sample_rate"])
+
+	// turning keep-all off resumes normal sampling
+	a.SetKeepAll(false)
+	a.GetSampleRateMulti("one", 1000)
+	a.GetSampleRateMulti("two", 1)
+	a.updateMaps()
+	assert.Less(t, 1, a.GetSampleRate("one"))
+
+	// a goal sample rate of 1 also keeps everything
+	a.GoalSampleRate = 1
+	assert.Equal(t, 1, a.GetSampleRate("one"))
+}
+
+func TestAvgSampleRateLoadStateInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+	}{
+		{"truncated", `{"saved_sample_rates":{"foo":2,"ba`},
+		{"empty object", `{}`},
+		{"null rates", `{"saved_sample_rates":null}`},
+		{"negative rate", `{"saved_sample_rates":{"foo":2,"bar":-4}}`},
+		{"zero rate", `{"saved_sample_rates":{"foo":0}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AvgSampleRate{}
+			err := a.LoadState([]byte(tt.state))
+			assert.Error(t, err)
+			// a rejected state leaves the sampler cold
+			assert.False(t, a.haveData)
+			assert.Nil(t, a.savedSampleRates)
+		})
+	}
+}
+
+// BenchmarkAvgSampleRateInterval50kKeys runs one full interval with 50,000
+// distinct keys - counting each key and then recalculating rates - with and
+// without ExpectedKeys, to show the effect of pre-sizing the maps.
+func BenchmarkAvgSampleRateInterval50kKeys(b *testing.B) {
+	const numKeys = 50000
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	for _, expected := range []int{0, numKeys} {
+		b.Run("ExpectedKeys="+strconv.Itoa(expected), func(b *testing.B) {
+			a := &AvgSampleRate{
+				GoalSampleRate: 10,
+				ExpectedKeys:   expected,
+			}
+			a.currentCounts = make(map[string]float64, expected)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for i, key := range keys {
+					a.GetSampleRateMulti(key, i%100+1)
+				}
+				a.updateMaps()
+			}
+		})
+	}
+}
+
+func TestAvgSampleRateHierarchicalLookup(t *testing.T) {
+	a := &AvgSampleRate{
+		HierarchicalLookup: true,
+		Separator:          "/",
+		currentCounts:      map[string]float64{},
+		savedSampleRates: map[string]int{
+			"route:/users":          8,
+			"route:/users/42/posts": 3,
+		},
+		haveData: true,
+	}
+	assert.Equal(t, 3, a.GetSampleRate("route:/users/42/posts"))
+	assert.Equal(t, 8, a.GetSampleRate("route:/users/42"))
+	assert.Equal(t, 8, a.GetSampleRate("route:/users/42/comments/7"))
+	assert.Equal(t, 1, a.GetSampleRate("route:/orders/1"))
+	assert.Equal(t, 1, a.GetSampleRate("nosegments"))
+	// keys are counted as given, not as the parent whose rate they used
+	assert.Equal(t, float64(1), a.currentCounts["route:/users/42"])
+
+	a.HierarchicalLookup = false
+	assert.Equal(t, 1, a.GetSampleRate("route:/users/42"))
+}
+
+func TestAvgSampleRatePinnedKeys(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate: 20,
+		PinnedKeys:     []string{"pinned"},
+	}
+	a.currentCounts = map[string]float64{"pinned": 1000, "unpinned": 1000, "other": 1}
+	a.updateMaps()
+	pinnedRate := a.savedSampleRates["pinned"]
+	assert.Greater(t, pinnedRate, 1)
+
+	// many intervals with no traffic at all, then some without the pinned key
+	for i := 0; i < 5; i++ {
+		a.updateMaps()
+	}
+	a.currentCounts = map[string]float64{"other": 10}
+	a.updateMaps()
+
+	assert.Equal(t, pinnedRate, a.GetSampleRate("pinned"))
+	assert.Equal(t, 1, a.GetSampleRate("unpinned"))
+}
+
+func TestAvgSampleRateResetKey(t *testing.T) {
+	a := &AvgSampleRate{
+		currentCounts:    map[string]float64{"stuck": 5, "fine": 5},
+		savedSampleRates: map[string]int{"stuck": 40, "fine": 8},
+		haveData:         true,
+	}
+	a.ResetKey("stuck")
+	assert.Equal(t, 1, a.GetSampleRate("stuck"))
+	assert.Equal(t, 8, a.GetSampleRate("fine"))
+	assert.Equal(t, map[string]float64{"stuck": 1, "fine": 6}, a.currentCounts)
+
+	// while rates are being calculated, the rate is forgotten after
+	a.updating = true
+	a.ResetKey("fine")
+	assert.Equal(t, 8, a.savedSampleRates["fine"])
+	a.finishResets()
+	assert.Empty(t, a.savedSampleRates)
+	assert.False(t, a.updating)
+}
+
+func TestAvgSampleRateUnknownKeyRate(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate:   10,
+		UnknownKeyRate:   10,
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{"known": 4},
+	}
+	// before there's data, the goal rate applies to every key
+	assert.Equal(t, 10, a.GetSampleRate("new"))
+	a.haveData = true
+	assert.Equal(t, 4, a.GetSampleRate("known"))
+	assert.Equal(t, 10, a.GetSampleRate("new"))
+
+	a.UnknownKeyRate = 0
+	assert.Equal(t, 1, a.GetSampleRate("new"))
+}
+
+func TestAvgSampleRateFreeze(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate:   10,
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{"busy": 20, "quiet": 2},
+		haveData:         true,
+	}
+	a.Freeze()
+	a.GetSampleRateMulti("quiet", 5000)
+	a.GetSampleRateMulti("new", 100)
+	a.updateMaps()
+	assert.Equal(t, map[string]int{"busy": 20, "quiet": 2}, a.savedSampleRates)
+	assert.Empty(t, a.currentCounts)
+	// the last interval's counts still describe the traffic
+	assert.Equal(t, map[string]float64{"quiet": 5000, "new": 100}, a.GetLastIntervalCounts())
+	assert.Equal(t, 1, a.GetSampleRate("new"))
+
+	a.Unfreeze()
+	a.GetSampleRateMulti("quiet", 5000)
+	a.updateMaps()
+	assert.NotEqual(t, 2, a.savedSampleRates["quiet"])
+}
+
+func TestAvgSampleRateGetLastIntervalCounts(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		currentCounts:  map[string]float64{},
+	}
+	assert.Empty(t, a.GetLastIntervalCounts())
+	a.GetSampleRateMulti("one", 5)
+	a.GetSampleRateMulti("two", 50)
+	a.updateMaps()
+	a.GetSampleRateMulti("one", 7)
+	a.GetSampleRateMulti("three", 1)
+
+	counts := a.GetLastIntervalCounts()
+	assert.Equal(t, map[string]float64{"one": 5, "two": 50}, counts)
+	counts["one"] = 1000
+	assert.Equal(t, float64(5), a.GetLastIntervalCounts()["one"])
+}
+
+func TestAvgSampleRateAdjustCount(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		currentCounts:  map[string]float64{},
+	}
+	a.GetSampleRateMulti("batch", 100)
+	a.GetSampleRateMulti("other", 10)
+	// the batch is retried, so its provisional count is taken back
+	a.AdjustCount("batch", -60)
+	a.AdjustCount("other", -20)
+	a.AdjustCount("unseen", -5)
+	a.updateMaps()
+
+	assert.Equal(t, map[string]float64{"batch": 40}, a.GetLastIntervalCounts())
+	mets := a.GetMetrics("")
+	assert.Equal(t, int64(2), mets["request_count"])
+	assert.Equal(t, int64(110), mets["event_count"])
+}
+
+func TestAvgSampleRateProject(t *testing.T) {
+	counts := map[string]float64{"a": 1000, "b": 100, "c": 10, "d": 1}
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		currentCounts:  map[string]float64{},
+	}
+	p := a.Project(counts)
+	// nothing live has changed
+	assert.Empty(t, a.savedSampleRates)
+	assert.Empty(t, a.currentCounts)
+
+	// the projection matches what the sampler does with the same traffic
+	for k, v := range counts {
+		a.currentCounts[k] = v
+	}
+	a.updateMaps()
+	assert.Equal(t, a.savedSampleRates, p.Rates)
+	var kept float64
+	rateCounts := map[int]int{}
+	for k, rate := range p.Rates {
+		kept += counts[k] / float64(rate)
+		rateCounts[rate]++
+	}
+	assert.InDelta(t, kept, p.Kept, 0.001)
+	assert.Equal(t, rateCounts, p.RateCounts)
+	assert.Equal(t, rateCounts[1], p.KeysAtRateOne)
+	assert.Greater(t, p.KeysAtRateOne, 0)
+
+	// so does the projection of weighted counts below 1
+	weighted := map[string]float64{"a": 1000, "b": 0.5, "c": 0.25}
+	p = a.Project(weighted)
+	for k, v := range weighted {
+		a.currentCounts[k] = v
+	}
+	a.updateMaps()
+	assert.Equal(t, a.savedSampleRates, p.Rates)
+
+	a.SetKeepAll(true)
+	p = a.Project(counts)
+	assert.Equal(t, map[int]int{1: 4}, p.RateCounts)
+	assert.Equal(t, float64(1111), p.Kept)
+}
+
+func TestAvgSampleRateTargetKeptPerInterval(t *testing.T) {
+	for _, scale := range []float64{10, 100, 1000} {
+		t.Run(fmt.Sprint(scale), func(t *testing.T) {
+			a := &AvgSampleRate{
+				GoalSampleRate:        10,
+				TargetKeptPerInterval: 500,
+				currentCounts:         map[string]float64{},
+			}
+			counts := map[string]float64{}
+			for i := 0; i < 20; i++ {
+				counts["key"+strconv.Itoa(i)] = scale * float64(i*i+1)
+			}
+			for k, v := range counts {
+				a.currentCounts[k] = v
+			}
+			a.updateMaps()
+
+			// however much traffic there was, about the target is kept
+			var kept float64
+			for k, rate := range a.savedSampleRates {
+				kept += counts[k] / float64(rate)
+			}
+			assert.InEpsilon(t, 500, kept, 0.1)
+			assert.Equal(t, a.savedSampleRates, a.Project(counts).Rates)
+		})
+	}
+
+	// with fewer events than the target, everything is kept
+	a := &AvgSampleRate{TargetKeptPerInterval: 500, currentCounts: map[string]float64{}}
+	a.currentCounts["a"] = 200
+	a.currentCounts["b"] = 100
+	a.updateMaps()
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, a.savedSampleRates)
+}
+
+func TestAvgSampleRateKeyConstraints(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate:        10,
+		ColdStartRate:         20,
+		UnknownKeyRate:        3,
+		NoBackgroundGoroutine: true,
+		KeyConstraints: map[string]KeyConstraint{
+			"busy":  {Max: 5},
+			"quiet": {Min: 50},
+			"both":  {Min: 2, Max: 4},
+			"none":  {},
+		},
+	}
+	assert.NoError(t, a.Start())
+	defer a.Stop()
+
+	// the cold start rate is bounded per key
+	assert.Equal(t, 5, a.GetSampleRate("busy"))
+	assert.Equal(t, 50, a.GetSampleRate("quiet"))
+	assert.Equal(t, 4, a.GetSampleRate("both"))
+	assert.Equal(t, 20, a.GetSampleRate("none"))
+
+	a.GetSampleRateMulti("busy", 10000)
+	a.GetSampleRateMulti("other", 10000)
+	for _, key := range []string{"quiet", "both", "none"} {
+		a.GetSampleRateMulti(key, 2)
+	}
+	a.Update()
+	// so are calculated rates
+	assert.Greater(t, a.savedSampleRates["busy"], 5)
+	r := a.Evaluate("busy", 1)
+	assert.Equal(t, 5, r.Rate)
+	assert.Equal(t, SourceCapped, r.Source)
+	assert.Equal(t, a.savedSampleRates["other"], a.GetSampleRate("other"))
+	assert.Equal(t, 1, a.savedSampleRates["quiet"])
+	r = a.Evaluate("quiet", 1)
+	assert.Equal(t, 50, r.Rate)
+	assert.Equal(t, SourceOverride, r.Source)
+	assert.Equal(t, 2, a.GetSampleRate("both"))
+	assert.Equal(t, 1, a.GetSampleRate("none"))
+	// and the rate for unknown keys
+	delete(a.savedSampleRates, "both")
+	assert.Equal(t, 3, a.GetSampleRate("both"))
+	a.KeyConstraints["new"] = KeyConstraint{Max: 2}
+	assert.Equal(t, 2, a.PeekSampleRate("new"))
+	assert.Equal(t, 3, a.GetSampleRate("unlisted"))
+
+	// keeping everything overrides them all
+	a.SetKeepAll(true)
+	assert.Equal(t, 1, a.GetSampleRate("quiet"))
+}
+
+func TestAvgSampleRateOnKeyRateChange(t *testing.T) {
+	type change struct {
+		key      string
+		old, new int
+	}
+	var changes []change
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		WatchKeys:      []string{"watched"},
+		OnKeyRateChange: func(key string, oldRate, newRate int) {
+			changes = append(changes, change{key, oldRate, newRate})
+		},
+		currentCounts: map[string]float64{},
+	}
+	interval := func(counts map[string]float64) {
+		for k, v := range counts {
+			a.currentCounts[k] = v
+		}
+		a.updateMaps()
+	}
+
+	interval(map[string]float64{"watched": 1000, "other": 10})
+	assert.Equal(t, []change{{"watched", 0, a.savedSampleRates["watched"]}}, changes)
+
+	// nothing changes with the same traffic
+	changes = nil
+	interval(map[string]float64{"watched": 1000, "other": 10})
+	assert.Empty(t, changes)
+
+	// both rates change, but only the watched key is reported
+	old := a.savedSampleRates["watched"]
+	otherOld := a.savedSampleRates["other"]
+	interval(map[string]float64{"watched": 1000, "other": 5000})
+	assert.NotEqual(t, otherOld, a.savedSampleRates["other"])
+	assert.Equal(t, []change{{"watched", old, a.savedSampleRates["watched"]}}, changes)
+
+	// the watched key goes quiet and loses its rate
+	changes = nil
+	old = a.savedSampleRates["watched"]
+	interval(map[string]float64{"other": 5000})
+	assert.Equal(t, []change{{"watched", old, 0}}, changes)
+}
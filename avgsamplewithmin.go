@@ -1,7 +1,6 @@
 package dynsampler
 
 import (
-	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -29,20 +28,88 @@ type AvgSampleWithMin struct {
 	// If neither one is set, the default is 30s.
 	ClearFrequencyDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// GoalSampleRate is the average sample rate we're aiming for, across all
 	// events. Default 10
 	GoalSampleRate int
 
+	// ColdStartRate, if greater than 0, is the sample rate returned for all keys
+	// before the first set of sample rates has been calculated. Keys are still
+	// counted during this period, subject to MaxKeys. If unset, GoalSampleRate is
+	// used.
+	ColdStartRate int
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
 	// the sample rate map within the interval defined by `ClearFrequencyDuration`. Once
 	// MaxKeys is reached, new keys will not be included in the sample rate map, but
 	// existing keys will continue to be be counted.
 	MaxKeys int
 
+	// KeyOrder is the order in which keys are visited when dividing up the
+	// budget of events to keep, which decides which keys benefit from budget
+	// left unused by quiet keys. See KeyOrder for details. Defaults to
+	// KeyOrderLexical.
+	KeyOrder KeyOrder
+
+	// ExtraBudgetPolicy decides how budget left unused by quiet keys is shared
+	// among the keys visited after them. See ExtraBudgetPolicy for details.
+	// Defaults to ExtraBudgetEqual.
+	ExtraBudgetPolicy ExtraBudgetPolicy
+
+	// SnapToNiceRates, if true, rounds each calculated sample rate to the
+	// nearest of a set of round numbers, so that rates are easier for people
+	// to read. This moves throughput away from the goal. With the default 1,
+	// 2, 5 series, a key can keep up to about 60% more or 40% fewer events
+	// than its calculated rate would, though across many keys the differences
+	// largely cancel out. Defaults to false.
+	SnapToNiceRates bool
+
+	// NiceRates are the rates SnapToNiceRates rounds to. Defaults to the
+	// series 1, 2, 5, 10, 20, 50, 100, and so on.
+	NiceRates []int
+
+	// HeavySampleThreshold is the sample rate above which a key counts as
+	// heavily sampled in the keys_above_threshold metric. A rising number of
+	// such keys means the budget is being concentrated in fewer keys. Defaults
+	// to 100.
+	HeavySampleThreshold int
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
 	// MinEventsPerSec - when the total number of events drops below this
 	// threshold, sampling will cease. default 50
 	MinEventsPerSec int
 
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]float64
 
@@ -54,20 +121,56 @@ type AvgSampleWithMin struct {
 
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
-	requestCount int64
-	eventCount   int64
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*AvgSampleWithMin)(nil)
 
-func (a *AvgSampleWithMin) Start() error {
-	// apply defaults
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (a *AvgSampleWithMin) Validate() error {
 	if a.ClearFrequencyDuration != 0 && a.ClearFrequencySec != 0 {
-		return fmt.Errorf("the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+		return newConfigError(ErrConflictingIntervalConfig, "the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	}
+	if a.ClearFrequencyDuration < 0 || a.ClearFrequencySec < 0 {
+		return newConfigError(ErrInvalidInterval, "the clear frequency must not be negative")
+	}
+	if a.GoalSampleRate < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalSampleRate %d must not be negative", a.GoalSampleRate)
 	}
+	if a.MinEventsPerSec < 0 {
+		return newConfigError(ErrInvalidThreshold, "the MinEventsPerSec %d must not be negative", a.MinEventsPerSec)
+	}
+	if a.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", a.HeavySampleThreshold)
+	}
+	if err := validateNiceRates(a.NiceRates); err != nil {
+		return err
+	}
+	return nil
+}
 
+func (a *AvgSampleWithMin) Start() error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
 	if a.ClearFrequencyDuration == 0 && a.ClearFrequencySec == 0 {
 		a.ClearFrequencyDuration = 30 * time.Second
 	} else if a.ClearFrequencySec != 0 {
@@ -81,11 +184,19 @@ func (a *AvgSampleWithMin) Start() error {
 		a.MinEventsPerSec = 50
 	}
 
+	if err := checkInterval("ClearFrequencyDuration", a.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
 	// initialize internal variables
-	a.savedSampleRates = make(map[string]int)
-	a.currentCounts = make(map[string]float64)
+	a.savedSampleRates = make(map[string]int, a.ExpectedKeys)
+	a.currentCounts = make(map[string]float64, a.ExpectedKeys)
 	a.done = make(chan struct{})
 
+	if a.NoBackgroundGoroutine {
+		return nil
+	}
+
 	// spin up calculator
 	go func() {
 		ticker := time.NewTicker(a.ClearFrequencyDuration)
@@ -104,18 +215,29 @@ func (a *AvgSampleWithMin) Start() error {
 
 func (a *AvgSampleWithMin) Stop() error {
 	close(a.done)
+	exportRates(a.ExportOnStop, &a.lock, &a.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (a *AvgSampleWithMin) Update() {
+	a.updateMaps()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (a *AvgSampleWithMin) updateMaps() {
 	// make a local copy of the sample counters for calculation
 	a.lock.Lock()
 	tmpCounts := a.currentCounts
-	a.currentCounts = make(map[string]float64)
+	a.keyspace.observe(len(tmpCounts))
+	a.intervalCount++
+	a.currentCounts = make(map[string]float64, a.ExpectedKeys)
 	a.lock.Unlock()
-	newSavedSampleRates := make(map[string]int)
+	newSavedSampleRates := make(map[string]int, len(tmpCounts))
+	heavy := newHeavyKeys(a.HeavySampleThreshold)
 	// short circuit if no traffic
 	numKeys := len(tmpCounts)
 	if numKeys == 0 {
@@ -123,40 +245,49 @@ func (a *AvgSampleWithMin) updateMaps() {
 		a.lock.Lock()
 		defer a.lock.Unlock()
 		a.savedSampleRates = newSavedSampleRates
+		a.heavyKeys = heavy
 		return
 	}
 
-	// Goal events to send this interval is the total count of received events
-	// divided by the desired average sample rate
-	var sumEvents float64
-	for _, count := range tmpCounts {
-		sumEvents += count
-	}
-	goalCount := float64(sumEvents) / float64(a.GoalSampleRate)
+	goalRatio, sumEvents := averageGoalRatio(tmpCounts, a.GoalSampleRate, 0)
 	// check to see if we fall below the minimum
 	if sumEvents < float64(a.MinEventsPerSec)*a.ClearFrequencyDuration.Seconds() {
 		// we still need to go through each key to set sample rates individually
 		for k := range tmpCounts {
-			newSavedSampleRates[k] = 1
+			heavy.set(newSavedSampleRates, k, 1)
 		}
 		a.lock.Lock()
 		defer a.lock.Unlock()
 		a.savedSampleRates = newSavedSampleRates
+		a.heavyKeys = heavy
+		a.keptFraction = keptFractionPPM(sumEvents, sumEvents)
 		return
 	}
-	// goalRatio is the goalCount divided by the sum of all the log values - it
-	// determines what percentage of the total event space belongs to each key
-	var logSum float64
-	for _, count := range tmpCounts {
-		logSum += math.Log10(float64(count))
+	if math.IsInf(goalRatio, 0) || math.IsNaN(goalRatio) {
+		// the sum of the logarithms is 0 when every key has a count of 1 or
+		// less, so there are no shares to split the goal by. Every key is as
+		// rare as a key can be, so all of them are kept.
+		for k := range tmpCounts {
+			heavy.set(newSavedSampleRates, k, 1)
+		}
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.savedSampleRates = newSavedSampleRates
+		a.heavyKeys = heavy
+		a.keptFraction = keptFractionPPM(sumEvents, sumEvents)
+		a.haveData = true
+		return
 	}
-	// Note that this can produce Inf if logSum is 0
-	goalRatio := goalCount / logSum
 
-	newSavedSampleRates = calculateSampleRates(goalRatio, tmpCounts)
+	newSavedSampleRates, kept := calculateSampleRates(goalRatio, tmpCounts, a.KeyOrder, a.ExtraBudgetPolicy, heavy)
+	if a.SnapToNiceRates {
+		kept = snapToNiceRates(newSavedSampleRates, tmpCounts, a.NiceRates, heavy)
+	}
 	a.lock.Lock()
 	defer a.lock.Unlock()
 	a.savedSampleRates = newSavedSampleRates
+	a.heavyKeys = heavy
+	a.keptFraction = keptFractionPPM(kept, sumEvents)
 	a.haveData = true
 }
 
@@ -169,22 +300,59 @@ func (a *AvgSampleWithMin) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (a *AvgSampleWithMin) GetSampleRateMulti(key string, count int) int {
+	return a.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (a *AvgSampleWithMin) GetSampleRateMulti64(key string, count int64) int {
 	a.lock.Lock()
 	defer a.lock.Unlock()
+	if a.currentCounts == nil {
+		// not started yet
+		return 1
+	}
 
 	a.requestCount++
-	a.eventCount += int64(count)
+	a.eventCount += count
 
-	// Enforce MaxKeys limit on the size of the map
-	if a.MaxKeys > 0 {
-		// If a key already exists, increment it. If not, but we're under the limit, store a new key
-		if _, found := a.currentCounts[key]; found || len(a.currentCounts) < a.MaxKeys {
+	key, track := a.oversizeKeys.check(key, a.MaxKeyLength, a.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if a.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := a.currentCounts[key]; found || len(a.currentCounts) < a.MaxKeys {
+				a.currentCounts[key] += float64(count)
+			} else {
+				a.droppedKeys.add(key)
+			}
+		} else {
 			a.currentCounts[key] += float64(count)
 		}
-	} else {
-		a.currentCounts[key] += float64(count)
 	}
+	return a.chooseRate(key)
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (a *AvgSampleWithMin) PeekSampleRate(key string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, a.MaxKeyLength, a.OnOversizeKey)
+	return a.chooseRate(key)
+}
+
+// chooseRate returns the sample rate for key. The caller must hold the lock.
+func (a *AvgSampleWithMin) chooseRate(key string) int {
 	if !a.haveData {
+		if a.ColdStartRate > 0 {
+			return a.ColdStartRate
+		}
 		return a.GoalSampleRate
 	}
 	if rate, found := a.savedSampleRates[key]; found {
@@ -203,13 +371,69 @@ func (a *AvgSampleWithMin) LoadState(state []byte) error {
 	return nil
 }
 
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (a *AvgSampleWithMin) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (a *AvgSampleWithMin) DroppedKeySamples() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (a *AvgSampleWithMin) OversizeKeyError() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.oversizeKeys.takeErr()
+}
+
 func (a *AvgSampleWithMin) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(a.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (a *AvgSampleWithMin) GetMetricsTyped(prefix string) map[string]Metric {
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": a.requestCount,
-		prefix + "event_count":   a.eventCount,
-		prefix + "keyspace_size": int64(len(a.currentCounts)),
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(a.requestCount),
+		prefix + "event_count":          counter(a.eventCount),
+		prefix + "interval_count":       counter(a.intervalCount),
+		prefix + "keyspace_size":        gauge(a.keyspace.report(a.SmoothKeyspaceMetric, int64(len(a.currentCounts)))),
+		prefix + "oversize_key_count":   counter(a.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":        gauge(a.keptFraction),
+		prefix + "keys_above_threshold": gauge(a.heavyKeys.value()),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (a *AvgSampleWithMin) GetMetricsSummary(prefix string) map[string]int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return summarizeRates(prefix, a.savedSampleRates, a.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (a *AvgSampleWithMin) GetAllSampleRates() map[string]int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return copyRates(a.savedSampleRates)
+}
@@ -1,6 +1,7 @@
 package dynsampler
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -166,6 +167,25 @@ func TestAvgSampleWithMinGetSampleRateStartup(t *testing.T) {
 	assert.Equal(t, a.currentCounts["key"], 1.)
 }
 
+func TestAvgSampleWithMinColdStart(t *testing.T) {
+	a := &AvgSampleWithMin{
+		GoalSampleRate: 10,
+		ColdStartRate:  3,
+		MaxKeys:        2,
+		currentCounts:  map[string]float64{},
+	}
+	// before any rates have been calculated, ColdStartRate is returned
+	assert.Equal(t, 3, a.GetSampleRate("one"))
+	assert.Equal(t, 3, a.GetSampleRate("two"))
+	// MaxKeys is enforced while cold, too
+	assert.Equal(t, 3, a.GetSampleRate("three"))
+	assert.Equal(t, 2, len(a.currentCounts))
+	_, found := a.currentCounts["three"]
+	assert.Equal(t, false, found)
+	assert.Equal(t, 3, a.GetSampleRateMulti("one", 5))
+	assert.Equal(t, 6., a.currentCounts["one"])
+}
+
 func TestAvgSampleWithMinGetSampleRate(t *testing.T) {
 	a := &AvgSampleWithMin{
 		haveData: true,
@@ -255,6 +275,9 @@ func TestAvgSampleWithMinMaxKeys(t *testing.T) {
 	a.GetSampleRate("one")
 	assert.Equal(t, 3, len(a.currentCounts))
 	assert.Equal(t, 2., a.currentCounts["one"])
+	// The rejected key should be available as a sample, and reading clears it
+	assert.Equal(t, []string{"four"}, a.DroppedKeySamples())
+	assert.Equal(t, []string{}, a.DroppedKeySamples())
 }
 
 func TestAvgSampleWithMin_Start(t *testing.T) {
@@ -280,6 +303,9 @@ func TestAvgSampleWithMin_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("AvgSampleWithMin error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("AvgSampleWithMin error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.ClearFrequencyDuration {
@@ -289,3 +315,43 @@ func TestAvgSampleWithMin_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestAvgSampleWithMinAllCountsOne(t *testing.T) {
+	a := &AvgSampleWithMin{
+		GoalSampleRate:         10,
+		ClearFrequencyDuration: 30 * time.Second,
+		currentCounts:          map[string]float64{},
+	}
+	for i := 0; i < 100; i++ {
+		a.currentCounts["key"+strconv.Itoa(i)] = 1
+	}
+	a.updateMaps()
+	assert.Len(t, a.savedSampleRates, 100)
+	for k, rate := range a.savedSampleRates {
+		assert.Equal(t, 1, rate, k)
+	}
+	assert.Equal(t, int64(1e6), a.GetMetrics("")["kept_fraction"])
+	assert.Equal(t, int64(0), a.GetMetrics("")["keys_above_threshold"])
+}
+
+func TestAvgSampleWithMinZeroCount(t *testing.T) {
+	rates := func(counts map[string]float64) map[string]int {
+		a := &AvgSampleWithMin{
+			GoalSampleRate:         10,
+			ClearFrequencyDuration: 30 * time.Second,
+			currentCounts:          counts,
+		}
+		a.updateMaps()
+		return a.savedSampleRates
+	}
+	want := rates(map[string]float64{"busy": 1000, "quiet": 10})
+	// a key seen only with a count of 0 doesn't change the other keys' rates
+	got := rates(map[string]float64{"busy": 1000, "quiet": 10, "zero": 0})
+	assert.Equal(t, want["busy"], got["busy"])
+	assert.Equal(t, want["quiet"], got["quiet"])
+	assert.Equal(t, 1, got["zero"])
+	assert.Greater(t, got["busy"], got["quiet"])
+
+	// nor does it stop keys that are all as rare as can be from being kept
+	assert.Equal(t, map[string]int{"one": 1, "zero": 1}, rates(map[string]float64{"one": 1, "zero": 0}))
+}
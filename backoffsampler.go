@@ -0,0 +1,216 @@
+package dynsampler
+
+import (
+	"sync"
+	"time"
+)
+
+// BackoffSampler implements Sampler and backs off exponentially as a key
+// repeats. The first time a key is seen in each ClearFrequencyDuration it gets
+// a sample rate of 1, the second time 2, then 4, 8, and so on, up to
+// MaxSampleRate. Each call counts as one occurrence, whatever its count.
+//
+// It sits between OnlyOnce, which reports the first occurrence of a key and
+// then suppresses it, and the throughput samplers: a key that keeps repeating
+// is still reported now and then, but the first few occurrences, which are
+// usually the most interesting, are very likely to be kept.
+type BackoffSampler struct {
+	// ClearFrequencyDuration is how often the occurrence counts reset. The
+	// default is 30s.
+	ClearFrequencyDuration time.Duration
+
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// MaxSampleRate is the highest sample rate a key backs off to. It doesn't
+	// need to be a power of two. Default 1024
+	MaxSampleRate int
+
+	// MaxKeys, if greater than 0, limits the number of distinct keys counted
+	// in each ClearFrequencyDuration. Once MaxKeys is reached, new keys get a
+	// sample rate of 1 every time, but existing keys continue to back off.
+	MaxKeys int
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// rates holds the sample rate to return for the next occurrence of each
+	// key seen in this interval
+	rates map[string]int
+	done  chan struct{}
+
+	lock sync.Mutex
+
+	// metrics
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*BackoffSampler)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (b *BackoffSampler) Validate() error {
+	if b.ClearFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the ClearFrequencyDuration %v must not be negative", b.ClearFrequencyDuration)
+	}
+	if b.MaxSampleRate < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the MaxSampleRate %d must not be negative", b.MaxSampleRate)
+	}
+	return nil
+}
+
+func (b *BackoffSampler) Start() error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
+	if b.ClearFrequencyDuration == 0 {
+		b.ClearFrequencyDuration = 30 * time.Second
+	}
+	if b.MaxSampleRate == 0 {
+		b.MaxSampleRate = 1024
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", b.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
+	// initialize internal variables
+	b.rates = make(map[string]int, b.ExpectedKeys)
+	b.done = make(chan struct{})
+
+	if b.NoBackgroundGoroutine {
+		return nil
+	}
+
+	// spin up calculator
+	go func() {
+		ticker := newTicker(b.ClearFrequencyDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				b.updateMaps()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *BackoffSampler) Stop() error {
+	close(b.done)
+	return nil
+}
+
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (b *BackoffSampler) Update() {
+	b.updateMaps()
+}
+
+// updateMaps forgets every key, so each starts again at a rate of 1.
+func (b *BackoffSampler) updateMaps() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.intervalCount++
+	b.rates = make(map[string]int, b.ExpectedKeys)
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (b *BackoffSampler) GetSampleRate(key string) int {
+	return b.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key.
+func (b *BackoffSampler) GetSampleRateMulti(key string, count int) int {
+	return b.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (b *BackoffSampler) GetSampleRateMulti64(key string, count int64) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rates == nil {
+		// not started yet
+		return 1
+	}
+	b.requestCount++
+	b.eventCount += count
+
+	rate, found := b.rates[key]
+	if !found {
+		if b.MaxKeys > 0 && len(b.rates) >= b.MaxKeys {
+			return 1
+		}
+		rate = 1
+	}
+	// double the rate for next time, without going past the cap
+	next := rate * 2
+	if next > b.MaxSampleRate || next < rate {
+		next = b.MaxSampleRate
+	}
+	b.rates[key] = next
+	return rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (b *BackoffSampler) PeekSampleRate(key string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if rate, found := b.rates[key]; found {
+		return rate
+	}
+	return 1
+}
+
+// SaveState is not implemented
+func (b *BackoffSampler) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (b *BackoffSampler) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (b *BackoffSampler) SupportsState() bool {
+	return false
+}
+
+func (b *BackoffSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(b.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (b *BackoffSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mets := map[string]Metric{
+		prefix + "request_count":  counter(b.requestCount),
+		prefix + "event_count":    counter(b.eventCount),
+		prefix + "interval_count": counter(b.intervalCount),
+		prefix + "keyspace_size":  gauge(int64(len(b.rates))),
+	}
+	return mets
+}
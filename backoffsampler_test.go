@@ -0,0 +1,42 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffSamplerGetSampleRate(t *testing.T) {
+	b := &BackoffSampler{
+		MaxSampleRate: 20,
+		rates:         map[string]int{},
+	}
+	var got []int
+	for i := 0; i < 7; i++ {
+		got = append(got, b.GetSampleRate("repeat"))
+	}
+	assert.Equal(t, []int{1, 2, 4, 8, 16, 20, 20}, got)
+	// other keys back off on their own schedule
+	assert.Equal(t, 1, b.GetSampleRate("other"))
+	assert.Equal(t, 2, b.GetSampleRate("other"))
+
+	// clearing starts every key again
+	b.updateMaps()
+	assert.Equal(t, 1, b.GetSampleRate("repeat"))
+	assert.Equal(t, 2, b.GetSampleRate("repeat"))
+	assert.Equal(t, int64(1), b.GetMetrics("")["interval_count"])
+}
+
+func TestBackoffSamplerMaxKeys(t *testing.T) {
+	b := &BackoffSampler{
+		MaxSampleRate: 1024,
+		MaxKeys:       1,
+		rates:         map[string]int{},
+	}
+	assert.Equal(t, 1, b.GetSampleRate("first"))
+	assert.Equal(t, 2, b.GetSampleRate("first"))
+	// keys past MaxKeys aren't tracked, so they are always kept
+	assert.Equal(t, 1, b.GetSampleRate("second"))
+	assert.Equal(t, 1, b.GetSampleRate("second"))
+	assert.Equal(t, int64(1), b.GetMetrics("")["keyspace_size"])
+}
@@ -7,8 +7,9 @@ import (
 )
 
 // BlockList is a data structure that keeps track of how often keys occur in a given time range in
-// order to perform windowed lookback sampling. BlockList operates with monotonically increasing
-// indexes, instead of timestamps.
+// order to perform windowed lookback sampling. BlockList operates with indexes, instead of
+// timestamps. Indexes normally increase monotonically, but an older index may be given when
+// replaying historical events; it is counted in its proper place.
 // A BlockList is a single linked list of Blocks. Each Block has a frequency hashmap and a unique
 // index.
 type BlockList interface {
@@ -17,7 +18,7 @@ type BlockList interface {
 }
 
 type Block struct {
-	index      int64 // MUST be monotonically increasing.
+	index      int64 // Blocks are kept in descending order of index.
 	keyToCount map[string]int
 	next       *Block
 }
@@ -45,6 +46,8 @@ func NewUnboundedBlockList() BlockList {
 // IncrementKey is used when we've encounted a new key. The current keyIndex is
 // also provided. This function will increment the key in the current block or
 // create a new block, if needed. The happy path invocation is very fast, O(1).
+// A keyIndex older than the newest block is counted in the block for that
+// index, which takes time proportional to how far back it is.
 // The count is the number of events that this call represents.
 func (b *UnboundedBlockList) IncrementKey(key string, keyIndex int64, count int) error {
 	b.lock.Lock()
@@ -53,20 +56,27 @@ func (b *UnboundedBlockList) IncrementKey(key string, keyIndex int64, count int)
 }
 
 func (b *UnboundedBlockList) doIncrement(key string, keyIndex int64, count int) error {
+	// Blocks are kept in descending order of index. Usually keyIndex is the
+	// newest, so this stops at the front of the list, but an older keyIndex
+	// (for example from a replayed event) walks back to its place.
+	prev := b.head
+	for prev.next != nil && prev.next.index > keyIndex {
+		prev = prev.next
+	}
+
 	// A block matching keyStamp exists. Just increment the key there.
-	if b.head.next != nil && b.head.next.index == keyIndex {
-		b.head.next.keyToCount[key] += count
+	if prev.next != nil && prev.next.index == keyIndex {
+		prev.next.keyToCount[key] += count
 		return nil
 	}
 
 	// We need to create a new block.
-	currentFront := b.head.next
-	b.head.next = &Block{
+	prev.next = &Block{
 		index:      keyIndex,
 		keyToCount: make(map[string]int),
-		next:       currentFront,
+		next:       prev.next,
 	}
-	b.head.next.keyToCount[key] += count
+	prev.next.keyToCount[key] += count
 	return nil
 }
 
@@ -173,11 +183,22 @@ func (b *BoundedBlockList) tryInsert(key string, keyIndex int64) bool {
 		return true
 	}
 
-	if exists {
-		b.keyToIndexes[key] = append([]int64{keyIndex}, indexes...)
-	} else {
+	if !exists {
 		b.keyToIndexes[key] = []int64{keyIndex}
+		return true
+	}
+	// Keep indexes in descending order, like the blocks themselves.
+	i := 0
+	for i < len(indexes) && indexes[i] > keyIndex {
+		i++
+	}
+	if i < len(indexes) && indexes[i] == keyIndex {
+		return true
 	}
+	indexes = append(indexes, 0)
+	copy(indexes[i+1:], indexes[i:])
+	indexes[i] = keyIndex
+	b.keyToIndexes[key] = indexes
 	return true
 }
 
@@ -255,3 +255,15 @@ func TestAllConcurrency(t *testing.T) {
 	concurrentUpdates(t, NewUnboundedBlockList())
 	concurrentUpdates(t, NewBoundedBlockList(10))
 }
+
+func TestOutOfOrderIndexes(t *testing.T) {
+	for _, blockList := range []BlockList{NewUnboundedBlockList(), NewBoundedBlockList(10)} {
+		atomicRecord := NewAtomicRecord(10)
+		for _, index := range []int64{5, 2, 7, 2, 6, 0, 7, 3} {
+			blockList.IncrementKey("test_key", index, 1)
+			atomicRecord.IncrementKey("test_key", index, 1)
+		}
+		assert.Equal(t, atomicRecord.AggregateCounts(8, 8), blockList.AggregateCounts(8, 8))
+		assert.Equal(t, atomicRecord.AggregateCounts(8, 4), blockList.AggregateCounts(8, 4))
+	}
+}
@@ -0,0 +1,54 @@
+package dynsampler
+
+import "time"
+
+// burstLogSize is the number of bursts retained for RecentBursts.
+const burstLogSize = 50
+
+// BurstEvent describes one burst detected by EMAThroughput.
+type BurstEvent struct {
+	// Time is when the burst was detected.
+	Time time.Time
+
+	// Sum is the weighted count of events in the last AdjustmentInterval (or
+	// the shorter interval chosen by AdaptiveInterval) when the burst was
+	// detected.
+	Sum float64
+
+	// Threshold is the burst threshold that Sum reached.
+	Threshold float64
+}
+
+// burstLog is a fixed-size ring buffer of the most recent bursts, so that
+// operators can find out when burst detection fired and by how much while
+// keeping memory bounded. The zero value is ready to use. It is not safe for
+// concurrent use; callers are expected to hold the owning sampler's lock.
+type burstLog struct {
+	events [burstLogSize]BurstEvent
+	next   int
+	full   bool
+}
+
+// add records a burst, overwriting the oldest entry if the buffer is full.
+func (b *burstLog) add(event BurstEvent) {
+	b.events[b.next] = event
+	b.next++
+	if b.next == len(b.events) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// drain returns the recorded bursts, oldest first, and empties the buffer.
+func (b *burstLog) drain() []BurstEvent {
+	var out []BurstEvent
+	if b.full {
+		out = make([]BurstEvent, 0, len(b.events))
+		out = append(out, b.events[b.next:]...)
+	} else {
+		out = make([]BurstEvent, 0, b.next)
+	}
+	out = append(out, b.events[:b.next]...)
+	*b = burstLog{}
+	return out
+}
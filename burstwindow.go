@@ -0,0 +1,59 @@
+package dynsampler
+
+import "time"
+
+// burstWindowSlots is the number of slots a burstWindow is divided into. The
+// window slides forward one slot at a time, so a burst is measured to within
+// a tenth of the window's length.
+const burstWindowSlots = 10
+
+// burstWindow holds the counts seen over a recent stretch of time, divided
+// into slots, so that burst detection can look at the most recent interval's
+// worth of traffic whether or not it lines up with the adjustment interval.
+type burstWindow struct {
+	slots   [burstWindowSlots]float64
+	current int
+	slotEnd time.Time
+}
+
+// advance moves the window up to t, clearing the slots that have fallen out
+// of a window of the given length. A length too short to divide into slots
+// leaves the window as it is, so it simply accumulates.
+func (w *burstWindow) advance(t time.Time, length time.Duration) {
+	slotLen := length / burstWindowSlots
+	if slotLen <= 0 {
+		return
+	}
+	if w.slotEnd.IsZero() {
+		w.slotEnd = t.Add(slotLen)
+		return
+	}
+	for n := 0; !t.Before(w.slotEnd) && n < burstWindowSlots; n++ {
+		w.current = (w.current + 1) % burstWindowSlots
+		w.slots[w.current] = 0
+		w.slotEnd = w.slotEnd.Add(slotLen)
+	}
+	if !t.Before(w.slotEnd) {
+		// it's been more than a whole window, and every slot is now clear
+		w.slotEnd = t.Add(slotLen)
+	}
+}
+
+// add counts count in the current slot.
+func (w *burstWindow) add(count float64) {
+	w.slots[w.current] += count
+}
+
+// sum returns the total of the counts in the window.
+func (w *burstWindow) sum() float64 {
+	var sum float64
+	for _, count := range w.slots {
+		sum += count
+	}
+	return sum
+}
+
+// reset clears the window.
+func (w *burstWindow) reset() {
+	w.slots = [burstWindowSlots]float64{}
+}
@@ -0,0 +1,101 @@
+package dynsampler
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits used to pick a register in a
+// cardinalityEstimate. 2^12 registers take 4KiB and give a typical error of
+// about 1.6%.
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// cardinalityEstimate estimates the number of distinct keys it has seen with
+// a HyperLogLog sketch. Its memory use is fixed no matter how many keys there
+// are. The zero value is ready to use.
+type cardinalityEstimate struct {
+	registers *[hllRegisters]uint8
+}
+
+// add records that key has been seen. It always uses keyHash, never a
+// sampler's HashFunc: the estimate stays inside the sampler, so its hashes
+// never have to agree with anyone else's, and it is only accurate with a hash
+// as well mixed as keyHash, which a HashFunc chosen for other reasons needn't
+// be.
+func (c *cardinalityEstimate) add(key string) {
+	c.addHash(keyHash(key))
+}
+
+// addKeys records that every key in counts has been seen. Samplers call it
+// with their counts once an interval, rather than calling add for every
+// event, which would hash each key again under the sampler's lock on every
+// call.
+func addKeys[C int | float64](c *cardinalityEstimate, counts map[string]C) {
+	for key := range counts {
+		c.add(key)
+	}
+}
+
+// addHash records that a key whose keyHash is x has been seen.
+func (c *cardinalityEstimate) addHash(x uint64) {
+	if c.registers == nil {
+		c.registers = new([hllRegisters]uint8)
+	}
+	i := x >> (64 - hllPrecision)
+	// the rank is the position of the first set bit in the rest of the hash
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > c.registers[i] {
+		c.registers[i] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct keys seen.
+func (c *cardinalityEstimate) estimate() int64 {
+	if c.registers == nil {
+		return 0
+	}
+	const m = float64(hllRegisters)
+	var sum float64
+	var zeros int
+	for _, r := range c.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// for small cardinalities, counting empty registers is more accurate
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(e))
+}
+
+// reset forgets every key seen so far, keeping the registers for reuse.
+func (c *cardinalityEstimate) reset() {
+	if c.registers != nil {
+		*c.registers = [hllRegisters]uint8{}
+	}
+}
+
+// keyHash returns a well-mixed 64-bit hash of key.
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits don't depend much on
+// the last bytes of the input, across the whole word.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,65 @@
+package dynsampler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityEstimate(t *testing.T) {
+	c := cardinalityEstimate{}
+	assert.Equal(t, int64(0), c.estimate())
+	for i := 0; i < 10; i++ {
+		c.add("key" + strconv.Itoa(i))
+	}
+	small := c.estimate()
+	assert.InDelta(t, 10, small, 1)
+	// repeated keys don't change the estimate
+	for i := 0; i < 10; i++ {
+		c.add("key" + strconv.Itoa(i))
+	}
+	assert.Equal(t, small, c.estimate())
+
+	for _, n := range []int{1000, 100000} {
+		c := cardinalityEstimate{}
+		for i := 0; i < n; i++ {
+			c.add("key" + strconv.Itoa(i))
+		}
+		assert.InEpsilon(t, n, c.estimate(), 0.05, "estimate for %d keys", n)
+	}
+}
+
+func TestEstimateCardinality(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 10,
+		Weight:         0.5,
+		AgeOutValue:    0.5,
+		MaxKeys:        10,
+		currentCounts:  map[string]float64{},
+		movingAverage:  map[string]float64{},
+	}
+	tt := &TotalThroughput{
+		GoalThroughputPerSec:   10,
+		ClearFrequencyDuration: time.Second,
+		MaxKeys:                10,
+		currentCounts:          map[string]int{},
+	}
+	for i := 0; i < 50; i++ {
+		e.GetSampleRate("key" + strconv.Itoa(i))
+		tt.GetSampleRate("key" + strconv.Itoa(i))
+	}
+	// the 40 keys beyond MaxKeys are part of the estimate as soon as they're
+	// dropped, and the 10 that were counted are added when the interval ends
+	assert.InDelta(t, 40, e.EstimateCardinality(), 2)
+	assert.InDelta(t, 40, tt.EstimateCardinality(), 2)
+	assert.Equal(t, int64(10), e.GetMetrics("e_")["e_keyspace_size"])
+	e.updateMaps()
+	tt.updateMaps()
+	// the estimate is close but not always exact
+	assert.InDelta(t, 50, e.EstimateCardinality(), 2)
+	assert.InDelta(t, 50, tt.EstimateCardinality(), 2)
+	assert.Equal(t, int64(e.EstimateCardinality()), e.GetMetrics("e_")["e_estimated_cardinality"])
+	assert.Equal(t, int64(tt.EstimateCardinality()), tt.GetMetrics("t_")["t_estimated_cardinality"])
+}
@@ -0,0 +1,84 @@
+package dynsampler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is a source of time for the samplers in this package. The default
+// clock uses the time package directly. Tests can replace it for the whole
+// process with SetClockForTesting.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a Ticker that fires every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker the samplers use.
+type Ticker interface {
+	// Chan returns the channel on which ticks are delivered.
+	Chan() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+
+	// Reset stops the ticker and resets its period to d.
+	Reset(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// clockBox lets the current Clock be swapped atomically.
+type clockBox struct {
+	clock Clock
+}
+
+var currentClock atomic.Pointer[clockBox]
+
+func init() {
+	currentClock.Store(&clockBox{realClock{}})
+}
+
+// SetClockForTesting replaces the clock used by every sampler in the process
+// and returns a function that restores the previous one. It is meant only for
+// tests and should never be used in production code.
+//
+// It is safe to call concurrently with running samplers, but a sampler only
+// picks up a new clock the next time it asks for one: the current time is read
+// on each use, while tickers are created when a sampler starts. Set the clock
+// before starting the samplers under test. WindowedThroughput (with its
+// default index generator) and EMAThroughput use this clock.
+func SetClockForTesting(c Clock) (restore func()) {
+	previous := currentClock.Swap(&clockBox{c})
+	return func() {
+		currentClock.Store(previous)
+	}
+}
+
+// now returns the current time according to the package clock.
+func now() time.Time {
+	return currentClock.Load().clock.Now()
+}
+
+// newTicker returns a ticker from the package clock.
+func newTicker(d time.Duration) Ticker {
+	return currentClock.Load().clock.NewTicker(d)
+}
@@ -0,0 +1,103 @@
+package dynsampler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock whose time only moves when the test says so. Its
+// tickers only fire when tick is called.
+type fakeClock struct {
+	lock    sync.Mutex
+	t       time.Time
+	tickers []*fakeTicker
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ft := &fakeTicker{c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, ft)
+	return ft
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// tick fires every ticker created so far.
+func (c *fakeClock) tick() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, ft := range c.tickers {
+		select {
+		case ft.c <- c.t:
+		default:
+		}
+	}
+}
+
+// tickerCount returns the number of tickers created so far.
+func (c *fakeClock) tickerCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.tickers)
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time { return t.c }
+func (t *fakeTicker) Stop()                  {}
+func (t *fakeTicker) Reset(d time.Duration)  {}
+
+func TestSetClockForTesting(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	restore := SetClockForTesting(clock)
+	defer restore()
+
+	g := UnixSecondsIndexGenerator{DurationPerIndex: time.Second}
+	assert.Equal(t, int64(1000), g.GetCurrentIndex())
+	clock.advance(5 * time.Second)
+	assert.Equal(t, int64(1005), g.GetCurrentIndex())
+
+	e := &EMAThroughput{
+		AdjustmentInterval:   time.Hour,
+		GoalThroughputPerSec: 1,
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	for i := 0; i < 100; i++ {
+		e.GetSampleRate("key")
+	}
+	// the ticker is created by the sampler's goroutine, and a tick before
+	// then would be lost
+	assert.Eventually(t, func() bool {
+		return clock.tickerCount() == 1
+	}, time.Second, time.Millisecond)
+	// nothing happens until the fake ticker fires, however long we wait, so
+	// the sampler is still using its initial rate
+	assert.Equal(t, int64(0), e.GetMetrics("")["interval_count"])
+	assert.Greater(t, e.GetSampleRate("key"), 1)
+	// 100 events an hour is well under the goal, so once rates are
+	// calculated the key is kept
+	clock.tick()
+	assert.Eventually(t, func() bool {
+		return e.GetSampleRate("key") == 1
+	}, time.Second, 10*time.Millisecond)
+
+	restore()
+	assert.IsType(t, realClock{}, currentClock.Load().clock)
+}
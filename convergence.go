@@ -0,0 +1,46 @@
+package dynsampler
+
+import "math"
+
+// defaultConvergenceThreshold is the ConvergenceThreshold used when none is
+// set.
+const defaultConvergenceThreshold = 0.1
+
+// convergenceDetector measures how many intervals the sample rates take to
+// settle after they shift. An interval in which some key's rate changes by
+// more than the threshold (as a fraction of its previous rate) starts or
+// continues a shift; the first interval after that in which no rate changes
+// that much ends it. Keys that appear or disappear are not counted as changes.
+// The zero value is ready to use. It is not safe for concurrent use; callers
+// are expected to hold the owning sampler's lock.
+type convergenceDetector struct {
+	// shifting is the number of intervals the current shift has lasted, or 0
+	// if rates are stable
+	shifting int64
+
+	// last is the number of intervals the most recent completed shift took
+	// to settle
+	last int64
+}
+
+// observe compares the rates calculated at the end of an interval with the
+// ones they replace.
+func (c *convergenceDetector) observe(oldRates, newRates map[string]int, threshold float64) {
+	if threshold <= 0 {
+		threshold = defaultConvergenceThreshold
+	}
+	var change float64
+	for key, rate := range newRates {
+		if old, found := oldRates[key]; found && old > 0 {
+			change = math.Max(change, math.Abs(float64(rate-old))/float64(old))
+		}
+	}
+	if change > threshold {
+		c.shifting++
+		return
+	}
+	if c.shifting > 0 {
+		c.last = c.shifting
+		c.shifting = 0
+	}
+}
@@ -0,0 +1,53 @@
+package dynsampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvergenceDetector(t *testing.T) {
+	var c convergenceDetector
+	steady := map[string]int{"a": 10, "b": 2}
+	c.observe(nil, steady, 0.1)
+	c.observe(steady, steady, 0.1)
+	assert.Equal(t, int64(0), c.last)
+
+	// a shift lasting three intervals, with a new key that doesn't count
+	c.observe(steady, map[string]int{"a": 20, "b": 2}, 0.1)
+	c.observe(map[string]int{"a": 20, "b": 2}, map[string]int{"a": 30, "b": 2, "c": 1}, 0.1)
+	c.observe(map[string]int{"a": 30, "b": 2}, map[string]int{"a": 34, "b": 2}, 0.1)
+	assert.Equal(t, int64(0), c.last)
+	c.observe(map[string]int{"a": 34, "b": 2}, map[string]int{"a": 35, "b": 2}, 0.1)
+	assert.Equal(t, int64(3), c.last)
+
+	// the zero threshold means the default
+	c.observe(map[string]int{"a": 35}, map[string]int{"a": 37}, 0)
+	assert.Equal(t, int64(0), c.shifting)
+}
+
+func TestEMAThroughputIntervalsToConverge(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		AdjustmentInterval:   time.Second,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		movingAverage:        map[string]float64{},
+	}
+	run := func(busy float64) {
+		e.currentCounts = map[string]float64{"busy": busy, "quiet": 10}
+		e.updateMaps()
+	}
+	// the rates take a couple of intervals to settle after starting
+	for i := 0; i < 10; i++ {
+		run(1000)
+	}
+	assert.Equal(t, int64(2), e.GetMetrics("")["intervals_to_converge"])
+
+	// a tenfold jump takes longer to work through the moving average
+	for i := 0; i < 10; i++ {
+		run(10000)
+	}
+	assert.Equal(t, int64(3), e.GetMetrics("")["intervals_to_converge"])
+}
@@ -0,0 +1,64 @@
+package dynsampler
+
+import "math"
+
+// countMinSketch keeps approximate counts for any number of keys in a fixed
+// amount of memory. Each key is counted in one cell of every row, chosen by a
+// different hash per row, and its count is the smallest of those cells. Other
+// keys that land in the same cells can only add to them, so the estimate is
+// never lower than the true count.
+//
+// With width w and depth d, an estimate exceeds the true count by more than
+// e/w times the total of all counts with probability at most e^-d.
+type countMinSketch struct {
+	width int
+	depth int
+	cells []int64
+}
+
+func newCountMinSketch(width, depth int) *countMinSketch {
+	return &countMinSketch{
+		width: width,
+		depth: depth,
+		cells: make([]int64, width*depth),
+	}
+}
+
+// add adds count to the key whose keyHash is x.
+func (c *countMinSketch) add(x uint64, count int64) {
+	h1, h2 := sketchHashes(x)
+	for row := 0; row < c.depth; row++ {
+		i := row*c.width + int((h1+uint64(row)*h2)%uint64(c.width))
+		if c.cells[i] > math.MaxInt64-count {
+			c.cells[i] = math.MaxInt64
+		} else {
+			c.cells[i] += count
+		}
+	}
+}
+
+// estimate returns the approximate count of the key whose keyHash is x.
+func (c *countMinSketch) estimate(x uint64) int64 {
+	h1, h2 := sketchHashes(x)
+	lowest := int64(math.MaxInt64)
+	for row := 0; row < c.depth; row++ {
+		i := row*c.width + int((h1+uint64(row)*h2)%uint64(c.width))
+		if c.cells[i] < lowest {
+			lowest = c.cells[i]
+		}
+	}
+	return lowest
+}
+
+// reset sets every count back to zero.
+func (c *countMinSketch) reset() {
+	for i := range c.cells {
+		c.cells[i] = 0
+	}
+}
+
+// sketchHashes splits a key hash into the two hashes that are combined to pick
+// a cell in each row. h2 is odd so that rows never collapse onto each other.
+func sketchHashes(x uint64) (h1, h2 uint64) {
+	return x & 0xffffffff, x>>32 | 1
+}
@@ -0,0 +1,68 @@
+package dynsampler
+
+import (
+	"math"
+	"sync"
+)
+
+// clampInt converts a count to an int for samplers that keep int counters,
+// saturating rather than wrapping on platforms where int is 32 bits.
+func clampInt(n int64) int {
+	if n > math.MaxInt {
+		return math.MaxInt
+	}
+	if n < math.MinInt {
+		return math.MinInt
+	}
+	return int(n)
+}
+
+// copyCounts returns a copy of a map of counts. The copy of a nil map is
+// empty rather than nil.
+func copyCounts(counts map[string]float64) map[string]float64 {
+	c := make(map[string]float64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
+// copyRates returns a copy of a map of sample rates. The copy of a nil map is
+// empty rather than nil.
+func copyRates(rates map[string]int) map[string]int {
+	c := make(map[string]int, len(rates))
+	for k, v := range rates {
+		c[k] = v
+	}
+	return c
+}
+
+// exportRates calls export, if it is set, with a copy of *rates taken while
+// holding lock. export is called after lock is released, so it may take as
+// long as it likes without holding up sampling. It is for the ExportOnStop
+// callbacks of the samplers' Stop methods.
+func exportRates(export func(rates map[string]int), lock sync.Locker, rates *map[string]int) {
+	if export == nil {
+		return
+	}
+	lock.Lock()
+	c := copyRates(*rates)
+	lock.Unlock()
+	export(c)
+}
+
+// adjustCount adds delta, which may be negative, to key's count, flooring the
+// result at zero. A key whose count reaches zero is removed, as if it hadn't
+// been counted. A key that isn't counted yet is only added if the map has
+// room for it under maxKeys.
+func adjustCount(counts map[string]float64, key string, delta float64, maxKeys int) {
+	count, found := counts[key]
+	if !found && (delta <= 0 || (maxKeys > 0 && len(counts) >= maxKeys)) {
+		return
+	}
+	if count += delta; count > 0 {
+		counts[key] = count
+	} else {
+		delete(counts, key)
+	}
+}
@@ -0,0 +1,32 @@
+package dynsampler
+
+// CountUnit decides what the throughput samplers count toward their goal for
+// each call to GetSampleRateMulti.
+//
+// The count passed to GetSampleRateMulti says how many events the call stands
+// for, and the rate returned applies to all of them. By default it is also
+// what throughput is measured in, so a goal of 100 per second means 100
+// spans. A caller that makes one call per trace, passing the number of spans
+// in the trace, may want the goal to be 100 traces per second instead, and
+// traces with many spans not to be sampled harder for it; CountUnitGroups
+// does that. Either way, the event_count metric is the sum of the counts
+// passed in.
+type CountUnit int
+
+const (
+	// CountUnitSpans measures throughput in the events each call stands for,
+	// the count passed to GetSampleRateMulti. This is the default.
+	CountUnitSpans CountUnit = iota
+	// CountUnitGroups measures throughput in calls, counting each call as one
+	// whatever count is passed, so that the goal is a number of groups, such
+	// as traces, per second.
+	CountUnitGroups
+)
+
+// of returns how much a call that stands for count events adds to throughput.
+func (u CountUnit) of(count int64) int64 {
+	if u == CountUnitGroups {
+		return 1
+	}
+	return count
+}
@@ -17,12 +17,22 @@ The following guidelines can help you choose a sampler. Depending on the shape o
 
 * If your logging system has a strict cap on the rate it can receive events, use `TotalThroughput`, which will calculate sample rates based on keeping *the entire system's* representative event throughput right around (or under) particular cap.
 
+* If you need `TotalThroughput` for a key space too large or unbounded to count exactly, use `SketchThroughput`. It counts keys approximately in a fixed amount of memory.
+
 * If your system has a rough cap on the rate it can receive events and your partitioned keyspace is fairly steady, use `PerKeyThroughput`, which will calculate sample rates based on keeping the event throughput roughly constant *per key/partition* (e.g. per user id)
 
+* If you need both a per-key limit and a limit on total throughput, use `PerKeyTotalThroughput`. It caps each key like `PerKeyThroughput` and then shares the total goal fairly between the keys, in a single calculation.
+
 * The best choice for a system with a large key space and a large disparity between the highest volume and lowest volume keys is `AvgSampleRateWithMin` - it will increase the sample rate of higher volume traffic proportionally to the logarithm of the specific key's volume. If total traffic falls below a configured minimum, it stops sampling to avoid any sampling when the traffic is too low to warrant it.
 
 * `EMASampleRate` works like `AvgSampleRate`, but calculates sample rates based on a moving average (Exponential Moving Average) of many measurement intervals rather than a single isolated interval. In addition, it can detect large bursts in traffic and will trigger a recalculation of sample rates before the regular interval.
 
+* If you need a hard ceiling on the number of events kept in each interval, use `StrictBudgetSampler`. It shares a fixed budget fairly between keys, and its `Decide` method chooses which events to keep so that the budget is never exceeded.
+
+* If you want `AvgSampleRate`'s distribution of sample rates across keys but also need a hard ceiling on total throughput, use `HybridSampler`. It aims for an average sample rate and raises every key's rate proportionally whenever the projected throughput would exceed the cap.
+
+* If sample rates are calculated centrally for a whole cluster, use `RemoteRateSampler` to serve them locally. It serves whatever rates it is given with `SetSampleRates` and counts traffic per key so the counts can be reported back.
+
 Each sampler implementation below has additional configuration parameters and a
 detailed description of how it chooses a sample rate.
 
@@ -30,5 +40,9 @@ Some implementations implement `SaveState` and `LoadState` - enabling you to ser
 and load it back. This is useful, for example, if you want to avoid losing calculated sample rates between process
 restarts.
 
+Most of the samplers that calculate sample rates also take an `ExportOnStop` callback, which `Stop` calls with a copy
+of the sample rates from the last update, so that the rates the sampler learned can be kept for analysis when the
+process shuts down. It is called synchronously, without the sampler's lock held, and `Stop` doesn't return until it does.
+
 */
 package dynsampler
@@ -0,0 +1,40 @@
+package dynsampler
+
+// droppedKeySamplesSize is the number of rejected keys retained for
+// DroppedKeySamples.
+const droppedKeySamplesSize = 100
+
+// droppedKeys is a fixed-size ring buffer of the most recent keys that were
+// rejected because a sampler had reached MaxKeys. It gives operators concrete
+// examples of the keys responsible for a cardinality problem while keeping
+// memory bounded. The zero value is ready to use. It is not safe for
+// concurrent use; callers are expected to hold the owning sampler's lock.
+type droppedKeys struct {
+	keys [droppedKeySamplesSize]string
+	next int
+	full bool
+}
+
+// add records a rejected key, overwriting the oldest entry if the buffer is full.
+func (d *droppedKeys) add(key string) {
+	d.keys[d.next] = key
+	d.next++
+	if d.next == len(d.keys) {
+		d.next = 0
+		d.full = true
+	}
+}
+
+// drain returns the recorded keys, oldest first, and empties the buffer.
+func (d *droppedKeys) drain() []string {
+	var out []string
+	if d.full {
+		out = make([]string, 0, len(d.keys))
+		out = append(out, d.keys[d.next:]...)
+	} else {
+		out = make([]string, 0, d.next)
+	}
+	out = append(out, d.keys[:d.next]...)
+	*d = droppedKeys{}
+	return out
+}
@@ -0,0 +1,28 @@
+package dynsampler
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDroppedKeys(t *testing.T) {
+	d := droppedKeys{}
+	assert.Equal(t, []string{}, d.drain())
+
+	d.add("one")
+	d.add("two")
+	assert.Equal(t, []string{"one", "two"}, d.drain())
+	// draining resets the buffer
+	assert.Equal(t, []string{}, d.drain())
+
+	// overfill the buffer; only the most recent keys are retained, oldest first
+	for i := 0; i < droppedKeySamplesSize+10; i++ {
+		d.add(strconv.Itoa(i))
+	}
+	keys := d.drain()
+	assert.Equal(t, droppedKeySamplesSize, len(keys))
+	assert.Equal(t, "10", keys[0])
+	assert.Equal(t, strconv.Itoa(droppedKeySamplesSize+9), keys[len(keys)-1])
+}
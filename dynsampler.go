@@ -1,5 +1,7 @@
 package dynsampler
 
+import "fmt"
+
 // Sampler is the interface to samplers using different methods to determine
 // sample rate. You should instantiate one of the actual samplers in this
 // package, depending on the sample method you'd like to use. Each sampling
@@ -7,7 +9,9 @@ package dynsampler
 // the sampler.
 type Sampler interface {
 	// Start initializes the sampler. You should call Start() before using the
-	// sampler.
+	// sampler. Calling GetSampleRate before Start is safe: samplers that
+	// calculate rates return 1 for every key until they are started, without
+	// counting the calls.
 	Start() error
 
 	// Stop halts the sampler and any background goroutines
@@ -36,9 +40,46 @@ type Sampler interface {
 	// implementation. It should be called before `Start`.
 	LoadState([]byte) error
 
+	// SupportsState reports whether SaveState returns the sampler's state.
+	// Samplers that don't keep state between restarts return false, and their
+	// SaveState returns no data, so callers need not persist anything for
+	// them.
+	SupportsState() bool
+
 	// GetMetrics returns a map of metrics about the sampler's performance.
 	// All values are returned as int64; counters are cumulative and the names
 	// always end with "_count", while gauges are instantaneous with no particular naming convention.
-	// All names are prefixed with the given string.
+	// All names are prefixed with the given string. Every sampler reports
+	// request_count, the number of calls to GetSampleRate and
+	// GetSampleRateMulti, and event_count, the number of events those calls
+	// represented, which is the sum of the counts passed to GetSampleRateMulti. The samplers in this
+	// package also have a GetMetricsTyped method that reports each metric's
+	// kind directly.
 	GetMetrics(prefix string) map[string]int64
 }
+
+// StartAll starts each of the given samplers in order. If one fails to start,
+// the samplers already started are stopped again and the error is returned,
+// wrapped with the position and type of the sampler that failed.
+func StartAll(samplers ...Sampler) error {
+	for i, s := range samplers {
+		if err := s.Start(); err != nil {
+			StopAll(samplers[:i]...)
+			return fmt.Errorf("starting sampler %d (%T): %w", i, s, err)
+		}
+	}
+	return nil
+}
+
+// StopAll stops each of the given samplers. Every sampler is stopped even if
+// an earlier one returns an error; the first error is returned, wrapped with
+// the position and type of the sampler that returned it.
+func StopAll(samplers ...Sampler) error {
+	var firstErr error
+	for i, s := range samplers {
+		if err := s.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping sampler %d (%T): %w", i, s, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,53 @@
+package dynsampler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lifecycleRecorder wraps a Sampler and records calls to Start and Stop.
+type lifecycleRecorder struct {
+	Sampler
+	started bool
+	stopped bool
+}
+
+func (l *lifecycleRecorder) Start() error {
+	err := l.Sampler.Start()
+	l.started = err == nil
+	return err
+}
+
+func (l *lifecycleRecorder) Stop() error {
+	l.stopped = true
+	return l.Sampler.Stop()
+}
+
+func TestStartAll(t *testing.T) {
+	first := &lifecycleRecorder{Sampler: &AvgSampleRate{}}
+	second := &lifecycleRecorder{Sampler: &TotalThroughput{}}
+	// conflicting interval configuration, so this one fails to start
+	broken := &lifecycleRecorder{Sampler: &PerKeyThroughput{
+		ClearFrequencySec:      2,
+		ClearFrequencyDuration: 2 * time.Second,
+	}}
+	last := &lifecycleRecorder{Sampler: &OnlyOnce{}}
+
+	err := StartAll(first, second, broken, last)
+	assert.True(t, errors.Is(err, ErrConflictingIntervalConfig))
+	assert.Contains(t, err.Error(), "sampler 2")
+	assert.True(t, first.started && first.stopped)
+	assert.True(t, second.started && second.stopped)
+	assert.False(t, broken.started || broken.stopped)
+	assert.False(t, last.started || last.stopped)
+
+	a := &lifecycleRecorder{Sampler: &AvgSampleRate{}}
+	b := &lifecycleRecorder{Sampler: &Static{}}
+	assert.Nil(t, StartAll(a, b))
+	assert.True(t, a.started && b.started)
+	assert.Nil(t, StopAll(a, b))
+	assert.True(t, a.stopped && b.stopped)
+}
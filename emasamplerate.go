@@ -3,7 +3,6 @@ package dynsampler
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -40,6 +39,14 @@ type EMASampleRate struct {
 	// If neither one is set, the default is 15s.
 	AdjustmentIntervalDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every AdjustmentIntervalDuration, for embedded
+	// use where background goroutines aren't welcome. The caller must call
+	// Update on its own schedule instead; without calls to Update, the sample
+	// rates never change. Bursts are still detected, but don't trigger an early
+	// update, and AdaptiveInterval has no effect. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// Weight is a value between (0, 1) indicating the weighting factor used to adjust
 	// the EMA. With larger values, newer data will influence the average more, and older
 	// values will be factored out more quickly.  In mathematical literature concerning EMA,
@@ -47,15 +54,141 @@ type EMASampleRate struct {
 	// Default is 0.5
 	Weight float64
 
+	// TimeWeightedEMA, if true, allows for intervals that don't last exactly
+	// AdjustmentIntervalDuration, because the process was paused or the update ran
+	// late. Each update measures the time since the last one, and the counts
+	// are scaled to one interval's worth before they are added to the moving
+	// average, with the weight that many intervals would have had together.
+	// Without it, a long interval's larger counts pull the averages up as if
+	// traffic had grown. Defaults to false.
+	TimeWeightedEMA bool
+
+	// MaxDeltaPerInterval, if greater than 0, limits how far a key's moving
+	// average can move in one interval, as a fraction of its value before the
+	// interval, so that one anomalous interval can't pull it far: with 0.5, a
+	// key averaging 100 moves to somewhere between 50 and 150, however many
+	// events it had. Keys new to the average aren't limited. Unlike burst
+	// detection, which reacts to a spike, this ignores most of it. Defaults to
+	// 0, which doesn't limit the averages.
+	MaxDeltaPerInterval float64
+
 	// GoalSampleRate is the average sample rate we're aiming for, across all
-	// events. Default 10
+	// events. Default 10. A GoalSampleRate of 1 keeps everything, as if KeepAll
+	// were set.
 	GoalSampleRate int
 
+	// KeepAll, if true, makes the sampler return a sample rate of 1 for every
+	// key, passing all traffic through while still counting it for metrics.
+	// Sample rates are not calculated while KeepAll is in effect. Use SetKeepAll
+	// to change it on a running sampler.
+	KeepAll bool
+
+	// PinnedKeys lists keys that are important but intermittent. Normally a
+	// key that ages out of the moving average loses its calculated sample rate
+	// and is sampled at 1 when it comes back, until the next calculation. A
+	// pinned key instead keeps the last rate calculated for it until it is back
+	// in the moving average. An interval with no traffic at all leaves every
+	// rate, pinned or not, as it was.
+	PinnedKeys []string
+
+	// ColdStartRate, if greater than 0, is the sample rate returned for all keys
+	// before the first set of sample rates has been calculated. Keys are still
+	// counted during this period, subject to MaxKeys. If unset, GoalSampleRate is
+	// used.
+	ColdStartRate int
+
+	// UnknownKeyRate, if greater than 0, is the sample rate returned for a key
+	// that has no calculated sample rate once the sampler has data: a key that
+	// is new, or that went quiet and lost its rate. The default of 1 keeps every
+	// event for such keys until rates are next calculated, which keeps traces
+	// through rare keys complete, but lets a brand new high-volume key through
+	// unsampled for up to an interval. A higher value, such as GoalSampleRate,
+	// guards against that flood at the cost of dropping events from rare keys,
+	// which can leave gaps in the traces they belong to.
+	UnknownKeyRate int
+
+	// KeyConstraints bounds the sample rates given to particular keys, in one
+	// place. The rate the sampler would otherwise give a listed key, whether
+	// calculated, ColdStartRate, or UnknownKeyRate, is raised to its Min or
+	// lowered to its Max. These samplers have no MinSampleRate or
+	// MaxSampleRate of their own, so per-key bounds are the only bounds, and
+	// KeepAll, which keeps everything, takes precedence over them. Keys are
+	// matched as GetSampleRate would count them, after MaxKeyLength is
+	// applied. Keys that aren't listed aren't constrained.
+	KeyConstraints map[string]KeyConstraint
+
+	// WarmKeyFrom, if set, is asked for a related key when a key with no
+	// calculated sample rate is seen, such as a new version of a route. If it
+	// returns a key that has a rate, the new key is given that rate until
+	// rates are next calculated, instead of UnknownKeyRate, which avoids a
+	// flood from new keys in predictable families. A rate it gives is
+	// remembered for the rest of the interval, for up to MaxKeys keys, but a
+	// key it has no rate for is asked about each time it is seen. It is asked
+	// with the sampler's lock held, so it must be quick and must not call the
+	// sampler. PeekSampleRate doesn't ask it.
+	WarmKeyFrom func(newKey string) (string, bool)
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys tracked in EMA.
 	// Once MaxKeys is reached, new keys will not be included in the sample rate map, but
 	// existing keys will continue to be be counted.
 	MaxKeys int
 
+	// KeyOrder is the order in which keys are visited when dividing up the
+	// budget of events to keep, which decides which keys benefit from budget
+	// left unused by quiet keys. See KeyOrder for details. Defaults to
+	// KeyOrderLexical.
+	KeyOrder KeyOrder
+
+	// ExtraBudgetPolicy decides how budget left unused by quiet keys is shared
+	// among the keys visited after them. See ExtraBudgetPolicy for details.
+	// Defaults to ExtraBudgetEqual.
+	ExtraBudgetPolicy ExtraBudgetPolicy
+
+	// SnapToNiceRates, if true, rounds each calculated sample rate to the
+	// nearest of a set of round numbers, so that rates are easier for people
+	// to read. This moves throughput away from the goal. With the default 1,
+	// 2, 5 series, a key can keep up to about 60% more or 40% fewer events
+	// than its calculated rate would, though across many keys the differences
+	// largely cancel out. Defaults to false.
+	SnapToNiceRates bool
+
+	// NiceRates are the rates SnapToNiceRates rounds to. Defaults to the
+	// series 1, 2, 5, 10, 20, 50, 100, and so on.
+	NiceRates []int
+
+	// OnKeyRateChange, if set, is called at the end of an interval for each
+	// watched key whose sample rate changed, with its old and new rates. A key
+	// with no rate, because it is new or has gone quiet, has a rate of 0. It
+	// is called from the goroutine that recalculates rates, without the
+	// sampler's lock held, so it may call the sampler, but a slow callback
+	// delays the next interval's rates.
+	OnKeyRateChange func(key string, oldRate, newRate int)
+
+	// WatchKeys lists the keys OnKeyRateChange is called for. If it is empty,
+	// the callback is called for every key whose rate changed.
+	WatchKeys []string
+
+	// HeavySampleThreshold is the sample rate above which a key counts as
+	// heavily sampled in the keys_above_threshold metric. A rising number of
+	// such keys means the budget is being concentrated in fewer keys. Defaults
+	// to 100.
+	HeavySampleThreshold int
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
 	// AgeOutValue indicates the threshold for removing keys from the EMA. The EMA of any key will approach 0
 	// if it is not repeatedly observed, but will never truly reach it, so we have to decide what constitutes "zero".
 	// Keys with averages below this threshold will be removed from the EMA. Default is the same as Weight, as this prevents
@@ -63,6 +196,15 @@ type EMASampleRate struct {
 	// unless you have very specific reasons to set it higher.
 	AgeOutValue float64
 
+	// AgeOutGraceIntervals is the number of consecutive intervals a key's
+	// moving average must stay below AgeOutValue before the key is removed
+	// from the EMA. A key that is seen again, or whose average climbs back to
+	// AgeOutValue, starts counting again. This keeps keys that are
+	// intermittent but recurring from churning in and out of the EMA.
+	// Defaults to 0, which, like 1, removes a key as soon as its average drops
+	// below AgeOutValue.
+	AgeOutGraceIntervals int
+
 	// BurstMultiple, if set, is multiplied by the sum of the running average of counts to define
 	// the burst detection threshold. If total counts observed for a given interval exceed the threshold
 	// EMA is updated immediately, rather than waiting on the AdjustmentIntervalDuration.
@@ -74,12 +216,91 @@ type EMASampleRate struct {
 	// Defaults to 3
 	BurstDetectionDelay uint
 
+	// AdaptiveInterval, if true, lets the sampler recalculate more often than
+	// AdjustmentIntervalDuration while traffic is volatile. When the rate of
+	// events changes by more than VolatilityThreshold from one interval to the
+	// next, the interval is halved, down to MinAdjustmentInterval; while traffic
+	// is stable it is doubled again, up to AdjustmentIntervalDuration.
+	AdaptiveInterval bool
+
+	// MinAdjustmentInterval is the shortest interval AdaptiveInterval will use.
+	// It must be shorter than AdjustmentIntervalDuration. Defaults to a
+	// quarter of AdjustmentIntervalDuration.
+	MinAdjustmentInterval time.Duration
+
+	// VolatilityThreshold is the fractional change in the rate of events
+	// between intervals that AdaptiveInterval considers volatile. Defaults to
+	// 0.5, a change of 50%.
+	VolatilityThreshold float64
+
+	// ConvergenceThreshold is the fractional change in a key's sample rate
+	// from one interval to the next below which the rates are considered
+	// stable. After the rates shift, the number of intervals they take to be
+	// stable again is reported as the intervals_to_converge metric, which
+	// helps when tuning Weight and the adjustment interval. Keys whose rates
+	// change by more than this and keep reversing direction, 3 or more times
+	// in the last 8 intervals, are counted by the oscillating_keys metric; a
+	// non-zero count suggests lowering Weight. Defaults to 0.1, a change of
+	// 10%.
+	ConvergenceThreshold float64
+
+	// DecayRateToOne, if true, changes what happens when a key ages out of the
+	// EMA. Instead of losing its sample rate at once (and so dropping straight
+	// to a rate of 1 if it comes back), the key keeps a saved rate that steps
+	// down linearly toward 1 over the next few intervals before it is removed.
+	// This avoids a sudden flood of events when a key that was heavily sampled
+	// reappears shortly after going quiet.
+	DecayRateToOne bool
+
+	// LenientLoad, if true, lets LoadState and ApplyState accept state saved
+	// by an EMAThroughput, so a deployment can switch between the two EMA samplers
+	// without starting from scratch. Only the moving average is taken from
+	// such state; its sample rates were calculated toward a different kind of
+	// goal and are ignored, so the sampler uses its startup rate until it next
+	// calculates rates from the imported average. State from any other kind of
+	// sampler is always rejected. Defaults to false, which rejects state saved
+	// by any other kind of sampler.
+	LenientLoad bool
+
+	// NoiseDetectionPrefixLen, if greater than 0, turns on a defense against
+	// a badly chosen key that makes many near-unique keys, each of which would
+	// otherwise be kept at a rate of 1. Keys are grouped by their first
+	// NoiseDetectionPrefixLen bytes, and a group with at least
+	// NoiseDetectionMinKeys keys is sampled as if it were a single key, so the
+	// whole group shares one, heavier, sample rate. New keys in such a group
+	// get the group's rate straight away. Keys shorter than the prefix are
+	// never grouped. Defaults to 0, which turns detection off.
+	NoiseDetectionPrefixLen int
+
+	// NoiseDetectionMinKeys is the number of keys sharing a prefix that makes
+	// them a noisy group, for NoiseDetectionPrefixLen. Defaults to 100.
+	NoiseDetectionMinKeys int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]float64
 	movingAverage    map[string]float64
+	decaying         map[string]*rateDecay
+	resetKeys        []string // keys reset while updating, to forget once it's done
+	ageOutGrace      ageOutGrace
+	timeWeighting    timeWeighting  // for TimeWeightedEMA
+	noisyRates       map[string]int // rates of noisy groups, by prefix
+	warmRates        map[string]int // rates from WarmKeyFrom, until the next update
 	burstThreshold   float64
 	currentBurstSum  float64
 	intervalCount    uint
+	intervalSum      float64 // events seen since nextInterval last ran
+	adaptive         adaptiveInterval
 	burstSignal      chan struct{}
 
 	// haveData indicates that we have gotten a sample of traffic. Before we've
@@ -89,26 +310,127 @@ type EMASampleRate struct {
 	updating bool
 	done     chan struct{}
 
+	// frozen stops updateMaps from calculating new rates. See Freeze.
+	frozen bool
+
+	// lastCounts holds the counts of the last interval. See
+	// GetLastIntervalCounts.
+	lastCounts map[string]float64
+
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// cardinality estimates the number of distinct keys seen since Start
+	cardinality cardinalityEstimate
+
 	// used only in tests
 	testSignalMapsDone chan struct{}
 
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
-	requestCount int64
-	eventCount   int64
-	burstCount   int64
+	requestCount  int64
+	eventCount    int64
+	burstCount    int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	effectiveRate int64      // thousandths, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+
+	// the smoothed volume the last interval's rates were based on
+	movingAverageSum  int64 // rounded to whole events
+	movingAverageKeys int64
+
+	// convergence measures how long rates take to settle after they shift
+	convergence convergenceDetector
+
+	// oscillation finds keys whose rates keep reversing direction
+	oscillation oscillationDetector
+
+	// rateHistogram counts the sample rates returned by GetSampleRateMulti
+	rateHistogram rateHistogram
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*EMASampleRate)(nil)
 
-func (e *EMASampleRate) Start() error {
-	// apply defaults
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (e *EMASampleRate) Validate() error {
 	if e.AdjustmentIntervalDuration != 0 && e.AdjustmentInterval != 0 {
-		return fmt.Errorf("the AdjustmentInterval configuration value is deprecated; use only AdjustmentIntervalDuration")
+		return newConfigError(ErrConflictingIntervalConfig, "the AdjustmentInterval configuration value is deprecated; use only AdjustmentIntervalDuration")
+	}
+	if e.AdjustmentIntervalDuration < 0 || e.AdjustmentInterval < 0 {
+		return newConfigError(ErrInvalidInterval, "the adjustment interval must not be negative")
+	}
+	if e.GoalSampleRate < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalSampleRate %d must not be negative", e.GoalSampleRate)
+	}
+	if e.UnknownKeyRate < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the UnknownKeyRate %d must not be negative", e.UnknownKeyRate)
+	}
+	if e.Weight < 0 || e.Weight > 1 {
+		return newConfigError(ErrInvalidWeight, "the Weight %v must be between 0 and 1", e.Weight)
+	}
+	if e.MinAdjustmentInterval < 0 {
+		return newConfigError(ErrInvalidInterval, "the MinAdjustmentInterval %v must not be negative", e.MinAdjustmentInterval)
+	}
+	if e.AdaptiveInterval && e.MinAdjustmentInterval > 0 {
+		interval := e.AdjustmentIntervalDuration
+		if e.AdjustmentInterval != 0 {
+			interval = time.Duration(e.AdjustmentInterval) * time.Second
+		} else if interval == 0 {
+			interval = 15 * time.Second
+		}
+		if e.MinAdjustmentInterval >= interval {
+			return newConfigError(ErrInvalidInterval, "the MinAdjustmentInterval %v must be shorter than the adjustment interval %v", e.MinAdjustmentInterval, interval)
+		}
+	}
+	if e.VolatilityThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the VolatilityThreshold %v must not be negative", e.VolatilityThreshold)
+	}
+	if e.MaxDeltaPerInterval < 0 {
+		return newConfigError(ErrInvalidThreshold, "the MaxDeltaPerInterval %v must not be negative", e.MaxDeltaPerInterval)
+	}
+	if e.ConvergenceThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the ConvergenceThreshold %v must not be negative", e.ConvergenceThreshold)
+	}
+	if e.AgeOutValue < 0 {
+		return newConfigError(ErrInvalidThreshold, "the AgeOutValue %v must not be negative", e.AgeOutValue)
+	}
+	if e.AgeOutGraceIntervals < 0 {
+		return newConfigError(ErrInvalidThreshold, "the AgeOutGraceIntervals %d must not be negative", e.AgeOutGraceIntervals)
+	}
+	if e.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", e.HeavySampleThreshold)
+	}
+	if e.NoiseDetectionPrefixLen < 0 {
+		return newConfigError(ErrInvalidThreshold, "the NoiseDetectionPrefixLen %d must not be negative", e.NoiseDetectionPrefixLen)
+	}
+	if e.NoiseDetectionMinKeys < 0 {
+		return newConfigError(ErrInvalidThreshold, "the NoiseDetectionMinKeys %d must not be negative", e.NoiseDetectionMinKeys)
+	}
+	if err := validateNiceRates(e.NiceRates); err != nil {
+		return err
+	}
+	if err := validateKeyConstraints(e.KeyConstraints); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *EMASampleRate) Start() error {
+	if err := e.Validate(); err != nil {
+		return err
 	}
 
+	// apply defaults
+
 	if e.AdjustmentIntervalDuration == 0 && e.AdjustmentInterval == 0 {
 		e.AdjustmentIntervalDuration = 15 * time.Second
 	} else if e.AdjustmentInterval != 0 {
@@ -130,31 +452,64 @@ func (e *EMASampleRate) Start() error {
 	if e.BurstDetectionDelay == 0 {
 		e.BurstDetectionDelay = 3
 	}
+	if e.MinAdjustmentInterval == 0 {
+		e.MinAdjustmentInterval = e.AdjustmentIntervalDuration / 4
+	}
+	if e.VolatilityThreshold == 0 {
+		e.VolatilityThreshold = 0.5
+	}
+	if e.ConvergenceThreshold == 0 {
+		e.ConvergenceThreshold = defaultConvergenceThreshold
+	}
+	if e.NoiseDetectionMinKeys == 0 {
+		e.NoiseDetectionMinKeys = 100
+	}
+	if err := checkInterval("AdjustmentIntervalDuration", e.AdjustmentIntervalDuration); err != nil {
+		return err
+	}
+	if e.AdaptiveInterval {
+		if err := checkInterval("MinAdjustmentInterval", e.MinAdjustmentInterval); err != nil {
+			return err
+		}
+	}
 
 	// Don't override these maps at startup in case they were loaded from a previous state
-	e.currentCounts = make(map[string]float64)
+	e.currentCounts = make(map[string]float64, e.ExpectedKeys)
 	if e.savedSampleRates == nil {
-		e.savedSampleRates = make(map[string]int)
+		e.savedSampleRates = make(map[string]int, e.ExpectedKeys)
 	}
 	if e.movingAverage == nil {
-		e.movingAverage = make(map[string]float64)
+		e.movingAverage = make(map[string]float64, e.ExpectedKeys)
 	}
 	e.burstSignal = make(chan struct{})
 	e.done = make(chan struct{})
 
+	if e.NoBackgroundGoroutine {
+		return nil
+	}
+
 	go func() {
-		ticker := time.NewTicker(e.AdjustmentIntervalDuration)
+		interval := e.AdjustmentIntervalDuration
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-e.burstSignal:
 				// reset ticker when we get a burst
 				ticker.Stop()
-				ticker = time.NewTicker(e.AdjustmentIntervalDuration)
+				ticker = time.NewTicker(interval)
 				e.updateMaps()
 			case <-ticker.C:
 				e.updateMaps()
+				e.lock.Lock()
 				e.intervalCount++
+				e.lock.Unlock()
+				if e.AdaptiveInterval {
+					if next := e.nextInterval(); next != interval {
+						interval = next
+						ticker.Reset(interval)
+					}
+				}
 			case <-e.done:
 				return
 			}
@@ -165,13 +520,29 @@ func (e *EMASampleRate) Start() error {
 
 func (e *EMASampleRate) Stop() error {
 	close(e.done)
+	exportRates(e.ExportOnStop, &e.lock, &e.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every AdjustmentIntervalDuration. It is
+// for use with NoBackgroundGoroutine.
+func (e *EMASampleRate) Update() {
+	e.updateMaps()
+	e.lock.Lock()
+	e.intervalCount++
+	e.lock.Unlock()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (e *EMASampleRate) updateMaps() {
+	// rate changes are reported after the deferred unlocks below have run
+	var changes []rateChange
+	defer func() { notifyRateChanges(e.OnKeyRateChange, changes) }()
+
 	e.lock.Lock()
+	addKeys(&e.cardinality, e.currentCounts)
 	if e.testSignalMapsDone != nil {
 		defer func() {
 			e.testSignalMapsDone <- struct{}{}
@@ -181,6 +552,24 @@ func (e *EMASampleRate) updateMaps() {
 	if len(e.currentCounts) == 0 {
 		// No traffic the last interval, don't update anything. This is deliberate to avoid
 		// the average decaying when there's no traffic (comes in bursts, or there's some kind of outage).
+		if e.TimeWeightedEMA {
+			e.timeWeighting.observe(now(), e.AdjustmentIntervalDuration)
+		}
+		e.keyspace.observe(0)
+		e.lastCounts = nil
+		e.lock.Unlock()
+		return
+	}
+	if e.frozen {
+		// the counts are dropped without being added to the moving average,
+		// so the saved rates stay as they are
+		if e.TimeWeightedEMA {
+			e.timeWeighting.observe(now(), e.AdjustmentIntervalDuration)
+		}
+		e.keyspace.observe(len(e.currentCounts))
+		e.lastCounts = e.currentCounts
+		e.currentCounts = make(map[string]float64, e.ExpectedKeys)
+		e.currentBurstSum = 0
 		e.lock.Unlock()
 		return
 	}
@@ -190,47 +579,230 @@ func (e *EMASampleRate) updateMaps() {
 		return
 	}
 	e.updating = true
+	if e.TimeWeightedEMA {
+		e.timeWeighting.observe(now(), e.AdjustmentIntervalDuration)
+	}
 	// make a local copy of the sample counters for calculation
 	tmpCounts := e.currentCounts
-	e.currentCounts = make(map[string]float64)
+	e.keyspace.observe(len(tmpCounts))
+	e.currentCounts = make(map[string]float64, e.ExpectedKeys)
 	e.currentBurstSum = 0
+	keepAll := e.keepAll()
 	e.lock.Unlock()
 
+	// updateEMA consumes tmpCounts, so keep a copy for GetLastIntervalCounts
+	lastCounts := make(map[string]float64, len(tmpCounts))
+	var intervalSum float64
+	for _, key := range sortedKeys(tmpCounts) {
+		intervalSum += tmpCounts[key]
+		lastCounts[key] = tmpCounts[key]
+	}
+
 	e.updateEMA(tmpCounts)
 
 	// Goal events to send this interval is the total count of events in the EMA
 	// divided by the desired average sample rate
+	keys := sortedKeys(e.movingAverage)
 	var sumEvents float64
-	for _, count := range e.movingAverage {
-		sumEvents += math.Max(1, count)
+	for _, key := range keys {
+		sumEvents += math.Max(1, e.movingAverage[key])
 	}
 
 	// Store this for burst detection. This is checked in GetSampleRate
 	// so we need to grab the lock when we update it.
 	e.lock.Lock()
 	e.burstThreshold = sumEvents * e.BurstMultiple
+	e.intervalSum += intervalSum
+	e.lastCounts = lastCounts
+	e.movingAverageSum = int64(math.Round(sumEvents))
+	e.movingAverageKeys = int64(len(e.movingAverage))
 	e.lock.Unlock()
 
+	// In keep-all mode every key gets a rate of 1, so there's nothing to
+	// calculate. The moving average is still maintained so that sensible rates
+	// are available as soon as keep-all is turned off.
+	if keepAll {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.keptFraction = 1e6
+		e.effectiveRate = 1e3
+		e.finishResets(nil)
+		e.updating = false
+		return
+	}
+
+	// noisy groups of keys are sampled as one key
+	averages := e.movingAverage
+	groups := noisyGroups(e.movingAverage, e.NoiseDetectionPrefixLen, e.NoiseDetectionMinKeys)
+	if len(groups) > 0 {
+		averages = groupAverages(e.movingAverage, groups)
+		keys = sortedKeys(averages)
+	}
+
 	goalCount := float64(sumEvents) / float64(e.GoalSampleRate)
 	// goalRatio is the goalCount divided by the sum of all the log values - it
 	// determines what percentage of the total event space belongs to each key
 	var logSum float64
-	for _, count := range e.movingAverage {
+	for _, key := range keys {
 		// We take the max of (1, count) because count * weight is < 1 for
 		// very small counts, which throws off the logSum and can cause
 		// incorrect samples rates to be computed when throughput is low
-		logSum += math.Log10(math.Max(1, count))
+		logSum += math.Log10(math.Max(1, averages[key]))
 	}
 	goalRatio := goalCount / logSum
 
-	newSavedSampleRates := calculateSampleRates(goalRatio, e.movingAverage)
+	heavy := newHeavyKeys(e.HeavySampleThreshold)
+	newSavedSampleRates, kept := calculateSampleRates(goalRatio, averages, e.KeyOrder, e.ExtraBudgetPolicy, heavy)
+	noisyRates := ungroupRates(newSavedSampleRates, groups, heavy)
+	if e.SnapToNiceRates {
+		kept = snapToNiceRates(newSavedSampleRates, e.movingAverage, e.NiceRates, heavy)
+	}
 	e.lock.Lock()
 	defer e.lock.Unlock()
+	if e.DecayRateToOne {
+		e.applyDecay(newSavedSampleRates, heavy)
+	}
+	carryPinnedRates(e.PinnedKeys, e.savedSampleRates, newSavedSampleRates, heavy)
+	e.convergence.observe(e.savedSampleRates, newSavedSampleRates, e.ConvergenceThreshold)
+	e.oscillation.observe(e.savedSampleRates, newSavedSampleRates, e.ConvergenceThreshold)
+	if e.OnKeyRateChange != nil {
+		changes = diffRates(e.WatchKeys, e.savedSampleRates, newSavedSampleRates)
+	}
 	e.savedSampleRates = newSavedSampleRates
+	e.noisyRates = noisyRates
+	e.warmRates = nil
+	e.heavyKeys = heavy
+	e.finishResets(newSavedSampleRates)
+	e.keptFraction = keptFractionPPM(kept, sumEvents)
+	e.effectiveRate = effectiveRateMilli(kept, sumEvents)
 	e.haveData = true
 	e.updating = false
 }
 
+// Project calculates the sample rates the sampler would use if counts were
+// the number of events seen for each key in an interval, and summarizes what
+// they would keep. It is a what-if for capacity planning: it uses the
+// sampler's configuration but not its traffic, and doesn't change anything.
+// The counts are treated as the moving average, as if traffic had arrived at
+// those rates for long enough to settle. PinnedKeys and DecayRateToOne are not
+// applied, since they depend on earlier rates.
+func (e *EMASampleRate) Project(counts map[string]float64) ProjectionResult {
+	e.lock.Lock()
+	keepAll := e.keepAll()
+	e.lock.Unlock()
+	goal := e.GoalSampleRate
+	if goal == 0 {
+		goal = 10
+	}
+	return projectSampleRates(goal, 0, keepAll, counts, e.KeyOrder, e.ExtraBudgetPolicy)
+}
+
+// GetLastIntervalCounts returns the number of events seen for each key in the
+// last complete interval, the counts most recently added to the moving
+// average. While the sampler is frozen, they are still replaced at the end of
+// each interval, though they never reach the moving average, so they describe
+// the traffic rather than the rates. This is useful for building volume
+// dashboards. The map is a copy, so the caller may keep or change it.
+func (e *EMASampleRate) GetLastIntervalCounts() map[string]float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return copyCounts(e.lastCounts)
+}
+
+// Freeze stops the sampler from calculating new sample rates until Unfreeze is
+// called, so that it keeps serving the rates it has now. This is useful during
+// an incident, when traffic is unusual and shouldn't change the rates. Traffic
+// seen while frozen is counted for metrics but never reaches the moving
+// average, and doesn't count as a burst. It is safe to call while the sampler
+// is running.
+func (e *EMASampleRate) Freeze() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.frozen = true
+}
+
+// Unfreeze undoes Freeze. The moving average picks up again from where it was
+// when the sampler was frozen.
+func (e *EMASampleRate) Unfreeze() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.frozen = false
+}
+
+// ResetKey forgets everything the sampler knows about key - its count in the
+// current interval, its sample rate, and its moving average - so that it is
+// treated as a new key the next time it is seen. Other keys are not affected.
+// This is useful when a key's rate has gone wrong and needs to start over. It
+// is safe to call while the sampler is running.
+func (e *EMASampleRate) ResetKey(key string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.currentCounts, key)
+	if e.updating {
+		// new rates are being calculated from the old rates and the moving
+		// average right now, so the key is forgotten once that's done
+		e.resetKeys = append(e.resetKeys, key)
+		return
+	}
+	e.heavyKeys.remove(e.savedSampleRates, key)
+	delete(e.movingAverage, key)
+	delete(e.decaying, key)
+}
+
+// finishResets forgets the keys reset while rates were being calculated,
+// removing them from the saved rates and the new rates too. The caller must
+// hold the lock.
+func (e *EMASampleRate) finishResets(newRates map[string]int) {
+	for _, key := range e.resetKeys {
+		e.heavyKeys.remove(e.savedSampleRates, key)
+		delete(e.movingAverage, key)
+		delete(e.decaying, key)
+		delete(newRates, key)
+	}
+	e.resetKeys = nil
+}
+
+// SetKeepAll turns pass-through mode on or off. It is safe to call while the
+// sampler is running.
+func (e *EMASampleRate) SetKeepAll(keepAll bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.KeepAll = keepAll
+}
+
+// unknownKeyRate is the sample rate for a key with no calculated rate.
+func (e *EMASampleRate) unknownKeyRate() int {
+	if e.UnknownKeyRate > 0 {
+		return e.UnknownKeyRate
+	}
+	return 1
+}
+
+// keepAll reports whether every key should get a sample rate of 1. The caller
+// must hold the lock.
+func (e *EMASampleRate) keepAll() bool {
+	return e.KeepAll || e.GoalSampleRate == 1
+}
+
+// currentIntervalMs returns the interval currently in use, in milliseconds,
+// for metrics.
+func (e *EMASampleRate) currentIntervalMs() int64 {
+	if e.AdaptiveInterval && e.adaptive.current > 0 {
+		return e.adaptive.current.Milliseconds()
+	}
+	return e.AdjustmentIntervalDuration.Milliseconds()
+}
+
+// nextInterval returns the interval to use after the one that just ended, when
+// AdaptiveInterval is set.
+func (e *EMASampleRate) nextInterval() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	sum := e.intervalSum
+	e.intervalSum = 0
+	return e.adaptive.next(sum, e.MinAdjustmentInterval, e.AdjustmentIntervalDuration, e.VolatilityThreshold)
+}
+
 // GetSampleRate takes a key and returns the appropriate sample rate for that
 // key.
 func (e *EMASampleRate) GetSampleRate(key string) int {
@@ -240,26 +812,45 @@ func (e *EMASampleRate) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (e *EMASampleRate) GetSampleRateMulti(key string, count int) int {
+	return e.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (e *EMASampleRate) GetSampleRateMulti64(key string, count int64) int {
 	e.lock.Lock()
 	defer e.lock.Unlock()
+	if e.currentCounts == nil {
+		// not started yet
+		return 1
+	}
 
 	e.requestCount++
-	e.eventCount += int64(count)
+	e.eventCount += count
 
-	// Enforce MaxKeys limit on the size of the map
-	if e.MaxKeys > 0 {
-		// If a key already exists, increment it. If not, but we're under the limit, store a new key
-		if _, found := e.currentCounts[key]; found || len(e.currentCounts) < e.MaxKeys {
+	key, track := e.oversizeKeys.check(key, e.MaxKeyLength, e.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if e.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := e.currentCounts[key]; found || len(e.currentCounts) < e.MaxKeys {
+				e.currentCounts[key] += float64(count)
+				e.currentBurstSum += float64(count)
+			} else {
+				// dropped keys never reach currentCounts, so they're added
+				// to the estimate here instead of in updateMaps
+				e.cardinality.add(key)
+				e.droppedKeys.add(key)
+			}
+		} else {
 			e.currentCounts[key] += float64(count)
 			e.currentBurstSum += float64(count)
 		}
-	} else {
-		e.currentCounts[key] += float64(count)
-		e.currentBurstSum += float64(count)
 	}
 
-	// Enforce the burst threshold
-	if e.burstThreshold > 0 && e.currentBurstSum >= e.burstThreshold && e.intervalCount >= e.BurstDetectionDelay {
+	// Enforce the burst threshold. While frozen, a burst couldn't change the
+	// rates, so it isn't detected.
+	if !e.frozen && e.burstThreshold > 0 && e.currentBurstSum >= e.burstThreshold && e.intervalCount >= e.BurstDetectionDelay {
 		// reset the burst sum to prevent additional burst updates from occurring while updateMaps is running
 		e.currentBurstSum = 0
 		e.burstCount++
@@ -270,74 +861,199 @@ func (e *EMASampleRate) GetSampleRateMulti(key string, count int) int {
 		}
 	}
 
+	rate := e.chooseRate(key, false)
+	e.rateHistogram.record(rate)
+	return rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (e *EMASampleRate) PeekSampleRate(key string) int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, e.MaxKeyLength, e.OnOversizeKey)
+	return e.chooseRate(key, true)
+}
+
+// chooseRate returns the sample rate for key. If peek is set, WarmKeyFrom
+// isn't asked and nothing is remembered. The caller must hold the lock.
+func (e *EMASampleRate) chooseRate(key string, peek bool) int {
+	if e.keepAll() {
+		return 1
+	}
+	rate := e.unconstrainedRate(key, peek)
+	if c, found := e.KeyConstraints[key]; found {
+		rate, _ = c.clamp(rate, SourceComputed)
+	}
+	return rate
+}
+
+// unconstrainedRate returns the sample rate for key before KeyConstraints are
+// applied. The caller must hold the lock.
+func (e *EMASampleRate) unconstrainedRate(key string, peek bool) int {
 	if !e.haveData {
+		if e.ColdStartRate > 0 {
+			return e.ColdStartRate
+		}
 		return e.GoalSampleRate
 	}
 	if rate, found := e.savedSampleRates[key]; found {
 		return rate
 	}
-	return 1
+	if rate := e.warmRate(key, peek); rate > 0 {
+		return rate
+	}
+	if n := e.NoiseDetectionPrefixLen; n > 0 && len(key) >= n {
+		if rate, found := e.noisyRates[key[:n]]; found {
+			return rate
+		}
+	}
+	return e.unknownKeyRate()
+}
+
+// warmRate returns the rate WarmKeyFrom gives key, a key with no saved rate,
+// or 0 if it gives none. A rate is remembered until the next update, unless
+// MaxKeys rates already are. If peek is set, only remembered rates are
+// returned. The caller must hold the lock.
+func (e *EMASampleRate) warmRate(key string, peek bool) int {
+	if rate, found := e.warmRates[key]; found || peek || e.WarmKeyFrom == nil {
+		return rate
+	}
+	related, ok := e.WarmKeyFrom(key)
+	if !ok {
+		return 0
+	}
+	rate := e.savedSampleRates[related]
+	if rate <= 0 || (e.MaxKeys > 0 && len(e.warmRates) >= e.MaxKeys) {
+		return rate
+	}
+	if e.warmRates == nil {
+		e.warmRates = make(map[string]int)
+	}
+	e.warmRates[key] = rate
+	return rate
 }
 
 func (e *EMASampleRate) updateEMA(newCounts map[string]float64) {
-	keysToUpdate := make([]string, 0, len(e.movingAverage))
-	for key := range e.movingAverage {
-		keysToUpdate = append(keysToUpdate, key)
+	// The new averages go in a new map, which replaces the old one under the
+	// lock, so that SaveState and Snapshot can copy the old one meanwhile. The
+	// grace periods and decaying rates are updated in copies for the same
+	// reason.
+	averages := make(map[string]float64, len(e.movingAverage))
+	grace := e.ageOutGrace.clone()
+	decaying := make(map[string]*rateDecay, len(e.decaying))
+	for key, d := range e.decaying {
+		decaying[key] = d
 	}
 
 	// Update any existing keys with new values
-	for _, key := range keysToUpdate {
+	for _, key := range sortedKeys(e.movingAverage) {
 		var newAvg float64
 		// Was this key seen in the last interval? Adjust by that amount
-		if val, found := newCounts[key]; found {
-			newAvg = adjustAverage(e.movingAverage[key], val, e.Weight)
+		val, seen := newCounts[key]
+		if seen {
+			newAvg = e.timeWeighting.adjust(e.movingAverage[key], val, e.Weight)
 		} else {
 			// Otherwise adjust by zero
-			newAvg = adjustAverage(e.movingAverage[key], 0, e.Weight)
+			newAvg = e.timeWeighting.adjust(e.movingAverage[key], 0, e.Weight)
 		}
+		newAvg = limitDelta(e.movingAverage[key], newAvg, e.MaxDeltaPerInterval)
 
 		// Age out this value if it's too small to care about for calculating sample rates
 		// This is also necessary to keep our map from going forever.
-		if newAvg < e.AgeOutValue {
-			delete(e.movingAverage, key)
+		if newAvg < e.AgeOutValue && !grace.keep(key, seen, e.AgeOutGraceIntervals) {
+			if e.DecayRateToOne {
+				e.startDecay(decaying, key)
+			}
 		} else {
-			e.movingAverage[key] = newAvg
+			averages[key] = newAvg
+			if newAvg >= e.AgeOutValue {
+				grace.forget(key)
+			}
 		}
 		// We've processed this key - don't process it again when we look at new counts
 		delete(newCounts, key)
 	}
 
-	for key := range newCounts {
-		newAvg := adjustAverage(0, newCounts[key], e.Weight)
+	for _, key := range sortedKeys(newCounts) {
+		newAvg := e.timeWeighting.adjust(0, newCounts[key], e.Weight)
 		if newAvg >= e.AgeOutValue {
-			e.movingAverage[key] = newAvg
+			averages[key] = newAvg
+			grace.forget(key)
+			// a key that is back in the EMA gets its rate from there again
+			delete(decaying, key)
 		}
 	}
+
+	e.lock.Lock()
+	e.movingAverage = averages
+	e.ageOutGrace = grace
+	e.decaying = decaying
+	e.lock.Unlock()
+}
+
+// startDecay begins stepping down the saved rate of a key that just aged out
+// of the EMA, by adding it to decaying. Keys that were already at a rate of 1
+// have nothing to decay.
+func (e *EMASampleRate) startDecay(decaying map[string]*rateDecay, key string) {
+	rate := e.savedSampleRates[key]
+	if rate <= 1 {
+		return
+	}
+	decaying[key] = &rateDecay{from: rate}
 }
 
+// applyDecay adds the decaying rates of aged-out keys to newRates, through
+// heavy, advancing each by one interval and forgetting those that have reached
+// the end. The caller must hold the lock.
+func (e *EMASampleRate) applyDecay(newRates map[string]int, heavy *heavyKeys) {
+	for key, d := range e.decaying {
+		d.intervals++
+		if d.intervals >= rateDecayIntervals {
+			delete(e.decaying, key)
+			continue
+		}
+		if _, found := newRates[key]; !found {
+			heavy.set(newRates, key, d.rate())
+		}
+	}
+}
+
+// emaSampleRateState is what SaveState saves for an EMASampleRate.
 type emaSampleRateState struct {
 	// These fields are exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	Sampler          string             `json:"sampler,omitempty"`
 	SavedSampleRates map[string]int     `json:"saved_sample_rates"`
 	MovingAverage    map[string]float64 `json:"moving_average"`
 }
 
 // SaveState returns a byte array with a JSON representation of the sampler state
 func (e *EMASampleRate) SaveState() ([]byte, error) {
+	// the maps are copied under the lock and marshaled after it is released,
+	// so sampling is only held up for the copy
 	e.lock.Lock()
-	defer e.lock.Unlock()
-
 	if e.savedSampleRates == nil {
+		e.lock.Unlock()
 		return nil, errors.New("saved sample rate map is nil")
 	}
 	if e.movingAverage == nil {
+		e.lock.Unlock()
 		return nil, errors.New("moving average map is nil")
 	}
-	s := &emaSampleRateState{SavedSampleRates: e.savedSampleRates, MovingAverage: e.movingAverage}
+	s := &emaSampleRateState{Sampler: stateSamplerEMASampleRate, SavedSampleRates: copyRates(e.savedSampleRates), MovingAverage: copyCounts(e.movingAverage)}
+	e.lock.Unlock()
 	return json.Marshal(s)
 }
 
 // LoadState accepts a byte array with a JSON representation of a previous instance's
-// state
+// state. State that is truncated, contains impossible values, or was saved by a
+// different kind of sampler is rejected with an error, leaving the sampler
+// unchanged. See LenientLoad for loading state saved by an EMAThroughput.
 func (e *EMASampleRate) LoadState(state []byte) error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
@@ -347,9 +1063,31 @@ func (e *EMASampleRate) LoadState(state []byte) error {
 	if err != nil {
 		return err
 	}
+	same, err := checkStateSampler(s.Sampler, stateSamplerEMASampleRate, e.LenientLoad)
+	if err != nil {
+		return err
+	}
+	if !same {
+		// only the moving average carries over from the other EMA sampler
+		if s.MovingAverage == nil {
+			return errors.New("invalid state: moving_average is missing")
+		}
+		if err := validateMovingAverage(s.MovingAverage); err != nil {
+			return err
+		}
+		e.movingAverage = s.MovingAverage
+		return nil
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+	if err := validateMovingAverage(s.MovingAverage); err != nil {
+		return err
+	}
 
 	// Load the previously calculated sample rates
 	e.savedSampleRates = s.SavedSampleRates
+	e.heavyKeys = countHeavyKeys(s.SavedSampleRates, e.HeavySampleThreshold)
 	e.movingAverage = s.MovingAverage
 	// Allow GetSampleRate to return calculated sample rates from the loaded map
 	e.haveData = true
@@ -357,16 +1095,193 @@ func (e *EMASampleRate) LoadState(state []byte) error {
 	return nil
 }
 
+// SupportsState reports that SaveState returns the sampler's state, so it is
+// worth persisting.
+func (e *EMASampleRate) SupportsState() bool {
+	return true
+}
+
+// ApplyState adopts the sample rates from a state produced by SaveState on a
+// running sampler, for example to take up rates computed elsewhere in a
+// cluster. Unlike LoadState, which is meant to be called before Start and
+// replaces everything, ApplyState keeps the counts collected so far in the
+// current interval, so they still contribute when rates are next calculated.
+// The moving average is replaced too if the state includes one; otherwise the
+// sampler keeps its own.
+//
+// The applied rates are used until the next interval's calculation replaces
+// them. State that is invalid is rejected with an error, leaving the sampler
+// unchanged. Replacing the rates or the moving average is not possible while
+// rates are being calculated, so that also returns an error and can be
+// retried. State
+// saved by a different kind of sampler is treated as it is by LoadState.
+func (e *EMASampleRate) ApplyState(state []byte) error {
+	s := emaSampleRateState{}
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	same, err := checkStateSampler(s.Sampler, stateSamplerEMASampleRate, e.LenientLoad)
+	if err != nil {
+		return err
+	}
+	if !same {
+		if s.MovingAverage == nil {
+			return errors.New("invalid state: moving_average is missing")
+		}
+		// keep our own rates, and take only the moving average below
+		s.SavedSampleRates = nil
+	} else if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+	if err := validateMovingAverage(s.MovingAverage); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.updating {
+		return errors.New("cannot apply state while sample rates are being calculated")
+	}
+	if s.MovingAverage != nil {
+		e.movingAverage = s.MovingAverage
+	}
+	if s.SavedSampleRates != nil {
+		e.savedSampleRates = s.SavedSampleRates
+		e.heavyKeys = countHeavyKeys(s.SavedSampleRates, e.HeavySampleThreshold)
+		e.haveData = true
+	}
+	return nil
+}
+
+// Snapshot returns a deep copy of the sampler's full internal state, taken
+// under its lock so that every part of it is from the same moment. See
+// Snapshot for what it holds.
+func (e *EMASampleRate) Snapshot() Snapshot {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return Snapshot{
+		Sampler:          stateSamplerEMASampleRate,
+		SavedSampleRates: copyRates(e.savedSampleRates),
+		MovingAverage:    copyCounts(e.movingAverage),
+		CurrentCounts:    copyCounts(e.currentCounts),
+		HaveData:         e.haveData,
+		IntervalCount:    uint64(e.intervalCount),
+		BurstThreshold:   e.burstThreshold,
+		AgeOutGrace:      e.ageOutGrace.snapshot(),
+		Decaying:         snapshotDecays(e.decaying),
+		LastIntervalEnd:  e.timeWeighting.last,
+		IntervalRatio:    e.timeWeighting.ratio,
+		RequestCount:     e.requestCount,
+		EventCount:       e.eventCount,
+		BurstCount:       e.burstCount,
+		KeptFraction:     e.keptFraction,
+	}
+}
+
+// Restore replaces the sampler's internal state with a snapshot taken from
+// another EMASampleRate by Snapshot, all at once, so that it behaves as that sampler
+// did. The snapshot is copied, so the caller may keep using it. A snapshot
+// from a different kind of sampler, or with impossible values, is rejected
+// with an error, leaving the sampler unchanged. It is safe to call while the
+// sampler is running, except while new rates are being calculated, which is
+// also an error.
+func (e *EMASampleRate) Restore(s Snapshot) error {
+	if err := s.validate(stateSamplerEMASampleRate); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.updating {
+		return errors.New("cannot restore a snapshot while sample rates are being calculated")
+	}
+	e.savedSampleRates = copyRates(s.SavedSampleRates)
+	e.heavyKeys = countHeavyKeys(e.savedSampleRates, e.HeavySampleThreshold)
+	e.movingAverage = copyCounts(s.MovingAverage)
+	var sum float64
+	for _, key := range sortedKeys(e.movingAverage) {
+		sum += math.Max(1, e.movingAverage[key])
+	}
+	e.movingAverageSum = int64(math.Round(sum))
+	e.movingAverageKeys = int64(len(e.movingAverage))
+	e.currentCounts = copyCounts(s.CurrentCounts)
+	e.haveData = s.HaveData
+	e.intervalCount = uint(s.IntervalCount)
+	e.burstThreshold = s.BurstThreshold
+	e.ageOutGrace.restore(s.AgeOutGrace)
+	e.decaying = restoreDecays(s.Decaying)
+	e.timeWeighting = timeWeighting{last: s.LastIntervalEnd, ratio: s.IntervalRatio}
+	e.requestCount = s.RequestCount
+	e.eventCount = s.EventCount
+	e.burstCount = s.BurstCount
+	e.keptFraction = s.KeptFraction
+	return nil
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (e *EMASampleRate) DroppedKeySamples() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.droppedKeys.drain()
+}
+
+// EstimateCardinality returns an estimate of the number of distinct keys the
+// sampler has seen since it started, including keys that weren't counted
+// because MaxKeys was reached. It is meant to help choose a value for MaxKeys.
+// The estimate is typically within a few percent of the true number, and
+// keeping it takes a fixed 4KiB however many keys there are. Keys that were
+// counted are added to it when the interval ends, so that neither sampling nor
+// reading the estimate has to hash them; keyspace_size reports the keys
+// counted so far in the current interval.
+func (e *EMASampleRate) EstimateCardinality() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return int(e.cardinality.estimate())
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (e *EMASampleRate) OversizeKeyError() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.oversizeKeys.takeErr()
+}
+
+// GetMetrics returns the sampler's metrics. In addition to the metrics common
+// to all samplers, it reports a cumulative histogram of the sample rates
+// returned so far as "rate_bucket_<N>_count" counters, like EMAThroughput,
+// and effective_sample_rate, the overall sample rate the last interval's rates
+// would give the smoothed traffic, in thousandths, so 10000 is a rate of 10.
 func (e *EMASampleRate) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(e.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (e *EMASampleRate) GetMetricsTyped(prefix string) map[string]Metric {
 	e.lock.Lock()
 	defer e.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count":  e.requestCount,
-		prefix + "event_count":    e.eventCount,
-		prefix + "burst_count":    e.burstCount,
-		prefix + "interval_count": int64(e.intervalCount),
-		prefix + "keyspace_size":  int64(len(e.currentCounts)),
+	mets := map[string]Metric{
+		prefix + "request_count":         counter(e.requestCount),
+		prefix + "event_count":           counter(e.eventCount),
+		prefix + "burst_count":           counter(e.burstCount),
+		prefix + "interval_count":        counter(int64(e.intervalCount)),
+		prefix + "interval_ms":           gauge(e.currentIntervalMs()),
+		prefix + "keyspace_size":         gauge(e.keyspace.report(e.SmoothKeyspaceMetric, int64(len(e.currentCounts)))),
+		prefix + "estimated_cardinality": gauge(e.cardinality.estimate()),
+		prefix + "oversize_key_count":    counter(e.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":         gauge(e.keptFraction),
+		prefix + "effective_sample_rate": gauge(e.effectiveRate),
+		prefix + "keys_above_threshold":  gauge(e.heavyKeys.value()),
+		prefix + "moving_average_sum":    gauge(e.movingAverageSum),
+		prefix + "moving_average_keys":   gauge(e.movingAverageKeys),
+		prefix + "intervals_to_converge": gauge(e.convergence.last),
+		prefix + "oscillating_keys":      gauge(e.oscillation.oscillating),
+		prefix + "noisy_key_groups":      gauge(int64(len(e.noisyRates))),
 	}
+	e.rateHistogram.addMetrics(mets, prefix)
 	return mets
 }
 
@@ -376,3 +1291,36 @@ func adjustAverage(oldAvg, value float64, alpha float64) float64 {
 
 	return adjustedNewVal + adjustedOldAvg
 }
+
+// limitDelta returns newAvg, moved back toward oldAvg if need be so that it
+// differs from oldAvg by no more than maxDelta times oldAvg, for
+// MaxDeltaPerInterval. A maxDelta of 0 doesn't limit it.
+func limitDelta(oldAvg, newAvg, maxDelta float64) float64 {
+	if maxDelta <= 0 {
+		return newAvg
+	}
+	limit := oldAvg * maxDelta
+	return math.Max(oldAvg-limit, math.Min(oldAvg+limit, newAvg))
+}
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (e *EMASampleRate) GetMetricsSummary(prefix string) map[string]int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return summarizeRates(prefix, e.savedSampleRates, e.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (e *EMASampleRate) GetAllSampleRates() map[string]int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return copyRates(e.savedSampleRates)
+}
@@ -1,9 +1,14 @@
 package dynsampler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,6 +60,20 @@ func TestEMASampleGetSampleRateStartup(t *testing.T) {
 	assert.Equal(t, e.currentCounts["key"], float64(1))
 }
 
+func TestEMASampleGetSampleRateColdStart(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 10,
+		ColdStartRate:  4,
+		MaxKeys:        1,
+		currentCounts:  map[string]float64{},
+	}
+	assert.Equal(t, 4, e.GetSampleRate("key"))
+	assert.Equal(t, 4, e.GetSampleRate("other"))
+	assert.Equal(t, 1, len(e.currentCounts))
+	assert.Equal(t, float64(1), e.currentCounts["key"])
+	assert.Equal(t, float64(1), e.currentBurstSum)
+}
+
 func TestEMASampleUpdateMaps(t *testing.T) {
 	e := &EMASampleRate{
 		GoalSampleRate: 20,
@@ -524,6 +543,9 @@ func TestEMASampleRate_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("EMASampleRate error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("EMASampleRate error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.AdjustmentIntervalDuration {
@@ -533,3 +555,777 @@ func TestEMASampleRate_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestEMASampleRateKeepAll(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 10,
+		Weight:         0.5,
+		AgeOutValue:    0.5,
+		BurstMultiple:  2,
+		KeepAll:        true,
+	}
+	e.currentCounts = map[string]float64{}
+	e.movingAverage = map[string]float64{}
+	e.savedSampleRates = map[string]int{}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 1, e.GetSampleRateMulti("one", 1000))
+		e.updateMaps()
+		assert.Equal(t, 0, len(e.savedSampleRates))
+	}
+	// the moving average is still maintained
+	assert.Equal(t, float64(875), e.movingAverage["one"])
+
+	e.SetKeepAll(false)
+	e.GetSampleRateMulti("one", 1000)
+	e.GetSampleRateMulti("two", 1)
+	e.updateMaps()
+	assert.Less(t, 1, e.GetSampleRate("one"))
+}
+
+func TestEMASampleRateLoadStateInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		wantErr bool
+	}{
+		{"valid", `{"saved_sample_rates":{"foo":2},"moving_average":{"foo":10.5}}`, false},
+		{"no moving average", `{"saved_sample_rates":{"foo":2}}`, false},
+		{"truncated", `{"saved_sample_rates":{"foo":2},"moving_av`, true},
+		{"missing rates", `{"moving_average":{"foo":10.5}}`, true},
+		{"negative rate", `{"saved_sample_rates":{"foo":-2},"moving_average":{"foo":10.5}}`, true},
+		{"negative average", `{"saved_sample_rates":{"foo":2},"moving_average":{"foo":-10.5}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &EMASampleRate{}
+			err := e.LoadState([]byte(tt.state))
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.False(t, e.haveData)
+			} else {
+				assert.NoError(t, err)
+				assert.True(t, e.haveData)
+			}
+		})
+	}
+}
+
+func TestEMASampleRateDecayRateToOne(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 20,
+		Weight:         0.5,
+		AgeOutValue:    600,
+		DecayRateToOne: true,
+		movingAverage:  map[string]float64{},
+	}
+	e.currentCounts = map[string]float64{"steady": 2000, "quiet": 2000}
+	e.updateMaps()
+	start := e.savedSampleRates["quiet"]
+	assert.Greater(t, start, 1)
+
+	// "quiet" stops sending, so its average halves below AgeOutValue and it
+	// ages out. Its rate should step down rather than vanish.
+	var rates []int
+	for i := 0; i < rateDecayIntervals; i++ {
+		e.currentCounts = map[string]float64{"steady": 2000}
+		e.updateMaps()
+		_, inEMA := e.movingAverage["quiet"]
+		assert.False(t, inEMA)
+		rates = append(rates, e.GetSampleRate("quiet"))
+		// don't let the lookup itself count as traffic
+		delete(e.currentCounts, "quiet")
+	}
+	for i := 1; i < len(rates)-1; i++ {
+		assert.Less(t, rates[i], rates[i-1], "rates should step down: %v", rates)
+	}
+	assert.Less(t, rates[0], start)
+	assert.Greater(t, rates[len(rates)-2], 1)
+	assert.Equal(t, 1, rates[len(rates)-1])
+	assert.Equal(t, 0, len(e.decaying))
+}
+
+func TestEMASampleRateAdaptiveInterval(t *testing.T) {
+	e := &EMASampleRate{
+		AdjustmentIntervalDuration: 8 * time.Second,
+		MinAdjustmentInterval:      1 * time.Second,
+		VolatilityThreshold:        0.5,
+		AdaptiveInterval:           true,
+		GoalSampleRate:             10,
+		Weight:                     0.5,
+		AgeOutValue:                0.5,
+		movingAverage:              map[string]float64{},
+	}
+	// runInterval simulates one tick of the background goroutine with the
+	// given events per second over the current interval
+	interval := e.AdjustmentIntervalDuration
+	runInterval := func(perSec float64) time.Duration {
+		e.currentCounts = map[string]float64{"key": perSec * interval.Seconds()}
+		e.updateMaps()
+		interval = e.nextInterval()
+		return interval
+	}
+
+	assert.Equal(t, 8*time.Second, runInterval(100))
+	// volatile traffic shortens the interval down to the floor
+	assert.Equal(t, 4*time.Second, runInterval(500))
+	assert.Equal(t, 2*time.Second, runInterval(50))
+	assert.Equal(t, 1*time.Second, runInterval(1000))
+	assert.Equal(t, 1*time.Second, runInterval(100))
+	// stable traffic lengthens it back up to AdjustmentIntervalDuration
+	assert.Equal(t, 2*time.Second, runInterval(100))
+	assert.Equal(t, 4*time.Second, runInterval(110))
+	assert.Equal(t, 8*time.Second, runInterval(100))
+	assert.Equal(t, 8*time.Second, runInterval(100))
+}
+
+func TestEMASampleRateApplyState(t *testing.T) {
+	e := &EMASampleRate{
+		currentCounts:    map[string]float64{"live": 7},
+		savedSampleRates: map[string]int{"old": 9},
+		movingAverage:    map[string]float64{"old": 100},
+	}
+
+	// rates only: the moving average and live counts are kept
+	assert.Nil(t, e.ApplyState([]byte(`{"saved_sample_rates":{"new":4}}`)))
+	assert.Equal(t, 4, e.GetSampleRate("new"))
+	assert.Equal(t, 1, e.GetSampleRate("old"))
+	assert.Equal(t, map[string]float64{"old": 100}, e.movingAverage)
+	assert.Equal(t, float64(7), e.currentCounts["live"])
+
+	// a full state replaces the moving average as well
+	other := &EMASampleRate{
+		savedSampleRates: map[string]int{"a": 2},
+		movingAverage:    map[string]float64{"a": 50},
+	}
+	state, err := other.SaveState()
+	assert.Nil(t, err)
+	assert.Nil(t, e.ApplyState(state))
+	assert.Equal(t, map[string]float64{"a": 50}, e.movingAverage)
+	assert.Equal(t, float64(7), e.currentCounts["live"])
+
+	// invalid state leaves everything alone
+	assert.Error(t, e.ApplyState([]byte(`{"saved_sample_rates":{"a":0}}`)))
+	assert.Equal(t, 2, e.GetSampleRate("a"))
+
+	// nothing can be replaced while rates are being calculated from it
+	e.updating = true
+	assert.Error(t, e.ApplyState(state))
+	assert.Error(t, e.ApplyState([]byte(`{"saved_sample_rates":{"a":3}}`)))
+	assert.Equal(t, map[string]int{"a": 2}, e.savedSampleRates)
+}
+
+func TestEMASampleRatePinnedKeys(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 20,
+		Weight:         0.5,
+		AgeOutValue:    300,
+		PinnedKeys:     []string{"pinned"},
+		movingAverage:  map[string]float64{},
+	}
+	e.currentCounts = map[string]float64{"pinned": 1000, "unpinned": 1000, "other": 1000}
+	e.updateMaps()
+	pinnedRate := e.savedSampleRates["pinned"]
+	assert.Greater(t, pinnedRate, 1)
+
+	// keep other traffic flowing; the quiet keys age out of the EMA at once
+	for i := 0; i < 20; i++ {
+		e.currentCounts = map[string]float64{"other": 1000}
+		e.updateMaps()
+	}
+	_, found := e.movingAverage["pinned"]
+	assert.False(t, found)
+
+	assert.Equal(t, pinnedRate, e.GetSampleRate("pinned"))
+	assert.Equal(t, 1, e.GetSampleRate("unpinned"))
+}
+
+func TestEMASampleRate_GetMetrics(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:       10,
+		Weight:               0.5,
+		AgeOutValue:          0.1,
+		HeavySampleThreshold: 2,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{},
+	}
+	e.GetSampleRateMulti("a", 100)
+	e.GetSampleRateMulti("b", 50)
+	e.GetSampleRate("c")
+	e.updateMaps()
+
+	mets := e.GetMetrics("e_")
+	assert.Equal(t, int64(3), mets["e_request_count"])
+	assert.Equal(t, int64(151), mets["e_event_count"])
+	assert.Equal(t, int64(0), mets["e_keyspace_size"])
+	// before there's data every key gets the goal rate
+	assert.Equal(t, int64(3), mets["e_rate_bucket_8_count"])
+	// the averages are 50, 25, and 0.5, and small averages count as 1
+	assert.Equal(t, int64(76), mets["e_moving_average_sum"])
+	assert.Equal(t, int64(3), mets["e_moving_average_keys"])
+	// "a" and "b" are sampled, and "c" is kept
+	assert.Equal(t, int64(2), mets["e_keys_above_threshold"])
+	// at rates of 12, 8, and 1, 50/12 + 25/8 + 1 of the 76 are kept
+	assert.Equal(t, int64(9166), mets["e_effective_sample_rate"])
+
+	// new keys get a rate of 1 once there's data
+	e.GetSampleRate("a")
+	e.GetSampleRate("new")
+	mets = e.GetMetrics("e_")
+	assert.Equal(t, int64(2), mets["e_keyspace_size"])
+	assert.Equal(t, int64(1), mets["e_rate_bucket_1_count"])
+	_, found := mets["e_burst_count"]
+	assert.True(t, found)
+	// metrics are only reported under the prefix they were asked for
+	_, found = mets["request_count"]
+	assert.False(t, found)
+}
+
+func TestEMASampleRateResetKey(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:   10,
+		currentCounts:    map[string]float64{"stuck": 5, "fine": 5},
+		savedSampleRates: map[string]int{"stuck": 40, "fine": 8},
+		movingAverage:    map[string]float64{"stuck": 400, "fine": 80},
+		haveData:         true,
+	}
+	e.ResetKey("stuck")
+	// the reset key is sampled like a brand new key, and its sibling is untouched
+	assert.Equal(t, 1, e.GetSampleRate("stuck"))
+	assert.Equal(t, 8, e.GetSampleRate("fine"))
+	assert.Equal(t, float64(1), e.currentCounts["stuck"])
+	assert.Equal(t, float64(6), e.currentCounts["fine"])
+	assert.Equal(t, map[string]float64{"fine": 80}, e.movingAverage)
+
+	// while rates are being calculated, the moving average is forgotten after
+	e.updating = true
+	e.ResetKey("fine")
+	assert.Equal(t, float64(80), e.movingAverage["fine"])
+	assert.Equal(t, 8, e.savedSampleRates["fine"])
+	rates := map[string]int{"fine": 8}
+	e.finishResets(rates)
+	assert.Empty(t, e.movingAverage)
+	assert.Empty(t, e.savedSampleRates)
+	assert.Empty(t, rates)
+}
+
+// ResetKey must be safe to call while Update reads the saved rates to start
+// decaying aged-out keys. Run with -race.
+func TestEMASampleRateResetKeyDuringUpdate(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:        10,
+		AgeOutValue:           5,
+		DecayRateToOne:        true,
+		NoBackgroundGoroutine: true,
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				e.ResetKey("other")
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		// busy keys get rates, then age out and decay together when they go
+		// quiet
+		if i%10 == 0 {
+			for k := 0; k < 5000; k++ {
+				e.GetSampleRateMulti("key"+strconv.Itoa(k), 100)
+			}
+		}
+		e.GetSampleRate("other")
+		e.Update()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestEMASampleRateUnknownKeyRate(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:   10,
+		UnknownKeyRate:   20,
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{"known": 4},
+		haveData:         true,
+	}
+	assert.Equal(t, 4, e.GetSampleRate("known"))
+	assert.Equal(t, 20, e.GetSampleRate("new"))
+
+	e.UnknownKeyRate = 0
+	assert.Equal(t, 1, e.GetSampleRate("new"))
+}
+
+// Two samplers given the same counts end up with exactly the same state, no
+// matter what order their maps happen to be iterated in.
+func TestEMASampleRateDeterministic(t *testing.T) {
+	run := func() *EMASampleRate {
+		e := &EMASampleRate{
+			GoalSampleRate: 7,
+			Weight:         0.3,
+			AgeOutValue:    0.3,
+			movingAverage:  map[string]float64{},
+		}
+		r := mrand.New(mrand.NewSource(42))
+		for interval := 0; interval < 10; interval++ {
+			e.currentCounts = map[string]float64{}
+			for i := 0; i < 500; i++ {
+				e.currentCounts[fmt.Sprintf("key%d", r.Intn(200))] += r.Float64() * 100
+			}
+			e.updateMaps()
+		}
+		return e
+	}
+	first, second := run(), run()
+	assert.Equal(t, first.movingAverage, second.movingAverage)
+	assert.Equal(t, first.savedSampleRates, second.savedSampleRates)
+}
+
+func TestEMASampleRateFreeze(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:   10,
+		Weight:           0.5,
+		AgeOutValue:      0.5,
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{"busy": 20, "quiet": 2},
+		movingAverage:    map[string]float64{"busy": 1000, "quiet": 10},
+		haveData:         true,
+	}
+	e.Freeze()
+	e.GetSampleRateMulti("quiet", 5000)
+	e.updateMaps()
+	assert.Equal(t, map[string]int{"busy": 20, "quiet": 2}, e.savedSampleRates)
+	assert.Equal(t, map[string]float64{"busy": 1000, "quiet": 10}, e.movingAverage)
+	assert.Empty(t, e.currentCounts)
+
+	e.Unfreeze()
+	e.GetSampleRateMulti("quiet", 5000)
+	e.updateMaps()
+	assert.NotEqual(t, float64(10), e.movingAverage["quiet"])
+}
+
+func TestEMASampleRateGetLastIntervalCounts(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate: 10,
+		Weight:         0.5,
+		AgeOutValue:    0.5,
+		currentCounts:  map[string]float64{},
+		movingAverage:  map[string]float64{},
+	}
+	assert.Empty(t, e.GetLastIntervalCounts())
+	e.GetSampleRateMulti("one", 5)
+	e.GetSampleRateMulti("two", 50)
+	e.updateMaps()
+	e.GetSampleRateMulti("one", 7)
+	e.GetSampleRateMulti("three", 1)
+
+	counts := e.GetLastIntervalCounts()
+	assert.Equal(t, map[string]float64{"one": 5, "two": 50}, counts)
+	counts["one"] = 1000
+	assert.Equal(t, float64(5), e.GetLastIntervalCounts()["one"])
+}
+
+func TestEMASampleRateProject(t *testing.T) {
+	counts := map[string]float64{"a": 5000, "b": 200, "c": 3}
+	e := &EMASampleRate{
+		GoalSampleRate: 20,
+		Weight:         1,
+		AgeOutValue:    0.5,
+		currentCounts:  map[string]float64{},
+		movingAverage:  map[string]float64{},
+	}
+	p := e.Project(counts)
+	assert.Empty(t, e.movingAverage)
+
+	// with a weight of 1 the moving average is the last interval's counts,
+	// so the sampler settles on the projected rates straight away
+	for k, v := range counts {
+		e.currentCounts[k] = v
+	}
+	e.updateMaps()
+	assert.Equal(t, e.savedSampleRates, p.Rates)
+	assert.Equal(t, 1, p.KeysAtRateOne)
+}
+
+func TestEMASampleRateOnKeyRateChange(t *testing.T) {
+	var keys []string
+	e := &EMASampleRate{
+		GoalSampleRate: 10,
+		Weight:         1,
+		AgeOutValue:    0.5,
+		movingAverage:  map[string]float64{},
+	}
+	e.OnKeyRateChange = func(key string, oldRate, newRate int) {
+		// the callback runs without the lock, so it can use the sampler
+		assert.Equal(t, newRate, e.GetAllSampleRates()[key])
+		keys = append(keys, key)
+	}
+	e.currentCounts = map[string]float64{"a": 1000, "b": 10}
+	e.updateMaps()
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// with nothing watched, every key whose rate changes is reported
+	keys = nil
+	e.currentCounts = map[string]float64{"a": 1000, "b": 10000}
+	e.updateMaps()
+	assert.Equal(t, []string{"a", "b"}, keys)
+	keys = nil
+	e.currentCounts = map[string]float64{"a": 1000, "b": 10000}
+	e.updateMaps()
+	assert.Empty(t, keys)
+}
+
+func TestEMASampleRateSnapshotRestore(t *testing.T) {
+	newSampler := func() *EMASampleRate {
+		return &EMASampleRate{
+			GoalSampleRate: 10,
+			Weight:         0.5,
+			AgeOutValue:    0.5,
+			currentCounts:  map[string]float64{},
+			movingAverage:  map[string]float64{},
+		}
+	}
+	active := newSampler()
+	for i := 0; i < 3; i++ {
+		active.GetSampleRateMulti("busy", 1000)
+		active.GetSampleRateMulti("quiet", 10)
+		active.updateMaps()
+	}
+	// part of an interval is in progress
+	active.GetSampleRateMulti("busy", 400)
+	active.GetSampleRateMulti("new", 50)
+
+	// the snapshot survives being sent over the network
+	data, err := json.Marshal(active.Snapshot())
+	assert.NoError(t, err)
+	var snap Snapshot
+	assert.NoError(t, json.Unmarshal(data, &snap))
+	standby := newSampler()
+	assert.NoError(t, standby.Restore(snap))
+
+	// the two behave identically from here on
+	activeMets, standbyMets := active.GetMetrics(""), standby.GetMetrics("")
+	for _, name := range []string{"request_count", "event_count", "keyspace_size", "kept_fraction", "moving_average_sum"} {
+		assert.Equal(t, activeMets[name], standbyMets[name], name)
+	}
+	for i := 0; i < 3; i++ {
+		for _, s := range []*EMASampleRate{active, standby} {
+			s.GetSampleRateMulti("busy", 2000)
+			s.GetSampleRateMulti("other", 30)
+			s.updateMaps()
+		}
+		assert.Equal(t, active.GetAllSampleRates(), standby.GetAllSampleRates())
+		assert.Equal(t, active.movingAverage, standby.movingAverage)
+	}
+
+	// the snapshot is a copy
+	snap.SavedSampleRates["busy"] = 1
+	assert.NotEqual(t, 1, standby.savedSampleRates["busy"])
+
+	snap.Sampler = stateSamplerEMAThroughput
+	assert.Error(t, standby.Restore(snap))
+}
+
+func TestEMASampleRateSnapshotRestoreDecay(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+	newSampler := func() *EMASampleRate {
+		return &EMASampleRate{
+			GoalSampleRate:             10,
+			AdjustmentIntervalDuration: time.Second,
+			Weight:                     0.5,
+			AgeOutValue:                1000,
+			AgeOutGraceIntervals:       2,
+			DecayRateToOne:             true,
+			TimeWeightedEMA:            true,
+			currentCounts:              map[string]float64{},
+			movingAverage:              map[string]float64{},
+		}
+	}
+	// interval i of the traffic: a key too quiet to be in the EMA, a key that
+	// stops early and one that stops later, with intervals of uneven lengths
+	interval := func(s *EMASampleRate, i int) {
+		s.GetSampleRateMulti("quiet", 10)
+		if i < 2 {
+			s.GetSampleRateMulti("early", 5000)
+		}
+		if i < 5 {
+			s.GetSampleRateMulti("late", 5000)
+		}
+		s.updateMaps()
+	}
+	active := newSampler()
+	for i := 0; i < 6; i++ {
+		clock.advance(time.Duration(1+i%2) * time.Second)
+		interval(active, i)
+	}
+
+	data, err := json.Marshal(active.Snapshot())
+	assert.NoError(t, err)
+	var snap Snapshot
+	assert.NoError(t, json.Unmarshal(data, &snap))
+	// one key is decaying and the other is in its grace period
+	assert.Contains(t, snap.Decaying, "early")
+	assert.Contains(t, snap.AgeOutGrace, "late")
+	assert.Greater(t, snap.IntervalRatio, float64(0))
+	standby := newSampler()
+	assert.NoError(t, standby.Restore(snap))
+
+	for i := 6; i < 12; i++ {
+		clock.advance(time.Duration(1+i%2) * time.Second)
+		interval(active, i)
+		interval(standby, i)
+		assert.Equal(t, active.GetAllSampleRates(), standby.GetAllSampleRates(), "interval %d", i)
+		assert.Equal(t, active.movingAverage, standby.movingAverage, "interval %d", i)
+	}
+
+	snap.Decaying["early"] = SnapshotDecay{From: 0}
+	assert.Error(t, standby.Restore(snap))
+}
+
+func TestEMASampleRateSnapshotWhileAgingOut(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:       10,
+		Weight:               0.5,
+		AgeOutValue:          1000,
+		AgeOutGraceIntervals: 2,
+		DecayRateToOne:       true,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{},
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				e.Snapshot()
+			}
+		}
+	}()
+	// each key is busy for a couple of intervals, then ages out
+	for i := 0; i < 50; i++ {
+		e.GetSampleRateMulti("steady", 5000)
+		for j := 0; j < 100; j++ {
+			e.GetSampleRateMulti(strconv.Itoa(i*100+j), 5000)
+			e.GetSampleRateMulti(strconv.Itoa((i+1)*100+j), 5000)
+		}
+		e.updateMaps()
+	}
+	close(done)
+	wg.Wait()
+	snap := e.Snapshot()
+	assert.NotEmpty(t, snap.AgeOutGrace)
+	assert.NotEmpty(t, snap.Decaying)
+}
+
+func TestEMASampleRatePeekSampleRate(t *testing.T) {
+	e := &EMASampleRate{GoalSampleRate: 10, NoBackgroundGoroutine: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	for i := 0; i < 1000; i++ {
+		e.GetSampleRate("busy")
+	}
+	e.GetSampleRate("quiet")
+	e.Update()
+	e.GetSampleRate("busy")
+
+	counts := copyCounts(e.currentCounts)
+	requests := e.requestCount
+	for _, key := range []string{"busy", "quiet", "new"} {
+		rate := e.PeekSampleRate(key)
+		assert.Equal(t, counts, e.currentCounts)
+		assert.Equal(t, requests, e.requestCount)
+		assert.Equal(t, e.GetSampleRate(key), rate, key)
+		counts = copyCounts(e.currentCounts)
+		requests = e.requestCount
+	}
+	assert.Greater(t, e.PeekSampleRate("busy"), 1)
+}
+
+func TestEMASampleRateNoiseDetection(t *testing.T) {
+	traffic := func(e *EMASampleRate) {
+		e.GetSampleRateMulti("steady", 1000)
+		// a key that is unique for every event
+		for i := 0; i < 2000; i++ {
+			e.GetSampleRate("request-" + strconv.Itoa(i))
+		}
+	}
+
+	plain := &EMASampleRate{GoalSampleRate: 10, NoBackgroundGoroutine: true}
+	assert.NoError(t, plain.Start())
+	defer plain.Stop()
+	traffic(plain)
+	plain.Update()
+	assert.Equal(t, 1, plain.PeekSampleRate("request-7"))
+
+	e := &EMASampleRate{GoalSampleRate: 10, NoiseDetectionPrefixLen: 8, NoBackgroundGoroutine: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	traffic(e)
+	e.Update()
+	// the unique keys share one heavier rate, as if they were one key
+	rate := e.PeekSampleRate("request-7")
+	assert.Greater(t, rate, 1)
+	for i := 0; i < 2000; i++ {
+		assert.Equal(t, rate, e.savedSampleRates["request-"+strconv.Itoa(i)])
+	}
+	// including keys in the group that haven't been seen yet
+	assert.Equal(t, rate, e.PeekSampleRate("request-new"))
+	assert.Equal(t, 1, e.PeekSampleRate("other"))
+	assert.Equal(t, int64(1), e.GetMetrics("")["noisy_key_groups"])
+
+	// and, as it has twice the traffic, it is sampled harder than the steady key
+	assert.Greater(t, rate, e.PeekSampleRate("steady"))
+}
+
+func TestEMASampleRateWarmKeyFrom(t *testing.T) {
+	var asked []string
+	e := &EMASampleRate{
+		GoalSampleRate:        10,
+		NoBackgroundGoroutine: true,
+		// a new version of a route is warmed from the first version
+		WarmKeyFrom: func(newKey string) (string, bool) {
+			asked = append(asked, newKey)
+			if strings.HasPrefix(newKey, "/api/v") {
+				return "/api/v1", true
+			}
+			return "", false
+		},
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	e.GetSampleRateMulti("/api/v1", 1000)
+	e.GetSampleRate("/health")
+	e.Update()
+	rate := e.savedSampleRates["/api/v1"]
+	assert.Greater(t, rate, 1)
+
+	// peeking doesn't ask about a new key
+	assert.Equal(t, 1, e.PeekSampleRate("/api/v2"))
+	assert.Empty(t, asked)
+	assert.Empty(t, e.warmRates)
+
+	// the new version inherits the old one's rate rather than 1
+	assert.Equal(t, rate, e.GetSampleRate("/api/v2"))
+	assert.Equal(t, rate, e.GetSampleRate("/api/v2"))
+	assert.Equal(t, rate, e.PeekSampleRate("/api/v2"))
+	assert.Equal(t, 1, e.GetSampleRate("/other"))
+	assert.Equal(t, 1, e.GetSampleRate("/other"))
+	// keys with rates of their own aren't warmed, a rate given is remembered,
+	// and keys without one aren't
+	assert.Equal(t, []string{"/api/v2", "/other", "/other"}, asked)
+	assert.Equal(t, map[string]int{"/api/v2": rate}, e.warmRates)
+
+	// once rates are recalculated the new key has its own
+	e.GetSampleRateMulti("/api/v1", 1000)
+	e.Update()
+	_, found := e.savedSampleRates["/api/v2"]
+	assert.True(t, found)
+	assert.Empty(t, e.warmRates)
+}
+
+func TestEMASampleRateWarmKeyFromMaxKeys(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:        10,
+		MaxKeys:               2,
+		NoBackgroundGoroutine: true,
+		WarmKeyFrom: func(newKey string) (string, bool) {
+			return "busy", true
+		},
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	e.GetSampleRateMulti("busy", 1000)
+	e.Update()
+	rate := e.savedSampleRates["busy"]
+	assert.Greater(t, rate, 1)
+
+	// every new key is warmed, but only MaxKeys of them are remembered
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, rate, e.GetSampleRate(fmt.Sprintf("new-%d", i)))
+	}
+	assert.Len(t, e.warmRates, 2)
+}
+
+func TestEMASampleRateKeyConstraints(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:        10,
+		NoBackgroundGoroutine: true,
+		KeyConstraints: map[string]KeyConstraint{
+			"busy":  {Max: 5},
+			"quiet": {Min: 50},
+		},
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	e.GetSampleRateMulti("busy", 10000)
+	e.GetSampleRateMulti("other", 10000)
+	e.GetSampleRate("quiet")
+	e.Update()
+	assert.Greater(t, e.savedSampleRates["busy"], 5)
+	assert.Equal(t, 5, e.GetSampleRate("busy"))
+	assert.Equal(t, 5, e.PeekSampleRate("busy"))
+	assert.Equal(t, e.savedSampleRates["other"], e.GetSampleRate("other"))
+	assert.Equal(t, 50, e.GetSampleRate("quiet"))
+	assert.Equal(t, 1, e.GetSampleRate("new"))
+}
+
+func TestEMASampleRateTimeWeightedEMA(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+
+	e := &EMASampleRate{AdjustmentIntervalDuration: time.Second, TimeWeightedEMA: true, NoBackgroundGoroutine: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	e.GetSampleRateMulti("key", 100)
+	e.Update()
+	assert.Equal(t, float64(50), e.movingAverage["key"])
+
+	// an interval three times as long, at the same rate of traffic, counts
+	// as three intervals of 100 events
+	clock.advance(3 * time.Second)
+	e.GetSampleRateMulti("key", 300)
+	e.Update()
+	assert.InDelta(t, 93.75, e.movingAverage["key"], 1e-9)
+}
+
+func TestEMASampleRateExportOnStop(t *testing.T) {
+	var exported map[string]int
+	e := &EMASampleRate{
+		GoalSampleRate:        10,
+		NoBackgroundGoroutine: true,
+		ExportOnStop:          func(rates map[string]int) { exported = rates },
+	}
+	assert.NoError(t, e.Start())
+
+	e.GetSampleRateMulti("busy", 1000)
+	e.GetSampleRate("quiet")
+	e.Update()
+	want := copyRates(e.savedSampleRates)
+	assert.Equal(t, 1, want["quiet"])
+	assert.Greater(t, want["busy"], 1)
+
+	assert.Nil(t, exported)
+	assert.NoError(t, e.Stop())
+	assert.Equal(t, want, exported)
+
+	// the callback gets a copy, not the sampler's own map
+	exported["busy"] = 1000
+	assert.Equal(t, want, e.savedSampleRates)
+}
@@ -3,7 +3,6 @@ package dynsampler
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -37,6 +36,14 @@ type EMAThroughput struct {
 	// recent observations. Default 15s.
 	AdjustmentInterval time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every AdjustmentInterval, for embedded
+	// use where background goroutines aren't welcome. The caller must call
+	// Update on its own schedule instead; without calls to Update, the sample
+	// rates never change. Bursts are still detected, but don't trigger an early
+	// update, and AdaptiveInterval has no effect. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// Weight is a value between (0, 1) indicating the weighting factor used to adjust
 	// the EMA. With larger values, newer data will influence the average more, and older
 	// values will be factored out more quickly.  In mathematical literature concerning EMA,
@@ -44,6 +51,34 @@ type EMAThroughput struct {
 	// Default is 0.5
 	Weight float64
 
+	// TimeWeightedEMA, if true, allows for intervals that don't last exactly
+	// AdjustmentInterval, because the process was paused or the update ran
+	// late. Each update measures the time since the last one, and the counts
+	// are scaled to one interval's worth before they are added to the moving
+	// average, with the weight that many intervals would have had together.
+	// Without it, a long interval's larger counts pull the averages up as if
+	// traffic had grown. Defaults to false.
+	TimeWeightedEMA bool
+
+	// MaxDeltaPerInterval, if greater than 0, limits how far a key's moving
+	// average can move in one interval, as a fraction of its value before the
+	// interval, so that one anomalous interval can't pull it far: with 0.5, a
+	// key averaging 100 moves to somewhere between 50 and 150, however many
+	// events it had. Keys new to the average aren't limited. Unlike burst
+	// detection, which reacts to a spike, this ignores most of it. Defaults to
+	// 0, which doesn't limit the averages.
+	MaxDeltaPerInterval float64
+
+	// VanishedKeyWeight, if greater than 0, is used in place of Weight to
+	// adjust the moving average of a key that had no events at all in an
+	// interval. A key that disappears keeps a share of the throughput budget
+	// until its average ages out, which leaves the remaining keys sampled more
+	// heavily than they need to be. Setting this higher than Weight makes
+	// vanished keys give up their share faster without making the rates of
+	// active keys any more jumpy; 1 drops a vanished key at once. Defaults to
+	// 0, which uses Weight.
+	VanishedKeyWeight float64
+
 	// InitialSampleRate is the sample rate to use during startup, before we
 	// have accumulated enough data to calculate a reasonable desired sample
 	// rate. This is mainly useful in situations where unsampled throughput is
@@ -56,12 +91,87 @@ type EMAThroughput struct {
 	// goal throughput. Actual throughput may exceed goal throughput. default 100
 	GoalThroughputPerSec int
 
+	// CountUnit decides whether throughput is measured in events, the count
+	// passed to GetSampleRateMulti, or in calls. The rate returned applies to
+	// all the events a call stands for either way. See CountUnit for details.
+	// Defaults to CountUnitSpans.
+	CountUnit CountUnit
+
+	// GoalSchedule, if set, replaces GoalThroughputPerSec during the times of
+	// day its windows cover, so that, for example, the goal can be lower at
+	// night. The goal is chosen from the wall-clock time whenever sample rates
+	// are recalculated; the first window that contains the time wins, and
+	// GoalThroughputPerSec applies outside all of them.
+	GoalSchedule []GoalWindow
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys tracked in EMA.
 	// Once MaxKeys is reached, new keys will not be included in the sample rate map, but
 	// existing keys will continue to be be counted.
 	// Defaults to 0
 	MaxKeys int
 
+	// KeyOrder is the order in which keys are visited when dividing up the
+	// budget of events to keep, which decides which keys benefit from budget
+	// left unused by quiet keys. See KeyOrder for details. Defaults to
+	// KeyOrderLexical.
+	KeyOrder KeyOrder
+
+	// ExtraBudgetPolicy decides how budget left unused by quiet keys is shared
+	// among the keys visited after them. See ExtraBudgetPolicy for details.
+	// Defaults to ExtraBudgetEqual.
+	ExtraBudgetPolicy ExtraBudgetPolicy
+
+	// SnapToNiceRates, if true, rounds each calculated sample rate to the
+	// nearest of a set of round numbers, so that rates are easier for people
+	// to read. This moves throughput away from the goal. With the default 1,
+	// 2, 5 series, a key can keep up to about 60% more or 40% fewer events
+	// than its calculated rate would, though across many keys the differences
+	// largely cancel out. MaxSampleRate is applied after rounding. Defaults to
+	// false.
+	SnapToNiceRates bool
+
+	// NiceRates are the rates SnapToNiceRates rounds to. Defaults to the
+	// series 1, 2, 5, 10, 20, 50, 100, and so on.
+	NiceRates []int
+
+	// HeavySampleThreshold is the sample rate above which a key counts as
+	// heavily sampled in the keys_above_threshold metric. A rising number of
+	// such keys means the budget is being concentrated in fewer keys. Defaults
+	// to 100.
+	HeavySampleThreshold int
+
+	// MinLogSum is the least the sum of the logarithms of the keys' moving
+	// averages is taken to be when the goal is shared out between them. Each
+	// key's share is its own logarithm divided by the sum, so when every key
+	// is quiet the sum is close to 0, and tiny changes in the averages swing
+	// the shares wildly from one interval to the next; if every average is 1
+	// or less, the sum is 0 and the shares can't be calculated at all. Below
+	// the floor, keys get smaller shares than the goal would allow, and are
+	// kept at rates near 1. Defaults to 1, the sum for a single key with an
+	// average of 10.
+	MinLogSum float64
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// MaxSampleRate, if greater than 0, is the highest sample rate any key will
+	// be given, so that even the busiest key keeps at least 1 in MaxSampleRate
+	// of its events. When the cap applies, actual throughput will exceed
+	// GoalThroughputPerSec. Defaults to 0, which means no cap.
+	MaxSampleRate int
+
 	// AgeOutValue indicates the threshold for removing keys from the EMA. The EMA of any key will approach 0
 	// if it is not repeatedly observed, but will never truly reach it, so we have to decide what constitutes "zero".
 	// Keys with averages below this threshold will be removed from the EMA. Default is the same as Weight, as this prevents
@@ -69,9 +179,20 @@ type EMAThroughput struct {
 	// unless you have very specific reasons to set it higher.
 	AgeOutValue float64
 
+	// AgeOutGraceIntervals is the number of consecutive intervals a key's
+	// moving average must stay below AgeOutValue before the key is removed
+	// from the EMA. A key that is seen again, or whose average climbs back to
+	// AgeOutValue, starts counting again. This keeps keys that are
+	// intermittent but recurring from churning in and out of the EMA.
+	// Defaults to 0, which, like 1, removes a key as soon as its average drops
+	// below AgeOutValue.
+	AgeOutGraceIntervals int
+
 	// BurstMultiple, if set, is multiplied by the sum of the running average of counts to define
-	// the burst detection threshold. If total counts observed for a given interval exceed the threshold
-	// EMA is updated immediately, rather than waiting on the AdjustmentInterval.
+	// the burst detection threshold. If total counts observed over the last AdjustmentInterval exceed the
+	// threshold EMA is updated immediately, rather than waiting on the AdjustmentInterval. The counts are
+	// kept in a window that slides forward in tenths of the interval, so a burst that straddles the end
+	// of an interval is still detected. With AdaptiveInterval, the window is as long as the interval in use.
 	// Defaults to 2; negative value disables. With a default of 2, if your traffic suddenly doubles,
 	// burst detection will kick in.
 	BurstMultiple float64
@@ -80,12 +201,76 @@ type EMAThroughput struct {
 	// Defaults to 3
 	BurstDetectionDelay uint
 
+	// AdaptiveInterval, if true, lets the sampler recalculate more often than
+	// AdjustmentInterval while traffic is volatile. When the rate of events
+	// changes by more than VolatilityThreshold from one interval to the next, the
+	// interval is halved, down to MinAdjustmentInterval; while traffic is stable
+	// it is doubled again, up to AdjustmentInterval. The goal for each interval
+	// is GoalThroughputPerSec over the interval in use.
+	AdaptiveInterval bool
+
+	// MinAdjustmentInterval is the shortest interval AdaptiveInterval will use.
+	// It must be shorter than AdjustmentInterval. Defaults to a quarter of
+	// AdjustmentInterval.
+	MinAdjustmentInterval time.Duration
+
+	// VolatilityThreshold is the fractional change in the rate of events
+	// between intervals that AdaptiveInterval considers volatile. Defaults to
+	// 0.5, a change of 50%.
+	VolatilityThreshold float64
+
+	// ConvergenceThreshold is the fractional change in a key's sample rate
+	// from one interval to the next below which the rates are considered
+	// stable. After the rates shift, the number of intervals they take to be
+	// stable again is reported as the intervals_to_converge metric, which
+	// helps when tuning Weight and the adjustment interval. Defaults to 0.1, a
+	// change of 10%.
+	ConvergenceThreshold float64
+
+	// LenientLoad, if true, lets LoadState and ApplyState accept state saved
+	// by an EMASampleRate, so a deployment can switch between the two EMA
+	// samplers without starting from scratch. Only the moving average is taken
+	// from such state; its sample rates were calculated toward a different
+	// kind of goal and are ignored, so the sampler uses its startup rate until
+	// it next calculates rates from the imported average. State from any other
+	// kind of sampler is always rejected. Defaults to false, which rejects
+	// state saved by any other kind of sampler.
+	LenientLoad bool
+
+	// TrackLockContention, if true, measures how long GetSampleRate and the
+	// other methods that count events wait for the sampler's lock, and reports
+	// the total as the lock_wait_micros_count counter. A large and growing
+	// total means callers are contending for the lock at high request rates.
+	// Uncontended calls take the lock without reading the clock, but contended
+	// ones read it twice. Defaults to false, which measures nothing and leaves
+	// the metric out.
+	TrackLockContention bool
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]float64
 	movingAverage    map[string]float64
+	resetKeys        []string // keys reset while updating, to forget once it's done
+	ageOutGrace      ageOutGrace
+	timeWeighting    timeWeighting // for TimeWeightedEMA
 	burstThreshold   float64
-	currentBurstSum  float64
+	currentBurstSum  float64 // the sum of burstWindow
+	burstWindow      burstWindow
+	burstLog         burstLog           // recent bursts, for RecentBursts
+	overshoot        overshoot[float64] // the last moving averages, for OvershootContributors
 	intervalCount    uint
+	intervalSum      float64 // events seen since nextInterval last ran
+	adaptive         adaptiveInterval
 	burstSignal      chan struct{}
 
 	// haveData indicates that we have gotten a sample of traffic. Before we've
@@ -95,28 +280,120 @@ type EMAThroughput struct {
 	updating bool
 	done     chan struct{}
 
+	// frozen stops updateMaps from calculating new rates. See Freeze.
+	frozen bool
+
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
 	// used only in tests
 	testSignalMapsDone chan struct{}
 
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
 	requestCount int64
 	eventCount   int64
 	burstCount   int64
+	keptFraction int64         // parts per million, as of the last interval with traffic
+	heavyKeys    *heavyKeys    // keys in savedSampleRates above HeavySampleThreshold
+	lockWait     time.Duration // with TrackLockContention
+
+	// the smoothed volume the last interval's rates were based on
+	movingAverageSum  int64 // rounded to whole events
+	movingAverageKeys int64
+
+	// convergence measures how long rates take to settle after they shift
+	convergence convergenceDetector
+
+	// rateHistogram counts the sample rates returned by GetSampleRateMulti
+	rateHistogram rateHistogram
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*EMAThroughput)(nil)
 
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (e *EMAThroughput) Validate() error {
+	if e.AdjustmentInterval != 0 && e.AdjustmentInterval < 1*time.Millisecond {
+		return newConfigError(ErrInvalidInterval, "the AdjustmentInterval %v is unreasonably short for a throughput sampler", e.AdjustmentInterval)
+	}
+	if e.GoalThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalThroughputPerSec %d must not be negative", e.GoalThroughputPerSec)
+	}
+	if err := validateGoalSchedule(e.GoalSchedule); err != nil {
+		return err
+	}
+	if e.InitialSampleRate < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the InitialSampleRate %d must not be negative", e.InitialSampleRate)
+	}
+	if e.MaxSampleRate < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the MaxSampleRate %d must not be negative", e.MaxSampleRate)
+	}
+	if e.Weight < 0 || e.Weight > 1 {
+		return newConfigError(ErrInvalidWeight, "the Weight %v must be between 0 and 1", e.Weight)
+	}
+	if e.VanishedKeyWeight < 0 || e.VanishedKeyWeight > 1 {
+		return newConfigError(ErrInvalidWeight, "the VanishedKeyWeight %v must be between 0 and 1", e.VanishedKeyWeight)
+	}
+	if e.MinAdjustmentInterval < 0 {
+		return newConfigError(ErrInvalidInterval, "the MinAdjustmentInterval %v must not be negative", e.MinAdjustmentInterval)
+	}
+	if e.AdaptiveInterval && e.MinAdjustmentInterval > 0 {
+		interval := e.AdjustmentInterval
+		if interval == 0 {
+			interval = 15 * time.Second
+		}
+		if e.MinAdjustmentInterval >= interval {
+			return newConfigError(ErrInvalidInterval, "the MinAdjustmentInterval %v must be shorter than the AdjustmentInterval %v", e.MinAdjustmentInterval, interval)
+		}
+	}
+	if e.VolatilityThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the VolatilityThreshold %v must not be negative", e.VolatilityThreshold)
+	}
+	if e.MaxDeltaPerInterval < 0 {
+		return newConfigError(ErrInvalidThreshold, "the MaxDeltaPerInterval %v must not be negative", e.MaxDeltaPerInterval)
+	}
+	if e.ConvergenceThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the ConvergenceThreshold %v must not be negative", e.ConvergenceThreshold)
+	}
+	if e.AgeOutValue < 0 {
+		return newConfigError(ErrInvalidThreshold, "the AgeOutValue %v must not be negative", e.AgeOutValue)
+	}
+	if e.AgeOutGraceIntervals < 0 {
+		return newConfigError(ErrInvalidThreshold, "the AgeOutGraceIntervals %d must not be negative", e.AgeOutGraceIntervals)
+	}
+	if e.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", e.HeavySampleThreshold)
+	}
+	if e.MinLogSum < 0 {
+		return newConfigError(ErrInvalidThreshold, "the MinLogSum %v must not be negative", e.MinLogSum)
+	}
+	if err := validateNiceRates(e.NiceRates); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (e *EMAThroughput) Start() error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
 	// apply defaults
 	if e.AdjustmentInterval == 0 {
 		e.AdjustmentInterval = 15 * time.Second
 	}
-	if e.AdjustmentInterval < 1*time.Millisecond {
-		return fmt.Errorf("the AdjustmentInterval %v is unreasonably short for a throughput sampler", e.AdjustmentInterval)
-	}
 	if e.InitialSampleRate == 0 {
 		e.InitialSampleRate = 10
 	}
@@ -135,31 +412,63 @@ func (e *EMAThroughput) Start() error {
 	if e.BurstDetectionDelay == 0 {
 		e.BurstDetectionDelay = 3
 	}
+	if e.MinAdjustmentInterval == 0 {
+		e.MinAdjustmentInterval = e.AdjustmentInterval / 4
+	}
+	if e.VolatilityThreshold == 0 {
+		e.VolatilityThreshold = 0.5
+	}
+	if e.MinLogSum == 0 {
+		e.MinLogSum = 1
+	}
+	if e.ConvergenceThreshold == 0 {
+		e.ConvergenceThreshold = defaultConvergenceThreshold
+	}
+	if err := checkInterval("AdjustmentInterval", e.AdjustmentInterval); err != nil {
+		return err
+	}
+	if e.AdaptiveInterval {
+		if err := checkInterval("MinAdjustmentInterval", e.MinAdjustmentInterval); err != nil {
+			return err
+		}
+	}
 
 	// Don't override these maps at startup in case they were loaded from a previous state
-	e.currentCounts = make(map[string]float64)
+	e.currentCounts = make(map[string]float64, e.ExpectedKeys)
 	if e.savedSampleRates == nil {
-		e.savedSampleRates = make(map[string]int)
+		e.savedSampleRates = make(map[string]int, e.ExpectedKeys)
 	}
 	if e.movingAverage == nil {
-		e.movingAverage = make(map[string]float64)
+		e.movingAverage = make(map[string]float64, e.ExpectedKeys)
 	}
 	e.burstSignal = make(chan struct{})
 	e.done = make(chan struct{})
 
+	if e.NoBackgroundGoroutine {
+		return nil
+	}
+
 	go func() {
-		ticker := time.NewTicker(e.AdjustmentInterval)
+		interval := e.AdjustmentInterval
+		ticker := newTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-e.burstSignal:
 				// reset ticker when we get a burst
-				ticker.Stop()
-				ticker = time.NewTicker(e.AdjustmentInterval)
+				ticker.Reset(interval)
 				e.updateMaps()
-			case <-ticker.C:
+			case <-ticker.Chan():
 				e.updateMaps()
+				e.lock.Lock()
 				e.intervalCount++
+				e.lock.Unlock()
+				if e.AdaptiveInterval {
+					if next := e.nextInterval(); next != interval {
+						interval = next
+						ticker.Reset(interval)
+					}
+				}
 			case <-e.done:
 				return
 			}
@@ -170,13 +479,25 @@ func (e *EMAThroughput) Start() error {
 
 func (e *EMAThroughput) Stop() error {
 	close(e.done)
+	exportRates(e.ExportOnStop, &e.lock, &e.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every AdjustmentInterval. It is
+// for use with NoBackgroundGoroutine.
+func (e *EMAThroughput) Update() {
+	e.updateMaps()
+	e.lock.Lock()
+	e.intervalCount++
+	e.lock.Unlock()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (e *EMAThroughput) updateMaps() {
 	e.lock.Lock()
+	e.eventRate.update(e.eventCount, now(), e.AdjustmentInterval)
 	if e.testSignalMapsDone != nil {
 		defer func() {
 			e.testSignalMapsDone <- struct{}{}
@@ -186,6 +507,21 @@ func (e *EMAThroughput) updateMaps() {
 	if len(e.currentCounts) == 0 {
 		// No traffic the last interval, don't update anything. This is deliberate to avoid
 		// the average decaying when there's no traffic (comes in bursts, or there's some kind of outage).
+		if e.TimeWeightedEMA {
+			e.timeWeighting.observe(now(), e.AdjustmentInterval)
+		}
+		e.keyspace.observe(0)
+		e.lock.Unlock()
+		return
+	}
+	if e.frozen {
+		// the counts are dropped without being added to the moving average,
+		// so the saved rates stay as they are
+		if e.TimeWeightedEMA {
+			e.timeWeighting.observe(now(), e.AdjustmentInterval)
+		}
+		e.keyspace.observe(len(e.currentCounts))
+		e.currentCounts = make(map[string]float64, e.ExpectedKeys)
 		e.lock.Unlock()
 		return
 	}
@@ -195,50 +531,183 @@ func (e *EMAThroughput) updateMaps() {
 		return
 	}
 	e.updating = true
+	if e.TimeWeightedEMA {
+		e.timeWeighting.observe(now(), e.AdjustmentInterval)
+	}
 	// make a local copy of the sample counters for calculation
 	tmpCounts := e.currentCounts
-	e.currentCounts = make(map[string]float64)
-	e.currentBurstSum = 0
+	e.keyspace.observe(len(tmpCounts))
+	e.currentCounts = make(map[string]float64, e.ExpectedKeys)
 	e.lock.Unlock()
 
+	var intervalSum float64
+	for _, key := range sortedKeys(tmpCounts) {
+		intervalSum += tmpCounts[key]
+	}
+
 	e.updateEMA(tmpCounts)
 
 	// Goal events to send this interval is the total count of events in the EMA
 	// divided by the desired average sample rate
+	keys := sortedKeys(e.movingAverage)
 	var sumEvents float64
-	for _, count := range e.movingAverage {
-		sumEvents += math.Max(1, count)
+	for _, key := range keys {
+		sumEvents += math.Max(1, e.movingAverage[key])
 	}
 
 	// Store this for burst detection. This is checked in GetSampleRate
 	// so we need to grab the lock when we update it.
 	e.lock.Lock()
 	e.burstThreshold = sumEvents * e.BurstMultiple
+	e.intervalSum += intervalSum
+	e.movingAverageSum = int64(math.Round(sumEvents))
+	e.movingAverageKeys = int64(len(e.movingAverage))
+	interval := e.currentInterval()
 	e.lock.Unlock()
 
 	// Calculate the desired average sample rate per second based on the volume we've received.
-	// This is the number of events we'd like to let through per adjustment interval.
-	goalCount := float64(e.GoalThroughputPerSec) * e.AdjustmentInterval.Seconds()
+	// This is the number of events we'd like to let through per adjustment interval,
+	// which is the interval AdaptiveInterval has chosen if it's on, since that's
+	// what the counts cover.
+	goal := goalAt(e.GoalSchedule, now(), e.GoalThroughputPerSec)
+	goalCount := float64(goal) * interval.Seconds()
 
 	// goalRatio is the goalCount divided by the sum of all the log values - it
 	// determines what percentage of the total event space belongs to each key
 	var logSum float64
-	for _, count := range e.movingAverage {
+	for _, key := range keys {
 		// We take the max of (1, count) because count * weight is < 1 for
 		// very small counts, which throws off the logSum and can cause
 		// incorrect samples rates to be computed when throughput is low
-		logSum += math.Log10(math.Max(1, count))
+		logSum += math.Log10(math.Max(1, e.movingAverage[key]))
 	}
+	// when every key is quiet, the sum is too small to share the goal out by
+	logSum = math.Max(logSum, e.MinLogSum)
 	goalRatio := goalCount / logSum
 
-	newSavedSampleRates := calculateSampleRates(goalRatio, e.movingAverage)
+	heavy := newHeavyKeys(e.HeavySampleThreshold)
+	newSavedSampleRates, kept := calculateSampleRates(goalRatio, e.movingAverage, e.KeyOrder, e.ExtraBudgetPolicy, heavy)
+	if e.SnapToNiceRates {
+		kept = snapToNiceRates(newSavedSampleRates, e.movingAverage, e.NiceRates, heavy)
+	}
+	if e.MaxSampleRate > 0 {
+		kept = 0
+		for key, rate := range newSavedSampleRates {
+			if rate > e.MaxSampleRate {
+				rate = e.MaxSampleRate
+				heavy.set(newSavedSampleRates, key, rate)
+			}
+			kept += math.Max(1, e.movingAverage[key]) / float64(rate)
+		}
+	}
 	e.lock.Lock()
 	defer e.lock.Unlock()
+	e.convergence.observe(e.savedSampleRates, newSavedSampleRates, e.ConvergenceThreshold)
 	e.savedSampleRates = newSavedSampleRates
+	e.heavyKeys = heavy
+	e.finishResets(newSavedSampleRates)
+	e.keptFraction = keptFractionPPM(kept, sumEvents)
+	e.overshoot.set(e.movingAverage, goalCount)
 	e.haveData = true
 	e.updating = false
 }
 
+// Freeze stops the sampler from calculating new sample rates until Unfreeze is
+// called, so that it keeps serving the rates it has now. This is useful during
+// an incident, when traffic is unusual and shouldn't change the rates. Traffic
+// seen while frozen is counted for metrics but never reaches the moving
+// average, and doesn't count as a burst. It is safe to call while the sampler
+// is running.
+func (e *EMAThroughput) Freeze() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.frozen = true
+}
+
+// Unfreeze undoes Freeze. The moving average picks up again from where it was
+// when the sampler was frozen.
+func (e *EMAThroughput) Unfreeze() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.frozen = false
+}
+
+// AdjustCount corrects key's count in the current interval by delta, which
+// may be negative, so that a caller that counted events provisionally, such as
+// a batch that is about to be retried, can take them back. delta is in the
+// units throughput is measured in, not converted by CountUnit: events with
+// CountUnitSpans, and calls with CountUnitGroups, so taking back a call of any
+// size is a delta of -1. Counts passed to GetSampleRateMultiWeighted are
+// weights, and delta is in the same units. The count never goes below zero, and the moving average only sees the corrected
+// count. It is not a new request, so metrics and burst detection are not
+// affected. Keys are matched as GetSampleRate would count them, after
+// MaxKeyLength is applied. It is safe to call while the sampler is running.
+func (e *EMAThroughput) AdjustCount(key string, delta int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	// a throwaway oversizeKeys, so the correction isn't counted as a new key
+	key, track := (&oversizeKeys{}).check(key, e.MaxKeyLength, e.OnOversizeKey)
+	if !track || e.currentCounts == nil {
+		return
+	}
+	adjustCount(e.currentCounts, key, float64(delta), e.MaxKeys)
+}
+
+// ResetKey forgets everything the sampler knows about key - its count in the
+// current interval, its sample rate, and its moving average - so that it is
+// treated as a new key the next time it is seen. Other keys are not affected.
+// This is useful when a key's rate has gone wrong and needs to start over. It
+// is safe to call while the sampler is running.
+func (e *EMAThroughput) ResetKey(key string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.currentCounts, key)
+	e.heavyKeys.remove(e.savedSampleRates, key)
+	if e.updating {
+		// new rates are being calculated from the moving average right now,
+		// so the key is forgotten once that's done
+		e.resetKeys = append(e.resetKeys, key)
+		return
+	}
+	delete(e.movingAverage, key)
+}
+
+// finishResets forgets the keys reset while rates were being calculated,
+// removing them from the new rates too. The caller must hold the lock.
+func (e *EMAThroughput) finishResets(newRates map[string]int) {
+	for _, key := range e.resetKeys {
+		delete(e.movingAverage, key)
+		e.heavyKeys.remove(newRates, key)
+	}
+	e.resetKeys = nil
+}
+
+// currentInterval returns the interval currently in use: the one chosen by
+// AdaptiveInterval, if it is on, or else AdjustmentInterval. The caller must
+// hold the lock.
+func (e *EMAThroughput) currentInterval() time.Duration {
+	if e.AdaptiveInterval && e.adaptive.current > 0 {
+		return e.adaptive.current
+	}
+	return e.AdjustmentInterval
+}
+
+// currentIntervalMs returns the interval currently in use, in milliseconds,
+// for metrics.
+func (e *EMAThroughput) currentIntervalMs() int64 {
+	return e.currentInterval().Milliseconds()
+}
+
+// nextInterval returns the interval to use after the one that just ended, when
+// AdaptiveInterval is set.
+func (e *EMAThroughput) nextInterval() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	sum := e.intervalSum
+	e.intervalSum = 0
+	return e.adaptive.next(sum, e.MinAdjustmentInterval, e.AdjustmentInterval, e.VolatilityThreshold)
+}
+
 // GetSampleRate takes a key and returns the appropriate sample rate for that
 // key.
 func (e *EMAThroughput) GetSampleRate(key string) int {
@@ -246,30 +715,104 @@ func (e *EMAThroughput) GetSampleRate(key string) int {
 }
 
 // GetSampleRateMulti takes a key representing count spans and returns the
-// appropriate sample rate for that key.
+// appropriate sample rate for that key. It is equivalent to calling
+// GetSampleRateMultiWeighted with a weight equal to count.
 func (e *EMAThroughput) GetSampleRateMulti(key string, count int) int {
+	return e.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (e *EMAThroughput) GetSampleRateMulti64(key string, count int64) int {
+	return e.evaluate(key, count, float64(e.CountUnit.of(count))).Rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (e *EMAThroughput) PeekSampleRate(key string) int {
 	e.lock.Lock()
 	defer e.lock.Unlock()
+	if e.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, e.MaxKeyLength, e.OnOversizeKey)
+	rate, _ := e.chooseRate(key)
+	return rate
+}
+
+// Evaluate is like GetSampleRateMulti, but returns a Result that explains the
+// sample rate as well as giving it.
+func (e *EMAThroughput) Evaluate(key string, count int) Result {
+	return e.evaluate(key, int64(count), float64(e.CountUnit.of(int64(count))))
+}
+
+// GetSampleRateMultiWeighted takes a key representing count spans and returns
+// the appropriate sample rate for that key, like GetSampleRateMulti, but lets
+// the caller say separately how much those spans cost.
+//
+// The two values are used for different things. count is the number of spans
+// the call represents; it is what event_count reports, and the rate returned
+// should be applied to those spans as usual. weight is what accumulates into
+// the moving average, so it is what GoalThroughputPerSec budgets and what
+// burst detection watches. If, for example, weight is the number of database
+// rows a request touched, GoalThroughputPerSec becomes a target number of rows
+// per second rather than spans per second, and a key whose calls are expensive
+// will be sampled harder than one whose calls are cheap at the same call rate.
+//
+// weight should not be negative. It is used as given, whatever CountUnit is.
+func (e *EMAThroughput) GetSampleRateMultiWeighted(key string, count int, weight float64) int {
+	return e.evaluate(key, int64(count), weight).Rate
+}
+
+// evaluate counts count spans of the given weight for key and decides on the
+// sample rate for them.
+func (e *EMAThroughput) evaluate(key string, count int64, weight float64) Result {
+	if e.TrackLockContention {
+		e.lockTimed()
+	} else {
+		e.lock.Lock()
+	}
+	defer e.lock.Unlock()
+	if e.currentCounts == nil {
+		// not started yet
+		return newResult(1, SourceColdStart, count)
+	}
 
 	e.requestCount++
-	e.eventCount += int64(count)
-
-	// Enforce MaxKeys limit on the size of the map
-	if e.MaxKeys > 0 {
-		// If a key already exists, increment it. If not, but we're under the limit, store a new key
-		if _, found := e.currentCounts[key]; found || len(e.currentCounts) < e.MaxKeys {
-			e.currentCounts[key] += float64(count)
-			e.currentBurstSum += float64(count)
+	e.eventCount += count
+
+	// the threshold comes from averages over the interval in use, so the
+	// window is that long too
+	e.burstWindow.advance(now(), e.currentInterval())
+	key, track := e.oversizeKeys.check(key, e.MaxKeyLength, e.OnOversizeKey)
+	counted := track
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if e.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := e.currentCounts[key]; found || len(e.currentCounts) < e.MaxKeys {
+				e.currentCounts[key] += weight
+				e.burstWindow.add(weight)
+			} else {
+				e.droppedKeys.add(key)
+				counted = false
+			}
+		} else {
+			e.currentCounts[key] += weight
+			e.burstWindow.add(weight)
 		}
-	} else {
-		e.currentCounts[key] += float64(count)
-		e.currentBurstSum += float64(count)
 	}
+	e.currentBurstSum = e.burstWindow.sum()
 
-	// Enforce the burst threshold
-	if e.burstThreshold > 0 && e.currentBurstSum >= e.burstThreshold && e.intervalCount >= e.BurstDetectionDelay {
+	// Enforce the burst threshold. While frozen, a burst couldn't change the
+	// rates, so it isn't detected.
+	if !e.frozen && e.burstThreshold > 0 && e.currentBurstSum >= e.burstThreshold && e.intervalCount >= e.BurstDetectionDelay {
 		// reset the burst sum to prevent additional burst updates from occurring while updateMaps is running
+		e.burstLog.add(BurstEvent{Time: now(), Sum: e.currentBurstSum, Threshold: e.burstThreshold})
 		e.currentBurstSum = 0
+		e.burstWindow.reset()
 		e.burstCount++
 		// send but don't block - consuming is blocked on updateMaps, which takes the same lock we're holding
 		select {
@@ -278,74 +821,121 @@ func (e *EMAThroughput) GetSampleRateMulti(key string, count int) int {
 		}
 	}
 
+	rate, source := e.chooseRate(key)
+	if !counted {
+		source = SourceRejected
+	}
+	e.rateHistogram.record(rate)
+	return newResult(rate, source, count)
+}
+
+// chooseRate returns the sample rate for key and where it came from. The
+// caller must hold the lock.
+func (e *EMAThroughput) chooseRate(key string) (int, RateSource) {
 	if !e.haveData {
-		return e.InitialSampleRate
+		return e.InitialSampleRate, SourceColdStart
 	}
 	if rate, found := e.savedSampleRates[key]; found {
-		return rate
+		if e.MaxSampleRate > 0 && rate >= e.MaxSampleRate {
+			return rate, SourceCapped
+		}
+		return rate, SourceComputed
 	}
-	return 1
+	return 1, SourceUnknownKey
 }
 
-func (e *EMAThroughput) updateEMA(newCounts map[string]float64) {
-	keysToUpdate := make([]string, 0, len(e.movingAverage))
-	for key := range e.movingAverage {
-		keysToUpdate = append(keysToUpdate, key)
+// lockTimed takes the lock, adding the time spent waiting for it to lockWait.
+// It uses the real clock, not the one tests can replace.
+func (e *EMAThroughput) lockTimed() {
+	if e.lock.TryLock() {
+		return
 	}
+	start := time.Now()
+	e.lock.Lock()
+	e.lockWait += time.Since(start)
+}
+
+func (e *EMAThroughput) updateEMA(newCounts map[string]float64) {
+	// The new averages go in a new map, which replaces the old one under the
+	// lock, so that SaveState and Snapshot can copy the old one meanwhile. The
+	// grace periods are updated in a copy for the same reason.
+	averages := make(map[string]float64, len(e.movingAverage))
+	grace := e.ageOutGrace.clone()
 
 	// Update any existing keys with new values
-	for _, key := range keysToUpdate {
+	for _, key := range sortedKeys(e.movingAverage) {
 		var newAvg float64
 		// Was this key seen in the last interval? Adjust by that amount
-		if val, found := newCounts[key]; found {
-			newAvg = adjustAverage(e.movingAverage[key], val, e.Weight)
+		val, seen := newCounts[key]
+		if seen {
+			newAvg = e.timeWeighting.adjust(e.movingAverage[key], val, e.Weight)
 		} else {
 			// Otherwise adjust by zero
-			newAvg = adjustAverage(e.movingAverage[key], 0, e.Weight)
+			weight := e.Weight
+			if e.VanishedKeyWeight > 0 {
+				weight = e.VanishedKeyWeight
+			}
+			newAvg = e.timeWeighting.adjust(e.movingAverage[key], 0, weight)
 		}
+		newAvg = limitDelta(e.movingAverage[key], newAvg, e.MaxDeltaPerInterval)
 
-		// Age out this value if it's too small to care about for calculating sample rates
-		// This is also necessary to keep our map from going forever.
-		if newAvg < e.AgeOutValue {
-			delete(e.movingAverage, key)
-		} else {
-			e.movingAverage[key] = newAvg
+		// Age out this value if it's too small to care about for calculating sample rates,
+		// by leaving it out of the new map. This is also necessary to keep our map from
+		// going forever.
+		if newAvg >= e.AgeOutValue || grace.keep(key, seen, e.AgeOutGraceIntervals) {
+			averages[key] = newAvg
+			if newAvg >= e.AgeOutValue {
+				grace.forget(key)
+			}
 		}
 		// We've processed this key - don't process it again when we look at new counts
 		delete(newCounts, key)
 	}
 
-	for key := range newCounts {
-		newAvg := adjustAverage(0, newCounts[key], e.Weight)
+	for _, key := range sortedKeys(newCounts) {
+		newAvg := e.timeWeighting.adjust(0, newCounts[key], e.Weight)
 		if newAvg >= e.AgeOutValue {
-			e.movingAverage[key] = newAvg
+			averages[key] = newAvg
+			grace.forget(key)
 		}
 	}
+
+	e.lock.Lock()
+	e.movingAverage = averages
+	e.ageOutGrace = grace
+	e.lock.Unlock()
 }
 
+// emaThroughputState is what SaveState saves for an EMAThroughput.
 type emaThroughputState struct {
 	// These fields are exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	Sampler          string             `json:"sampler,omitempty"`
 	SavedSampleRates map[string]int     `json:"saved_sample_rates"`
 	MovingAverage    map[string]float64 `json:"moving_average"`
 }
 
 // SaveState returns a byte array with a JSON representation of the sampler state
 func (e *EMAThroughput) SaveState() ([]byte, error) {
+	// the maps are copied under the lock and marshaled after it is released,
+	// so sampling is only held up for the copy
 	e.lock.Lock()
-	defer e.lock.Unlock()
-
 	if e.savedSampleRates == nil {
+		e.lock.Unlock()
 		return nil, errors.New("saved sample rate map is nil")
 	}
 	if e.movingAverage == nil {
+		e.lock.Unlock()
 		return nil, errors.New("moving average map is nil")
 	}
-	s := &emaThroughputState{SavedSampleRates: e.savedSampleRates, MovingAverage: e.movingAverage}
+	s := &emaThroughputState{Sampler: stateSamplerEMAThroughput, SavedSampleRates: copyRates(e.savedSampleRates), MovingAverage: copyCounts(e.movingAverage)}
+	e.lock.Unlock()
 	return json.Marshal(s)
 }
 
 // LoadState accepts a byte array with a JSON representation of a previous instance's
-// state
+// state. State that is truncated, contains impossible values, or was saved by a
+// different kind of sampler is rejected with an error, leaving the sampler
+// unchanged. See LenientLoad for loading state saved by an EMASampleRate.
 func (e *EMAThroughput) LoadState(state []byte) error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
@@ -355,9 +945,31 @@ func (e *EMAThroughput) LoadState(state []byte) error {
 	if err != nil {
 		return err
 	}
+	same, err := checkStateSampler(s.Sampler, stateSamplerEMAThroughput, e.LenientLoad)
+	if err != nil {
+		return err
+	}
+	if !same {
+		// only the moving average carries over from the other EMA sampler
+		if s.MovingAverage == nil {
+			return errors.New("invalid state: moving_average is missing")
+		}
+		if err := validateMovingAverage(s.MovingAverage); err != nil {
+			return err
+		}
+		e.movingAverage = s.MovingAverage
+		return nil
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+	if err := validateMovingAverage(s.MovingAverage); err != nil {
+		return err
+	}
 
 	// Load the previously calculated sample rates
 	e.savedSampleRates = s.SavedSampleRates
+	e.heavyKeys = countHeavyKeys(s.SavedSampleRates, e.HeavySampleThreshold)
 	e.movingAverage = s.MovingAverage
 	// Allow GetSampleRate to return calculated sample rates from the loaded map
 	e.haveData = true
@@ -365,15 +977,220 @@ func (e *EMAThroughput) LoadState(state []byte) error {
 	return nil
 }
 
+// SupportsState reports that SaveState returns the sampler's state, so it is
+// worth persisting.
+func (e *EMAThroughput) SupportsState() bool {
+	return true
+}
+
+// ApplyState adopts the sample rates from a state produced by SaveState on a
+// running sampler, for example to take up rates computed elsewhere in a
+// cluster. Unlike LoadState, which is meant to be called before Start and
+// replaces everything, ApplyState keeps the counts collected so far in the
+// current interval, so they still contribute when rates are next calculated.
+// The moving average is replaced too if the state includes one; otherwise the
+// sampler keeps its own.
+//
+// The applied rates are used until the next interval's calculation replaces
+// them. State that is invalid is rejected with an error, leaving the sampler
+// unchanged. Replacing the moving average is not possible while rates are
+// being calculated, so that also returns an error and can be retried. State
+// saved by a different kind of sampler is treated as it is by LoadState.
+func (e *EMAThroughput) ApplyState(state []byte) error {
+	s := emaThroughputState{}
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	same, err := checkStateSampler(s.Sampler, stateSamplerEMAThroughput, e.LenientLoad)
+	if err != nil {
+		return err
+	}
+	if !same {
+		if s.MovingAverage == nil {
+			return errors.New("invalid state: moving_average is missing")
+		}
+		// keep our own rates, and take only the moving average below
+		s.SavedSampleRates = nil
+	} else if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+	if err := validateMovingAverage(s.MovingAverage); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if s.MovingAverage != nil {
+		if e.updating {
+			return errors.New("cannot replace the moving average while sample rates are being calculated")
+		}
+		e.movingAverage = s.MovingAverage
+	}
+	if s.SavedSampleRates != nil {
+		e.savedSampleRates = s.SavedSampleRates
+		e.heavyKeys = countHeavyKeys(s.SavedSampleRates, e.HeavySampleThreshold)
+		e.haveData = true
+	}
+	return nil
+}
+
+// Snapshot returns a deep copy of the sampler's full internal state, taken
+// under its lock so that every part of it is from the same moment. See
+// Snapshot for what it holds.
+func (e *EMAThroughput) Snapshot() Snapshot {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return Snapshot{
+		Sampler:          stateSamplerEMAThroughput,
+		SavedSampleRates: copyRates(e.savedSampleRates),
+		MovingAverage:    copyCounts(e.movingAverage),
+		CurrentCounts:    copyCounts(e.currentCounts),
+		HaveData:         e.haveData,
+		IntervalCount:    uint64(e.intervalCount),
+		BurstThreshold:   e.burstThreshold,
+		AgeOutGrace:      e.ageOutGrace.snapshot(),
+		LastIntervalEnd:  e.timeWeighting.last,
+		IntervalRatio:    e.timeWeighting.ratio,
+		RequestCount:     e.requestCount,
+		EventCount:       e.eventCount,
+		BurstCount:       e.burstCount,
+		KeptFraction:     e.keptFraction,
+	}
+}
+
+// Restore replaces the sampler's internal state with a snapshot taken from
+// another EMAThroughput by Snapshot, all at once, so that it behaves as that sampler
+// did. The snapshot is copied, so the caller may keep using it. A snapshot
+// from a different kind of sampler, or with impossible values, is rejected
+// with an error, leaving the sampler unchanged. It is safe to call while the
+// sampler is running, except while new rates are being calculated, which is
+// also an error.
+func (e *EMAThroughput) Restore(s Snapshot) error {
+	if err := s.validate(stateSamplerEMAThroughput); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.updating {
+		return errors.New("cannot restore a snapshot while sample rates are being calculated")
+	}
+	e.savedSampleRates = copyRates(s.SavedSampleRates)
+	e.heavyKeys = countHeavyKeys(e.savedSampleRates, e.HeavySampleThreshold)
+	e.movingAverage = copyCounts(s.MovingAverage)
+	var sum float64
+	for _, key := range sortedKeys(e.movingAverage) {
+		sum += math.Max(1, e.movingAverage[key])
+	}
+	e.movingAverageSum = int64(math.Round(sum))
+	e.movingAverageKeys = int64(len(e.movingAverage))
+	e.currentCounts = copyCounts(s.CurrentCounts)
+	e.haveData = s.HaveData
+	e.intervalCount = uint(s.IntervalCount)
+	e.burstThreshold = s.BurstThreshold
+	e.ageOutGrace.restore(s.AgeOutGrace)
+	e.timeWeighting = timeWeighting{last: s.LastIntervalEnd, ratio: s.IntervalRatio}
+	e.requestCount = s.RequestCount
+	e.eventCount = s.EventCount
+	e.burstCount = s.BurstCount
+	e.keptFraction = s.KeptFraction
+	return nil
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (e *EMAThroughput) DroppedKeySamples() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.droppedKeys.drain()
+}
+
+// RecentBursts returns up to the last 50 bursts detected, oldest first, and
+// clears the list. It is safe to call while the sampler is in use, and is
+// useful for finding out after an incident when burst detection fired and by
+// how much.
+func (e *EMAThroughput) RecentBursts() []BurstEvent {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.burstLog.drain()
+}
+
+// OvershootContributors returns up to n of the keys that kept the most events
+// beyond an equal share of the goal in the last interval, largest first, to
+// show why throughput is over the goal: many rare keys at a rate of 1, or a
+// busy key that isn't sampled hard enough. Rates are calculated from the
+// moving averages, so each key's kept events are estimated from its moving
+// average and rate, as for the kept_fraction metric. It doesn't change
+// anything, and is safe to call while the sampler is in use.
+func (e *EMAThroughput) OvershootContributors(n int) []KeyContribution {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.overshoot.top(n, e.savedSampleRates)
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (e *EMAThroughput) OversizeKeyError() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.oversizeKeys.takeErr()
+}
+
+// GetMetrics returns the sampler's metrics. In addition to the metrics common
+// to all samplers, it reports a cumulative histogram of the sample rates
+// returned so far as "rate_bucket_<N>_count" counters, where N is the lowest
+// rate in each power-of-two bucket (1, 2, 4, 8, ...). Only buckets that have
+// been used are reported.
 func (e *EMAThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(e.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (e *EMAThroughput) GetMetricsTyped(prefix string) map[string]Metric {
 	e.lock.Lock()
 	defer e.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count":  e.requestCount,
-		prefix + "event_count":    e.eventCount,
-		prefix + "burst_count":    e.burstCount,
-		prefix + "interval_count": int64(e.intervalCount),
-		prefix + "keyspace_size":  int64(len(e.currentCounts)),
+	mets := map[string]Metric{
+		prefix + "request_count":         counter(e.requestCount),
+		prefix + "event_count":           counter(e.eventCount),
+		prefix + "burst_count":           counter(e.burstCount),
+		prefix + "interval_count":        counter(int64(e.intervalCount)),
+		prefix + "interval_ms":           gauge(e.currentIntervalMs()),
+		prefix + "keyspace_size":         gauge(e.keyspace.report(e.SmoothKeyspaceMetric, int64(len(e.currentCounts)))),
+		prefix + "oversize_key_count":    counter(e.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":         gauge(e.keptFraction),
+		prefix + "keys_above_threshold":  gauge(e.heavyKeys.value()),
+		prefix + "events_per_sec":        gauge(e.eventRate.perSec),
+		prefix + "moving_average_sum":    gauge(e.movingAverageSum),
+		prefix + "moving_average_keys":   gauge(e.movingAverageKeys),
+		prefix + "intervals_to_converge": gauge(e.convergence.last),
+	}
+	if e.TrackLockContention {
+		mets[prefix+"lock_wait_micros_count"] = counter(e.lockWait.Microseconds())
 	}
+	e.rateHistogram.addMetrics(mets, prefix)
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (e *EMAThroughput) GetMetricsSummary(prefix string) map[string]int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return summarizeRates(prefix, e.savedSampleRates, e.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (e *EMAThroughput) GetAllSampleRates() map[string]int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return copyRates(e.savedSampleRates)
+}
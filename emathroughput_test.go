@@ -3,6 +3,8 @@ package dynsampler
 import (
 	"math"
 	mrand "math/rand"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -262,3 +264,701 @@ func TestEMAThroughputSampleRateHitsTargetRate(t *testing.T) {
 		}
 	}
 }
+
+func TestEMAThroughput_GetMetrics(t *testing.T) {
+	e := &EMAThroughput{
+		InitialSampleRate: 10,
+		currentCounts:     map[string]float64{},
+	}
+	e.GetSampleRateMulti("a", 5)
+	e.GetSampleRate("b")
+	e.haveData = true
+	e.savedSampleRates = map[string]int{"a": 3}
+	e.GetSampleRate("a")
+	e.GetSampleRate("c")
+
+	mets := e.GetMetrics("e_")
+	assert.Equal(t, int64(4), mets["e_request_count"])
+	assert.Equal(t, int64(8), mets["e_event_count"])
+	assert.Equal(t, int64(3), mets["e_keyspace_size"])
+	assert.Equal(t, int64(1), mets["e_rate_bucket_1_count"])
+	assert.Equal(t, int64(1), mets["e_rate_bucket_2_count"])
+	assert.Equal(t, int64(2), mets["e_rate_bucket_8_count"])
+	_, found := mets["e_rate_bucket_4_count"]
+	assert.False(t, found)
+	assert.Equal(t, int64(0), mets["e_moving_average_sum"])
+	assert.Equal(t, int64(0), mets["e_moving_average_keys"])
+
+	// the averages are 3, 0.5, and 0.5, and small averages count as 1
+	e.GoalThroughputPerSec = 1
+	e.AdjustmentInterval = time.Second
+	e.Weight = 0.5
+	e.AgeOutValue = 0.1
+	e.HeavySampleThreshold = 1
+	e.movingAverage = map[string]float64{}
+	e.updateMaps()
+	mets = e.GetMetrics("e_")
+	assert.Equal(t, int64(5), mets["e_moving_average_sum"])
+	assert.Equal(t, int64(3), mets["e_moving_average_keys"])
+	assert.Equal(t, int64(8), mets["e_events_per_sec"])
+	// only "a" is busy enough to be sampled
+	assert.Equal(t, int64(1), mets["e_keys_above_threshold"])
+}
+
+func TestEMAThroughputGetSampleRateMultiWeighted(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		AdjustmentInterval:   1 * time.Second,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		InitialSampleRate:    10,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{},
+	}
+	// one call for a single span that touched 500 rows, and many cheap calls
+	assert.Equal(t, 10, e.GetSampleRateMultiWeighted("expensive", 1, 500))
+	for i := 0; i < 50; i++ {
+		e.GetSampleRateMultiWeighted("cheap", 1, 1)
+	}
+	// the weight is what gets counted toward the budget...
+	assert.Equal(t, float64(500), e.currentCounts["expensive"])
+	assert.Equal(t, float64(50), e.currentCounts["cheap"])
+	// ...while the count is what gets reported as events
+	mets := e.GetMetrics("")
+	assert.Equal(t, int64(51), mets["event_count"])
+
+	e.updateMaps()
+	assert.Greater(t, e.GetSampleRateMultiWeighted("expensive", 1, 500), e.GetSampleRateMultiWeighted("cheap", 1, 1))
+
+	// GetSampleRateMulti weighs each span as one unit
+	e.GetSampleRateMulti("cheap", 3)
+	assert.Equal(t, float64(4), e.currentCounts["cheap"])
+}
+
+func TestEMAThroughputCountUnit(t *testing.T) {
+	rates := func(unit CountUnit) (big, small int) {
+		e := &EMAThroughput{
+			GoalThroughputPerSec:  10,
+			AdjustmentInterval:    time.Second,
+			CountUnit:             unit,
+			NoBackgroundGoroutine: true,
+		}
+		assert.NoError(t, e.Start())
+		defer e.Stop()
+		// the same number of spans, in a few big traces and many small ones
+		for i := 0; i < 10; i++ {
+			e.GetSampleRateMulti("big", 100)
+		}
+		for i := 0; i < 1000; i++ {
+			e.GetSampleRateMulti("small", 1)
+		}
+		assert.Equal(t, int64(2000), e.GetMetrics("")["event_count"])
+		e.Update()
+		return e.PeekSampleRate("big"), e.PeekSampleRate("small")
+	}
+
+	big, small := rates(CountUnitSpans)
+	assert.Equal(t, big, small)
+	// counting traces, the few big ones are sampled much less than the many
+	// small ones
+	big, small = rates(CountUnitGroups)
+	assert.Less(t, big*10, small)
+}
+
+func TestEMAThroughputMinLogSum(t *testing.T) {
+	e := &EMAThroughput{GoalThroughputPerSec: 5, AdjustmentInterval: time.Second, NoBackgroundGoroutine: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	assert.Equal(t, float64(1), e.MinLogSum)
+
+	// every average is below 1, so the sum of their logs is 0
+	for i := 0; i < 20; i++ {
+		e.GetSampleRate("key" + strconv.Itoa(i))
+	}
+	e.Update()
+	for key, rate := range e.savedSampleRates {
+		assert.Equal(t, 1, rate, key)
+	}
+	assert.Equal(t, int64(1000000), e.GetMetrics("")["kept_fraction"])
+
+	// many keys whose averages wobble just above 1
+	r := mrand.New(mrand.NewSource(1))
+	for interval := 0; interval < 20; interval++ {
+		for i := 0; i < 20; i++ {
+			e.GetSampleRateMultiWeighted("key"+strconv.Itoa(i), 1, 1+r.Float64()*0.1)
+		}
+		e.Update()
+		for key, rate := range e.savedSampleRates {
+			assert.GreaterOrEqual(t, rate, 1, key)
+			assert.LessOrEqual(t, rate, 2, key)
+		}
+		kept := e.GetMetrics("")["kept_fraction"]
+		assert.GreaterOrEqual(t, kept, int64(500000))
+		assert.LessOrEqual(t, kept, int64(1000000))
+	}
+}
+
+func TestEMAThroughputMaxDeltaPerInterval(t *testing.T) {
+	e := &EMAThroughput{
+		AdjustmentInterval:    time.Second,
+		MaxDeltaPerInterval:   0.2,
+		NoBackgroundGoroutine: true,
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	for i := 0; i < 10; i++ {
+		e.GetSampleRateMulti("steady", 100)
+		e.Update()
+	}
+	before := e.movingAverage["steady"]
+	assert.InDelta(t, 100, before, 20)
+
+	// a 100x spike moves the average by no more than 20%
+	e.GetSampleRateMulti("steady", 10000)
+	e.Update()
+	assert.InDelta(t, before*1.2, e.movingAverage["steady"], 1e-9)
+
+	// and so does the interval after it, when the key disappears
+	spiked := e.movingAverage["steady"]
+	e.GetSampleRate("other")
+	e.Update()
+	assert.InDelta(t, spiked*0.8, e.movingAverage["steady"], 1e-9)
+
+	// a key new to the average isn't limited
+	e.GetSampleRateMulti("new", 10000)
+	e.Update()
+	assert.InDelta(t, 5000, e.movingAverage["new"], 1e-9)
+}
+
+func TestEMAThroughputOvershootContributors(t *testing.T) {
+	e := &EMAThroughput{
+		AdjustmentInterval:    time.Second,
+		GoalThroughputPerSec:  100,
+		MaxSampleRate:         2,
+		NoBackgroundGoroutine: true,
+	}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	// the hot key can't be sampled harder than 2, so it keeps far more than
+	// its share of the goal; the quiet keys stay within theirs
+	for i := 0; i < 5; i++ {
+		e.GetSampleRateMulti("hot", 10000)
+		for j := 0; j < 10; j++ {
+			e.GetSampleRateMulti("quiet"+strconv.Itoa(j), 2)
+		}
+		e.Update()
+	}
+	got := e.OvershootContributors(5)
+	if assert.Len(t, got, 1) {
+		c := got[0]
+		assert.Equal(t, "hot", c.Key)
+		assert.Equal(t, 2, c.SampleRate)
+		assert.InDelta(t, e.movingAverage["hot"], c.Count, 1e-9)
+		assert.InDelta(t, c.Count/2, c.Kept, 1e-9)
+		assert.InDelta(t, 100.0/11, c.FairShare, 1e-9)
+		assert.InDelta(t, c.Kept-c.FairShare, c.Excess, 1e-9)
+	}
+}
+
+func TestEMAThroughputTimeWeightedEMA(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+
+	newSampler := func(timeWeighted bool) *EMAThroughput {
+		e := &EMAThroughput{
+			AdjustmentInterval:    time.Second,
+			TimeWeightedEMA:       timeWeighted,
+			NoBackgroundGoroutine: true,
+		}
+		assert.NoError(t, e.Start())
+		return e
+	}
+	fixed, weighted := newSampler(false), newSampler(true)
+	defer fixed.Stop()
+	defer weighted.Stop()
+
+	// a steady 100 events per second, but the intervals run short and long
+	var fixedErr, weightedErr float64
+	spacing := []time.Duration{time.Second, 300 * time.Millisecond, 2500 * time.Millisecond, time.Second, 4 * time.Second, 700 * time.Millisecond}
+	for round := 0; round < 5; round++ {
+		for _, d := range spacing {
+			clock.advance(d)
+			events := int(100 * d.Seconds())
+			fixed.GetSampleRateMulti("key", events)
+			weighted.GetSampleRateMulti("key", events)
+			fixed.Update()
+			weighted.Update()
+			if round > 0 {
+				fixedErr += math.Abs(fixed.movingAverage["key"] - 100)
+				weightedErr += math.Abs(weighted.movingAverage["key"] - 100)
+			}
+		}
+	}
+	assert.InDelta(t, 100, weighted.movingAverage["key"], 1)
+	assert.Less(t, weightedErr*10, fixedErr)
+}
+
+func TestEMAThroughputMaxSampleRate(t *testing.T) {
+	newSampler := func(maxRate int) *EMAThroughput {
+		return &EMAThroughput{
+			GoalThroughputPerSec: 10,
+			AdjustmentInterval:   1 * time.Second,
+			Weight:               0.5,
+			AgeOutValue:          0.5,
+			MaxSampleRate:        maxRate,
+			movingAverage:        map[string]float64{},
+		}
+	}
+	counts := func() map[string]float64 {
+		return map[string]float64{"dominant": 100000, "rare": 10}
+	}
+
+	uncapped := newSampler(0)
+	uncapped.currentCounts = counts()
+	uncapped.updateMaps()
+	assert.Greater(t, uncapped.savedSampleRates["dominant"], 50)
+
+	capped := newSampler(50)
+	capped.currentCounts = counts()
+	capped.updateMaps()
+	assert.Equal(t, 50, capped.savedSampleRates["dominant"])
+	assert.Equal(t, uncapped.savedSampleRates["rare"], capped.savedSampleRates["rare"])
+}
+
+func TestEMAThroughputApplyState(t *testing.T) {
+	e := &EMAThroughput{
+		currentCounts:    map[string]float64{"live": 7},
+		savedSampleRates: map[string]int{"old": 9},
+		movingAverage:    map[string]float64{"old": 100},
+	}
+	assert.Nil(t, e.ApplyState([]byte(`{"saved_sample_rates":{"new":4},"moving_average":{"new":40}}`)))
+	assert.Equal(t, 4, e.GetSampleRate("new"))
+	assert.Equal(t, map[string]float64{"new": 40}, e.movingAverage)
+	assert.Equal(t, float64(7), e.currentCounts["live"])
+}
+
+func TestEMAThroughputAdaptiveInterval(t *testing.T) {
+	e := &EMAThroughput{
+		AdjustmentInterval:    8 * time.Second,
+		MinAdjustmentInterval: 1 * time.Second,
+		VolatilityThreshold:   0.5,
+		AdaptiveInterval:      true,
+		GoalThroughputPerSec:  10,
+		Weight:                0.5,
+		AgeOutValue:           0.5,
+		movingAverage:         map[string]float64{},
+	}
+	// runInterval simulates one tick of the background goroutine with the
+	// given events per second over the current interval
+	interval := e.AdjustmentInterval
+	runInterval := func(perSec float64) time.Duration {
+		e.currentCounts = map[string]float64{"key": perSec * interval.Seconds()}
+		e.updateMaps()
+		interval = e.nextInterval()
+		return interval
+	}
+
+	// the first interval has nothing to compare against
+	assert.Equal(t, 8*time.Second, runInterval(100))
+	// volatile traffic shortens the interval down to the floor
+	assert.Equal(t, 4*time.Second, runInterval(500))
+	assert.Equal(t, 2*time.Second, runInterval(50))
+	assert.Equal(t, 1*time.Second, runInterval(1000))
+	assert.Equal(t, 1*time.Second, runInterval(100))
+	assert.Equal(t, int64(1000), e.GetMetrics("")["interval_ms"])
+	// stable traffic lengthens it back up to AdjustmentInterval
+	assert.Equal(t, 2*time.Second, runInterval(100))
+	assert.Equal(t, 4*time.Second, runInterval(110))
+	assert.Equal(t, 8*time.Second, runInterval(100))
+	assert.Equal(t, 8*time.Second, runInterval(100))
+	// an interval without traffic leaves it alone
+	e.currentCounts = map[string]float64{}
+	e.updateMaps()
+	assert.Equal(t, 8*time.Second, e.nextInterval())
+}
+
+func TestEMAThroughputAdaptiveIntervalGoal(t *testing.T) {
+	e := &EMAThroughput{
+		AdjustmentInterval:   8 * time.Second,
+		AdaptiveInterval:     true,
+		GoalThroughputPerSec: 100,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		movingAverage:        map[string]float64{},
+	}
+	// the interval has been shortened to a quarter of AdjustmentInterval, so
+	// each interval's counts cover 2 seconds
+	e.adaptive.current = 2 * time.Second
+	perSec := map[string]float64{"a": 1000, "b": 500, "c": 100, "d": 10}
+	for i := 0; i < 20; i++ {
+		e.currentCounts = map[string]float64{}
+		for key, n := range perSec {
+			e.currentCounts[key] = n * 2
+		}
+		e.updateMaps()
+	}
+	var keptPerSec float64
+	for key, n := range perSec {
+		keptPerSec += n / float64(e.GetSampleRate(key))
+	}
+	assert.InDelta(t, 100, keptPerSec, 20)
+}
+
+func TestEMAThroughputBurstAcrossIntervals(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+
+	e := &EMAThroughput{
+		AdjustmentInterval:   time.Second,
+		GoalThroughputPerSec: 100,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		BurstMultiple:        1,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{"foo": 2000},
+	}
+	e.GetSampleRate("warmup")
+	// a burst starts near the end of one interval...
+	clock.advance(900 * time.Millisecond)
+	e.GetSampleRateMulti("bar", 600)
+	e.updateMaps()
+	// 1000 for foo, 300 for bar, and 0.5 for warmup, which counts as 1
+	assert.Equal(t, float64(1301), e.burstThreshold)
+	assert.Equal(t, int64(0), e.burstCount)
+
+	// ...and carries on into the next, where it is still detected even though
+	// neither interval saw enough events on its own
+	clock.advance(200 * time.Millisecond)
+	e.GetSampleRateMulti("bar", 800)
+	assert.Equal(t, int64(1), e.burstCount)
+	assert.Equal(t, float64(0), e.currentBurstSum)
+
+	// the same events spread over more than an interval are not a burst
+	clock.advance(200 * time.Millisecond)
+	e.GetSampleRateMulti("bar", 600)
+	clock.advance(1100 * time.Millisecond)
+	e.GetSampleRateMulti("bar", 800)
+	assert.Equal(t, int64(1), e.burstCount)
+	assert.Equal(t, float64(800), e.currentBurstSum)
+}
+
+func TestEMAThroughputAdaptiveIntervalBurst(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+
+	e := &EMAThroughput{
+		AdjustmentInterval:   8 * time.Second,
+		AdaptiveInterval:     true,
+		GoalThroughputPerSec: 100,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		BurstMultiple:        2,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{"key": 2000},
+	}
+	// the interval has been shortened to a quarter of AdjustmentInterval, and
+	// the moving average has settled on its traffic
+	e.adaptive.current = 2 * time.Second
+	// steady traffic of 1000 events a second is never a burst
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 20; j++ {
+			clock.advance(100 * time.Millisecond)
+			e.GetSampleRateMulti("key", 100)
+		}
+		e.updateMaps()
+	}
+	assert.Equal(t, int64(0), e.GetMetrics("")["burst_count"])
+
+	// but twice that over the length of the shortened interval is
+	for j := 0; j < 20; j++ {
+		clock.advance(50 * time.Millisecond)
+		e.GetSampleRateMulti("key", 200)
+	}
+	assert.Equal(t, int64(1), e.GetMetrics("")["burst_count"])
+}
+
+func TestEMAThroughputRecentBursts(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+
+	e := &EMAThroughput{
+		AdjustmentInterval: time.Second,
+		BurstMultiple:      2,
+		currentCounts:      map[string]float64{},
+		movingAverage:      map[string]float64{"foo": 500},
+		burstThreshold:     1000,
+	}
+	assert.Empty(t, e.RecentBursts())
+
+	e.GetSampleRateMulti("foo", 400)
+	assert.Empty(t, e.RecentBursts())
+	clock.advance(100 * time.Millisecond)
+	e.GetSampleRateMulti("foo", 700)
+	assert.Equal(t, int64(1), e.burstCount)
+	assert.Equal(t, []BurstEvent{{Time: clock.Now(), Sum: 1100, Threshold: 1000}}, e.RecentBursts())
+	// reading the bursts clears them
+	assert.Empty(t, e.RecentBursts())
+
+	// only the most recent are kept
+	for i := 0; i < burstLogSize+10; i++ {
+		clock.advance(time.Millisecond)
+		e.GetSampleRateMulti("foo", 1000+i)
+	}
+	bursts := e.RecentBursts()
+	assert.Len(t, bursts, burstLogSize)
+	assert.Equal(t, float64(1010), bursts[0].Sum)
+	assert.Equal(t, float64(1000+burstLogSize+9), bursts[burstLogSize-1].Sum)
+}
+
+func TestEMAThroughputResetKey(t *testing.T) {
+	e := &EMAThroughput{
+		currentCounts:    map[string]float64{"stuck": 5, "fine": 5},
+		savedSampleRates: map[string]int{"stuck": 40, "fine": 8},
+		movingAverage:    map[string]float64{"stuck": 400, "fine": 80},
+		haveData:         true,
+	}
+	e.ResetKey("stuck")
+	assert.Equal(t, 1, e.GetSampleRate("stuck"))
+	assert.Equal(t, 8, e.GetSampleRate("fine"))
+	assert.Equal(t, map[string]float64{"fine": 80}, e.movingAverage)
+	assert.Equal(t, map[string]int{"fine": 8}, e.savedSampleRates)
+}
+
+// Two samplers given the same counts end up with exactly the same state, no
+// matter what order their maps happen to be iterated in.
+func TestEMAThroughputDeterministic(t *testing.T) {
+	run := func() *EMAThroughput {
+		e := &EMAThroughput{
+			GoalThroughputPerSec: 50,
+			AdjustmentInterval:   time.Second,
+			Weight:               0.3,
+			AgeOutValue:          0.3,
+			movingAverage:        map[string]float64{},
+		}
+		r := mrand.New(mrand.NewSource(42))
+		for interval := 0; interval < 10; interval++ {
+			e.currentCounts = map[string]float64{}
+			for i := 0; i < 500; i++ {
+				e.currentCounts["key"+strconv.Itoa(r.Intn(200))] += r.Float64() * 100
+			}
+			e.updateMaps()
+		}
+		return e
+	}
+	first, second := run(), run()
+	assert.Equal(t, first.movingAverage, second.movingAverage)
+	assert.Equal(t, first.savedSampleRates, second.savedSampleRates)
+}
+
+func TestEMAThroughputFreeze(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		AdjustmentInterval:   time.Second,
+		Weight:               0.5,
+		AgeOutValue:          0.5,
+		currentCounts:        map[string]float64{},
+		savedSampleRates:     map[string]int{"busy": 20, "quiet": 2},
+		movingAverage:        map[string]float64{"busy": 1000, "quiet": 10},
+		haveData:             true,
+	}
+	e.Freeze()
+	e.GetSampleRateMulti("quiet", 5000)
+	e.updateMaps()
+	assert.Equal(t, map[string]int{"busy": 20, "quiet": 2}, e.savedSampleRates)
+	assert.Equal(t, map[string]float64{"busy": 1000, "quiet": 10}, e.movingAverage)
+	assert.Empty(t, e.currentCounts)
+
+	// a burst while frozen isn't detected
+	e.burstThreshold = 100
+	e.GetSampleRateMulti("quiet", 5000)
+	assert.Equal(t, int64(0), e.GetMetrics("")["burst_count"])
+	assert.Empty(t, e.RecentBursts())
+	e.updateMaps()
+
+	e.Unfreeze()
+	e.GetSampleRateMulti("quiet", 5000)
+	e.updateMaps()
+	assert.NotEqual(t, 2, e.savedSampleRates["quiet"])
+}
+
+// When a dominant key disappears, VanishedKeyWeight gives its share of the
+// budget to the remaining keys sooner.
+func TestEMAThroughputVanishedKeyWeight(t *testing.T) {
+	ratesAfterVanishing := func(vanishedWeight float64) map[string]int {
+		e := &EMAThroughput{
+			GoalThroughputPerSec: 10,
+			AdjustmentInterval:   time.Second,
+			Weight:               0.2,
+			VanishedKeyWeight:    vanishedWeight,
+			AgeOutValue:          0.5,
+			movingAverage:        map[string]float64{},
+		}
+		for i := 0; i < 20; i++ {
+			e.currentCounts = map[string]float64{"dominant": 100000, "a": 1000, "b": 1000}
+			e.updateMaps()
+		}
+		e.currentCounts = map[string]float64{"a": 1000, "b": 1000}
+		e.updateMaps()
+		return e.savedSampleRates
+	}
+	slow := ratesAfterVanishing(0)
+	fast := ratesAfterVanishing(0.9)
+	assert.Less(t, fast["a"], slow["a"])
+	assert.Less(t, fast["b"], slow["b"])
+}
+
+func TestEMAThroughputGoalSchedule(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 21, 59, 0, 0, time.UTC)}
+	defer SetClockForTesting(clock)()
+
+	e := &EMAThroughput{
+		AdjustmentInterval:   10 * time.Second,
+		GoalThroughputPerSec: 10,
+		GoalSchedule:         []GoalWindow{{From: 22 * time.Hour, To: 6 * time.Hour, Goal: 1}},
+		Weight:               1,
+		AgeOutValue:          0.5,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{},
+	}
+	e.currentCounts["a"] = 1000
+	e.updateMaps()
+	assert.Equal(t, 10, e.savedSampleRates["a"])
+
+	// from 10pm the goal drops to 1/s, so the rate goes up tenfold
+	clock.advance(time.Minute)
+	e.currentCounts["a"] = 1000
+	e.updateMaps()
+	assert.Equal(t, 100, e.savedSampleRates["a"])
+}
+
+func TestEMAThroughputAdjustCount(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		MaxKeys:              2,
+		currentCounts:        map[string]float64{},
+	}
+	e.GetSampleRateMulti("batch", 100)
+	e.AdjustCount("batch", -30)
+	e.AdjustCount("late", 5)
+	// MaxKeys is reached, so a new key can't be added
+	e.AdjustCount("full", 5)
+	assert.Equal(t, map[string]float64{"batch": 70, "late": 5}, e.currentCounts)
+	// taking back all of a key's count frees its slot
+	e.AdjustCount("late", -10)
+	e.AdjustCount("full", 5)
+	assert.Equal(t, map[string]float64{"batch": 70, "full": 5}, e.currentCounts)
+	assert.Equal(t, int64(1), e.GetMetrics("")["request_count"])
+}
+
+func TestEMAThroughputAdjustCountGroups(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		CountUnit:            CountUnitGroups,
+		currentCounts:        map[string]float64{},
+	}
+	e.GetSampleRateMulti("trace", 50)
+	e.GetSampleRateMulti("trace", 30)
+	assert.Equal(t, map[string]float64{"trace": 2}, e.currentCounts)
+	// delta counts calls, not the spans in them
+	e.AdjustCount("trace", -1)
+	assert.Equal(t, map[string]float64{"trace": 1}, e.currentCounts)
+}
+
+func TestEMAThroughputSnapshotWhileAgingOut(t *testing.T) {
+	e := &EMAThroughput{
+		GoalThroughputPerSec: 10,
+		AdjustmentInterval:   time.Second,
+		Weight:               0.5,
+		AgeOutValue:          1000,
+		AgeOutGraceIntervals: 2,
+		currentCounts:        map[string]float64{},
+		movingAverage:        map[string]float64{},
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				e.Snapshot()
+			}
+		}
+	}()
+	// each key is busy for a couple of intervals, then ages out
+	for i := 0; i < 50; i++ {
+		e.GetSampleRateMulti("steady", 5000)
+		for j := 0; j < 100; j++ {
+			e.GetSampleRateMulti(strconv.Itoa(i*100+j), 5000)
+			e.GetSampleRateMulti(strconv.Itoa((i+1)*100+j), 5000)
+		}
+		e.updateMaps()
+	}
+	close(done)
+	wg.Wait()
+	assert.NotEmpty(t, e.Snapshot().AgeOutGrace)
+}
+
+func TestEMAThroughputSnapshotRestore(t *testing.T) {
+	newSampler := func() *EMAThroughput {
+		return &EMAThroughput{
+			GoalThroughputPerSec: 10,
+			AdjustmentInterval:   time.Second,
+			Weight:               0.5,
+			AgeOutValue:          0.5,
+			currentCounts:        map[string]float64{},
+			movingAverage:        map[string]float64{},
+		}
+	}
+	active := newSampler()
+	active.GetSampleRateMulti("busy", 1000)
+	active.GetSampleRateMulti("quiet", 10)
+	active.updateMaps()
+	active.GetSampleRateMulti("busy", 400)
+
+	standby := newSampler()
+	assert.NoError(t, standby.Restore(active.Snapshot()))
+	assert.Equal(t, active.Snapshot(), standby.Snapshot())
+	for _, s := range []*EMAThroughput{active, standby} {
+		s.GetSampleRateMulti("busy", 2000)
+		s.updateMaps()
+	}
+	assert.Equal(t, active.GetAllSampleRates(), standby.GetAllSampleRates())
+
+	assert.Error(t, newSampler().Restore(Snapshot{Sampler: stateSamplerEMAThroughput}))
+}
+
+func TestEMAThroughputLockContention(t *testing.T) {
+	e := &EMAThroughput{NoBackgroundGoroutine: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	e.GetSampleRate("key")
+	assert.NotContains(t, e.GetMetrics(""), "lock_wait_micros_count", "not tracked by default")
+
+	e = &EMAThroughput{NoBackgroundGoroutine: true, TrackLockContention: true}
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	e.GetSampleRate("key")
+	assert.Equal(t, int64(0), e.GetMetrics("")["lock_wait_micros_count"], "no contention yet")
+
+	// hold the lock while another caller waits for it. If the caller hasn't
+	// reached the lock by the time it is let go, there was no wait to
+	// measure, so try again.
+	assert.Eventually(t, func() bool {
+		e.lock.Lock()
+		done := make(chan struct{})
+		go func() {
+			e.GetSampleRate("key")
+			close(done)
+		}()
+		time.Sleep(time.Millisecond)
+		e.lock.Unlock()
+		<-done
+		return e.GetMetrics("")["lock_wait_micros_count"] > 0
+	}, 5*time.Second, time.Millisecond)
+}
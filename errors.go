@@ -0,0 +1,66 @@
+package dynsampler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// These errors are returned (wrapped in a more specific message) by Validate
+// and Start when a sampler is misconfigured. Use errors.Is
+// to check for them.
+var (
+	// ErrConflictingIntervalConfig means both a deprecated integer-seconds
+	// interval and its time.Duration replacement were set.
+	ErrConflictingIntervalConfig = errors.New("conflicting interval configuration")
+	// ErrInvalidInterval means an interval or duration is negative or too short.
+	ErrInvalidInterval = errors.New("invalid interval")
+	// ErrInvalidGoal means a goal sample rate or throughput is negative.
+	ErrInvalidGoal = errors.New("invalid goal")
+	// ErrInvalidWeight means an EMA weight is outside the range 0 to 1.
+	ErrInvalidWeight = errors.New("invalid weight")
+	// ErrInvalidThreshold means a threshold such as AgeOutValue or
+	// MinEventsPerSec is negative.
+	ErrInvalidThreshold = errors.New("invalid threshold")
+	// ErrInvalidSampleRate means a configured sample rate is negative.
+	ErrInvalidSampleRate = errors.New("invalid sample rate")
+)
+
+// ErrKeyTooLong means a key was longer than a sampler's MaxKeyLength. It isn't
+// a configuration problem: it is reported, wrapped, by OversizeKeyError rather
+// than by Validate or Start.
+var ErrKeyTooLong = errors.New("key too long")
+
+// MinInterval is the shortest interval any sampler will recalculate or clear
+// on. Start returns ErrInvalidInterval if an interval, once defaults and
+// deprecated fields have been applied, is shorter than this, including when it
+// is zero or negative because a deprecated seconds field overflowed.
+const MinInterval = time.Millisecond
+
+// checkInterval returns an error if d, an interval named name that has been
+// resolved from its configuration, is too short to run a ticker on.
+func checkInterval(name string, d time.Duration) error {
+	if d < MinInterval {
+		return newConfigError(ErrInvalidInterval, "the %s %v must be at least %v", name, d, MinInterval)
+	}
+	return nil
+}
+
+// configError carries a human-readable description of a configuration problem
+// while matching one of the sentinel errors above with errors.Is.
+type configError struct {
+	kind error
+	msg  string
+}
+
+func newConfigError(kind error, format string, args ...interface{}) error {
+	return configError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e configError) Error() string {
+	return e.msg
+}
+
+func (e configError) Unwrap() error {
+	return e.kind
+}
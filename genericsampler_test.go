@@ -1,7 +1,16 @@
 package dynsampler_test
 
 import (
+	"encoding/json"
+	"errors"
 	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -113,3 +122,713 @@ func TestGenericSamplerBehavior(t *testing.T) {
 		})
 	}
 }
+
+// Every sampler can check its configuration without being started.
+func TestSamplerValidate(t *testing.T) {
+	type validator interface {
+		Validate() error
+	}
+	tests := []struct {
+		name    string
+		sampler validator
+		wantErr error
+	}{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{}, nil},
+		{"AvgSampleRate both intervals", &dynsampler.AvgSampleRate{ClearFrequencySec: 1, ClearFrequencyDuration: time.Second}, dynsampler.ErrConflictingIntervalConfig},
+		{"AvgSampleRate negative goal", &dynsampler.AvgSampleRate{GoalSampleRate: -1}, dynsampler.ErrInvalidGoal},
+		{"AvgSampleRate negative unknown key rate", &dynsampler.AvgSampleRate{UnknownKeyRate: -1}, dynsampler.ErrInvalidSampleRate},
+		{"AvgSampleRate negative target", &dynsampler.AvgSampleRate{TargetKeptPerInterval: -1}, dynsampler.ErrInvalidGoal},
+		{"AvgSampleRate key min above max", &dynsampler.AvgSampleRate{KeyConstraints: map[string]dynsampler.KeyConstraint{"a": {Min: 10, Max: 5}}}, dynsampler.ErrInvalidSampleRate},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{}, nil},
+		{"AvgSampleWithMin negative min", &dynsampler.AvgSampleWithMin{MinEventsPerSec: -1}, dynsampler.ErrInvalidThreshold},
+		{"BackoffSampler", &dynsampler.BackoffSampler{}, nil},
+		{"BackoffSampler negative max rate", &dynsampler.BackoffSampler{MaxSampleRate: -1}, dynsampler.ErrInvalidSampleRate},
+		{"EMASampleRate", &dynsampler.EMASampleRate{}, nil},
+		{"EMASampleRate both intervals", &dynsampler.EMASampleRate{AdjustmentInterval: 1, AdjustmentIntervalDuration: time.Second}, dynsampler.ErrConflictingIntervalConfig},
+		{"EMASampleRate adaptive floor not below interval", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: time.Second, MinAdjustmentInterval: time.Second, AdaptiveInterval: true}, dynsampler.ErrInvalidInterval},
+		{"EMASampleRate adaptive floor above default interval", &dynsampler.EMASampleRate{MinAdjustmentInterval: time.Minute, AdaptiveInterval: true}, dynsampler.ErrInvalidInterval},
+		{"EMASampleRate bad weight", &dynsampler.EMASampleRate{Weight: 1.5}, dynsampler.ErrInvalidWeight},
+		{"EMASampleRate negative unknown key rate", &dynsampler.EMASampleRate{UnknownKeyRate: -1}, dynsampler.ErrInvalidSampleRate},
+		{"EMASampleRate negative key max", &dynsampler.EMASampleRate{KeyConstraints: map[string]dynsampler.KeyConstraint{"a": {Max: -1}}}, dynsampler.ErrInvalidSampleRate},
+		{"EMASampleRate negative noise prefix", &dynsampler.EMASampleRate{NoiseDetectionPrefixLen: -1}, dynsampler.ErrInvalidThreshold},
+		{"EMASampleRate negative convergence threshold", &dynsampler.EMASampleRate{ConvergenceThreshold: -0.1}, dynsampler.ErrInvalidThreshold},
+		{"EMASampleRate negative max delta", &dynsampler.EMASampleRate{MaxDeltaPerInterval: -0.5}, dynsampler.ErrInvalidThreshold},
+		{"EMAThroughput", &dynsampler.EMAThroughput{}, nil},
+		{"EMAThroughput short interval", &dynsampler.EMAThroughput{AdjustmentInterval: time.Microsecond}, dynsampler.ErrInvalidInterval},
+		{"EMAThroughput adaptive floor above interval", &dynsampler.EMAThroughput{AdjustmentInterval: time.Second, MinAdjustmentInterval: 2 * time.Second, AdaptiveInterval: true}, dynsampler.ErrInvalidInterval},
+		{"EMAThroughput negative goal", &dynsampler.EMAThroughput{GoalThroughputPerSec: -5}, dynsampler.ErrInvalidGoal},
+		{"EMAThroughput negative max rate", &dynsampler.EMAThroughput{MaxSampleRate: -1}, dynsampler.ErrInvalidSampleRate},
+		{"EMAThroughput bad vanished key weight", &dynsampler.EMAThroughput{VanishedKeyWeight: 2}, dynsampler.ErrInvalidWeight},
+		{"EMAThroughput negative convergence threshold", &dynsampler.EMAThroughput{ConvergenceThreshold: -0.1}, dynsampler.ErrInvalidThreshold},
+		{"EMAThroughput negative log sum floor", &dynsampler.EMAThroughput{MinLogSum: -1}, dynsampler.ErrInvalidThreshold},
+		{"EMAThroughput negative max delta", &dynsampler.EMAThroughput{MaxDeltaPerInterval: -0.5}, dynsampler.ErrInvalidThreshold},
+		{"OnlyOnce", &dynsampler.OnlyOnce{ClearFrequencySec: -1}, nil},
+		{"OnlyOnce both intervals", &dynsampler.OnlyOnce{ClearFrequencySec: 1, ClearFrequencyDuration: time.Second}, dynsampler.ErrConflictingIntervalConfig},
+		{"OnlyOnce negative resuppress", &dynsampler.OnlyOnce{ResuppressAfter: -1}, dynsampler.ErrInvalidThreshold},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{}, nil},
+		{"PerKeyThroughput negative goal", &dynsampler.PerKeyThroughput{PerKeyThroughputPerSec: -1}, dynsampler.ErrInvalidGoal},
+		{"PerKeyThroughput negative TTL", &dynsampler.PerKeyThroughput{KeyTTL: -time.Second}, dynsampler.ErrInvalidInterval},
+		{"PerKeyTotalThroughput", &dynsampler.PerKeyTotalThroughput{}, nil},
+		{"PerKeyTotalThroughput negative goal", &dynsampler.PerKeyTotalThroughput{GoalThroughputPerSec: -1}, dynsampler.ErrInvalidGoal},
+		{"ShardedSampler", &dynsampler.ShardedSampler{Sampler: &dynsampler.Static{}, ShardIndex: 1, ShardCount: 2}, nil},
+		{"ShardedSampler index out of range", &dynsampler.ShardedSampler{Sampler: &dynsampler.Static{}, ShardIndex: 2, ShardCount: 2}, dynsampler.ErrInvalidThreshold},
+		{"ShardedSampler negative count", &dynsampler.ShardedSampler{Sampler: &dynsampler.Static{}, ShardCount: -1}, dynsampler.ErrInvalidThreshold},
+		{"SketchThroughput", &dynsampler.SketchThroughput{}, nil},
+		{"SketchThroughput negative width", &dynsampler.SketchThroughput{SketchWidth: -1}, dynsampler.ErrInvalidThreshold},
+		{"Static", &dynsampler.Static{Rates: map[string]int{"a": 2}}, nil},
+		{"Static negative rate", &dynsampler.Static{Rates: map[string]int{"a": -2}}, dynsampler.ErrInvalidSampleRate},
+		{"StrictBudgetSampler", &dynsampler.StrictBudgetSampler{}, nil},
+		{"StrictBudgetSampler negative budget", &dynsampler.StrictBudgetSampler{BudgetPerInterval: -1}, dynsampler.ErrInvalidGoal},
+		{"TotalThroughput", &dynsampler.TotalThroughput{}, nil},
+		{"TotalThroughput negative budget", &dynsampler.TotalThroughput{HardKeptBudgetPerInterval: -1}, dynsampler.ErrInvalidGoal},
+		{"TotalThroughput negative heavy threshold", &dynsampler.TotalThroughput{HeavySampleThreshold: -1}, dynsampler.ErrInvalidThreshold},
+		{"TotalThroughput negative interval", &dynsampler.TotalThroughput{ClearFrequencyDuration: -time.Second}, dynsampler.ErrInvalidInterval},
+		{"TotalThroughput negative TTL", &dynsampler.TotalThroughput{KeyTTL: -time.Second}, dynsampler.ErrInvalidInterval},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{}, nil},
+		{"WindowedThroughput negative goal", &dynsampler.WindowedThroughput{GoalThroughputPerSec: -1}, dynsampler.ErrInvalidGoal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sampler.Validate()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Every sampler that runs on a ticker refuses to start with an interval that is
+// too short once it has been resolved, whether it was set too short or a
+// deprecated seconds field overflowed.
+func TestStartRejectsShortIntervals(t *testing.T) {
+	const overflowSec = math.MaxInt64/int(time.Second) + 1
+	tests := []struct {
+		name    string
+		sampler dynsampler.Sampler
+	}{
+		{"AvgSampleRate short", &dynsampler.AvgSampleRate{ClearFrequencyDuration: time.Microsecond}},
+		{"AvgSampleRate overflow", &dynsampler.AvgSampleRate{ClearFrequencySec: overflowSec}},
+		{"AvgSampleWithMin short", &dynsampler.AvgSampleWithMin{ClearFrequencyDuration: time.Microsecond}},
+		{"AvgSampleWithMin overflow", &dynsampler.AvgSampleWithMin{ClearFrequencySec: overflowSec}},
+		{"BackoffSampler short", &dynsampler.BackoffSampler{ClearFrequencyDuration: time.Microsecond}},
+		{"EMASampleRate short", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: time.Microsecond}},
+		{"EMASampleRate overflow", &dynsampler.EMASampleRate{AdjustmentInterval: overflowSec}},
+		{"EMASampleRate short adaptive floor", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: 2 * time.Millisecond, AdaptiveInterval: true}},
+		{"EMAThroughput short adaptive floor", &dynsampler.EMAThroughput{AdjustmentInterval: 2 * time.Millisecond, AdaptiveInterval: true}},
+		{"HybridSampler short", &dynsampler.HybridSampler{ClearFrequencyDuration: time.Microsecond}},
+		{"OnlyOnce short", &dynsampler.OnlyOnce{ClearFrequencyDuration: time.Microsecond}},
+		{"PerKeyThroughput short", &dynsampler.PerKeyThroughput{ClearFrequencyDuration: time.Microsecond}},
+		{"PerKeyThroughput overflow", &dynsampler.PerKeyThroughput{ClearFrequencySec: overflowSec}},
+		{"PerKeyTotalThroughput short", &dynsampler.PerKeyTotalThroughput{ClearFrequencyDuration: time.Microsecond}},
+		{"SketchThroughput short", &dynsampler.SketchThroughput{ClearFrequencyDuration: time.Microsecond}},
+		{"StrictBudgetSampler short", &dynsampler.StrictBudgetSampler{ClearFrequencyDuration: time.Microsecond}},
+		{"TotalThroughput short", &dynsampler.TotalThroughput{ClearFrequencyDuration: time.Microsecond}},
+		{"TotalThroughput overflow", &dynsampler.TotalThroughput{ClearFrequencySec: overflowSec}},
+		{"WindowedThroughput short", &dynsampler.WindowedThroughput{UpdateFrequencyDuration: time.Microsecond}},
+		{"WindowedThroughput lookback shorter than update", &dynsampler.WindowedThroughput{
+			UpdateFrequencyDuration:   time.Second,
+			LookbackFrequencyDuration: time.Millisecond,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sampler.Start()
+			if err == nil {
+				tt.sampler.Stop()
+			}
+			if !errors.Is(err, dynsampler.ErrInvalidInterval) {
+				t.Errorf("Start() error = %v, want %v", err, dynsampler.ErrInvalidInterval)
+			}
+		})
+	}
+}
+
+// Every sampler accepts 64-bit counts without narrowing them in its metrics,
+// and counts calls and events separately.
+func TestGetSampleRateMulti64(t *testing.T) {
+	type multi64 interface {
+		dynsampler.Sampler
+		GetSampleRateMulti64(key string, count int64) int
+	}
+	samplers := []multi64{
+		&dynsampler.AvgSampleRate{},
+		&dynsampler.AvgSampleWithMin{},
+		&dynsampler.BackoffSampler{},
+		&dynsampler.EMASampleRate{},
+		&dynsampler.EMAThroughput{},
+		&dynsampler.HybridSampler{},
+		&dynsampler.OnlyOnce{},
+		&dynsampler.PerKeyThroughput{},
+		&dynsampler.PerKeyTotalThroughput{},
+		&dynsampler.RemoteRateSampler{},
+		&dynsampler.SketchThroughput{},
+		&dynsampler.Static{},
+		&dynsampler.StrictBudgetSampler{},
+		&dynsampler.TotalThroughput{},
+		&dynsampler.WindowedThroughput{},
+	}
+	const big = int64(math.MaxInt32) + 10
+	for _, s := range samplers {
+		if err := s.Start(); err != nil {
+			t.Fatalf("%T: %v starting sampler", s, err)
+		}
+		if rate := s.GetSampleRateMulti64("key", big); rate < 0 {
+			t.Errorf("%T: got negative rate %d", s, rate)
+		}
+		s.GetSampleRateMulti("key", 5)
+		if got := s.GetMetrics("")["event_count"]; got != big+5 {
+			t.Errorf("%T: event_count = %d, want %d", s, got, big+5)
+		}
+		if got := s.GetMetrics("")["request_count"]; got != 2 {
+			t.Errorf("%T: request_count = %d, want 2", s, got)
+		}
+		s.Stop()
+	}
+}
+
+// Every sampler reports the same metrics typed and untyped, and only counters
+// have names ending in "_count".
+func TestGetMetricsTyped(t *testing.T) {
+	type typedMetrics interface {
+		dynsampler.Sampler
+		GetMetricsTyped(prefix string) map[string]dynsampler.Metric
+	}
+	samplers := []typedMetrics{
+		&dynsampler.AvgSampleRate{},
+		&dynsampler.AvgSampleWithMin{},
+		&dynsampler.BackoffSampler{},
+		&dynsampler.EMASampleRate{},
+		&dynsampler.EMAThroughput{},
+		&dynsampler.HybridSampler{},
+		&dynsampler.MaxRuleSampler{Samplers: []dynsampler.Sampler{&dynsampler.Static{}}},
+		&dynsampler.OnlyOnce{},
+		&dynsampler.PerKeyThroughput{},
+		&dynsampler.PerKeyTotalThroughput{},
+		&dynsampler.RemoteRateSampler{},
+		&dynsampler.ShardedSampler{Sampler: &dynsampler.Static{}},
+		&dynsampler.SketchThroughput{},
+		&dynsampler.Static{},
+		&dynsampler.StrictBudgetSampler{},
+		&dynsampler.TotalThroughput{},
+		&dynsampler.WindowedThroughput{},
+	}
+	for _, s := range samplers {
+		if err := s.Start(); err != nil {
+			t.Fatalf("%T: %v starting sampler", s, err)
+		}
+		s.GetSampleRateMulti("key", 5)
+		typed := s.GetMetricsTyped("p_")
+		mets := s.GetMetrics("p_")
+		if len(typed) != len(mets) {
+			t.Errorf("%T: %d typed metrics, %d untyped", s, len(typed), len(mets))
+		}
+		for name, m := range typed {
+			if mets[name] != m.Value {
+				t.Errorf("%T: %s = %d typed, %d untyped", s, name, m.Value, mets[name])
+			}
+			wantKind := dynsampler.MetricGauge
+			if strings.HasSuffix(name, "_count") {
+				wantKind = dynsampler.MetricCounter
+			}
+			if m.Kind != wantKind {
+				t.Errorf("%T: %s is a %v, want %v", s, name, m.Kind, wantKind)
+			}
+		}
+		if got := typed["p_event_count"]; got != (dynsampler.Metric{Value: 5, Kind: dynsampler.MetricCounter}) {
+			t.Errorf("%T: p_event_count = %+v", s, got)
+		}
+		s.Stop()
+	}
+}
+
+// zipfKeys returns n keys drawn from a zipfian distribution over numKeys
+// distinct keys, so that a few keys are very common and most are rare, the
+// way real traffic usually looks. The seed is fixed so runs are comparable.
+func zipfKeys(n, numKeys int) []string {
+	names := make([]string, numKeys)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	z := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, uint64(numKeys-1))
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = names[z.Uint64()]
+	}
+	return keys
+}
+
+// TestGetSampleRateBeforeStart checks that every sampler can be asked for a
+// rate before it is started, without panicking, and gives a rate of 1.
+func TestGetSampleRateBeforeStart(t *testing.T) {
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{}},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{}},
+		{"BackoffSampler", &dynsampler.BackoffSampler{}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{}},
+		{"HybridSampler", &dynsampler.HybridSampler{}},
+		{"MaxRuleSampler", &dynsampler.MaxRuleSampler{Samplers: []dynsampler.Sampler{&dynsampler.TotalThroughput{}}}},
+		{"OnlyOnce", &dynsampler.OnlyOnce{}},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{}},
+		{"PerKeyTotalThroughput", &dynsampler.PerKeyTotalThroughput{}},
+		{"RemoteRateSampler", &dynsampler.RemoteRateSampler{}},
+		{"SketchThroughput", &dynsampler.SketchThroughput{}},
+		{"ShardedSampler", &dynsampler.ShardedSampler{Sampler: &dynsampler.TotalThroughput{}, ShardCount: 2}},
+		{"Static", &dynsampler.Static{}},
+		{"StrictBudgetSampler", &dynsampler.StrictBudgetSampler{}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{}},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{}},
+	}
+	for _, ns := range samplers {
+		t.Run(ns.name, func(t *testing.T) {
+			if rate := ns.sampler.GetSampleRateMulti("key", 10); rate != 1 {
+				t.Errorf("GetSampleRateMulti() before Start = %d, want 1", rate)
+			}
+			ns.sampler.GetMetrics("")
+			if err := ns.sampler.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer ns.sampler.Stop()
+			ns.sampler.GetSampleRateMulti("key", 10)
+		})
+	}
+}
+
+// With NoBackgroundGoroutine set, Start must not launch anything, and the
+// caller drives the sampler with Update.
+func TestNoBackgroundGoroutine(t *testing.T) {
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{NoBackgroundGoroutine: true}},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{NoBackgroundGoroutine: true}},
+		{"BackoffSampler", &dynsampler.BackoffSampler{NoBackgroundGoroutine: true}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{NoBackgroundGoroutine: true}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{NoBackgroundGoroutine: true}},
+		{"HybridSampler", &dynsampler.HybridSampler{NoBackgroundGoroutine: true}},
+		{"OnlyOnce", &dynsampler.OnlyOnce{NoBackgroundGoroutine: true}},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{NoBackgroundGoroutine: true}},
+		{"PerKeyTotalThroughput", &dynsampler.PerKeyTotalThroughput{NoBackgroundGoroutine: true}},
+		{"SketchThroughput", &dynsampler.SketchThroughput{NoBackgroundGoroutine: true}},
+		{"StrictBudgetSampler", &dynsampler.StrictBudgetSampler{NoBackgroundGoroutine: true}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{NoBackgroundGoroutine: true}},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{NoBackgroundGoroutine: true}},
+	}
+	for _, ns := range samplers {
+		t.Run(ns.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			if err := ns.sampler.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer ns.sampler.Stop()
+			if after := runtime.NumGoroutine(); after > before {
+				t.Errorf("Start launched %d goroutines, want 0", after-before)
+			}
+			for i := 0; i < 100; i++ {
+				ns.sampler.GetSampleRateMulti("key"+strconv.Itoa(i%10), 10)
+			}
+			u, ok := ns.sampler.(interface{ Update() })
+			if !ok {
+				t.Fatalf("%T has no Update method", ns.sampler)
+			}
+			u.Update()
+			ns.sampler.GetSampleRateMulti("key0", 10)
+		})
+	}
+}
+
+// SaveState marshals a copy of the sampler's maps outside its lock, so it must
+// be safe to call while the maps are being changed. Run with -race.
+func TestSaveStateWhileSampling(t *testing.T) {
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{NoBackgroundGoroutine: true}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{NoBackgroundGoroutine: true}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{NoBackgroundGoroutine: true}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{NoBackgroundGoroutine: true}},
+	}
+	for _, ns := range samplers {
+		t.Run(ns.name, func(t *testing.T) {
+			s := ns.sampler
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			update := s.(interface{ Update() })
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+						s.GetSampleRateMulti("key"+strconv.Itoa(i%500), i%10+1)
+						if i%50 == 0 {
+							update.Update()
+						}
+					}
+				}
+			}()
+			for i := 0; i < 50; i++ {
+				state, err := s.SaveState()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decoded map[string]interface{}
+				if err := json.Unmarshal(state, &decoded); err != nil {
+					t.Fatalf("SaveState() returned invalid JSON: %v", err)
+				}
+			}
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestSupportsState(t *testing.T) {
+	tsts := []struct {
+		name    string
+		sampler dynsampler.Sampler
+		want    bool
+	}{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{}, true},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{}, false},
+		{"BackoffSampler", &dynsampler.BackoffSampler{}, false},
+		{"EMASampleRate", &dynsampler.EMASampleRate{}, true},
+		{"EMAThroughput", &dynsampler.EMAThroughput{}, true},
+		{"HybridSampler", &dynsampler.HybridSampler{}, false},
+		{"MaxRuleSampler with state", &dynsampler.MaxRuleSampler{Samplers: []dynsampler.Sampler{&dynsampler.Static{}, &dynsampler.EMAThroughput{}}}, true},
+		{"MaxRuleSampler without state", &dynsampler.MaxRuleSampler{Samplers: []dynsampler.Sampler{&dynsampler.Static{}}}, false},
+		{"OnlyOnce", &dynsampler.OnlyOnce{}, false},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{}, false},
+		{"PerKeyTotalThroughput", &dynsampler.PerKeyTotalThroughput{}, false},
+		{"RemoteRateSampler", &dynsampler.RemoteRateSampler{}, false},
+		{"SketchThroughput", &dynsampler.SketchThroughput{}, false},
+		{"ShardedSampler", &dynsampler.ShardedSampler{Sampler: &dynsampler.EMAThroughput{}}, true},
+		{"Static", &dynsampler.Static{}, false},
+		{"StrictBudgetSampler", &dynsampler.StrictBudgetSampler{}, false},
+		{"TotalThroughput", &dynsampler.TotalThroughput{}, true},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{}, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			if got := tst.sampler.SupportsState(); got != tst.want {
+				t.Errorf("SupportsState() = %v, want %v", got, tst.want)
+			}
+			if tst.want {
+				return
+			}
+			// a sampler without state must not return any
+			if err := tst.sampler.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer tst.sampler.Stop()
+			tst.sampler.GetSampleRate("key")
+			if state, err := tst.sampler.SaveState(); err != nil || len(state) > 0 {
+				t.Errorf("SaveState() = %q, %v, want no state", state, err)
+			}
+		})
+	}
+}
+
+// PeekSampleRate must return the rate GetSampleRate would, without changing
+// anything GetSampleRate counts.
+func TestPeekSampleRate(t *testing.T) {
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{NoBackgroundGoroutine: true}},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{NoBackgroundGoroutine: true}},
+		{"BackoffSampler", &dynsampler.BackoffSampler{NoBackgroundGoroutine: true}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{NoBackgroundGoroutine: true}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{NoBackgroundGoroutine: true}},
+		{"HybridSampler", &dynsampler.HybridSampler{NoBackgroundGoroutine: true}},
+		{"MaxRuleSampler", &dynsampler.MaxRuleSampler{Samplers: []dynsampler.Sampler{&dynsampler.TotalThroughput{NoBackgroundGoroutine: true}}}},
+		{"OnlyOnce", &dynsampler.OnlyOnce{NoBackgroundGoroutine: true}},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{NoBackgroundGoroutine: true}},
+		{"PerKeyTotalThroughput", &dynsampler.PerKeyTotalThroughput{NoBackgroundGoroutine: true}},
+		{"RemoteRateSampler", &dynsampler.RemoteRateSampler{Default: 7}},
+		{"SketchThroughput", &dynsampler.SketchThroughput{NoBackgroundGoroutine: true}},
+		{"ShardedSampler", &dynsampler.ShardedSampler{Sampler: &dynsampler.TotalThroughput{NoBackgroundGoroutine: true}, ShardCount: 2}},
+		{"Static", &dynsampler.Static{Rates: map[string]int{"key0": 3}, Default: 7}},
+		{"StrictBudgetSampler", &dynsampler.StrictBudgetSampler{BudgetPerInterval: 50, NoBackgroundGoroutine: true}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{NoBackgroundGoroutine: true}},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{NoBackgroundGoroutine: true}},
+	}
+	for _, ns := range samplers {
+		t.Run(ns.name, func(t *testing.T) {
+			p, ok := ns.sampler.(interface{ PeekSampleRate(string) int })
+			if !ok {
+				t.Fatalf("%T has no PeekSampleRate method", ns.sampler)
+			}
+			if peeked, rate := p.PeekSampleRate("key0"), ns.sampler.GetSampleRate("key0"); peeked != rate {
+				t.Errorf("PeekSampleRate() before Start = %d, but GetSampleRate returned %d", peeked, rate)
+			}
+			if err := ns.sampler.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer ns.sampler.Stop()
+			for i := 0; i < 1000; i++ {
+				ns.sampler.GetSampleRateMulti("key"+strconv.Itoa(i%10), 1+i%100)
+			}
+			if u, ok := ns.sampler.(interface{ Update() }); ok {
+				u.Update()
+			}
+			for i := 0; i < 100; i++ {
+				ns.sampler.GetSampleRate("key" + strconv.Itoa(i%10))
+			}
+
+			for _, key := range []string{"key0", "key9", "unseen"} {
+				before := ns.sampler.GetMetrics("")
+				peeked := p.PeekSampleRate(key)
+				if after := ns.sampler.GetMetrics(""); !reflect.DeepEqual(before, after) {
+					t.Errorf("PeekSampleRate(%q) changed the metrics from %v to %v", key, before, after)
+				}
+				if rate := ns.sampler.GetSampleRate(key); rate != peeked {
+					t.Errorf("PeekSampleRate(%q) = %d, but GetSampleRate returned %d", key, peeked, rate)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGetSampleRateMulti measures the hot path of every sampler with
+// concurrent callers and a realistic spread of keys. The samplers are running,
+// so their background updates contend for the same locks as the callers.
+func BenchmarkGetSampleRateMulti(b *testing.B) {
+	samplers := []struct {
+		name    string
+		sampler dynsampler.Sampler
+	}{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"BackoffSampler", &dynsampler.BackoffSampler{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: 100 * time.Millisecond}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{AdjustmentInterval: 100 * time.Millisecond}},
+		{"HybridSampler", &dynsampler.HybridSampler{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"OnlyOnce", &dynsampler.OnlyOnce{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"RemoteRateSampler", &dynsampler.RemoteRateSampler{}},
+		{"SketchThroughput", &dynsampler.SketchThroughput{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"Static", &dynsampler.Static{Rates: map[string]int{"key0": 10}}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{UpdateFrequencyDuration: 100 * time.Millisecond}},
+	}
+	keys := zipfKeys(1<<16, 10000)
+	for _, bb := range samplers {
+		b.Run(bb.name, func(b *testing.B) {
+			s := bb.sampler
+			if err := s.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer s.Stop()
+			var offset int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// each caller starts at a different place in the keys
+				i := int(atomic.AddInt64(&offset, 7919))
+				for pb.Next() {
+					s.GetSampleRateMulti(keys[i%len(keys)], i%10+1)
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkGetSampleRateMultiWhileScraping is like BenchmarkGetSampleRateMulti,
+// but with a monitoring system reading the sampler's metrics as fast as it can
+// at the same time, to show how much scraping holds up sampling.
+func BenchmarkGetSampleRateMultiWhileScraping(b *testing.B) {
+	samplers := []struct {
+		name    string
+		sampler dynsampler.Sampler
+	}{
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{ClearFrequencyDuration: 100 * time.Millisecond}},
+		{"Static", &dynsampler.Static{Rates: map[string]int{"key0": 10}}},
+	}
+	keys := zipfKeys(1<<16, 10000)
+	for _, bb := range samplers {
+		b.Run(bb.name, func(b *testing.B) {
+			s := bb.sampler
+			if err := s.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer s.Stop()
+
+			done := make(chan struct{})
+			var scrapes sync.WaitGroup
+			scrapes.Add(1)
+			go func() {
+				defer scrapes.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						s.GetMetrics("")
+					}
+				}
+			}()
+
+			var offset int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&offset, 7919))
+				for pb.Next() {
+					s.GetSampleRateMulti(keys[i%len(keys)], i%10+1)
+					i++
+				}
+			})
+			b.StopTimer()
+			close(done)
+			scrapes.Wait()
+		})
+	}
+}
+
+// BenchmarkGetSampleRateWhileSaving measures sampling while state with a large
+// number of keys is saved over and over at the same time. The max-ns/op
+// metric is the longest a single call took, which is about how long SaveState
+// holds the sampler's lock.
+func BenchmarkGetSampleRateWhileSaving(b *testing.B) {
+	const numKeys = 200000
+	rates := make(map[string]int, numKeys)
+	averages := make(map[string]float64, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := "key" + strconv.Itoa(i)
+		rates[key] = i%100 + 1
+		averages[key] = float64(i%1000 + 1)
+	}
+	state, err := json.Marshal(map[string]interface{}{"saved_sample_rates": rates, "moving_average": averages})
+	if err != nil {
+		b.Fatal(err)
+	}
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{ClearFrequencyDuration: time.Hour}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: time.Hour}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{AdjustmentInterval: time.Hour}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{ClearFrequencyDuration: time.Hour}},
+	}
+	for _, ns := range samplers {
+		b.Run(ns.name, func(b *testing.B) {
+			s := ns.sampler
+			if err := s.LoadState(state); err != nil {
+				b.Fatal(err)
+			}
+			if err := s.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer s.Stop()
+
+			done := make(chan struct{})
+			var saves sync.WaitGroup
+			saves.Add(1)
+			go func() {
+				defer saves.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						if _, err := s.SaveState(); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}
+			}()
+
+			var longest int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				s.GetSampleRate("key" + strconv.Itoa(i%numKeys))
+				if d := int64(time.Since(start)); d > longest {
+					longest = d
+				}
+			}
+			b.StopTimer()
+			close(done)
+			saves.Wait()
+			b.ReportMetric(float64(longest), "max-ns/op")
+		})
+	}
+}
+
+// establishedKeySamplers returns one of every sampler, already started, with
+// "key" seen and, where possible, given a sample rate, along with a function
+// that stops them.
+func establishedKeySamplers(tb testing.TB) ([]namedSampler, func()) {
+	samplers := []namedSampler{
+		{"AvgSampleRate", &dynsampler.AvgSampleRate{ClearFrequencyDuration: time.Hour}},
+		{"AvgSampleWithMin", &dynsampler.AvgSampleWithMin{ClearFrequencyDuration: time.Hour}},
+		{"BackoffSampler", &dynsampler.BackoffSampler{ClearFrequencyDuration: time.Hour}},
+		{"EMASampleRate", &dynsampler.EMASampleRate{AdjustmentIntervalDuration: time.Hour}},
+		{"EMAThroughput", &dynsampler.EMAThroughput{AdjustmentInterval: time.Hour}},
+		{"HybridSampler", &dynsampler.HybridSampler{ClearFrequencyDuration: time.Hour}},
+		{"OnlyOnce", &dynsampler.OnlyOnce{ClearFrequencyDuration: time.Hour}},
+		{"PerKeyThroughput", &dynsampler.PerKeyThroughput{ClearFrequencyDuration: time.Hour}},
+		{"RemoteRateSampler", &dynsampler.RemoteRateSampler{}},
+		{"SketchThroughput", &dynsampler.SketchThroughput{ClearFrequencyDuration: time.Hour}},
+		{"Static", &dynsampler.Static{Rates: map[string]int{"key": 10}}},
+		{"TotalThroughput", &dynsampler.TotalThroughput{ClearFrequencyDuration: time.Hour}},
+		{"WindowedThroughput", &dynsampler.WindowedThroughput{
+			UpdateFrequencyDuration:   time.Hour,
+			LookbackFrequencyDuration: time.Hour,
+		}},
+	}
+	// samplers that can load state start out with a rate for the key
+	state := []byte(`{"saved_sample_rates":{"key":10},"moving_average":{"key":100}}`)
+	for _, ns := range samplers {
+		if err := ns.sampler.LoadState(state); err != nil {
+			tb.Fatalf("%s: %v loading state", ns.name, err)
+		}
+		if err := ns.sampler.Start(); err != nil {
+			tb.Fatalf("%s: %v starting sampler", ns.name, err)
+		}
+		if r, ok := ns.sampler.(*dynsampler.RemoteRateSampler); ok {
+			r.SetSampleRates(map[string]int{"key": 10})
+		}
+		ns.sampler.GetSampleRate("key")
+	}
+	return samplers, func() {
+		for _, ns := range samplers {
+			ns.sampler.Stop()
+		}
+	}
+}
+
+type namedSampler struct {
+	name    string
+	sampler dynsampler.Sampler
+}
+
+// Looking up a key the sampler already knows is the hottest path, and must
+// not allocate.
+func TestGetSampleRateEstablishedKeyDoesNotAllocate(t *testing.T) {
+	samplers, stop := establishedKeySamplers(t)
+	defer stop()
+	for _, ns := range samplers {
+		allocs := testing.AllocsPerRun(1000, func() {
+			ns.sampler.GetSampleRate("key")
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocs per call, want 0", ns.name, allocs)
+		}
+	}
+}
+
+func BenchmarkGetSampleRateEstablishedKey(b *testing.B) {
+	samplers, stop := establishedKeySamplers(b)
+	defer stop()
+	for _, ns := range samplers {
+		b.Run(ns.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				ns.sampler.GetSampleRate("key")
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/honeycombio/dynsampler-go
 
-go 1.17
+go 1.19
 
 require github.com/stretchr/testify v1.10.0
 
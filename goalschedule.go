@@ -0,0 +1,61 @@
+package dynsampler
+
+import "time"
+
+// goalScheduleDay is the length of the day that GoalWindow offsets are
+// measured within.
+const goalScheduleDay = 24 * time.Hour
+
+// A GoalWindow is a time of day during which a throughput sampler aims for a
+// different goal. From and To are wall-clock times of day, written as offsets
+// from midnight, so a window from 22h to 6h covers the night. They follow the
+// clock rather than the time elapsed since midnight, so a window keeps to the
+// same hours on days when daylight saving time starts or ends. A window
+// includes From but not To.
+type GoalWindow struct {
+	From, To time.Duration
+
+	// Goal is the target number of events to send per second during the
+	// window. It must be greater than 0.
+	Goal int
+}
+
+// contains reports whether the offset from midnight falls within the window.
+func (w GoalWindow) contains(offset time.Duration) bool {
+	if w.From <= w.To {
+		return offset >= w.From && offset < w.To
+	}
+	// the window wraps around midnight
+	return offset >= w.From || offset < w.To
+}
+
+// validateGoalSchedule checks that every window's offsets are within a day
+// and that its goal is positive.
+func validateGoalSchedule(schedule []GoalWindow) error {
+	for i, w := range schedule {
+		if w.From < 0 || w.From > goalScheduleDay || w.To < 0 || w.To > goalScheduleDay || w.From == w.To {
+			return newConfigError(ErrInvalidInterval, "GoalSchedule window %d from %v to %v is not a time range within a day", i, w.From, w.To)
+		}
+		if w.Goal <= 0 {
+			return newConfigError(ErrInvalidGoal, "GoalSchedule window %d has goal %d; it must be greater than 0", i, w.Goal)
+		}
+	}
+	return nil
+}
+
+// goalAt returns the goal of the first window in schedule that contains the
+// wall-clock time of t, or fallback if none of them do.
+func goalAt(schedule []GoalWindow, t time.Time, fallback int) int {
+	if len(schedule) == 0 {
+		return fallback
+	}
+	hour, min, sec := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	for _, w := range schedule {
+		if w.contains(offset) {
+			return w.Goal
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,54 @@
+package dynsampler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoalAt(t *testing.T) {
+	schedule := []GoalWindow{
+		{From: 22 * time.Hour, To: 6 * time.Hour, Goal: 10},
+		{From: 12 * time.Hour, To: 13 * time.Hour, Goal: 50},
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 3, 1, h, m, 0, 0, time.UTC)
+	}
+	assert.Equal(t, 10, goalAt(schedule, at(23, 0), 100))
+	assert.Equal(t, 10, goalAt(schedule, at(0, 0), 100))
+	assert.Equal(t, 10, goalAt(schedule, at(5, 59), 100))
+	assert.Equal(t, 100, goalAt(schedule, at(6, 0), 100))
+	assert.Equal(t, 50, goalAt(schedule, at(12, 30), 100))
+	assert.Equal(t, 100, goalAt(schedule, at(13, 0), 100))
+	assert.Equal(t, 100, goalAt(nil, at(23, 0), 100))
+}
+
+func TestGoalAtDaylightSaving(t *testing.T) {
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	schedule := []GoalWindow{{From: 3 * time.Hour, To: 4 * time.Hour, Goal: 10}}
+	// On 10 March 2024 the clocks in New York went from 2:00 straight to
+	// 3:00, so 3:30 that morning was only 2.5 hours after midnight.
+	assert.Equal(t, 100, goalAt(schedule, time.Date(2024, 3, 10, 1, 30, 0, 0, nyc), 100))
+	assert.Equal(t, 10, goalAt(schedule, time.Date(2024, 3, 10, 3, 30, 0, 0, nyc), 100))
+	assert.Equal(t, 100, goalAt(schedule, time.Date(2024, 3, 10, 4, 0, 0, 0, nyc), 100))
+	// On 3 November 2024 1:00 to 2:00 happened twice, so 3:30 was 4.5 hours
+	// after midnight.
+	assert.Equal(t, 10, goalAt(schedule, time.Date(2024, 11, 3, 3, 30, 0, 0, nyc), 100))
+	assert.Equal(t, 100, goalAt(schedule, time.Date(2024, 11, 3, 2, 30, 0, 0, nyc), 100))
+}
+
+func TestValidateGoalSchedule(t *testing.T) {
+	assert.NoError(t, validateGoalSchedule([]GoalWindow{{From: 0, To: 24 * time.Hour, Goal: 1}}))
+	err := validateGoalSchedule([]GoalWindow{{From: time.Hour, To: 25 * time.Hour, Goal: 1}})
+	assert.True(t, errors.Is(err, ErrInvalidInterval))
+	err = validateGoalSchedule([]GoalWindow{{From: time.Hour, To: time.Hour, Goal: 1}})
+	assert.True(t, errors.Is(err, ErrInvalidInterval))
+	err = validateGoalSchedule([]GoalWindow{{From: time.Hour, To: 2 * time.Hour}})
+	assert.True(t, errors.Is(err, ErrInvalidGoal))
+	assert.Error(t, (&TotalThroughput{GoalSchedule: []GoalWindow{{Goal: 1}}}).Validate())
+}
@@ -0,0 +1,383 @@
+package dynsampler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// HybridSampler implements Sampler and blends two goals: it aims for an
+// average sample rate across all events, like AvgSampleRate, but never lets
+// the estimated total throughput exceed a cap, like TotalThroughput.
+//
+// Each interval, sample rates are first calculated exactly as AvgSampleRate
+// would, distributing the goal logarithmically across keys. If the number of
+// events those rates would keep exceeds MaxThroughputPerSec for the interval,
+// every rate is scaled up by the same factor so that the total fits under the
+// cap. When traffic is light enough, the cap has no effect and the sampler
+// behaves like AvgSampleRate.
+type HybridSampler struct {
+	// ClearFrequencyDuration is how often the counters reset as a Duration.
+	// Default 30s.
+	ClearFrequencyDuration time.Duration
+
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// GoalSampleRate is the average sample rate we're aiming for, across all
+	// events. Default 10
+	GoalSampleRate int
+
+	// MaxThroughputPerSec is the maximum number of events per second we want to
+	// keep. If the goal sample rate would keep more than this, sample rates are
+	// raised proportionally until it doesn't. Default 100
+	MaxThroughputPerSec int
+
+	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
+	// the sample rate map within the interval defined by `ClearFrequencyDuration`. Once
+	// MaxKeys is reached, new keys will not be included in the sample rate map, but
+	// existing keys will continue to be be counted.
+	MaxKeys int
+
+	// KeyOrder is the order in which keys are visited when dividing up the
+	// budget of events to keep, which decides which keys benefit from budget
+	// left unused by quiet keys. See KeyOrder for details. Defaults to
+	// KeyOrderLexical.
+	KeyOrder KeyOrder
+
+	// ExtraBudgetPolicy decides how budget left unused by quiet keys is shared
+	// among the keys visited after them. See ExtraBudgetPolicy for details.
+	// Defaults to ExtraBudgetEqual.
+	ExtraBudgetPolicy ExtraBudgetPolicy
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
+	savedSampleRates map[string]int
+	currentCounts    map[string]float64
+
+	// haveData indicates that we have gotten a sample of traffic. Before we've
+	// gotten any samples of traffic, we should use the default goal sample rate
+	// for all events instead of sampling everything at 1
+	haveData bool
+	done     chan struct{}
+
+	lock sync.Mutex
+
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
+	// metrics
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*HybridSampler)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (h *HybridSampler) Validate() error {
+	if h.ClearFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the ClearFrequencyDuration %v must not be negative", h.ClearFrequencyDuration)
+	}
+	if h.GoalSampleRate < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalSampleRate %d must not be negative", h.GoalSampleRate)
+	}
+	if h.MaxThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the MaxThroughputPerSec %d must not be negative", h.MaxThroughputPerSec)
+	}
+	if h.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", h.HeavySampleThreshold)
+	}
+	return nil
+}
+
+func (h *HybridSampler) Start() error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
+	if h.ClearFrequencyDuration == 0 {
+		h.ClearFrequencyDuration = 30 * time.Second
+	}
+	if h.GoalSampleRate == 0 {
+		h.GoalSampleRate = 10
+	}
+	if h.MaxThroughputPerSec == 0 {
+		h.MaxThroughputPerSec = 100
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", h.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
+	// initialize internal variables
+	h.savedSampleRates = make(map[string]int, h.ExpectedKeys)
+	h.currentCounts = make(map[string]float64, h.ExpectedKeys)
+	h.done = make(chan struct{})
+
+	if h.NoBackgroundGoroutine {
+		return nil
+	}
+
+	// spin up calculator
+	go func() {
+		ticker := time.NewTicker(h.ClearFrequencyDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.updateMaps()
+			case <-h.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *HybridSampler) Stop() error {
+	close(h.done)
+	exportRates(h.ExportOnStop, &h.lock, &h.savedSampleRates)
+	return nil
+}
+
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (h *HybridSampler) Update() {
+	h.updateMaps()
+}
+
+// updateMaps calculates a new saved rate map based on the contents of the
+// counter map
+func (h *HybridSampler) updateMaps() {
+	// make a local copy of the sample counters for calculation
+	h.lock.Lock()
+	tmpCounts := h.currentCounts
+	h.keyspace.observe(len(tmpCounts))
+	h.intervalCount++
+	h.currentCounts = make(map[string]float64, h.ExpectedKeys)
+	h.lock.Unlock()
+	// short circuit if no traffic
+	if len(tmpCounts) == 0 {
+		// no traffic the last interval. clear the result map
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.savedSampleRates = make(map[string]int)
+		h.heavyKeys = nil
+		return
+	}
+
+	// First, calculate rates just like AvgSampleRate.
+	goalRatio, sumEvents := averageGoalRatio(tmpCounts, h.GoalSampleRate, 0)
+
+	heavy := newHeavyKeys(h.HeavySampleThreshold)
+	newSavedSampleRates, kept := calculateSampleRates(goalRatio, tmpCounts, h.KeyOrder, h.ExtraBudgetPolicy, heavy)
+
+	// Then, if those rates would keep more than the throughput cap allows,
+	// scale every rate up by the amount we're over.
+	maxKept := float64(h.MaxThroughputPerSec) * h.ClearFrequencyDuration.Seconds()
+	if kept > maxKept {
+		scale := kept / maxKept
+		kept = 0
+		for key, rate := range newSavedSampleRates {
+			newRate := int(math.Ceil(float64(rate) * scale))
+			heavy.set(newSavedSampleRates, key, newRate)
+			kept += tmpCounts[key] / float64(newRate)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.savedSampleRates = newSavedSampleRates
+	h.heavyKeys = heavy
+	h.keptFraction = keptFractionPPM(kept, sumEvents)
+	h.haveData = true
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (h *HybridSampler) GetSampleRate(key string) int {
+	return h.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key.
+func (h *HybridSampler) GetSampleRateMulti(key string, count int) int {
+	return h.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (h *HybridSampler) GetSampleRateMulti64(key string, count int64) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+
+	h.requestCount++
+	h.eventCount += count
+
+	key, track := h.oversizeKeys.check(key, h.MaxKeyLength, h.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if h.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := h.currentCounts[key]; found || len(h.currentCounts) < h.MaxKeys {
+				h.currentCounts[key] += float64(count)
+			} else {
+				h.droppedKeys.add(key)
+			}
+		} else {
+			h.currentCounts[key] += float64(count)
+		}
+	}
+	return h.chooseRate(key)
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (h *HybridSampler) PeekSampleRate(key string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, h.MaxKeyLength, h.OnOversizeKey)
+	return h.chooseRate(key)
+}
+
+// chooseRate returns the sample rate for key. The caller must hold the lock.
+func (h *HybridSampler) chooseRate(key string) int {
+	if !h.haveData {
+		return h.GoalSampleRate
+	}
+	if rate, found := h.savedSampleRates[key]; found {
+		return rate
+	}
+	return 1
+}
+
+// SaveState is not implemented
+func (h *HybridSampler) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (h *HybridSampler) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (h *HybridSampler) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (h *HybridSampler) DroppedKeySamples() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (h *HybridSampler) OversizeKeyError() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.oversizeKeys.takeErr()
+}
+
+func (h *HybridSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(h.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (h *HybridSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(h.requestCount),
+		prefix + "event_count":          counter(h.eventCount),
+		prefix + "interval_count":       counter(h.intervalCount),
+		prefix + "keyspace_size":        gauge(h.keyspace.report(h.SmoothKeyspaceMetric, int64(len(h.currentCounts)))),
+		prefix + "keys_above_threshold": gauge(h.heavyKeys.value()),
+		prefix + "oversize_key_count":   counter(h.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":        gauge(h.keptFraction),
+	}
+	return mets
+}
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (h *HybridSampler) GetMetricsSummary(prefix string) map[string]int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return summarizeRates(prefix, h.savedSampleRates, h.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (h *HybridSampler) GetAllSampleRates() map[string]int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return copyRates(h.savedSampleRates)
+}
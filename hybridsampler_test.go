@@ -0,0 +1,119 @@
+package dynsampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridSamplerUpdateMaps(t *testing.T) {
+	counts := map[string]float64{
+		"one":   1,
+		"two":   1,
+		"three": 2,
+		"four":  5,
+		"five":  8,
+		"six":   15,
+		"seven": 45,
+		"eight": 612,
+		"nine":  2000,
+		"ten":   10000,
+	}
+	copyCounts := func() map[string]float64 {
+		c := make(map[string]float64, len(counts))
+		for k, v := range counts {
+			c[k] = v
+		}
+		return c
+	}
+	avg := &AvgSampleRate{GoalSampleRate: 20}
+	avg.currentCounts = copyCounts()
+	avg.updateMaps()
+
+	// 12689 events at an average rate of 20 is about 634 kept events, or
+	// about 21 per second over a 30 second interval.
+	t.Run("cap does not bind", func(t *testing.T) {
+		h := &HybridSampler{
+			ClearFrequencyDuration: 30 * time.Second,
+			GoalSampleRate:         20,
+			MaxThroughputPerSec:    100,
+		}
+		h.currentCounts = copyCounts()
+		h.updateMaps()
+		assert.Equal(t, 0, len(h.currentCounts))
+		assert.Equal(t, avg.savedSampleRates, h.savedSampleRates)
+		assert.Equal(t, countHeavyKeys(h.savedSampleRates, 0).value(), h.GetMetrics("")["keys_above_threshold"])
+	})
+
+	t.Run("cap binds", func(t *testing.T) {
+		h := &HybridSampler{
+			ClearFrequencyDuration: 30 * time.Second,
+			GoalSampleRate:         20,
+			MaxThroughputPerSec:    5,
+		}
+		h.currentCounts = copyCounts()
+		h.updateMaps()
+		var kept float64
+		for key, count := range counts {
+			rate := h.savedSampleRates[key]
+			assert.GreaterOrEqual(t, rate, avg.savedSampleRates[key], "rate for %s should not go down", key)
+			kept += count / float64(rate)
+		}
+		assert.LessOrEqual(t, kept, float64(5*30))
+		// the rates were scaled up together, so the ordering between keys holds
+		assert.Less(t, h.savedSampleRates["eight"], h.savedSampleRates["nine"])
+		assert.Less(t, h.savedSampleRates["nine"], h.savedSampleRates["ten"])
+		// the count follows the rates as they are scaled
+		assert.Equal(t, countHeavyKeys(h.savedSampleRates, 0).value(), h.GetMetrics("")["keys_above_threshold"])
+	})
+
+	t.Run("no traffic", func(t *testing.T) {
+		h := &HybridSampler{
+			ClearFrequencyDuration: 30 * time.Second,
+			GoalSampleRate:         20,
+			MaxThroughputPerSec:    5,
+		}
+		h.currentCounts = map[string]float64{}
+		h.updateMaps()
+		assert.Equal(t, map[string]int{}, h.savedSampleRates)
+	})
+}
+
+func TestHybridSamplerZeroCount(t *testing.T) {
+	rates := func(counts map[string]float64) map[string]int {
+		h := &HybridSampler{
+			ClearFrequencyDuration: 30 * time.Second,
+			GoalSampleRate:         10,
+			MaxThroughputPerSec:    1000,
+			currentCounts:          counts,
+		}
+		h.updateMaps()
+		return h.savedSampleRates
+	}
+	want := rates(map[string]float64{"busy": 1000, "quiet": 10})
+	// a key seen only with a count of 0 doesn't change the other keys' rates
+	got := rates(map[string]float64{"busy": 1000, "quiet": 10, "zero": 0})
+	assert.Equal(t, want["busy"], got["busy"])
+	assert.Equal(t, want["quiet"], got["quiet"])
+	assert.Equal(t, 1, got["zero"])
+	assert.Greater(t, got["busy"], got["quiet"])
+}
+
+func TestHybridSamplerGetSampleRate(t *testing.T) {
+	h := &HybridSampler{GoalSampleRate: 10}
+	h.currentCounts = map[string]float64{}
+	// before any data has been seen, the goal rate is returned
+	assert.Equal(t, 10, h.GetSampleRate("one"))
+
+	h.savedSampleRates = map[string]int{"one": 4}
+	h.haveData = true
+	assert.Equal(t, 4, h.GetSampleRate("one"))
+	assert.Equal(t, 1, h.GetSampleRate("two"))
+	assert.Equal(t, float64(2), h.currentCounts["one"])
+
+	mets := h.GetMetrics("h_")
+	assert.Equal(t, int64(3), mets["h_request_count"])
+	assert.Equal(t, int64(3), mets["h_event_count"])
+	assert.Equal(t, int64(2), mets["h_keyspace_size"])
+}
@@ -5,38 +5,115 @@ import (
 	"sort"
 )
 
+// KeyOrder is the order in which the key-based samplers visit keys when
+// dividing up their budget of events to keep.
+//
+// Each key is allotted a share of the budget. A key with fewer events than its
+// share gets a sample rate of 1, and the unused part of its share is passed on
+// to the keys visited after it. The order therefore decides which keys benefit
+// from that extra budget.
+type KeyOrder int
+
+const (
+	// KeyOrderLexical visits keys in lexicographic order, so extra budget
+	// accumulates toward keys that sort later. This is the default.
+	KeyOrderLexical KeyOrder = iota
+	// KeyOrderDescendingCount visits the busiest keys first, so they claim
+	// their share of the budget before any extra has been freed up by quieter
+	// keys. Busy keys then get rates based on their own share alone, and the
+	// extra goes to the quieter keys that follow, which are likely to be kept
+	// entirely anyway. The result is usually higher sample rates for busy keys,
+	// and fewer events kept overall, than with KeyOrderLexical. Keys with the
+	// same count are visited in lexicographic order.
+	KeyOrderDescendingCount
+)
+
+// ExtraBudgetPolicy decides how the key-based samplers share out the budget
+// left unused by keys with fewer events than their share, among the keys
+// visited after them. See KeyOrder for the order keys are visited in.
+type ExtraBudgetPolicy int
+
+const (
+	// ExtraBudgetEqual gives each remaining key an equal part of the extra
+	// budget. This is the default.
+	ExtraBudgetEqual ExtraBudgetPolicy = iota
+	// ExtraBudgetByCount gives each remaining key a part of the extra budget
+	// in proportion to its count. Busy keys get most of it, which lowers their
+	// sample rates, and quiet keys get little, so a quiet key that would have
+	// been kept entirely on the strength of the extra may be sampled instead.
+	ExtraBudgetByCount
+)
+
+// averageGoalRatio returns the goal ratio for calculateSampleRates that gives
+// counts an average sample rate of goalSampleRate, or keeps targetKept events
+// if it is greater than 0, along with the number of events in counts. The goal
+// is shared out by the logarithms of the counts, so counts below 1, whose
+// logarithms are negative and would throw off the sum, are taken to be 1.
+func averageGoalRatio(counts map[string]float64, goalSampleRate, targetKept int) (goalRatio, sumEvents float64) {
+	var logSum float64
+	for _, key := range sortedKeys(counts) {
+		sumEvents += counts[key]
+		logSum += math.Log10(math.Max(1, counts[key]))
+	}
+	// Goal events to send this interval is the total count of received events
+	// divided by the desired average sample rate, or the target, if there is one
+	goalCount := sumEvents / float64(goalSampleRate)
+	if targetKept > 0 {
+		goalCount = float64(targetKept)
+	}
+	// goalRatio is the goalCount divided by the sum of all the log values - it
+	// determines what percentage of the total event space belongs to each key
+	return goalCount / logSum, sumEvents
+}
+
 // This is an extraction of common calculation logic for all the key-based samplers.
-func calculateSampleRates(goalRatio float64, buckets map[string]float64) map[string]int {
+// Along with the new sample rates, it returns an estimate of the number of
+// events that will be kept by applying those rates to the counts in buckets.
+// The rates are set through heavy, which may be nil.
+func calculateSampleRates(goalRatio float64, buckets map[string]float64, order KeyOrder, policy ExtraBudgetPolicy, heavy *heavyKeys) (map[string]int, float64) {
 	// must go through the keys in a fixed order to prevent rounding from changing
 	// results
-	keys := make([]string, len(buckets))
-	var i int
-	for k := range buckets {
-		keys[i] = k
-		i++
+	keys := sortedKeys(buckets)
+	if order == KeyOrderDescendingCount {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return buckets[keys[i]] > buckets[keys[j]]
+		})
 	}
-	sort.Strings(keys)
 
 	// goal number of events per key is goalRatio * key count, but never less than
 	// one. If a key falls below its goal, it gets a sample rate of 1 and the
 	// extra available events get passed on down the line.
-	newSampleRates := make(map[string]int)
+	newSampleRates := make(map[string]int, len(buckets))
 	keysRemaining := len(buckets)
+	// countRemaining is the total count of the keys not yet visited, for
+	// ExtraBudgetByCount
+	var countRemaining float64
+	if policy == ExtraBudgetByCount {
+		for _, key := range keys {
+			countRemaining += math.Max(1, buckets[key])
+		}
+	}
 	var extra float64
+	var kept float64
 	for _, key := range keys {
 		count := math.Max(1, buckets[key])
 		// take the max of 1 or my log10 share of the total
 		goalForKey := math.Max(1, math.Log10(count)*goalRatio)
 		// take this key's share of the extra and pass the rest along
 		extraForKey := extra / float64(keysRemaining)
+		if policy == ExtraBudgetByCount {
+			extraForKey = extra * count / countRemaining
+			countRemaining -= count
+		}
 		goalForKey += extraForKey
 		extra -= extraForKey
 		keysRemaining--
 		if count <= goalForKey {
 			// there are fewer samples than the allotted number for this key. set
 			// sample rate to 1 and redistribute the unused slots for future keys
-			newSampleRates[key] = 1
+			heavy.set(newSampleRates, key, 1)
 			extra += goalForKey - count
+			kept += count
 		} else {
 			// there are more samples than the allotted number. Sample this key enough
 			// to knock it under the limit (aka round up)
@@ -45,12 +122,46 @@ func calculateSampleRates(goalRatio float64, buckets map[string]float64) map[str
 			// and subsequent division ends up with NaN. If that's the case,
 			// fall back to 1
 			if math.IsNaN(rate) {
-				newSampleRates[key] = 1
+				heavy.set(newSampleRates, key, 1)
 			} else {
-				newSampleRates[key] = int(rate)
+				heavy.set(newSampleRates, key, int(rate))
 			}
 			extra += goalForKey - (count / float64(newSampleRates[key]))
+			kept += count / float64(newSampleRates[key])
 		}
 	}
-	return newSampleRates
+	return newSampleRates, kept
+}
+
+// keptFractionPPM converts an estimate of kept events out of a total number of
+// observed events into parts per million, so it can be reported as an int64
+// metric. It returns 0 if nothing was observed.
+func keptFractionPPM(kept, total float64) int64 {
+	if total <= 0 {
+		return 0
+	}
+	return int64(math.Round(kept / total * 1e6))
+}
+
+// effectiveRateMilli returns the overall sample rate that keeping kept of
+// total events amounts to, in thousandths, or 0 if nothing was kept.
+func effectiveRateMilli(kept, total float64) int64 {
+	if kept <= 0 {
+		return 0
+	}
+	return int64(math.Round(total / kept * 1e3))
+}
+
+// sortedKeys returns the keys of m in sorted order. Floating point addition
+// isn't associative, so adding up counts in map order, which changes from run
+// to run, can give slightly different totals for the same counts. Going
+// through keys in sorted order instead means that identical counts always
+// produce bit-identical results, in any process.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
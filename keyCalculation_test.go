@@ -0,0 +1,62 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateSampleRatesKeyOrder(t *testing.T) {
+	buckets := map[string]float64{
+		"a": 2,
+		"b": 5,
+		"c": 1000,
+		"d": 4000,
+		"e": 3,
+	}
+	// lexically, the quiet keys "a" and "b" come first and pass their unused
+	// budget on to "c" and "d"
+	heavy := newHeavyKeys(200)
+	lexical, lexicalKept := calculateSampleRates(3, buckets, KeyOrderLexical, ExtraBudgetEqual, heavy)
+	assert.Equal(t, map[string]int{"a": 2, "b": 3, "c": 110, "d": 365, "e": 2}, lexical)
+	assert.Equal(t, int64(1), heavy.value())
+
+	// by count, "d" and "c" claim their budget before any extra is available
+	byCount, byCountKept := calculateSampleRates(3, buckets, KeyOrderDescendingCount, ExtraBudgetEqual, nil)
+	assert.Equal(t, map[string]int{"a": 2, "b": 3, "c": 112, "d": 371, "e": 2}, byCount)
+	assert.Less(t, byCountKept, lexicalKept)
+}
+
+func TestCalculateSampleRatesExtraBudgetPolicy(t *testing.T) {
+	buckets := map[string]float64{
+		"a": 2,
+		"b": 3,
+		"c": 12,
+		"d": 5000,
+	}
+	// shared equally, the budget "a" and "b" don't use is enough for "c" to
+	// be kept entirely
+	equal, _ := calculateSampleRates(10, buckets, KeyOrderLexical, ExtraBudgetEqual, nil)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1, "d": 130}, equal)
+
+	// shared by count, nearly all of it goes to "d"
+	byCount, _ := calculateSampleRates(10, buckets, KeyOrderLexical, ExtraBudgetByCount, nil)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 2, "d": 113}, byCount)
+}
+
+func TestHeavyKeys(t *testing.T) {
+	rates := map[string]int{}
+	heavy := newHeavyKeys(0)
+	heavy.set(rates, "a", 150)
+	heavy.set(rates, "b", 100)
+	assert.Equal(t, int64(1), heavy.value())
+	// changing a rate moves the key in or out of the count
+	heavy.set(rates, "a", 50)
+	heavy.set(rates, "b", 101)
+	assert.Equal(t, int64(1), heavy.value())
+	heavy.remove(rates, "b")
+	heavy.remove(rates, "missing")
+	assert.Equal(t, int64(0), heavy.value())
+	assert.Equal(t, map[string]int{"a": 50}, rates)
+	assert.Equal(t, int64(0), (*heavyKeys)(nil).value())
+}
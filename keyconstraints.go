@@ -0,0 +1,40 @@
+package dynsampler
+
+// A KeyConstraint bounds the sample rate given to one key. See the
+// KeyConstraints field of the samplers that support it.
+type KeyConstraint struct {
+	// Min, if greater than 0, is the lowest sample rate the key is given, so
+	// that it is never kept more than 1 in Min.
+	Min int
+
+	// Max, if greater than 0, is the highest sample rate the key is given, so
+	// that it is always kept at least 1 in Max.
+	Max int
+}
+
+// clamp returns rate moved into the constraint's bounds, and the source to
+// report for it: source if it was already within them, SourceOverride if it
+// was raised to Min, and SourceCapped if it was lowered to Max.
+func (c KeyConstraint) clamp(rate int, source RateSource) (int, RateSource) {
+	if c.Min > 0 && rate < c.Min {
+		return c.Min, SourceOverride
+	}
+	if c.Max > 0 && rate > c.Max {
+		return c.Max, SourceCapped
+	}
+	return rate, source
+}
+
+// validateKeyConstraints checks that no bound is negative, and that no key's
+// Min is above its Max.
+func validateKeyConstraints(constraints map[string]KeyConstraint) error {
+	for key, c := range constraints {
+		if c.Min < 0 || c.Max < 0 {
+			return newConfigError(ErrInvalidSampleRate, "the KeyConstraints for %q must not be negative", key)
+		}
+		if c.Min > 0 && c.Max > 0 && c.Min > c.Max {
+			return newConfigError(ErrInvalidSampleRate, "the KeyConstraints for %q have a Min of %d above their Max of %d", key, c.Min, c.Max)
+		}
+	}
+	return nil
+}
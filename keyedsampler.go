@@ -0,0 +1,74 @@
+package dynsampler
+
+import "errors"
+
+// KeyedSampler wraps a Sampler so that callers can pass their own values, such
+// as spans or log lines, instead of building a key for each one. KeyFunc turns
+// a value into the key that is passed to the wrapped Sampler. Keeping the key
+// logic in one place means every call site partitions traffic the same way.
+//
+// Everything except choosing the key is left to the wrapped Sampler, including
+// its configuration, its state, and its metrics. Because its GetSampleRate
+// takes a T rather than a string, KeyedSampler is not itself a Sampler.
+type KeyedSampler[T any] struct {
+	// Sampler is the sampler that decides sample rates. It is required.
+	Sampler Sampler
+
+	// KeyFunc returns the key to sample an item by. It is required, and must
+	// be safe to call from multiple goroutines at once.
+	KeyFunc func(T) string
+}
+
+// Start starts the wrapped sampler.
+func (k *KeyedSampler[T]) Start() error {
+	if k.Sampler == nil || k.KeyFunc == nil {
+		return errors.New("KeyedSampler needs both a Sampler and a KeyFunc")
+	}
+	return k.Sampler.Start()
+}
+
+// Stop stops the wrapped sampler.
+func (k *KeyedSampler[T]) Stop() error {
+	return k.Sampler.Stop()
+}
+
+// GetSampleRate returns the sample rate for item's key.
+func (k *KeyedSampler[T]) GetSampleRate(item T) int {
+	return k.Sampler.GetSampleRate(k.KeyFunc(item))
+}
+
+// GetSampleRateMulti returns the sample rate for item's key, for an item that
+// represents count events.
+func (k *KeyedSampler[T]) GetSampleRateMulti(item T, count int) int {
+	return k.Sampler.GetSampleRateMulti(k.KeyFunc(item), count)
+}
+
+// PeekSampleRate returns the wrapped sampler's PeekSampleRate for item's key,
+// without counting it, or 1 if the wrapped sampler has no PeekSampleRate.
+func (k *KeyedSampler[T]) PeekSampleRate(item T) int {
+	if p, ok := k.Sampler.(interface{ PeekSampleRate(string) int }); ok {
+		return p.PeekSampleRate(k.KeyFunc(item))
+	}
+	return 1
+}
+
+// SaveState returns the wrapped sampler's state.
+func (k *KeyedSampler[T]) SaveState() ([]byte, error) {
+	return k.Sampler.SaveState()
+}
+
+// LoadState loads state into the wrapped sampler. Like the sampler's own
+// LoadState, it should be called before Start.
+func (k *KeyedSampler[T]) LoadState(state []byte) error {
+	return k.Sampler.LoadState(state)
+}
+
+// SupportsState reports whether the wrapped sampler saves state.
+func (k *KeyedSampler[T]) SupportsState() bool {
+	return k.Sampler.SupportsState()
+}
+
+// GetMetrics returns the wrapped sampler's metrics.
+func (k *KeyedSampler[T]) GetMetrics(prefix string) map[string]int64 {
+	return k.Sampler.GetMetrics(prefix)
+}
@@ -0,0 +1,34 @@
+package dynsampler
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpan struct {
+	service string
+	status  int
+}
+
+func TestKeyedSampler(t *testing.T) {
+	k := &KeyedSampler[testSpan]{
+		Sampler: &Static{Rates: map[string]int{"api:200": 10}, Default: 2},
+		KeyFunc: func(s testSpan) string {
+			return s.service + ":" + strconv.Itoa(s.status)
+		},
+	}
+	assert.NoError(t, k.Start())
+	defer k.Stop()
+
+	assert.Equal(t, 10, k.GetSampleRate(testSpan{"api", 200}))
+	assert.Equal(t, 2, k.GetSampleRate(testSpan{"api", 500}))
+	assert.Equal(t, 10, k.GetSampleRateMulti(testSpan{"api", 200}, 4))
+	assert.Equal(t, int64(6), k.GetMetrics("")["event_count"])
+}
+
+func TestKeyedSamplerRequiresKeyFunc(t *testing.T) {
+	k := &KeyedSampler[testSpan]{Sampler: &Static{}}
+	assert.Error(t, k.Start())
+}
@@ -0,0 +1,65 @@
+package dynsampler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// OversizeKeyPolicy decides what a sampler does with a key longer than its
+// MaxKeyLength. Every sampler that keeps per-key state supports it; Static
+// only looks keys up in its Rates map, so it has no need to.
+type OversizeKeyPolicy int
+
+const (
+	// OversizeKeyTruncate shortens the key to MaxKeyLength bytes, backing up
+	// to the start of a UTF-8 character if necessary, and samples it as usual.
+	// Distinct keys that share a long prefix will be counted together. This is
+	// the default.
+	OversizeKeyTruncate OversizeKeyPolicy = iota
+	// OversizeKeyDrop does not count the key at all. The call gets the sample
+	// rate the sampler would give a key it has never seen.
+	OversizeKeyDrop
+	// OversizeKeyError behaves like OversizeKeyDrop, and also records an error
+	// wrapping ErrKeyTooLong that can be retrieved with OversizeKeyError.
+	OversizeKeyError
+)
+
+// oversizeKeys applies a sampler's MaxKeyLength and OnOversizeKey settings and
+// keeps track of what it has rejected. The zero value is ready to use. It is
+// not safe for concurrent use; callers are expected to hold the owning
+// sampler's lock, except that count may be read without it.
+type oversizeKeys struct {
+	count atomic.Int64
+	err   error
+}
+
+// check returns the key to use in place of key, and whether it should be
+// counted at all.
+func (o *oversizeKeys) check(key string, maxLen int, policy OversizeKeyPolicy) (string, bool) {
+	if maxLen <= 0 || len(key) <= maxLen {
+		return key, true
+	}
+	o.count.Add(1)
+	switch policy {
+	case OversizeKeyDrop:
+		return key, false
+	case OversizeKeyError:
+		o.err = fmt.Errorf("%w: %d bytes is longer than MaxKeyLength %d", ErrKeyTooLong, len(key), maxLen)
+		return key, false
+	default:
+		end := maxLen
+		for end > 0 && !utf8.RuneStart(key[end]) {
+			end--
+		}
+		return key[:end], true
+	}
+}
+
+// takeErr returns the most recent error recorded by OversizeKeyError and
+// clears it.
+func (o *oversizeKeys) takeErr() error {
+	err := o.err
+	o.err = nil
+	return err
+}
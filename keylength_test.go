@@ -0,0 +1,68 @@
+package dynsampler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOversizeKeysCheck(t *testing.T) {
+	var o oversizeKeys
+	key, track := o.check("short", 10, OversizeKeyDrop)
+	assert.Equal(t, "short", key)
+	assert.True(t, track)
+	key, track = o.check(strings.Repeat("x", 100), 0, OversizeKeyDrop)
+	assert.Equal(t, 100, len(key))
+	assert.True(t, track)
+	assert.Equal(t, int64(0), o.count.Load())
+
+	// truncation does not split a multi-byte character
+	key, track = o.check("abcédef", 4, OversizeKeyTruncate)
+	assert.Equal(t, "abc", key)
+	assert.True(t, track)
+	assert.Equal(t, int64(1), o.count.Load())
+	assert.Nil(t, o.takeErr())
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	longKey := strings.Repeat("k", 1<<20)
+	tests := []struct {
+		name      string
+		policy    OversizeKeyPolicy
+		wantKey   string
+		wantError bool
+	}{
+		{"truncate", OversizeKeyTruncate, strings.Repeat("k", 64), false},
+		{"drop", OversizeKeyDrop, "", false},
+		{"error", OversizeKeyError, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &TotalThroughput{
+				MaxKeyLength:  64,
+				OnOversizeKey: tt.policy,
+			}
+			s.currentCounts = map[string]int{}
+			s.savedSampleRates = map[string]int{}
+
+			assert.Equal(t, 1, s.GetSampleRate(longKey))
+			if tt.wantKey == "" {
+				assert.Equal(t, 0, len(s.currentCounts))
+			} else {
+				assert.Equal(t, map[string]int{tt.wantKey: 1}, s.currentCounts)
+			}
+			err := s.OversizeKeyError()
+			if tt.wantError {
+				assert.True(t, errors.Is(err, ErrKeyTooLong))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, s.OversizeKeyError())
+			mets := s.GetMetrics("")
+			assert.Equal(t, int64(1), mets["oversize_key_count"])
+			assert.Equal(t, int64(1), mets["request_count"])
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package dynsampler
+
+import "math"
+
+// keyspaceWeight is how far each interval's key space size moves the average
+// reported with SmoothKeyspaceMetric.
+const keyspaceWeight = 0.5
+
+// smoothedKeyspace is a moving average of the size of a sampler's key space,
+// measured at the end of each interval, for SmoothKeyspaceMetric. The zero
+// value is ready to use. It is not safe for concurrent use; callers are
+// expected to hold the owning sampler's lock.
+type smoothedKeyspace struct {
+	avg      float64
+	observed bool
+}
+
+// observe adds the size of the key space at the end of an interval to the
+// average. The first size observed starts it.
+func (k *smoothedKeyspace) observe(size int) {
+	if !k.observed {
+		k.avg = float64(size)
+		k.observed = true
+		return
+	}
+	k.avg = adjustAverage(k.avg, float64(size), keyspaceWeight)
+}
+
+// report returns the keyspace_size to report: the average if smooth is set
+// and an interval has ended, and current otherwise.
+func (k *smoothedKeyspace) report(smooth bool, current int64) int64 {
+	if !smooth || !k.observed {
+		return current
+	}
+	return int64(math.Round(k.avg))
+}
@@ -0,0 +1,62 @@
+package dynsampler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmoothKeyspaceMetric(t *testing.T) {
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		SmoothKeyspaceMetric:   true,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, tt.Start())
+	defer tt.Stop()
+	interval := func(numKeys int) {
+		for i := 0; i < numKeys; i++ {
+			tt.GetSampleRate("key" + strconv.Itoa(i))
+		}
+		tt.Update()
+	}
+	keyspaceSize := func() int64 {
+		return tt.GetMetrics("")["keyspace_size"]
+	}
+
+	// before an interval has ended, the true size is reported
+	tt.GetSampleRate("key0")
+	assert.Equal(t, int64(1), keyspaceSize())
+	tt.Update()
+	for i := 0; i < 10; i++ {
+		interval(10)
+	}
+	assert.Equal(t, int64(10), keyspaceSize())
+
+	// keys arriving during an interval don't move it
+	tt.GetSampleRate("key0")
+	assert.Equal(t, int64(10), keyspaceSize())
+
+	// when the key space grows, it lags behind, but catches up
+	interval(100)
+	assert.Equal(t, int64(55), keyspaceSize())
+	last := keyspaceSize()
+	for i := 0; i < 10; i++ {
+		interval(100)
+		size := keyspaceSize()
+		assert.GreaterOrEqual(t, size, last)
+		assert.LessOrEqual(t, size, int64(100))
+		last = size
+	}
+	assert.Equal(t, int64(100), last)
+
+	// and the same when it shrinks
+	interval(20)
+	assert.Equal(t, int64(60), keyspaceSize())
+
+	// without it, the size is reported as it is
+	tt.SmoothKeyspaceMetric = false
+	assert.Equal(t, int64(0), keyspaceSize())
+}
@@ -0,0 +1,39 @@
+package dynsampler
+
+import "time"
+
+// keyTTL remembers when each key was last counted, so that a throughput
+// sampler can keep serving a key's last rate for KeyTTL after the key goes
+// quiet. The zero value is ready to use.
+type keyTTL struct {
+	lastSeen map[string]time.Time
+}
+
+// carry records that the keys in counts were seen at the given time, and
+// copies into rates the rate in oldRates of every key missing from counts
+// that was seen less than ttl before then. Keys seen longer ago are
+// forgotten. It does nothing if ttl isn't positive. The rates are set
+// through heavy, which may be nil.
+func (k *keyTTL) carry(ttl time.Duration, at time.Time, counts map[string]int, oldRates, rates map[string]int, heavy *heavyKeys) {
+	if ttl <= 0 {
+		k.lastSeen = nil
+		return
+	}
+	if k.lastSeen == nil {
+		k.lastSeen = make(map[string]time.Time, len(counts))
+	}
+	for key := range counts {
+		k.lastSeen[key] = at
+	}
+	for key, seen := range k.lastSeen {
+		if _, found := counts[key]; found {
+			continue
+		}
+		rate, found := oldRates[key]
+		if !found || at.Sub(seen) >= ttl {
+			delete(k.lastSeen, key)
+			continue
+		}
+		heavy.set(rates, key, rate)
+	}
+}
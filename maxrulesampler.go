@@ -0,0 +1,158 @@
+package dynsampler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// MaxRuleSampler implements Sampler by asking several samplers for a rate and
+// using the highest, which drops the most. Each sampler enforces its own
+// constraint, and no constraint is broken, so that, for example, a
+// PerKeyThroughput and a TotalThroughput together cap both the throughput of
+// each key and the throughput of the whole system.
+//
+// Every sampler sees every key and count, so each one's view of the traffic
+// is the same as it would be on its own. The rates they calculate are not
+// adjusted for each other, so the combined throughput is usually lower than
+// any one of them would allow.
+type MaxRuleSampler struct {
+	// Samplers are the samplers to combine. They are started and stopped with
+	// the MaxRuleSampler, and must not be shared with anything else.
+	Samplers []Sampler
+
+	lock sync.Mutex
+
+	// metrics
+	requestCount int64
+	eventCount   int64
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*MaxRuleSampler)(nil)
+
+// Start starts every sampler in order. If one fails, the ones already started
+// are stopped and the error is returned.
+func (m *MaxRuleSampler) Start() error {
+	return StartAll(m.Samplers...)
+}
+
+// Stop stops every sampler, returning the first error.
+func (m *MaxRuleSampler) Stop() error {
+	return StopAll(m.Samplers...)
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (m *MaxRuleSampler) GetSampleRate(key string) int {
+	return m.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti passes the key and count to every sampler and returns the
+// highest rate any of them chose, or 1 if there are no samplers.
+func (m *MaxRuleSampler) GetSampleRateMulti(key string, count int) int {
+	m.lock.Lock()
+	m.requestCount++
+	m.eventCount += int64(count)
+	m.lock.Unlock()
+
+	rate := 1
+	for _, s := range m.Samplers {
+		if r := s.GetSampleRateMulti(key, count); r > rate {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// PeekSampleRate returns the highest rate PeekSampleRate returns for key
+// among the samplers that have one, or 1 if none do, without counting the key
+// or the call in any of them.
+func (m *MaxRuleSampler) PeekSampleRate(key string) int {
+	rate := 1
+	for _, s := range m.Samplers {
+		if p, ok := s.(interface{ PeekSampleRate(string) int }); ok {
+			if r := p.PeekSampleRate(key); r > rate {
+				rate = r
+			}
+		}
+	}
+	return rate
+}
+
+// SaveState returns the state of every sampler, as a JSON array with one
+// element for each, in order. Samplers that don't save state have a null
+// element. If none of them saves state, there is no state to return.
+func (m *MaxRuleSampler) SaveState() ([]byte, error) {
+	if !m.SupportsState() {
+		return nil, nil
+	}
+	states := make([]json.RawMessage, len(m.Samplers))
+	for i, s := range m.Samplers {
+		state, err := s.SaveState()
+		if err != nil {
+			return nil, fmt.Errorf("saving state of sampler %d (%T): %w", i, s, err)
+		}
+		if len(state) > 0 {
+			states[i] = state
+		}
+	}
+	return json.Marshal(states)
+}
+
+// LoadState loads state saved by SaveState into each sampler. The samplers
+// must be the same kinds, in the same order, as when the state was saved.
+func (m *MaxRuleSampler) LoadState(state []byte) error {
+	var states []json.RawMessage
+	if err := json.Unmarshal(state, &states); err != nil {
+		return err
+	}
+	if len(states) != len(m.Samplers) {
+		return fmt.Errorf("state is for %d samplers, not %d", len(states), len(m.Samplers))
+	}
+	for i, s := range m.Samplers {
+		if len(states[i]) == 0 || string(states[i]) == "null" {
+			continue
+		}
+		if err := s.LoadState(states[i]); err != nil {
+			return fmt.Errorf("loading state of sampler %d (%T): %w", i, s, err)
+		}
+	}
+	return nil
+}
+
+// SupportsState reports whether any of the samplers saves state.
+func (m *MaxRuleSampler) SupportsState() bool {
+	for _, s := range m.Samplers {
+		if s.SupportsState() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMetrics returns the MaxRuleSampler's own request_count and event_count,
+// along with every sampler's metrics, prefixed with "sampler_<N>_", where N is
+// the sampler's position in Samplers.
+func (m *MaxRuleSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(m.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. Metrics from samplers without a GetMetricsTyped method
+// are marked by their names.
+func (m *MaxRuleSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	m.lock.Lock()
+	mets := map[string]Metric{
+		prefix + "request_count": counter(m.requestCount),
+		prefix + "event_count":   counter(m.eventCount),
+	}
+	m.lock.Unlock()
+	for i, s := range m.Samplers {
+		for name, met := range typedMetricsOf(s, prefix+"sampler_"+strconv.Itoa(i)+"_") {
+			mets[name] = met
+		}
+	}
+	return mets
+}
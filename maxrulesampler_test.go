@@ -0,0 +1,46 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxRuleSampler(t *testing.T) {
+	keepAll := &Static{Default: 1}
+	capped := &Static{Rates: map[string]int{"busy": 50}, Default: 1}
+	m := &MaxRuleSampler{Samplers: []Sampler{keepAll, capped}}
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// the sampler that caps hard wins over the one that keeps everything
+	assert.Equal(t, 50, m.GetSampleRateMulti("busy", 3))
+	assert.Equal(t, 1, m.GetSampleRate("quiet"))
+
+	mets := m.GetMetrics("m_")
+	assert.Equal(t, int64(2), mets["m_request_count"])
+	assert.Equal(t, int64(4), mets["m_event_count"])
+	assert.Equal(t, int64(4), mets["m_sampler_0_event_count"])
+	assert.Equal(t, int64(4), mets["m_sampler_1_event_count"])
+}
+
+func TestMaxRuleSamplerState(t *testing.T) {
+	newSampler := func() *MaxRuleSampler {
+		return &MaxRuleSampler{Samplers: []Sampler{
+			&Static{},
+			&AvgSampleRate{},
+		}}
+	}
+	first := newSampler()
+	first.Samplers[1].(*AvgSampleRate).savedSampleRates = map[string]int{"key": 7}
+	state, err := first.SaveState()
+	assert.NoError(t, err)
+
+	second := newSampler()
+	assert.NoError(t, second.LoadState(state))
+	assert.Equal(t, map[string]int{"key": 7}, second.Samplers[1].(*AvgSampleRate).savedSampleRates)
+
+	// state for a different set of samplers is rejected
+	third := &MaxRuleSampler{Samplers: []Sampler{&Static{}}}
+	assert.Error(t, third.LoadState(state))
+}
@@ -0,0 +1,164 @@
+package dynsampler
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// MetricKind says how a metric's value behaves over time.
+type MetricKind int
+
+const (
+	// MetricGauge is a value that can go up or down, describing the sampler
+	// at the moment it is read.
+	MetricGauge MetricKind = iota
+	// MetricCounter is a cumulative value that only goes up. Its name always
+	// ends with "_count".
+	MetricCounter
+)
+
+// String returns "gauge" or "counter".
+func (k MetricKind) String() string {
+	if k == MetricCounter {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// Metric is a single value reported by GetMetricsTyped, along with its kind,
+// so that adapters for metrics systems don't have to guess the kind from the
+// metric's name.
+type Metric struct {
+	Value int64
+	Kind  MetricKind
+}
+
+func counter(value int64) Metric {
+	return Metric{Value: value, Kind: MetricCounter}
+}
+
+func gauge(value int64) Metric {
+	return Metric{Value: value, Kind: MetricGauge}
+}
+
+// metricValues drops the kinds from typed metrics, giving the map returned by
+// GetMetrics.
+func metricValues(typed map[string]Metric) map[string]int64 {
+	mets := make(map[string]int64, len(typed))
+	for name, m := range typed {
+		mets[name] = m.Value
+	}
+	return mets
+}
+
+// typedMetricsOf returns s's metrics with their kinds, from its
+// GetMetricsTyped method if it has one. Otherwise the kinds are worked out
+// from the names: a counter's name ends with "_count", and anything else is
+// taken to be a gauge. It is for samplers that wrap other samplers.
+func typedMetricsOf(s Sampler, prefix string) map[string]Metric {
+	if typed, ok := s.(interface {
+		GetMetricsTyped(prefix string) map[string]Metric
+	}); ok {
+		return typed.GetMetricsTyped(prefix)
+	}
+	mets := s.GetMetrics(prefix)
+	typed := make(map[string]Metric, len(mets))
+	for name, value := range mets {
+		if strings.HasSuffix(name, "_count") {
+			typed[name] = counter(value)
+		} else {
+			typed[name] = gauge(value)
+		}
+	}
+	return typed
+}
+
+// eventRate works out the rate of events per second between updates from a
+// cumulative event count, for the events_per_sec metric. The zero value is
+// ready to use. It is not safe for concurrent use; callers are expected to
+// hold the owning sampler's lock.
+type eventRate struct {
+	lastCount int64
+	lastTime  time.Time
+	perSec    int64
+}
+
+// update records that total events had been seen by t, at the end of an
+// interval that is nominally d long. The rate is measured over the time since
+// the last update, which may differ from d if the interval was cut short, or
+// over d for the first interval.
+func (r *eventRate) update(total int64, t time.Time, d time.Duration) {
+	elapsed := d
+	if !r.lastTime.IsZero() && t.After(r.lastTime) {
+		elapsed = t.Sub(r.lastTime)
+	}
+	if elapsed > 0 {
+		r.perSec = int64(math.Round(float64(total-r.lastCount) / elapsed.Seconds()))
+	}
+	r.lastCount = total
+	r.lastTime = t
+}
+
+// defaultHeavySampleThreshold is the HeavySampleThreshold used when none is
+// set.
+const defaultHeavySampleThreshold = 100
+
+// heavyKeys counts the keys in a rate map whose rate is above a sampler's
+// HeavySampleThreshold, for the keys_above_threshold metric. Rates are set
+// through it as the map is built, so the count is kept without another pass
+// over the map. A nil *heavyKeys counts nothing, and just changes the map.
+type heavyKeys struct {
+	threshold int
+	count     int64
+}
+
+// newHeavyKeys returns a heavyKeys for an empty map that counts rates above
+// threshold, or above defaultHeavySampleThreshold if threshold isn't positive.
+func newHeavyKeys(threshold int) *heavyKeys {
+	if threshold <= 0 {
+		threshold = defaultHeavySampleThreshold
+	}
+	return &heavyKeys{threshold: threshold}
+}
+
+// countHeavyKeys returns a heavyKeys for rates, which were not built through
+// one, such as rates loaded from saved state.
+func countHeavyKeys(rates map[string]int, threshold int) *heavyKeys {
+	h := newHeavyKeys(threshold)
+	for _, rate := range rates {
+		if rate > h.threshold {
+			h.count++
+		}
+	}
+	return h
+}
+
+// set gives key the rate in rates.
+func (h *heavyKeys) set(rates map[string]int, key string, rate int) {
+	if h != nil {
+		if old, found := rates[key]; found && old > h.threshold {
+			h.count--
+		}
+		if rate > h.threshold {
+			h.count++
+		}
+	}
+	rates[key] = rate
+}
+
+// remove deletes key from rates.
+func (h *heavyKeys) remove(rates map[string]int, key string) {
+	if old, found := rates[key]; found && h != nil && old > h.threshold {
+		h.count--
+	}
+	delete(rates, key)
+}
+
+// value returns the number of keys counted, for the metric.
+func (h *heavyKeys) value() int64 {
+	if h == nil {
+		return 0
+	}
+	return h.count
+}
@@ -0,0 +1,36 @@
+package dynsampler
+
+import "sort"
+
+// summarizeRates builds the result of GetMetricsSummary. Every sampler reports
+// the same set of names so dashboards built on one work for all of them:
+//
+//	keys        - the number of keys with a calculated sample rate
+//	min_rate    - the lowest of those sample rates
+//	max_rate    - the highest of those sample rates
+//	median_rate - the median of those sample rates (the lower of the two
+//	              middle values when there is an even number of keys)
+//	event_count - the cumulative number of events seen, as in GetMetrics
+//
+// The rates are 0 when there are no keys. All names are prefixed with the
+// given string.
+func summarizeRates(prefix string, rates map[string]int, eventCount int64) map[string]int64 {
+	var minRate, maxRate, medianRate int
+	if len(rates) > 0 {
+		sorted := make([]int, 0, len(rates))
+		for _, rate := range rates {
+			sorted = append(sorted, rate)
+		}
+		sort.Ints(sorted)
+		minRate = sorted[0]
+		maxRate = sorted[len(sorted)-1]
+		medianRate = sorted[(len(sorted)-1)/2]
+	}
+	return map[string]int64{
+		prefix + "keys":        int64(len(rates)),
+		prefix + "min_rate":    int64(minRate),
+		prefix + "max_rate":    int64(maxRate),
+		prefix + "median_rate": int64(medianRate),
+		prefix + "event_count": eventCount,
+	}
+}
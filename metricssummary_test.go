@@ -0,0 +1,63 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeRates(t *testing.T) {
+	mets := summarizeRates("s_", map[string]int{"a": 1, "b": 10, "c": 4, "d": 2}, 50)
+	assert.Equal(t, map[string]int64{
+		"s_keys":        4,
+		"s_min_rate":    1,
+		"s_max_rate":    10,
+		"s_median_rate": 2,
+		"s_event_count": 50,
+	}, mets)
+
+	mets = summarizeRates("", nil, 0)
+	assert.Equal(t, int64(0), mets["keys"])
+	assert.Equal(t, int64(0), mets["median_rate"])
+}
+
+func TestGetMetricsSummaryShape(t *testing.T) {
+	type summarizer interface {
+		GetMetricsSummary(prefix string) map[string]int64
+	}
+	samplers := []summarizer{
+		&AvgSampleRate{},
+		&AvgSampleWithMin{},
+		&EMASampleRate{},
+		&EMAThroughput{},
+		&HybridSampler{},
+		&OnlyOnce{},
+		&PerKeyThroughput{},
+		&RemoteRateSampler{},
+		&Static{},
+		&TotalThroughput{},
+		&WindowedThroughput{},
+	}
+	want := summarizeRates("x_", nil, 0)
+	for _, s := range samplers {
+		mets := s.GetMetricsSummary("x_")
+		assert.Equal(t, len(want), len(mets), "%T", s)
+		for name := range want {
+			_, found := mets[name]
+			assert.True(t, found, "%T is missing %s", s, name)
+		}
+	}
+
+	a := &AvgSampleRate{
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{"a": 3, "b": 7, "c": 5},
+		haveData:         true,
+	}
+	a.GetSampleRateMulti("a", 4)
+	mets := a.GetMetricsSummary("")
+	assert.Equal(t, int64(3), mets["keys"])
+	assert.Equal(t, int64(3), mets["min_rate"])
+	assert.Equal(t, int64(7), mets["max_rate"])
+	assert.Equal(t, int64(5), mets["median_rate"])
+	assert.Equal(t, int64(4), mets["event_count"])
+}
@@ -0,0 +1,80 @@
+package dynsampler
+
+import (
+	"math"
+	"sort"
+)
+
+// niceRate returns the value nearest to rate in nice, or in the 1-2-5 series
+// (1, 2, 5, 10, 20, 50, ...) if nice is empty. nice must be sorted. Nearness is
+// measured by ratio, not difference, so that 35 becomes 50 rather than 20:
+// either way the number of events kept changes by about the same proportion.
+// Ties go to the lower value, which keeps more events.
+func niceRate(rate int, nice []int) int {
+	if rate < 1 {
+		return rate
+	}
+	var candidates []int
+	if len(nice) > 0 {
+		i := sort.SearchInts(nice, rate)
+		if i < len(nice) {
+			candidates = append(candidates, nice[i])
+		}
+		if i > 0 {
+			candidates = append(candidates, nice[i-1])
+		}
+	} else {
+		m := 1
+		for m <= rate/10 {
+			m *= 10
+		}
+		candidates = []int{m, 2 * m, 5 * m}
+		if m <= math.MaxInt/10 {
+			candidates = append(candidates, 10*m)
+		}
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if d, bd := ratioDistance(c, rate), ratioDistance(best, rate); d < bd || (d == bd && c < best) {
+			best = c
+		}
+	}
+	return best
+}
+
+// ratioDistance returns how far apart a and b are, as a ratio.
+func ratioDistance(a, b int) float64 {
+	return math.Abs(math.Log(float64(a)) - math.Log(float64(b)))
+}
+
+// snapToNiceRates replaces each rate in rates with the nearest nice one, as
+// niceRate does, and returns the number of events the snapped rates would
+// keep from counts. The rates are set through heavy, which may be nil.
+func snapToNiceRates(rates map[string]int, counts map[string]float64, nice []int, heavy *heavyKeys) float64 {
+	if len(nice) > 0 && !sort.IntsAreSorted(nice) {
+		nice = append([]int(nil), nice...)
+		sort.Ints(nice)
+	}
+	var kept float64
+	for _, key := range sortedKeys(counts) {
+		rate, found := rates[key]
+		if !found {
+			continue
+		}
+		rate = niceRate(rate, nice)
+		heavy.set(rates, key, rate)
+		kept += math.Max(1, counts[key]) / float64(rate)
+	}
+	return kept
+}
+
+// validateNiceRates checks that every value in a NiceRates list is a usable
+// sample rate.
+func validateNiceRates(nice []int) error {
+	for _, rate := range nice {
+		if rate < 1 {
+			return newConfigError(ErrInvalidSampleRate, "the NiceRates value %d must be at least 1", rate)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package dynsampler
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNiceRate(t *testing.T) {
+	for rate, want := range map[int]int{
+		1: 1, 2: 2, 3: 2, 4: 5, 7: 5, 8: 10, 14: 10, 15: 20, 35: 50, 37: 50, 213: 200, 700: 500, 800: 1000,
+	} {
+		assert.Equal(t, want, niceRate(rate, nil), rate)
+	}
+	assert.Equal(t, 1, niceRate(1, []int{1, 4, 16}))
+	assert.Equal(t, 4, niceRate(6, []int{1, 4, 16}))
+	assert.Equal(t, 16, niceRate(9, []int{1, 4, 16}))
+	assert.Equal(t, 16, niceRate(1000, []int{1, 4, 16}))
+	assert.Equal(t, math.MaxInt, niceRate(math.MaxInt, []int{1, math.MaxInt}))
+	niceRate(math.MaxInt, nil)
+}
+
+func TestAvgSampleRateSnapToNiceRates(t *testing.T) {
+	counts := map[string]float64{}
+	for i := 1; i <= 200; i++ {
+		counts["key"+strconv.Itoa(i)] = float64(i * i)
+	}
+	newSampler := func(snap bool) *AvgSampleRate {
+		a := &AvgSampleRate{
+			GoalSampleRate:  20,
+			SnapToNiceRates: snap,
+			currentCounts:   copyCounts(counts),
+		}
+		a.updateMaps()
+		return a
+	}
+	exact := newSampler(false)
+	nice := newSampler(true)
+
+	changed := 0
+	for key, rate := range nice.savedSampleRates {
+		assert.Equal(t, niceRate(rate, nil), rate, key)
+		if exact.savedSampleRates[key] != rate {
+			changed++
+		}
+	}
+	assert.Greater(t, changed, 0)
+
+	// throughput stays close to what the exact rates give
+	exactKept := exact.GetMetrics("")["kept_fraction"]
+	niceKept := nice.GetMetrics("")["kept_fraction"]
+	assert.InEpsilon(t, exactKept, niceKept, 0.1)
+
+	assert.Error(t, (&AvgSampleRate{NiceRates: []int{0, 10}}).Validate())
+}
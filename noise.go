@@ -0,0 +1,62 @@
+package dynsampler
+
+// noisyGroups finds the groups of keys in averages that share their first
+// prefixLen bytes, and returns the members of each group with at least
+// minKeys keys, by prefix. Keys shorter than prefixLen are never grouped.
+func noisyGroups(averages map[string]float64, prefixLen, minKeys int) map[string][]string {
+	if prefixLen <= 0 {
+		return nil
+	}
+	groups := make(map[string][]string)
+	for _, key := range sortedKeys(averages) {
+		if len(key) < prefixLen {
+			continue
+		}
+		prefix := key[:prefixLen]
+		groups[prefix] = append(groups[prefix], key)
+	}
+	for prefix, keys := range groups {
+		if len(keys) < minKeys {
+			delete(groups, prefix)
+		}
+	}
+	return groups
+}
+
+// groupAverages returns a copy of averages in which the keys of each group
+// are replaced by a single entry for the whole group, holding their sum, so
+// that the group is sampled as if it were one key. Each group's entry is
+// keyed by its prefix, which can't clash with another key: a key equal to the
+// prefix is one of the group's members.
+func groupAverages(averages map[string]float64, groups map[string][]string) map[string]float64 {
+	grouped := make(map[string]float64, len(averages))
+	for key, avg := range averages {
+		grouped[key] = avg
+	}
+	for prefix, keys := range groups {
+		var sum float64
+		for _, key := range keys {
+			sum += averages[key]
+			delete(grouped, key)
+		}
+		grouped[prefix] = sum
+	}
+	return grouped
+}
+
+// ungroupRates replaces the entry for each group in rates, made from the
+// averages returned by groupAverages, with an entry for each of its members,
+// and returns the groups' rates by prefix. The rates are changed through
+// heavy, which may be nil.
+func ungroupRates(rates map[string]int, groups map[string][]string, heavy *heavyKeys) map[string]int {
+	groupRates := make(map[string]int, len(groups))
+	for prefix, keys := range groups {
+		rate := rates[prefix]
+		heavy.remove(rates, prefix)
+		for _, key := range keys {
+			heavy.set(rates, key, rate)
+		}
+		groupRates[prefix] = rate
+	}
+	return groupRates
+}
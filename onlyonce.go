@@ -1,7 +1,6 @@
 package dynsampler
 
 import (
-	"fmt"
 	"sync"
 	"time"
 )
@@ -30,8 +29,44 @@ type OnlyOnce struct {
 	// If neither one is set, the default is 30s.
 	ClearFrequencyDuration time.Duration
 
-	seen map[string]bool
-	done chan struct{}
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that clears the seen keys every ClearFrequencyDuration, for embedded use
+	// where background goroutines aren't welcome. The caller must call Update
+	// on its own schedule instead; without calls to Update, keys are never
+	// cleared. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// ResuppressAfter, if greater than 0, reports a key again after it has
+	// been suppressed this many times, and then suppresses it again, so a
+	// key that keeps repeating is reported periodically rather than only once
+	// per ClearFrequencyDuration. For example, with a ResuppressAfter of 99,
+	// one in every 100 events for a key is reported. The suppression counts
+	// reset along with the seen keys. Defaults to 0, which suppresses a key
+	// until it is cleared.
+	ResuppressAfter int
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate. Keys that are dropped are treated as
+	// already seen, so they are not reported.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	seen       map[string]bool
+	suppressed map[string]int // times each seen key has been suppressed, with ResuppressAfter
+	done       chan struct{}
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
 
 	// metrics
 	requestCount int64
@@ -43,10 +78,23 @@ type OnlyOnce struct {
 // Ensure we implement the sampler interface
 var _ Sampler = (*OnlyOnce)(nil)
 
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults. Negative clear frequencies are
+// valid and mean that keys are never cleared.
+func (o *OnlyOnce) Validate() error {
+	if o.ClearFrequencyDuration != 0 && o.ClearFrequencySec != 0 {
+		return newConfigError(ErrConflictingIntervalConfig, "the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	}
+	if o.ResuppressAfter < 0 {
+		return newConfigError(ErrInvalidThreshold, "the ResuppressAfter %d must not be negative", o.ResuppressAfter)
+	}
+	return nil
+}
+
 // Start initializes the static dynsampler
 func (o *OnlyOnce) Start() error {
-	if o.ClearFrequencyDuration != 0 && o.ClearFrequencySec != 0 {
-		return fmt.Errorf("the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	if err := o.Validate(); err != nil {
+		return err
 	}
 
 	if o.ClearFrequencyDuration == 0 && o.ClearFrequencySec == 0 {
@@ -55,14 +103,22 @@ func (o *OnlyOnce) Start() error {
 		o.ClearFrequencyDuration = time.Duration(o.ClearFrequencySec) * time.Second
 	}
 
+	o.seen = make(map[string]bool, o.ExpectedKeys)
+
 	// if it's negative, we don't even start something
 	if o.ClearFrequencyDuration < 0 {
 		return nil
 	}
+	if err := checkInterval("ClearFrequencyDuration", o.ClearFrequencyDuration); err != nil {
+		return err
+	}
 
-	o.seen = make(map[string]bool)
 	o.done = make(chan struct{})
 
+	if o.NoBackgroundGoroutine {
+		return nil
+	}
+
 	// spin up calculator
 	go func() {
 		ticker := time.NewTicker(o.ClearFrequencyDuration)
@@ -86,10 +142,18 @@ func (o *OnlyOnce) Stop() error {
 	return nil
 }
 
+// Update clears the keys that have been seen, as the goroutine launched by
+// Start does every ClearFrequencyDuration. It is for use with
+// NoBackgroundGoroutine.
+func (o *OnlyOnce) Update() {
+	o.updateMaps()
+}
+
 func (o *OnlyOnce) updateMaps() {
 	o.lock.Lock()
 	defer o.lock.Unlock()
-	o.seen = make(map[string]bool)
+	o.seen = make(map[string]bool, o.ExpectedKeys)
+	o.suppressed = nil
 }
 
 // GetSampleRate takes a key and returns the appropriate sample rate for that
@@ -101,18 +165,65 @@ func (o *OnlyOnce) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (o *OnlyOnce) GetSampleRateMulti(key string, count int) int {
+	return o.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (o *OnlyOnce) GetSampleRateMulti64(key string, count int64) int {
 	o.lock.Lock()
 	defer o.lock.Unlock()
+	if o.seen == nil {
+		// not started yet
+		return 1
+	}
 	o.requestCount++
-	o.eventCount += int64(count)
+	o.eventCount += count
 
+	key, track := o.oversizeKeys.check(key, o.MaxKeyLength, o.OnOversizeKey)
+	if !track {
+		return 1000000000
+	}
 	if _, found := o.seen[key]; found {
+		if o.ResuppressAfter > 0 {
+			if o.suppressed == nil {
+				o.suppressed = make(map[string]int)
+			}
+			if o.suppressed[key] >= o.ResuppressAfter {
+				delete(o.suppressed, key)
+				return 1
+			}
+			o.suppressed[key]++
+		}
 		return 1000000000
 	}
 	o.seen[key] = true
 	return 1
 }
 
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (o *OnlyOnce) PeekSampleRate(key string) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.seen == nil {
+		// not started yet
+		return 1
+	}
+	key, track := (&oversizeKeys{}).check(key, o.MaxKeyLength, o.OnOversizeKey)
+	if !track {
+		return 1000000000
+	}
+	if _, found := o.seen[key]; !found {
+		return 1
+	}
+	if o.ResuppressAfter > 0 && o.suppressed[key] >= o.ResuppressAfter {
+		return 1
+	}
+	return 1000000000
+}
+
 // SaveState is not implemented
 func (o *OnlyOnce) SaveState() ([]byte, error) {
 	return nil, nil
@@ -123,13 +234,44 @@ func (o *OnlyOnce) LoadState(state []byte) error {
 	return nil
 }
 
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (o *OnlyOnce) SupportsState() bool {
+	return false
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (o *OnlyOnce) OversizeKeyError() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.oversizeKeys.takeErr()
+}
+
 func (o *OnlyOnce) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(o.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (o *OnlyOnce) GetMetricsTyped(prefix string) map[string]Metric {
 	o.lock.Lock()
 	defer o.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": o.requestCount,
-		prefix + "event_count":   o.eventCount,
-		prefix + "keyspace_size": int64(len(o.seen)),
+	mets := map[string]Metric{
+		prefix + "request_count":      counter(o.requestCount),
+		prefix + "event_count":        counter(o.eventCount),
+		prefix + "keyspace_size":      gauge(int64(len(o.seen))),
+		prefix + "oversize_key_count": counter(o.oversizeKeys.count.Load()),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns the same small, fixed set of aggregate metrics as
+// the other samplers. OnlyOnce does not calculate per-key rates, so only
+// event_count is non-zero.
+func (o *OnlyOnce) GetMetricsSummary(prefix string) map[string]int64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return summarizeRates(prefix, nil, o.eventCount)
+}
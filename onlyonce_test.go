@@ -1,6 +1,7 @@
 package dynsampler
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -64,6 +65,25 @@ func TestOnlyOnceGetSampleRate(t *testing.T) {
 	}
 }
 
+func TestOnlyOnceResuppressAfter(t *testing.T) {
+	o := &OnlyOnce{ResuppressAfter: 2}
+	o.seen = map[string]bool{}
+	var rates []int
+	for i := 0; i < 7; i++ {
+		rates = append(rates, o.GetSampleRate("repeat"))
+	}
+	// reported, suppressed twice, reported again, and so on
+	assert.Equal(t, []int{1, 1000000000, 1000000000, 1, 1000000000, 1000000000, 1}, rates)
+
+	// clearing the seen keys clears the suppression counts too
+	o.GetSampleRate("repeat")
+	o.updateMaps()
+	assert.Equal(t, 1, o.GetSampleRate("repeat"))
+	assert.Equal(t, 1000000000, o.GetSampleRate("repeat"))
+	assert.Equal(t, 1000000000, o.GetSampleRate("repeat"))
+	assert.Equal(t, 1, o.GetSampleRate("repeat"))
+}
+
 func TestOnlyOnce_Start(t *testing.T) {
 	tests := []struct {
 		name                   string
@@ -89,6 +109,9 @@ func TestOnlyOnce_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("OnlyOnce error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("OnlyOnce error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.ClearFrequencyDuration {
@@ -98,3 +121,11 @@ func TestOnlyOnce_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestOnlyOnceNeverCleared(t *testing.T) {
+	o := &OnlyOnce{ClearFrequencyDuration: -1}
+	assert.NoError(t, o.Start())
+	defer o.Stop()
+	assert.Equal(t, 1, o.GetSampleRate("key"))
+	assert.Equal(t, 1000000000, o.GetSampleRate("key"))
+}
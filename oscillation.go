@@ -0,0 +1,73 @@
+package dynsampler
+
+import (
+	"math"
+	"math/bits"
+)
+
+// oscillationReversals is the number of times a key's rate must reverse
+// direction within the last 8 intervals for it to count as oscillating.
+const oscillationReversals = 3
+
+// rateDirections is the recent history of one key's sample rate.
+type rateDirections struct {
+	// last is the direction of the key's most recent significant rate change:
+	// 1 for up, -1 for down, or 0 if there hasn't been one
+	last int8
+
+	// reversals has a bit for each of the last 8 intervals, the lowest for
+	// the most recent, set if the key's rate reversed direction in it
+	reversals uint8
+}
+
+// oscillationDetector finds keys whose sample rates keep reversing direction,
+// ping-ponging between high and low rates from one interval to the next,
+// which is a sign that Weight is too high or the interval too short. A change
+// counts only if it is more than the threshold (as a fraction of the previous
+// rate), so small wobbles are ignored. Only the keys that have a rate are
+// tracked, so the history is bounded by the size of the key space. The zero
+// value is ready to use. It is not safe for concurrent use; callers are
+// expected to hold the owning sampler's lock.
+type oscillationDetector struct {
+	keys map[string]rateDirections
+
+	// oscillating is the number of keys that reversed direction at least
+	// oscillationReversals times within the last 8 intervals
+	oscillating int64
+}
+
+// observe compares the rates calculated at the end of an interval with the
+// ones they replace.
+func (o *oscillationDetector) observe(oldRates, newRates map[string]int, threshold float64) {
+	if threshold <= 0 {
+		threshold = defaultConvergenceThreshold
+	}
+	if o.keys == nil {
+		o.keys = make(map[string]rateDirections, len(newRates))
+	}
+	for key := range o.keys {
+		if _, found := newRates[key]; !found {
+			delete(o.keys, key)
+		}
+	}
+	o.oscillating = 0
+	for key, rate := range newRates {
+		h := o.keys[key]
+		h.reversals <<= 1
+		if old, found := oldRates[key]; found && old > 0 &&
+			math.Abs(float64(rate-old))/float64(old) > threshold {
+			var dir int8 = 1
+			if rate < old {
+				dir = -1
+			}
+			if h.last != 0 && dir != h.last {
+				h.reversals |= 1
+			}
+			h.last = dir
+		}
+		o.keys[key] = h
+		if bits.OnesCount8(h.reversals) >= oscillationReversals {
+			o.oscillating++
+		}
+	}
+}
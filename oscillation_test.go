@@ -0,0 +1,71 @@
+package dynsampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOscillationDetector(t *testing.T) {
+	var o oscillationDetector
+	up := map[string]int{"a": 20, "b": 5}
+	down := map[string]int{"a": 10, "b": 5}
+	o.observe(nil, down, 0.1)
+	o.observe(down, up, 0.1)
+	o.observe(up, down, 0.1)
+	o.observe(down, up, 0.1)
+	assert.Equal(t, int64(0), o.oscillating, "two reversals aren't enough")
+	o.observe(up, down, 0.1)
+	assert.Equal(t, int64(1), o.oscillating)
+
+	// small wobbles don't count as changes
+	wobble := map[string]int{"a": 11, "b": 5}
+	o.observe(down, wobble, 0.1)
+	o.observe(wobble, down, 0.1)
+	assert.Equal(t, int64(1), o.oscillating)
+
+	// reversals fall out of the window after 8 intervals
+	for i := 0; i < 3; i++ {
+		o.observe(down, down, 0.1)
+	}
+	assert.Equal(t, int64(1), o.oscillating)
+	o.observe(down, down, 0.1)
+	assert.Equal(t, int64(0), o.oscillating)
+
+	// keys that lose their rate are forgotten
+	o.observe(down, map[string]int{"b": 5}, 0.1)
+	assert.NotContains(t, o.keys, "a")
+}
+
+func TestEMASampleRateOscillatingKeys(t *testing.T) {
+	e := &EMASampleRate{
+		GoalSampleRate:             10,
+		AdjustmentIntervalDuration: time.Second,
+		Weight:                     1,
+		AgeOutValue:                0.5,
+		movingAverage:              map[string]float64{},
+	}
+	run := func(busy float64) {
+		e.currentCounts = map[string]float64{"busy": busy, "quiet": 100}
+		e.updateMaps()
+	}
+	// with no smoothing, steady traffic gives steady rates
+	for i := 0; i < 8; i++ {
+		run(10000)
+	}
+	assert.Equal(t, int64(0), e.GetMetrics("")["oscillating_keys"])
+
+	// traffic that swings back and forth makes the busy key's rate swing with
+	// it, while the quiet key stays at 1
+	for i := 0; i < 8; i++ {
+		run(1000)
+		run(10000)
+	}
+	assert.Equal(t, int64(1), e.GetMetrics("")["oscillating_keys"])
+
+	for i := 0; i < 8; i++ {
+		run(10000)
+	}
+	assert.Equal(t, int64(0), e.GetMetrics("")["oscillating_keys"])
+}
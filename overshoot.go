@@ -0,0 +1,93 @@
+package dynsampler
+
+import (
+	"math"
+	"sort"
+)
+
+// KeyContribution describes how much one key kept beyond its fair share of
+// a sampler's goal in the last interval. It is returned by
+// OvershootContributors.
+type KeyContribution struct {
+	// Key is the key.
+	Key string
+
+	// Count is the number of events the rate was calculated from.
+	Count float64
+
+	// SampleRate is the sample rate the key was given.
+	SampleRate int
+
+	// Kept is the estimated number of events kept at that rate.
+	Kept float64
+
+	// FairShare is the number of events each key would keep if the goal were
+	// split equally between all the keys.
+	FairShare float64
+
+	// Excess is how far Kept is above FairShare.
+	Excess float64
+}
+
+// overshoot holds what an interval's rates were calculated from, for
+// OvershootContributors. It keeps the sampler's own map of counts rather than
+// a copy, so recording an interval costs nothing. The zero value has no
+// contributors. It is not safe for concurrent use; callers are expected to
+// hold the owning sampler's lock.
+type overshoot[C int | float64] struct {
+	// counts are the counts the rates were calculated from, by key. The
+	// sampler must replace the map rather than fill it in again for a new
+	// interval.
+	counts map[string]C
+
+	// fairShare is the goal for the interval divided by the number of keys
+	fairShare float64
+}
+
+// set records the counts the rates for an interval were calculated from, and
+// the number of events the interval's goal was to keep.
+func (o *overshoot[C]) set(counts map[string]C, goalCount float64) {
+	o.counts = counts
+	o.fairShare = 0
+	if len(counts) > 0 {
+		o.fairShare = goalCount / float64(len(counts))
+	}
+}
+
+// top returns up to n of the keys whose estimated kept events at rates exceed
+// their fair share the most, largest first. Keys with no rate are taken to
+// have a rate of 1, which is what they are given.
+func (o *overshoot[C]) top(n int, rates map[string]int) []KeyContribution {
+	if n <= 0 {
+		return nil
+	}
+	var contribs []KeyContribution
+	for key, count := range o.counts {
+		rate := rates[key]
+		if rate < 1 {
+			rate = 1
+		}
+		kept := math.Max(1, float64(count)) / float64(rate)
+		if kept <= o.fairShare {
+			continue
+		}
+		contribs = append(contribs, KeyContribution{
+			Key:        key,
+			Count:      float64(count),
+			SampleRate: rate,
+			Kept:       kept,
+			FairShare:  o.fairShare,
+			Excess:     kept - o.fairShare,
+		})
+	}
+	sort.Slice(contribs, func(i, j int) bool {
+		if contribs[i].Excess != contribs[j].Excess {
+			return contribs[i].Excess > contribs[j].Excess
+		}
+		return contribs[i].Key < contribs[j].Key
+	})
+	if len(contribs) > n {
+		contribs = contribs[:n]
+	}
+	return contribs
+}
@@ -1,9 +1,9 @@
 package dynsampler
 
 import (
-	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +24,13 @@ type PerKeyThroughput struct {
 	// If neither one is set, the default is 30s.
 	ClearFrequencyDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// PerKeyThroughputPerSec is the target number of events to send per second
 	// per key. Sample rates are generated on a per key basis to squash the
 	// throughput down to match the goal throughput. default 10
@@ -35,26 +42,116 @@ type PerKeyThroughput struct {
 	// existing keys will continue to be be counted.
 	MaxKeys int
 
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// KeyTTL, if greater than 0, is how long a key keeps its last sample
+	// rate after it stops appearing. Rates are recalculated from each
+	// interval's traffic alone, so without it a key that is quiet for one
+	// interval loses its rate, and gets a rate of 1 when it comes back until
+	// the next recalculation, which can let a flood through. Defaults to 0.
+	KeyTTL time.Duration
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]int
 	done             chan struct{}
 
 	lock sync.Mutex
 
-	// metrics
-	requestCount int64
-	eventCount   int64
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// keyTTL remembers when keys were last seen, for KeyTTL
+	keyTTL keyTTL
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
+	// metrics. request_count and event_count are counted so that they can be
+	// read without the lock, as are the number of keys counted this interval
+	// and, once an interval, the rest, so that GetMetrics never takes it.
+	counts        requestCounter
+	keyCount      atomic.Int64 // len(currentCounts), stored under the lock
+	metrics       atomic.Pointer[perKeyThroughputMetrics]
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+}
+
+// perKeyThroughputMetrics holds the metrics of a PerKeyThroughput that change
+// once an interval, as of the end of the last one. A new one is published at
+// the end of each interval, so that they are always read together.
+type perKeyThroughputMetrics struct {
+	intervalCount      int64
+	keysAboveThreshold int64
+	keptFraction       int64
+	eventsPerSec       int64
+	keyspace           smoothedKeyspace
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*PerKeyThroughput)(nil)
 
-func (p *PerKeyThroughput) Start() error {
-	// apply defaults
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (p *PerKeyThroughput) Validate() error {
 	if p.ClearFrequencyDuration != 0 && p.ClearFrequencySec != 0 {
-		return fmt.Errorf("the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+		return newConfigError(ErrConflictingIntervalConfig, "the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	}
+	if p.ClearFrequencyDuration < 0 || p.ClearFrequencySec < 0 {
+		return newConfigError(ErrInvalidInterval, "the clear frequency must not be negative")
 	}
+	if p.KeyTTL < 0 {
+		return newConfigError(ErrInvalidInterval, "the KeyTTL %v must not be negative", p.KeyTTL)
+	}
+	if p.PerKeyThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the PerKeyThroughputPerSec %d must not be negative", p.PerKeyThroughputPerSec)
+	}
+	if p.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", p.HeavySampleThreshold)
+	}
+	return nil
+}
 
+func (p *PerKeyThroughput) Start() error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
 	if p.ClearFrequencyDuration == 0 && p.ClearFrequencySec == 0 {
 		p.ClearFrequencyDuration = 30 * time.Second
 	} else if p.ClearFrequencySec != 0 {
@@ -65,11 +162,19 @@ func (p *PerKeyThroughput) Start() error {
 		p.PerKeyThroughputPerSec = 10
 	}
 
+	if err := checkInterval("ClearFrequencyDuration", p.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
 	// initialize internal variables
-	p.savedSampleRates = make(map[string]int)
-	p.currentCounts = make(map[string]int)
+	p.savedSampleRates = make(map[string]int, p.ExpectedKeys)
+	p.currentCounts = make(map[string]int, p.ExpectedKeys)
 	p.done = make(chan struct{})
 
+	if p.NoBackgroundGoroutine {
+		return nil
+	}
+
 	// spin up calculator
 	go func() {
 		ticker := time.NewTicker(p.ClearFrequencyDuration)
@@ -88,16 +193,30 @@ func (p *PerKeyThroughput) Start() error {
 
 func (p *PerKeyThroughput) Stop() error {
 	close(p.done)
+	exportRates(p.ExportOnStop, &p.lock, &p.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (p *PerKeyThroughput) Update() {
+	p.updateMaps()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (p *PerKeyThroughput) updateMaps() {
 	// make a local copy of the sample counters for calculation
 	p.lock.Lock()
 	tmpCounts := p.currentCounts
-	p.currentCounts = make(map[string]int)
+	p.keyspace.observe(len(tmpCounts))
+	oldRates := p.savedSampleRates
+	p.intervalCount++
+	p.currentCounts = make(map[string]int, p.ExpectedKeys)
+	p.keyCount.Store(0)
+	_, events := p.counts.read()
+	p.eventRate.update(events, now(), p.ClearFrequencyDuration)
 	p.lock.Unlock()
 	// short circuit if no traffic
 	numKeys := len(tmpCounts)
@@ -106,20 +225,43 @@ func (p *PerKeyThroughput) updateMaps() {
 		p.lock.Lock()
 		defer p.lock.Unlock()
 		p.savedSampleRates = make(map[string]int)
+		p.heavyKeys = newHeavyKeys(p.HeavySampleThreshold)
+		p.keyTTL.carry(p.KeyTTL, now(), tmpCounts, oldRates, p.savedSampleRates, p.heavyKeys)
+		p.publishMetrics()
 		return
 	}
 	actualPerKeyRate := p.PerKeyThroughputPerSec * int(p.ClearFrequencyDuration.Seconds())
 	// for each key, calculate sample rate by dividing counted events by the
 	// desired number of events
-	newSavedSampleRates := make(map[string]int)
+	newSavedSampleRates := make(map[string]int, len(tmpCounts))
+	heavy := newHeavyKeys(p.HeavySampleThreshold)
+	var sumEvents, kept float64
 	for k, v := range tmpCounts {
 		rate := int(math.Max(1, (float64(v) / float64(actualPerKeyRate))))
-		newSavedSampleRates[k] = rate
+		heavy.set(newSavedSampleRates, k, rate)
+		sumEvents += float64(v)
+		kept += float64(v) / float64(rate)
 	}
+	p.keyTTL.carry(p.KeyTTL, now(), tmpCounts, oldRates, newSavedSampleRates, heavy)
 	// save newly calculated sample rates
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	p.savedSampleRates = newSavedSampleRates
+	p.heavyKeys = heavy
+	p.keptFraction = keptFractionPPM(kept, sumEvents)
+	p.publishMetrics()
+}
+
+// publishMetrics publishes the metrics that change once an interval, for
+// GetMetrics. The caller must hold the lock.
+func (p *PerKeyThroughput) publishMetrics() {
+	p.metrics.Store(&perKeyThroughputMetrics{
+		intervalCount:      p.intervalCount,
+		keysAboveThreshold: p.heavyKeys.value(),
+		keptFraction:       p.keptFraction,
+		eventsPerSec:       p.eventRate.perSec,
+		keyspace:           p.keyspace,
+	})
 }
 
 // GetSampleRate takes a key and returns the appropriate sample rate for that
@@ -131,20 +273,34 @@ func (p *PerKeyThroughput) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (p *PerKeyThroughput) GetSampleRateMulti(key string, count int) int {
+	return p.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (p *PerKeyThroughput) GetSampleRateMulti64(key string, count int64) int {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	if p.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	p.counts.add(count)
 
-	p.requestCount++
-	p.eventCount += int64(count)
-
-	// Enforce MaxKeys limit on the size of the map
-	if p.MaxKeys > 0 {
-		// If a key already exists, add the count. If not, but we're under the limit, store a new key
-		if _, found := p.currentCounts[key]; found || len(p.currentCounts) < p.MaxKeys {
-			p.currentCounts[key] += count
+	key, track := p.oversizeKeys.check(key, p.MaxKeyLength, p.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if p.MaxKeys > 0 {
+			// If a key already exists, add the count. If not, but we're under the limit, store a new key
+			if _, found := p.currentCounts[key]; found || len(p.currentCounts) < p.MaxKeys {
+				p.currentCounts[key] += clampInt(count)
+			} else {
+				p.droppedKeys.add(key)
+			}
+		} else {
+			p.currentCounts[key] += clampInt(count)
 		}
-	} else {
-		p.currentCounts[key] += count
+		p.keyCount.Store(int64(len(p.currentCounts)))
 	}
 	if rate, found := p.savedSampleRates[key]; found {
 		return rate
@@ -152,6 +308,19 @@ func (p *PerKeyThroughput) GetSampleRateMulti(key string, count int) int {
 	return 1
 }
 
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (p *PerKeyThroughput) PeekSampleRate(key string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key, _ = (&oversizeKeys{}).check(key, p.MaxKeyLength, p.OnOversizeKey)
+	if rate, found := p.savedSampleRates[key]; found {
+		return rate
+	}
+	return 1
+}
+
 // SaveState is not implemented
 func (p *PerKeyThroughput) SaveState() ([]byte, error) {
 	return nil, nil
@@ -162,13 +331,78 @@ func (p *PerKeyThroughput) LoadState(state []byte) error {
 	return nil
 }
 
-func (p *PerKeyThroughput) GetMetrics(prefix string) map[string]int64 {
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (p *PerKeyThroughput) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (p *PerKeyThroughput) DroppedKeySamples() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (p *PerKeyThroughput) OversizeKeyError() error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": p.requestCount,
-		prefix + "event_count":   p.eventCount,
-		prefix + "keyspace_size": int64(len(p.currentCounts)),
+	return p.oversizeKeys.takeErr()
+}
+
+func (p *PerKeyThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(p.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. It doesn't take the sampler's lock, so scraping often
+// doesn't hold sampling up. request_count and event_count always agree with
+// each other: a request in progress is counted in both or in neither. The
+// metrics that change once an interval are all from the end of the same one.
+func (p *PerKeyThroughput) GetMetricsTyped(prefix string) map[string]Metric {
+	requests, events := p.counts.read()
+	m := p.metrics.Load()
+	if m == nil {
+		// no interval has ended yet
+		m = &perKeyThroughputMetrics{}
+	}
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(requests),
+		prefix + "event_count":          counter(events),
+		prefix + "interval_count":       counter(m.intervalCount),
+		prefix + "keyspace_size":        gauge(m.keyspace.report(p.SmoothKeyspaceMetric, p.keyCount.Load())),
+		prefix + "keys_above_threshold": gauge(m.keysAboveThreshold),
+		prefix + "oversize_key_count":   counter(p.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":        gauge(m.keptFraction),
+		prefix + "events_per_sec":       gauge(m.eventsPerSec),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (p *PerKeyThroughput) GetMetricsSummary(prefix string) map[string]int64 {
+	_, events := p.counts.read()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return summarizeRates(prefix, p.savedSampleRates, events)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (p *PerKeyThroughput) GetAllSampleRates() map[string]int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return copyRates(p.savedSampleRates)
+}
@@ -1,6 +1,7 @@
 package dynsampler
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -240,6 +241,9 @@ func TestPerKeyThroughputMaxKeys(t *testing.T) {
 	p.GetSampleRate("one")
 	assert.Equal(t, 3, len(p.currentCounts))
 	assert.Equal(t, 2, p.currentCounts["one"])
+	// The rejected key should be available as a sample, and reading clears it
+	assert.Equal(t, []string{"four"}, p.DroppedKeySamples())
+	assert.Equal(t, []string{}, p.DroppedKeySamples())
 }
 
 func TestPerKeyThroughput_Start(t *testing.T) {
@@ -265,6 +269,9 @@ func TestPerKeyThroughput_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("PerKeyThroughput error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("PerKeyThroughput error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.ClearFrequencyDuration {
@@ -274,3 +281,58 @@ func TestPerKeyThroughput_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestPerKeyThroughput_GetMetrics(t *testing.T) {
+	p := &PerKeyThroughput{
+		ClearFrequencyDuration: time.Second,
+		PerKeyThroughputPerSec: 5,
+		HeavySampleThreshold:   1,
+	}
+	p.currentCounts = map[string]int{}
+	p.savedSampleRates = map[string]int{}
+	p.GetSampleRateMulti("a", 10)
+	p.GetSampleRateMulti("b", 2)
+
+	mets := p.GetMetrics("p_")
+	assert.Equal(t, int64(2), mets["p_request_count"])
+	assert.Equal(t, int64(12), mets["p_event_count"])
+	assert.Equal(t, int64(2), mets["p_keyspace_size"])
+	assert.Equal(t, int64(0), mets["p_interval_count"])
+
+	p.updateMaps()
+	mets = p.GetMetrics("p_")
+	assert.Equal(t, int64(12), mets["p_events_per_sec"])
+	// "a" gets a rate of 2, and "b" a rate of 1
+	assert.Equal(t, int64(1), mets["p_keys_above_threshold"])
+	p.updateMaps()
+	mets = p.GetMetrics("p_")
+	assert.Equal(t, int64(2), mets["p_interval_count"])
+	assert.Equal(t, int64(0), mets["p_events_per_sec"])
+	assert.Equal(t, int64(0), mets["p_keys_above_threshold"])
+}
+
+func TestPerKeyThroughputKeyTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+	p := &PerKeyThroughput{
+		ClearFrequencyDuration: time.Second,
+		PerKeyThroughputPerSec: 5,
+		KeyTTL:                 2 * time.Second,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+
+	p.GetSampleRateMulti("flood", 100)
+	p.Update()
+	assert.Equal(t, 20, p.PeekSampleRate("flood"))
+
+	// a whole interval without traffic doesn't lose the rate
+	clock.advance(time.Second)
+	p.Update()
+	assert.Equal(t, map[string]int{"flood": 20}, p.savedSampleRates)
+
+	clock.advance(time.Second)
+	p.Update()
+	assert.Empty(t, p.savedSampleRates)
+}
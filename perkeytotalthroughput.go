@@ -0,0 +1,377 @@
+package dynsampler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// PerKeyTotalThroughput implements Sampler and enforces two limits at once: at
+// most PerKeyThroughputPerSec events per second for each key, and at most
+// GoalThroughputPerSec events per second in total.
+//
+// Chaining a PerKeyThroughput and a TotalThroughput with MaxRuleSampler counts
+// every event twice and lets each pick a rate without knowing about the
+// other, so the result depends on how they interact. This sampler calculates
+// one set of rates from one set of counts instead. At the end of each
+// interval, every key is first limited to the per-key goal; then, if the keys
+// together would still send more than the total goal, the total is shared
+// between them as fairly as it can be: keys that need less than an equal
+// share keep what the per-key goal allowed them, and the rest is split
+// equally between the busier keys (see StrictBudgetSampler).
+//
+// Like TotalThroughput, it can't send fewer than one event per key per
+// interval on average, so with more keys than the total goal allows for, the
+// actual throughput exceeds GoalThroughputPerSec.
+type PerKeyTotalThroughput struct {
+	// ClearFrequencyDuration is how often the counters reset. The default is
+	// 30s.
+	ClearFrequencyDuration time.Duration
+
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// PerKeyThroughputPerSec is the most events to send per second for any
+	// one key. Default 10
+	PerKeyThroughputPerSec int
+
+	// GoalThroughputPerSec is the most events to send per second across all
+	// keys. Default 100
+	GoalThroughputPerSec int
+
+	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
+	// the sample rate map within the interval defined by `ClearFrequencyDuration`. Once
+	// MaxKeys is reached, new keys will not be included in the sample rate map, but
+	// existing keys will continue to be be counted.
+	MaxKeys int
+
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
+	savedSampleRates map[string]int
+	currentCounts    map[string]int
+	done             chan struct{}
+
+	lock sync.Mutex
+
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
+	// metrics
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+	perKeyCapped  int64      // keys limited by the per-key goal
+	totalCapped   int64      // keys limited further by the total goal
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*PerKeyTotalThroughput)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (p *PerKeyTotalThroughput) Validate() error {
+	if p.ClearFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the ClearFrequencyDuration %v must not be negative", p.ClearFrequencyDuration)
+	}
+	if p.PerKeyThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the PerKeyThroughputPerSec %d must not be negative", p.PerKeyThroughputPerSec)
+	}
+	if p.GoalThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalThroughputPerSec %d must not be negative", p.GoalThroughputPerSec)
+	}
+	if p.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", p.HeavySampleThreshold)
+	}
+	return nil
+}
+
+func (p *PerKeyTotalThroughput) Start() error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
+	if p.ClearFrequencyDuration == 0 {
+		p.ClearFrequencyDuration = 30 * time.Second
+	}
+	if p.PerKeyThroughputPerSec == 0 {
+		p.PerKeyThroughputPerSec = 10
+	}
+	if p.GoalThroughputPerSec == 0 {
+		p.GoalThroughputPerSec = 100
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", p.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
+	// initialize internal variables
+	p.savedSampleRates = make(map[string]int, p.ExpectedKeys)
+	p.currentCounts = make(map[string]int, p.ExpectedKeys)
+	p.done = make(chan struct{})
+
+	if p.NoBackgroundGoroutine {
+		return nil
+	}
+
+	// spin up calculator
+	go func() {
+		ticker := newTicker(p.ClearFrequencyDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				p.updateMaps()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *PerKeyTotalThroughput) Stop() error {
+	close(p.done)
+	exportRates(p.ExportOnStop, &p.lock, &p.savedSampleRates)
+	return nil
+}
+
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (p *PerKeyTotalThroughput) Update() {
+	p.updateMaps()
+}
+
+// updateMaps calculates a new saved rate map based on the contents of the
+// counter map, applying the per-key goal and then the total goal.
+func (p *PerKeyTotalThroughput) updateMaps() {
+	// make a local copy of the sample counters for calculation
+	p.lock.Lock()
+	tmpCounts := p.currentCounts
+	p.keyspace.observe(len(tmpCounts))
+	p.intervalCount++
+	p.currentCounts = make(map[string]int, p.ExpectedKeys)
+	p.eventRate.update(p.eventCount, now(), p.ClearFrequencyDuration)
+	p.lock.Unlock()
+	// short circuit if no traffic
+	if len(tmpCounts) == 0 {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.savedSampleRates = make(map[string]int)
+		p.heavyKeys = nil
+		p.perKeyCapped, p.totalCapped = 0, 0
+		return
+	}
+	seconds := p.ClearFrequencyDuration.Seconds()
+	perKeyGoal := int(math.Max(1, float64(p.PerKeyThroughputPerSec)*seconds))
+	totalGoal := int(math.Max(1, float64(p.GoalThroughputPerSec)*seconds))
+
+	// the per-key goal limits what each key may send, and then the total
+	// goal is shared out between those limits
+	wanted := make(map[string]int, len(tmpCounts))
+	for k, v := range tmpCounts {
+		wanted[k] = v
+		if v > perKeyGoal {
+			wanted[k] = perKeyGoal
+		}
+	}
+	shares, _ := allocateBudget(totalGoal, wanted)
+
+	newSavedSampleRates := make(map[string]int, len(tmpCounts))
+	heavy := newHeavyKeys(p.HeavySampleThreshold)
+	var sumEvents, kept float64
+	var perKeyCapped, totalCapped int64
+	for k, v := range tmpCounts {
+		share := shares[k]
+		switch {
+		case share < wanted[k]:
+			totalCapped++
+		case wanted[k] < v:
+			perKeyCapped++
+		}
+		rate := int(math.Max(1, float64(v)))
+		if share > 0 {
+			rate = int(math.Max(1, float64(v)/float64(share)))
+		}
+		heavy.set(newSavedSampleRates, k, rate)
+		sumEvents += float64(v)
+		kept += float64(v) / float64(rate)
+	}
+	// save newly calculated sample rates
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.savedSampleRates = newSavedSampleRates
+	p.heavyKeys = heavy
+	p.keptFraction = keptFractionPPM(kept, sumEvents)
+	p.perKeyCapped, p.totalCapped = perKeyCapped, totalCapped
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (p *PerKeyTotalThroughput) GetSampleRate(key string) int {
+	return p.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key.
+func (p *PerKeyTotalThroughput) GetSampleRateMulti(key string, count int) int {
+	return p.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (p *PerKeyTotalThroughput) GetSampleRateMulti64(key string, count int64) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	p.requestCount++
+	p.eventCount += count
+
+	key, track := p.oversizeKeys.check(key, p.MaxKeyLength, p.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if p.MaxKeys > 0 {
+			// If a key already exists, add the count. If not, but we're under the limit, store a new key
+			if _, found := p.currentCounts[key]; found || len(p.currentCounts) < p.MaxKeys {
+				p.currentCounts[key] += clampInt(count)
+			} else {
+				p.droppedKeys.add(key)
+			}
+		} else {
+			p.currentCounts[key] += clampInt(count)
+		}
+	}
+	if rate, found := p.savedSampleRates[key]; found {
+		return rate
+	}
+	return 1
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (p *PerKeyTotalThroughput) PeekSampleRate(key string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key, _ = (&oversizeKeys{}).check(key, p.MaxKeyLength, p.OnOversizeKey)
+	if rate, found := p.savedSampleRates[key]; found {
+		return rate
+	}
+	return 1
+}
+
+// SaveState is not implemented
+func (p *PerKeyTotalThroughput) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (p *PerKeyTotalThroughput) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (p *PerKeyTotalThroughput) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (p *PerKeyTotalThroughput) DroppedKeySamples() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (p *PerKeyTotalThroughput) OversizeKeyError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.oversizeKeys.takeErr()
+}
+
+func (p *PerKeyTotalThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(p.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. per_key_capped_keys and total_capped_keys are the
+// numbers of keys that, as of the last interval, were limited by the per-key
+// goal and limited further by the total goal.
+func (p *PerKeyTotalThroughput) GetMetricsTyped(prefix string) map[string]Metric {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(p.requestCount),
+		prefix + "event_count":          counter(p.eventCount),
+		prefix + "interval_count":       counter(p.intervalCount),
+		prefix + "keyspace_size":        gauge(p.keyspace.report(p.SmoothKeyspaceMetric, int64(len(p.currentCounts)))),
+		prefix + "keys_above_threshold": gauge(p.heavyKeys.value()),
+		prefix + "oversize_key_count":   counter(p.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":        gauge(p.keptFraction),
+		prefix + "events_per_sec":       gauge(p.eventRate.perSec),
+		prefix + "per_key_capped_keys":  gauge(p.perKeyCapped),
+		prefix + "total_capped_keys":    gauge(p.totalCapped),
+	}
+	return mets
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (p *PerKeyTotalThroughput) GetAllSampleRates() map[string]int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return copyRates(p.savedSampleRates)
+}
@@ -0,0 +1,100 @@
+package dynsampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerKeyTotalThroughputUpdateMaps(t *testing.T) {
+	p := &PerKeyTotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		PerKeyThroughputPerSec: 10,
+		GoalThroughputPerSec:   25,
+	}
+	tsts := []struct {
+		counts           map[string]int
+		wantRates        map[string]int
+		wantPerKeyCapped int64
+		wantTotalCapped  int64
+	}{
+		{
+			// only the per-key goal binds
+			map[string]int{"a": 5, "b": 50},
+			map[string]int{"a": 1, "b": 5},
+			1, 0,
+		},
+		{
+			// the per-key goal allows 4+8+10+10 events, more than the total
+			// goal, so the quiet key keeps all its events and the others share
+			// the rest equally
+			map[string]int{"a": 4, "b": 8, "c": 100, "d": 1000},
+			map[string]int{"a": 1, "b": 1, "c": 14, "d": 142},
+			0, 3,
+		},
+		{
+			// nearly as many keys as the total goal allows for, so the quiet
+			// keys use it all up and the busiest get nothing left to share
+			map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1, "g": 1, "h": 1, "i": 1, "j": 1,
+				"k": 1, "l": 1, "m": 1, "n": 1, "o": 1, "p": 1, "q": 1, "r": 1, "s": 1, "t": 1,
+				"u": 1, "v": 1, "w": 1, "x": 1, "y": 2, "z": 2},
+			map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1, "g": 1, "h": 1, "i": 1, "j": 1,
+				"k": 1, "l": 1, "m": 1, "n": 1, "o": 1, "p": 1, "q": 1, "r": 1, "s": 1, "t": 1,
+				"u": 1, "v": 1, "w": 1, "x": 1, "y": 2, "z": 2},
+			0, 2,
+		},
+		{
+			map[string]int{},
+			map[string]int{},
+			0, 0,
+		},
+	}
+	for i, tst := range tsts {
+		p.currentCounts = tst.counts
+		p.updateMaps()
+		assert.Equal(t, tst.wantRates, p.savedSampleRates, "test %d", i)
+		assert.Equal(t, tst.wantPerKeyCapped, p.GetMetrics("")["per_key_capped_keys"], "test %d", i)
+		assert.Equal(t, tst.wantTotalCapped, p.GetMetrics("")["total_capped_keys"], "test %d", i)
+	}
+}
+
+func TestPerKeyTotalThroughputGetSampleRate(t *testing.T) {
+	p := &PerKeyTotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		PerKeyThroughputPerSec: 10,
+		GoalThroughputPerSec:   25,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 1, p.GetSampleRate("busy"))
+	}
+	p.GetSampleRateMulti("quiet", 4)
+	p.Update()
+	assert.Equal(t, 10, p.GetSampleRate("busy"))
+	assert.Equal(t, 1, p.GetSampleRate("quiet"))
+	assert.Equal(t, 1, p.GetSampleRate("new"))
+	assert.Equal(t, int64(104+3), p.GetMetrics("")["event_count"])
+	assert.Equal(t, int64(0), p.GetMetrics("")["keys_above_threshold"])
+}
+
+func TestPerKeyTotalThroughputZeroCount(t *testing.T) {
+	p := &PerKeyTotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		PerKeyThroughputPerSec: 10,
+		GoalThroughputPerSec:   25,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+
+	p.GetSampleRateMulti("zero", 0)
+	p.GetSampleRateMulti("busy", 100)
+	p.Update()
+	// a key seen with no events still gets a valid rate
+	assert.Equal(t, 1, p.GetSampleRate("zero"))
+	assert.Equal(t, 10, p.GetSampleRate("busy"))
+}
@@ -0,0 +1,188 @@
+// Package persist keeps a sampler's state in a store across process restarts.
+//
+// A PersistentSampler wraps any dynsampler.Sampler. When it starts, it loads
+// the state saved last time from a StateStore; while it runs, it saves the
+// state every SaveInterval; and when it stops, it saves the state one last
+// time. The package has a MemoryStore and a FileStore, and doesn't depend on
+// any database. To keep state in Redis, or anywhere else, implement
+// StateStore. For example, with the github.com/redis/go-redis/v9 client:
+//
+//	type RedisStore struct {
+//		Client *redis.Client
+//		TTL    time.Duration
+//	}
+//
+//	func (r RedisStore) Save(key string, data []byte) error {
+//		return r.Client.Set(context.Background(), key, data, r.TTL).Err()
+//	}
+//
+//	func (r RedisStore) Load(key string) ([]byte, error) {
+//		data, err := r.Client.Get(context.Background(), key).Bytes()
+//		if errors.Is(err, redis.Nil) {
+//			return nil, persist.ErrNotFound
+//		}
+//		return data, err
+//	}
+//
+// Give each process its own key, such as the host name and the sampler's
+// purpose, unless the processes are meant to share one sampler's state.
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/dynsampler-go"
+)
+
+// ErrNotFound is returned by StateStore.Load when nothing has been saved
+// under the key.
+var ErrNotFound = errors.New("no state saved")
+
+// StateStore stores samplers' saved state, keyed by name. Implementations
+// must be safe for concurrent use.
+type StateStore interface {
+	// Save stores data under key, replacing whatever was there.
+	Save(key string, data []byte) error
+
+	// Load returns the data last saved under key, or ErrNotFound if there is
+	// none.
+	Load(key string) ([]byte, error)
+}
+
+// PersistentSampler implements dynsampler.Sampler by wrapping another sampler
+// and keeping its state in a StateStore. Everything but Start and Stop is
+// passed straight to the wrapped sampler.
+type PersistentSampler struct {
+	dynsampler.Sampler
+
+	// Store is where the state is kept. It is required.
+	Store StateStore
+
+	// Key is the name the state is kept under. It is required.
+	Key string
+
+	// SaveInterval is how often the state is saved while the sampler runs.
+	// Defaults to 1 minute. If it is negative, the state is saved only when
+	// the sampler stops.
+	SaveInterval time.Duration
+
+	// OnError, if set, is called with errors from loading state in Start and
+	// from saving it in the background, which otherwise are dropped. Errors from loading state
+	// don't stop the sampler from starting; it starts without the state
+	// instead. It is called from Start and from the goroutine that saves the
+	// state, so it must not block for long.
+	OnError func(error)
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Ensure we implement the sampler interface
+var _ dynsampler.Sampler = (*PersistentSampler)(nil)
+
+// Start loads the state saved under Key, if there is any, into the wrapped
+// sampler, starts it, and starts saving its state every SaveInterval.
+func (p *PersistentSampler) Start() error {
+	if p.Sampler == nil || p.Store == nil || p.Key == "" {
+		return errors.New("a PersistentSampler needs a Sampler, a Store, and a Key")
+	}
+	if p.SaveInterval == 0 {
+		p.SaveInterval = time.Minute
+	}
+
+	if err := p.load(); err != nil {
+		p.report(err)
+	}
+	if err := p.Sampler.Start(); err != nil {
+		return err
+	}
+
+	p.done = make(chan struct{})
+	if p.SaveInterval < 0 {
+		return nil
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.SaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.Save(); err != nil {
+					p.report(err)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops saving state in the background, saves it one last time, and
+// stops the wrapped sampler. The error from saving, if any, is returned after
+// the sampler is stopped.
+func (p *PersistentSampler) Stop() error {
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+	}
+	saveErr := p.Save()
+	if err := p.Sampler.Stop(); err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// Save saves the wrapped sampler's state to the store now. Nothing is stored
+// for samplers that don't support state, or that return no data.
+func (p *PersistentSampler) Save() error {
+	if !p.Sampler.SupportsState() {
+		return nil
+	}
+	state, err := p.Sampler.SaveState()
+	if err != nil {
+		return fmt.Errorf("saving state of %T: %w", p.Sampler, err)
+	}
+	if len(state) == 0 {
+		return nil
+	}
+	if err := p.Store.Save(p.Key, state); err != nil {
+		return fmt.Errorf("storing state under %q: %w", p.Key, err)
+	}
+	return nil
+}
+
+// PeekSampleRate returns the wrapped sampler's PeekSampleRate for key, or 1
+// if the wrapped sampler has no PeekSampleRate.
+func (p *PersistentSampler) PeekSampleRate(key string) int {
+	if s, ok := p.Sampler.(interface{ PeekSampleRate(string) int }); ok {
+		return s.PeekSampleRate(key)
+	}
+	return 1
+}
+
+// load loads the state saved under Key into the wrapped sampler.
+func (p *PersistentSampler) load() error {
+	state, err := p.Store.Load(p.Key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading state under %q: %w", p.Key, err)
+	}
+	if err := p.Sampler.LoadState(state); err != nil {
+		return fmt.Errorf("loading state into %T: %w", p.Sampler, err)
+	}
+	return nil
+}
+
+func (p *PersistentSampler) report(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
@@ -0,0 +1,109 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/dynsampler-go"
+)
+
+func TestFileStore(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}
+
+	_, err := store.Load("sampler")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, store.Save("sampler", []byte("one")))
+	assert.NoError(t, store.Save("sampler", []byte("two")))
+	data, err := store.Load("sampler")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+
+	// only the state file is left behind
+	files, err := os.ReadDir(store.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	for _, key := range []string{"", ".", "..", "../sampler", `a\b`} {
+		assert.Error(t, store.Save(key, []byte("x")), key)
+		_, err := store.Load(key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	var store MemoryStore
+	_, err := store.Load("sampler")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	data := []byte("state")
+	assert.NoError(t, store.Save("sampler", data))
+	data[0] = 'X'
+	loaded, err := store.Load("sampler")
+	assert.NoError(t, err)
+	assert.Equal(t, "state", string(loaded))
+}
+
+func TestPersistentSamplerRestart(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}
+
+	first := &dynsampler.AvgSampleRate{GoalSampleRate: 10, NoBackgroundGoroutine: true}
+	p := &PersistentSampler{Sampler: first, Store: store, Key: "avg", SaveInterval: -1}
+	assert.NoError(t, p.Start())
+	for i := 0; i < 1000; i++ {
+		p.GetSampleRate("busy")
+	}
+	p.GetSampleRate("quiet")
+	first.Update()
+	busyRate := p.GetSampleRate("busy")
+	assert.Greater(t, busyRate, 1)
+	assert.NoError(t, p.Stop())
+
+	// a new process picks up the rates where the last one left off
+	second := &dynsampler.AvgSampleRate{GoalSampleRate: 10, NoBackgroundGoroutine: true}
+	p = &PersistentSampler{Sampler: second, Store: store, Key: "avg", SaveInterval: -1}
+	assert.NoError(t, p.Start())
+	assert.Equal(t, busyRate, p.GetSampleRate("busy"))
+	assert.NoError(t, p.Stop())
+}
+
+func TestPersistentSamplerSavesPeriodically(t *testing.T) {
+	store := &MemoryStore{}
+	s := &dynsampler.AvgSampleRate{NoBackgroundGoroutine: true}
+	p := &PersistentSampler{Sampler: s, Store: store, Key: "avg", SaveInterval: 10 * time.Millisecond}
+	assert.NoError(t, p.Start())
+	defer p.Stop()
+
+	assert.Eventually(t, func() bool {
+		_, err := store.Load("avg")
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPersistentSamplerBadState(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}
+	assert.NoError(t, os.WriteFile(filepath.Join(store.Dir, "avg"), []byte("{not json"), 0o600))
+
+	var errs []error
+	p := &PersistentSampler{
+		Sampler:      &dynsampler.AvgSampleRate{},
+		Store:        store,
+		Key:          "avg",
+		SaveInterval: -1,
+		OnError:      func(err error) { errs = append(errs, err) },
+	}
+	assert.NoError(t, p.Start(), "bad state doesn't stop the sampler from starting")
+	assert.Len(t, errs, 1)
+	assert.NoError(t, p.Stop())
+
+	// stopping replaced the bad state
+	data, err := store.Load("avg")
+	assert.NoError(t, err)
+	assert.NoError(t, (&dynsampler.AvgSampleRate{}).LoadState(data))
+
+	assert.Error(t, (&PersistentSampler{Sampler: &dynsampler.AvgSampleRate{}}).Start())
+}
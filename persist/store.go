@@ -0,0 +1,97 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a StateStore that keeps state in memory. It keeps state
+// across a sampler being stopped and replaced within a process, and is useful
+// in tests. The zero value is ready to use.
+type MemoryStore struct {
+	lock   sync.Mutex
+	states map[string][]byte
+}
+
+// Ensure we implement the StateStore interface
+var _ StateStore = (*MemoryStore)(nil)
+
+// Save stores a copy of data under key.
+func (m *MemoryStore) Save(key string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.states == nil {
+		m.states = make(map[string][]byte)
+	}
+	m.states[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// Load returns a copy of the data saved under key.
+func (m *MemoryStore) Load(key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, found := m.states[key]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// FileStore is a StateStore that keeps the state for each key in a file of
+// the same name in Dir. Files are replaced atomically, so a crash while saving
+// leaves the previous state intact. Keys must be usable as file names.
+type FileStore struct {
+	// Dir is the directory the files are kept in. It must exist.
+	Dir string
+}
+
+// Ensure we implement the StateStore interface
+var _ StateStore = FileStore{}
+
+// Save writes data to a temporary file in Dir and renames it to key.
+func (f FileStore) Save(key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.Dir, "."+key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the file named key in Dir.
+func (f FileStore) Load(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// path returns the name of key's file, or an error if key isn't a plain file
+// name.
+func (f FileStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("the key %q is not a valid file name", key)
+	}
+	return filepath.Join(f.Dir, key), nil
+}
@@ -0,0 +1,16 @@
+package dynsampler
+
+// carryPinnedRates copies the rate of each pinned key from oldRates into
+// newRates if the latest calculation didn't produce one, so that pinned keys
+// keep their last calculated rate through intervals in which they are quiet.
+// The rates are set through heavy, which may be nil.
+func carryPinnedRates(pinned []string, oldRates, newRates map[string]int, heavy *heavyKeys) {
+	for _, key := range pinned {
+		if _, found := newRates[key]; found {
+			continue
+		}
+		if rate, found := oldRates[key]; found {
+			heavy.set(newRates, key, rate)
+		}
+	}
+}
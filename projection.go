@@ -0,0 +1,51 @@
+package dynsampler
+
+// ProjectionResult describes what a sampler would do with a hypothetical set
+// of counts. It is returned by the samplers' Project methods.
+type ProjectionResult struct {
+	// Rates is the sample rate each key would get.
+	Rates map[string]int
+
+	// Kept is the estimated number of events that would be kept.
+	Kept float64
+
+	// RateCounts is the number of keys that would get each sample rate.
+	RateCounts map[int]int
+
+	// KeysAtRateOne is the number of keys that would be kept entirely.
+	KeysAtRateOne int
+}
+
+// projectSampleRates calculates the rates that a sampler aiming for an average
+// sample rate of goalSampleRate would give to counts, the same way the
+// samplers do at the end of an interval, and summarizes them. A targetKept
+// greater than 0 aims to keep that many events instead. With keepAll, every
+// key gets a rate of 1. counts is not changed.
+func projectSampleRates(goalSampleRate, targetKept int, keepAll bool, counts map[string]float64, order KeyOrder, policy ExtraBudgetPolicy) ProjectionResult {
+	var rates map[string]int
+	var kept float64
+	if keepAll {
+		rates = make(map[string]int, len(counts))
+		for key, count := range counts {
+			rates[key] = 1
+			kept += count
+		}
+	} else if len(counts) > 0 {
+		goalRatio, _ := averageGoalRatio(counts, goalSampleRate, targetKept)
+		rates, kept = calculateSampleRates(goalRatio, counts, order, policy, nil)
+	}
+
+	p := ProjectionResult{
+		Rates:      make(map[string]int, len(rates)),
+		Kept:       kept,
+		RateCounts: make(map[int]int),
+	}
+	for key, rate := range rates {
+		p.Rates[key] = rate
+		p.RateCounts[rate]++
+		if rate == 1 {
+			p.KeysAtRateOne++
+		}
+	}
+	return p
+}
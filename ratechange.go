@@ -0,0 +1,47 @@
+package dynsampler
+
+import "sort"
+
+// rateChange is a change in one key's sample rate, to be reported to an
+// OnKeyRateChange callback.
+type rateChange struct {
+	key              string
+	oldRate, newRate int
+}
+
+// diffRates returns the changes between oldRates and newRates for the keys in
+// watch, or for every key in either map if watch is empty, in key order. A key
+// with no rate has a rate of 0, so keys that gain or lose a rate are included.
+func diffRates(watch []string, oldRates, newRates map[string]int) []rateChange {
+	keys := watch
+	if len(keys) == 0 {
+		keys = make([]string, 0, len(newRates))
+		for key := range newRates {
+			keys = append(keys, key)
+		}
+		for key := range oldRates {
+			if _, found := newRates[key]; !found {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+	var changes []rateChange
+	for _, key := range keys {
+		if oldRates[key] != newRates[key] {
+			changes = append(changes, rateChange{key, oldRates[key], newRates[key]})
+		}
+	}
+	return changes
+}
+
+// notifyRateChanges calls fn for each change. It must be called without the
+// sampler's lock held, so that fn may call back into the sampler.
+func notifyRateChanges(fn func(key string, oldRate, newRate int), changes []rateChange) {
+	if fn == nil {
+		return
+	}
+	for _, c := range changes {
+		fn(c.key, c.oldRate, c.newRate)
+	}
+}
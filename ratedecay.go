@@ -0,0 +1,21 @@
+package dynsampler
+
+import "math"
+
+// rateDecayIntervals is the number of intervals over which a decaying sample
+// rate steps down to 1.
+const rateDecayIntervals = 4
+
+// rateDecay tracks the saved sample rate of a key that has aged out of a
+// moving average while it steps down toward 1.
+type rateDecay struct {
+	from      int
+	intervals int
+}
+
+// rate returns the sample rate for the current step, moving linearly from the
+// original rate toward 1 and never going below it.
+func (d *rateDecay) rate() int {
+	remaining := float64(rateDecayIntervals-d.intervals) / rateDecayIntervals
+	return int(math.Max(1, math.Ceil(1+float64(d.from-1)*remaining)))
+}
@@ -0,0 +1,39 @@
+package dynsampler
+
+import (
+	"math/bits"
+	"strconv"
+)
+
+// rateHistogram is a cumulative histogram of the sample rates a sampler has
+// returned, bucketed by powers of two: bucket 1 holds rates of 1, bucket 2
+// holds 2-3, bucket 4 holds 4-7, and so on. Rates below 1 are counted in
+// bucket 0. The zero value is ready to use. It is not safe for concurrent use;
+// callers are expected to hold the owning sampler's lock.
+type rateHistogram struct {
+	buckets [64]int64
+}
+
+// record counts one returned sample rate.
+func (h *rateHistogram) record(rate int) {
+	if rate < 1 {
+		h.buckets[0]++
+		return
+	}
+	h.buckets[bits.Len64(uint64(rate))]++
+}
+
+// addMetrics adds a "<prefix>rate_bucket_<N>_count" entry to mets for every
+// bucket that has been used, where N is the lowest rate in the bucket.
+func (h *rateHistogram) addMetrics(mets map[string]Metric, prefix string) {
+	for i, n := range h.buckets {
+		if n == 0 {
+			continue
+		}
+		var lower uint64
+		if i > 0 {
+			lower = 1 << (i - 1)
+		}
+		mets[prefix+"rate_bucket_"+strconv.FormatUint(lower, 10)+"_count"] = counter(n)
+	}
+}
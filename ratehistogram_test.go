@@ -0,0 +1,24 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateHistogram(t *testing.T) {
+	h := rateHistogram{}
+	for _, rate := range []int{0, 1, 1, 2, 3, 4, 7, 8, 1000} {
+		h.record(rate)
+	}
+	mets := map[string]Metric{}
+	h.addMetrics(mets, "p_")
+	assert.Equal(t, map[string]int64{
+		"p_rate_bucket_0_count":   1,
+		"p_rate_bucket_1_count":   2,
+		"p_rate_bucket_2_count":   2,
+		"p_rate_bucket_4_count":   2,
+		"p_rate_bucket_8_count":   1,
+		"p_rate_bucket_512_count": 1,
+	}, metricValues(mets))
+}
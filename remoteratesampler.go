@@ -0,0 +1,206 @@
+package dynsampler
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RemoteRateSampler implements Sampler by serving sample rates that were
+// calculated somewhere else. In a cluster, a central service can compute
+// authoritative rates from everyone's traffic; each process polls for them,
+// hands them to SetSampleRates, and uses this sampler to serve them locally.
+//
+// The sampler never calculates rates itself and so runs no background
+// goroutine. It does still count the traffic it sees per key, so that the
+// counts can be collected with TakeCounts and reported back to the service
+// that computes the rates.
+type RemoteRateSampler struct {
+	// Default is the sample rate to use for keys that have no rate, including
+	// every key before SetSampleRates is first called. Default 1
+	Default int
+
+	// MaxKeys, if greater than 0, limits the number of distinct keys counted
+	// between calls to TakeCounts. Once MaxKeys is reached, new keys will not
+	// be counted, but existing keys will continue to be be counted. Rates are
+	// served for all keys regardless.
+	MaxKeys int
+
+	rates         atomic.Pointer[map[string]int]
+	currentCounts map[string]int
+
+	lock sync.Mutex
+
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// metrics
+	requestCount int64
+	eventCount   int64
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*RemoteRateSampler)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (r *RemoteRateSampler) Validate() error {
+	if r.Default < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the Default sample rate %d must not be negative", r.Default)
+	}
+	return nil
+}
+
+func (r *RemoteRateSampler) Start() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.Default == 0 {
+		r.Default = 1
+	}
+	r.currentCounts = make(map[string]int)
+	return nil
+}
+
+func (r *RemoteRateSampler) Stop() error {
+	return nil
+}
+
+// SetSampleRates replaces the sample rates being served. It is safe to call
+// while the sampler is serving GetSampleRate calls, and never blocks them. The
+// sampler takes ownership of the map; callers should not modify it after
+// passing it in. Passing nil makes every key use Default.
+func (r *RemoteRateSampler) SetSampleRates(rates map[string]int) {
+	r.rates.Store(&rates)
+}
+
+// TakeCounts returns the number of events seen for each key since the last
+// call to TakeCounts (or since Start), and resets them.
+func (r *RemoteRateSampler) TakeCounts() map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	counts := r.currentCounts
+	r.currentCounts = make(map[string]int, len(counts))
+	return counts
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (r *RemoteRateSampler) GetSampleRate(key string) int {
+	return r.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key.
+func (r *RemoteRateSampler) GetSampleRateMulti(key string, count int) int {
+	return r.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (r *RemoteRateSampler) GetSampleRateMulti64(key string, count int64) int {
+	r.lock.Lock()
+	if r.currentCounts == nil {
+		// not started yet
+		r.lock.Unlock()
+		return 1
+	}
+	r.requestCount++
+	r.eventCount += count
+
+	// Enforce MaxKeys limit on the size of the map
+	if r.MaxKeys > 0 {
+		// If a key already exists, increment it. If not, but we're under the limit, store a new key
+		if _, found := r.currentCounts[key]; found || len(r.currentCounts) < r.MaxKeys {
+			r.currentCounts[key] += clampInt(count)
+		} else {
+			r.droppedKeys.add(key)
+		}
+	} else {
+		r.currentCounts[key] += clampInt(count)
+	}
+	r.lock.Unlock()
+
+	if rates := r.rates.Load(); rates != nil {
+		if rate, found := (*rates)[key]; found {
+			return rate
+		}
+	}
+	return r.Default
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (r *RemoteRateSampler) PeekSampleRate(key string) int {
+	r.lock.Lock()
+	started := r.currentCounts != nil
+	r.lock.Unlock()
+	if !started {
+		return 1
+	}
+	if rates := r.rates.Load(); rates != nil {
+		if rate, found := (*rates)[key]; found {
+			return rate
+		}
+	}
+	return r.Default
+}
+
+// SaveState is not implemented
+func (r *RemoteRateSampler) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (r *RemoteRateSampler) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (r *RemoteRateSampler) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (r *RemoteRateSampler) DroppedKeySamples() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.droppedKeys.drain()
+}
+
+func (r *RemoteRateSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(r.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (r *RemoteRateSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	mets := map[string]Metric{
+		prefix + "request_count": counter(r.requestCount),
+		prefix + "event_count":   counter(r.eventCount),
+		prefix + "keyspace_size": gauge(int64(len(r.currentCounts))),
+	}
+	return mets
+}
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (r *RemoteRateSampler) GetMetricsSummary(prefix string) map[string]int64 {
+	var rates map[string]int
+	if p := r.rates.Load(); p != nil {
+		rates = *p
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return summarizeRates(prefix, rates, r.eventCount)
+}
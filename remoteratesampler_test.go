@@ -0,0 +1,55 @@
+package dynsampler
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteRateSampler(t *testing.T) {
+	r := &RemoteRateSampler{Default: 5}
+	assert.Nil(t, r.Start())
+	defer r.Stop()
+
+	// until rates arrive, everything gets the default
+	assert.Equal(t, 5, r.GetSampleRate("a"))
+
+	r.SetSampleRates(map[string]int{"a": 10, "b": 2})
+	assert.Equal(t, 10, r.GetSampleRateMulti("a", 3))
+	assert.Equal(t, 2, r.GetSampleRate("b"))
+	assert.Equal(t, 5, r.GetSampleRate("c"))
+
+	mets := r.GetMetrics("r_")
+	assert.Equal(t, int64(4), mets["r_request_count"])
+	assert.Equal(t, int64(6), mets["r_event_count"])
+	assert.Equal(t, int64(3), mets["r_keyspace_size"])
+
+	assert.Equal(t, map[string]int{"a": 4, "b": 1, "c": 1}, r.TakeCounts())
+	assert.Equal(t, map[string]int{}, r.TakeCounts())
+
+	r.SetSampleRates(nil)
+	assert.Equal(t, 5, r.GetSampleRate("a"))
+}
+
+func TestRemoteRateSamplerRace(t *testing.T) {
+	r := &RemoteRateSampler{}
+	assert.Nil(t, r.Start())
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				rate := r.GetSampleRate("key" + strconv.Itoa(i))
+				assert.NotEqual(t, 0, rate, "rate should never be zero")
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		r.SetSampleRates(map[string]int{"key1": i + 1})
+		r.TakeCounts()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,29 @@
+package dynsampler
+
+// RepresentedCount asks s for the sample rate for one event with the given
+// key, the same way GetSampleRate does, and returns it as the number of
+// original events that the event stands for if it is kept.
+//
+// A sample rate of N means one in N events is kept, so each kept event
+// represents N events, itself included: a backend that reweights by the
+// represented count recovers the original volume. This is the same number
+// Honeycomb expects as an event's SampleRate; the two names are for pipelines
+// that think in terms of weights and of rates respectively. Events that are
+// dropped represent nothing, so the count only applies to events that are
+// kept, and it must be recorded with them. Call this once per event, as it
+// counts the event toward the sampler's traffic.
+func RepresentedCount(s Sampler, key string) int {
+	return s.GetSampleRate(key)
+}
+
+// AnnotateSampleRate asks s for the sample rate for one event with the given
+// key, the same way GetSampleRate does, stores it in event under field, and
+// returns it. The caller still decides whether to keep the event; if it is
+// kept, the field tells the backend how many events it represents (see
+// RepresentedCount). An existing value in field is replaced. event must not
+// be nil.
+func AnnotateSampleRate(s Sampler, key string, event map[string]interface{}, field string) int {
+	rate := s.GetSampleRate(key)
+	event[field] = rate
+	return rate
+}
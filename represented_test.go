@@ -0,0 +1,22 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepresentedCount(t *testing.T) {
+	s := &Static{Rates: map[string]int{"busy": 20}, Default: 1}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	assert.Equal(t, 20, RepresentedCount(s, "busy"))
+	assert.Equal(t, 1, RepresentedCount(s, "quiet"))
+
+	event := map[string]interface{}{"name": "request", "SampleRate": 5}
+	assert.Equal(t, 20, AnnotateSampleRate(s, "busy", event, "SampleRate"))
+	assert.Equal(t, map[string]interface{}{"name": "request", "SampleRate": 20}, event)
+
+	assert.Equal(t, int64(3), s.GetMetrics("")["request_count"])
+}
@@ -0,0 +1,39 @@
+package dynsampler
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// requestCounter counts requests and the events in them without a lock, so
+// that GetMetrics can read both without holding up sampling. The two are read
+// together: a request is never counted in one and not yet in the other. The
+// zero value is ready to use, and it is safe for concurrent use.
+type requestCounter struct {
+	started  atomic.Int64 // requests counted, which is request_count
+	events   atomic.Int64
+	finished atomic.Int64 // requests whose events have been added
+}
+
+// add counts one request of count events.
+func (c *requestCounter) add(count int64) {
+	c.started.Add(1)
+	c.events.Add(count)
+	c.finished.Add(1)
+}
+
+// read returns the number of requests and events counted. The events are read
+// between the finished and started counts; if those are equal, every request
+// counted had finished before the events were read and none had started since,
+// so the events are exactly those of the requests. Otherwise a request was in
+// progress, and it tries again.
+func (c *requestCounter) read() (requests, events int64) {
+	for {
+		finished := c.finished.Load()
+		events = c.events.Load()
+		if requests = c.started.Load(); requests == finished {
+			return requests, events
+		}
+		runtime.Gosched()
+	}
+}
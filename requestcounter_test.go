@@ -0,0 +1,51 @@
+package dynsampler
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMetricsWhileSampling(t *testing.T) {
+	samplers := map[string]Sampler{
+		"Static":           &Static{Rates: map[string]int{"key0": 10}},
+		"PerKeyThroughput": &PerKeyThroughput{NoBackgroundGoroutine: true},
+	}
+	for name, s := range samplers {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, s.Start())
+			defer s.Stop()
+
+			// every request has 3 events, so the counts must always agree
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 2000; j++ {
+						s.GetSampleRateMulti("key"+strconv.Itoa((i+j)%10), 3)
+					}
+				}(i)
+			}
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				default:
+				}
+				mets := s.GetMetrics("")
+				assert.Equal(t, 3*mets["request_count"], mets["event_count"])
+			}
+			mets := s.GetMetrics("")
+			assert.Equal(t, int64(8000), mets["request_count"])
+			assert.Equal(t, int64(24000), mets["event_count"])
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package dynsampler
+
+// RateSource says where the sample rate in a Result came from.
+type RateSource int
+
+const (
+	// SourceComputed means the rate was calculated for the key from recent
+	// traffic.
+	SourceComputed RateSource = iota
+	// SourceColdStart means no rates had been calculated yet, so the
+	// sampler's startup rate was used.
+	SourceColdStart
+	// SourceUnknownKey means rates have been calculated, but not for this key,
+	// usually because it is new or has been quiet, so the sampler's rate for
+	// unknown keys was used.
+	SourceUnknownKey
+	// SourceOverride means configuration decided the rate regardless of
+	// traffic, for example because KeepAll is set.
+	SourceOverride
+	// SourceCapped means the rate calculated for the key was at a configured
+	// maximum, such as MaxSampleRate, so the key would otherwise have been
+	// sampled harder.
+	SourceCapped
+	// SourceRejected means the key was not counted, because it was too long
+	// or MaxKeys had been reached. It still gets a rate, but that rate won't
+	// reflect its traffic.
+	SourceRejected
+)
+
+// String returns the name of the source, such as "computed".
+func (s RateSource) String() string {
+	switch s {
+	case SourceComputed:
+		return "computed"
+	case SourceColdStart:
+		return "cold_start"
+	case SourceUnknownKey:
+		return "unknown_key"
+	case SourceOverride:
+		return "override"
+	case SourceCapped:
+		return "capped"
+	case SourceRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// Result describes a sampling decision made by Evaluate: the sample rate, why
+// it was chosen, and how many of the events it covers are expected to be
+// kept.
+type Result struct {
+	// Rate is the sample rate, the same as GetSampleRateMulti would return.
+	Rate int
+	// Source says where Rate came from.
+	Source RateSource
+	// KeptEstimate is the number of the events that are expected to be kept
+	// at Rate, which is the count divided by Rate.
+	KeptEstimate float64
+}
+
+func newResult(rate int, source RateSource, count int64) Result {
+	r := Result{Rate: rate, Source: source}
+	if rate > 0 {
+		r.KeptEstimate = float64(count) / float64(rate)
+	}
+	return r
+}
@@ -0,0 +1,48 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvgSampleRateEvaluate(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate: 10,
+		MaxKeys:        2,
+		currentCounts:  map[string]float64{},
+	}
+	assert.Equal(t, Result{Rate: 10, Source: SourceColdStart, KeptEstimate: 2}, a.Evaluate("a", 20))
+
+	a.haveData = true
+	a.savedSampleRates = map[string]int{"a": 4}
+	assert.Equal(t, Result{Rate: 4, Source: SourceComputed, KeptEstimate: 2}, a.Evaluate("a", 8))
+	assert.Equal(t, Result{Rate: 1, Source: SourceUnknownKey, KeptEstimate: 3}, a.Evaluate("b", 3))
+	// MaxKeys is reached, so c isn't counted
+	assert.Equal(t, Result{Rate: 1, Source: SourceRejected, KeptEstimate: 1}, a.Evaluate("c", 1))
+
+	a.KeepAll = true
+	assert.Equal(t, Result{Rate: 1, Source: SourceOverride, KeptEstimate: 8}, a.Evaluate("a", 8))
+	// Evaluate counts events just like GetSampleRateMulti
+	assert.Equal(t, float64(36), a.currentCounts["a"])
+}
+
+func TestEMAThroughputEvaluate(t *testing.T) {
+	e := &EMAThroughput{
+		InitialSampleRate: 10,
+		MaxSampleRate:     50,
+		currentCounts:     map[string]float64{},
+	}
+	assert.Equal(t, Result{Rate: 10, Source: SourceColdStart, KeptEstimate: 0.5}, e.Evaluate("a", 5))
+
+	e.haveData = true
+	e.savedSampleRates = map[string]int{"a": 4, "busy": 50}
+	assert.Equal(t, Result{Rate: 4, Source: SourceComputed, KeptEstimate: 1}, e.Evaluate("a", 4))
+	assert.Equal(t, Result{Rate: 50, Source: SourceCapped, KeptEstimate: 2}, e.Evaluate("busy", 100))
+	assert.Equal(t, Result{Rate: 1, Source: SourceUnknownKey, KeptEstimate: 1}, e.Evaluate("new", 1))
+
+	e.MaxKeyLength = 2
+	e.OnOversizeKey = OversizeKeyDrop
+	assert.Equal(t, SourceRejected, e.Evaluate("too long", 1).Source)
+	assert.Equal(t, "rejected", SourceRejected.String())
+}
@@ -0,0 +1,176 @@
+package dynsampler
+
+import (
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+// ShardedSampler implements Sampler for one node of a fleet that divides the
+// key space between its nodes. Keys are hashed, and the range of hashes is
+// split into ShardCount equal parts; the node with ShardIndex i is responsible
+// for the i'th. Keys in this node's range are passed to the wrapped Sampler,
+// and keys in other nodes' ranges are kept at a rate of 1, on the
+// understanding that the node responsible for them samples them instead.
+//
+// Every node must use the same ShardCount and HashFunc, or their ranges won't
+// fit together, and some keys will be sampled by two nodes or by none.
+type ShardedSampler struct {
+	// Sampler samples the keys in this node's range. It is required, and is
+	// started and stopped with the ShardedSampler.
+	Sampler Sampler
+
+	// ShardIndex is this node's shard, from 0 to ShardCount-1.
+	ShardIndex int
+
+	// ShardCount is the number of shards the key space is divided into.
+	// Defaults to 1, which leaves every key to this node.
+	ShardCount int
+
+	// HashFunc, if set, replaces the hash used to place keys in shards. It
+	// must be safe to call from multiple goroutines at once, and should spread
+	// its results evenly over all 64 bits, or some shards will get more than
+	// their share of keys. Changing it moves keys between shards. Defaults to
+	// FNV-1a, with its bits mixed.
+	HashFunc func(string) uint64
+
+	lock sync.Mutex
+
+	// metrics
+	requestCount int64
+	eventCount   int64
+	passedCount  int64 // calls for keys in other shards
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*ShardedSampler)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate first.
+func (s *ShardedSampler) Validate() error {
+	if s.Sampler == nil {
+		return errors.New("ShardedSampler needs a Sampler")
+	}
+	if s.ShardCount < 0 {
+		return newConfigError(ErrInvalidThreshold, "the ShardCount %d must not be negative", s.ShardCount)
+	}
+	if s.ShardIndex < 0 || s.ShardIndex >= s.shardCount() {
+		return newConfigError(ErrInvalidThreshold, "the ShardIndex %d must be from 0 to %d", s.ShardIndex, s.shardCount()-1)
+	}
+	return nil
+}
+
+// Start starts the wrapped sampler.
+func (s *ShardedSampler) Start() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	return s.Sampler.Start()
+}
+
+// Stop stops the wrapped sampler.
+func (s *ShardedSampler) Stop() error {
+	return s.Sampler.Stop()
+}
+
+// shardCount returns ShardCount, or its default.
+func (s *ShardedSampler) shardCount() int {
+	if s.ShardCount < 1 {
+		return 1
+	}
+	return s.ShardCount
+}
+
+// Shard returns the shard responsible for key, from 0 to ShardCount-1.
+func (s *ShardedSampler) Shard(key string) int {
+	var x uint64
+	if s.HashFunc != nil {
+		x = s.HashFunc(key)
+	} else {
+		x = keyHash(key)
+	}
+	// the high word of x*ShardCount is the range x falls in
+	shard, _ := bits.Mul64(x, uint64(s.shardCount()))
+	return int(shard)
+}
+
+// owns reports whether key is in this node's shard.
+func (s *ShardedSampler) owns(key string) bool {
+	return s.shardCount() == 1 || s.Shard(key) == s.ShardIndex
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (s *ShardedSampler) GetSampleRate(key string) int {
+	return s.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti returns the wrapped sampler's rate for a key in this
+// node's shard, and 1 for any other key.
+func (s *ShardedSampler) GetSampleRateMulti(key string, count int) int {
+	owned := s.owns(key)
+	s.lock.Lock()
+	s.requestCount++
+	s.eventCount += int64(count)
+	if !owned {
+		s.passedCount++
+	}
+	s.lock.Unlock()
+
+	if !owned {
+		return 1
+	}
+	return s.Sampler.GetSampleRateMulti(key, count)
+}
+
+// PeekSampleRate returns the rate GetSampleRate would return for key, without
+// counting it, or 1 if the wrapped sampler has no PeekSampleRate.
+func (s *ShardedSampler) PeekSampleRate(key string) int {
+	if !s.owns(key) {
+		return 1
+	}
+	if p, ok := s.Sampler.(interface{ PeekSampleRate(string) int }); ok {
+		return p.PeekSampleRate(key)
+	}
+	return 1
+}
+
+// SaveState returns the wrapped sampler's state.
+func (s *ShardedSampler) SaveState() ([]byte, error) {
+	return s.Sampler.SaveState()
+}
+
+// LoadState loads state into the wrapped sampler. Like the sampler's own
+// LoadState, it should be called before Start.
+func (s *ShardedSampler) LoadState(state []byte) error {
+	return s.Sampler.LoadState(state)
+}
+
+// SupportsState reports whether the wrapped sampler saves state.
+func (s *ShardedSampler) SupportsState() bool {
+	return s.Sampler.SupportsState()
+}
+
+// GetMetrics returns the ShardedSampler's own request_count and event_count,
+// which include every call, and passed_count, the calls for keys in other
+// shards, along with the wrapped sampler's metrics prefixed with "sampler_".
+func (s *ShardedSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(s.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. Metrics from a sampler without a GetMetricsTyped method
+// are marked by their names.
+func (s *ShardedSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	s.lock.Lock()
+	mets := map[string]Metric{
+		prefix + "request_count": counter(s.requestCount),
+		prefix + "event_count":   counter(s.eventCount),
+		prefix + "passed_count":  counter(s.passedCount),
+	}
+	s.lock.Unlock()
+	for name, met := range typedMetricsOf(s.Sampler, prefix+"sampler_") {
+		mets[name] = met
+	}
+	return mets
+}
@@ -0,0 +1,93 @@
+package dynsampler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedSampler(t *testing.T) {
+	shards := make([]*ShardedSampler, 2)
+	for i := range shards {
+		shards[i] = &ShardedSampler{
+			Sampler:    &Static{Default: 10},
+			ShardIndex: i,
+			ShardCount: len(shards),
+		}
+		assert.NoError(t, shards[i].Start())
+		defer shards[i].Stop()
+	}
+
+	const numKeys = 1000
+	owned := make([]int64, len(shards))
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		// each key is sampled by exactly one shard, the one it hashes to, and
+		// passed through by the other
+		var sampledBy []int
+		for j, s := range shards {
+			if rate := s.GetSampleRate(key); rate == 10 {
+				sampledBy = append(sampledBy, j)
+			} else {
+				assert.Equal(t, 1, rate)
+			}
+		}
+		if assert.Len(t, sampledBy, 1, key) {
+			assert.Equal(t, shards[0].Shard(key), sampledBy[0])
+			owned[sampledBy[0]]++
+		}
+	}
+	assert.Equal(t, int64(numKeys), owned[0]+owned[1])
+	// the keys are spread about evenly
+	assert.InDelta(t, numKeys/2, owned[0], numKeys/10)
+
+	for i, s := range shards {
+		mets := s.GetMetrics("s_")
+		assert.Equal(t, int64(numKeys), mets["s_request_count"])
+		assert.Equal(t, numKeys-owned[i], mets["s_passed_count"])
+		// keys passed through never reach the wrapped sampler
+		assert.Equal(t, owned[i], mets["s_sampler_request_count"])
+	}
+}
+
+func TestShardedSamplerHashFuncSpreadsSkewedKeys(t *testing.T) {
+	const shardCount = 4
+	byDefault := &ShardedSampler{Sampler: &Static{}, ShardCount: shardCount}
+	// keys that all land in the same shard with the default hash, as keys
+	// chosen to cause a hotspot might
+	var keys []string
+	for i := 0; len(keys) < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if byDefault.Shard(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	salted := &ShardedSampler{
+		Sampler:    &Static{},
+		ShardCount: shardCount,
+		HashFunc:   func(key string) uint64 { return keyHash("salt:" + key) },
+	}
+	perShard := make([]int, shardCount)
+	for _, key := range keys {
+		perShard[salted.Shard(key)]++
+	}
+	for shard, n := range perShard {
+		assert.InDelta(t, len(keys)/shardCount, n, float64(len(keys))/10, "shard %d", shard)
+	}
+}
+
+func TestShardedSamplerHashFunc(t *testing.T) {
+	// the top of the hash range belongs to the last shard
+	s := &ShardedSampler{
+		Sampler:    &Static{Default: 5},
+		ShardIndex: 3,
+		ShardCount: 4,
+		HashFunc:   func(string) uint64 { return ^uint64(0) },
+	}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.Equal(t, 3, s.Shard("anything"))
+	assert.Equal(t, 5, s.GetSampleRate("anything"))
+	assert.Equal(t, 5, s.PeekSampleRate("anything"))
+}
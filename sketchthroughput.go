@@ -0,0 +1,279 @@
+package dynsampler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SketchThroughput implements Sampler and, like TotalThroughput, attempts to
+// meet a goal of a fixed number of events per second, split equally across
+// the active keys. Instead of keeping a count for every key in a map, it
+// counts keys in a count-min sketch and estimates the number of distinct keys
+// with a HyperLogLog, so its memory use is fixed no matter how many keys there
+// are. Use it for key spaces that are unbounded, where TotalThroughput would
+// need a MaxKeys so low that it would drop most keys.
+//
+// The price is that counts are approximate. A key's count is never
+// underestimated, but it can be overestimated by keys that share its cells in
+// the sketch: with probability at least 1 - e^-SketchDepth, the error is at
+// most e/SketchWidth times the total number of events in the interval. With
+// the defaults that is about 0.13% of the interval's events, 98% of the time.
+// An overestimated count gives its key a higher sample rate than
+// TotalThroughput would, so quiet keys that collide with busy ones are
+// sampled more heavily. The number of keys is estimated to within a few
+// percent, which moves every key's rate by the same proportion.
+//
+// Because it doesn't know which keys it has seen, SketchThroughput can't save
+// its state, report the sample rates it is using, or count the keys with high
+// rates for a keys_above_threshold metric.
+type SketchThroughput struct {
+	// ClearFrequencyDuration is how often the counters reset. The default is
+	// 30s.
+	ClearFrequencyDuration time.Duration
+
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// GoalThroughputPerSec is the target number of events to send per second.
+	// Sample rates are generated to squash the total throughput down to match the
+	// goal throughput. Actual throughput may exceed goal throughput. default 100
+	GoalThroughputPerSec int
+
+	// SketchWidth is the number of counters in each row of the sketch. Wider
+	// sketches make overestimates smaller. Default 2048
+	SketchWidth int
+
+	// SketchDepth is the number of rows in the sketch. Deeper sketches make
+	// large overestimates less likely. Default 4
+	SketchDepth int
+
+	// HashFunc, if set, replaces the hash used to place keys in the sketch and
+	// to estimate the number of keys. It must be safe to call from multiple
+	// goroutines at once, and should spread its results evenly over all 64
+	// bits, or keys will share cells and be overestimated. Supplying one helps
+	// when the keys follow a pattern the default hash handles badly. Changing
+	// it changes every key's hash, so hashes worked out elsewhere with a
+	// different function can't be compared with this sampler's. Defaults to
+	// FNV-1a, with its bits mixed.
+	HashFunc func(string) uint64
+
+	// currentCounts counts events in this interval, and savedCounts holds the
+	// counts from the last one, which the sample rates are calculated from
+	currentCounts *countMinSketch
+	savedCounts   *countMinSketch
+
+	// currentKeys estimates the number of keys seen in this interval
+	currentKeys cardinalityEstimate
+
+	// throughputPerKey is the goal number of events for each key in an
+	// interval, or 0 before the first interval with traffic
+	throughputPerKey float64
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
+	done chan struct{}
+
+	lock sync.Mutex
+
+	// metrics
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	savedKeys     int64
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*SketchThroughput)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (s *SketchThroughput) Validate() error {
+	if s.ClearFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the ClearFrequencyDuration %v must not be negative", s.ClearFrequencyDuration)
+	}
+	if s.GoalThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalThroughputPerSec %d must not be negative", s.GoalThroughputPerSec)
+	}
+	if s.SketchWidth < 0 || s.SketchDepth < 0 {
+		return newConfigError(ErrInvalidThreshold, "the sketch size %dx%d must not be negative", s.SketchWidth, s.SketchDepth)
+	}
+	return nil
+}
+
+func (s *SketchThroughput) Start() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
+	if s.ClearFrequencyDuration == 0 {
+		s.ClearFrequencyDuration = 30 * time.Second
+	}
+	if s.GoalThroughputPerSec == 0 {
+		s.GoalThroughputPerSec = 100
+	}
+	if s.SketchWidth == 0 {
+		s.SketchWidth = 2048
+	}
+	if s.SketchDepth == 0 {
+		s.SketchDepth = 4
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", s.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
+	// initialize internal variables
+	s.currentCounts = newCountMinSketch(s.SketchWidth, s.SketchDepth)
+	s.savedCounts = newCountMinSketch(s.SketchWidth, s.SketchDepth)
+	s.done = make(chan struct{})
+
+	if s.NoBackgroundGoroutine {
+		return nil
+	}
+
+	// spin up calculator
+	go func() {
+		ticker := newTicker(s.ClearFrequencyDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				s.updateMaps()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *SketchThroughput) Stop() error {
+	close(s.done)
+	return nil
+}
+
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (s *SketchThroughput) Update() {
+	s.updateMaps()
+}
+
+// updateMaps makes the current counts the ones sample rates are calculated
+// from, and starts counting again.
+func (s *SketchThroughput) updateMaps() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.intervalCount++
+	s.eventRate.update(s.eventCount, now(), s.ClearFrequencyDuration)
+	s.currentCounts, s.savedCounts = s.savedCounts, s.currentCounts
+	s.currentCounts.reset()
+	s.savedKeys = s.currentKeys.estimate()
+	s.currentKeys.reset()
+	if s.savedKeys == 0 {
+		// no traffic last interval, so every key gets a rate of 1
+		s.throughputPerKey = 0
+		return
+	}
+	// split the total throughput equally across the number of keys.
+	totalGoalThroughput := float64(s.GoalThroughputPerSec) * s.ClearFrequencyDuration.Seconds()
+	s.throughputPerKey = totalGoalThroughput / float64(s.savedKeys)
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (s *SketchThroughput) GetSampleRate(key string) int {
+	return s.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key.
+func (s *SketchThroughput) GetSampleRateMulti(key string, count int) int {
+	return s.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (s *SketchThroughput) GetSampleRateMulti64(key string, count int64) int {
+	x := s.hash(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	s.requestCount++
+	s.eventCount += count
+
+	s.currentCounts.add(x, count)
+	s.currentKeys.addHash(x)
+	if s.throughputPerKey == 0 {
+		return 1
+	}
+	return int(math.Max(1, float64(s.savedCounts.estimate(x))/s.throughputPerKey))
+}
+
+// hash returns the hash of key, from HashFunc if it is set.
+func (s *SketchThroughput) hash(key string) uint64 {
+	if s.HashFunc != nil {
+		return s.HashFunc(key)
+	}
+	return keyHash(key)
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (s *SketchThroughput) PeekSampleRate(key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.currentCounts == nil || s.throughputPerKey == 0 {
+		return 1
+	}
+	return int(math.Max(1, float64(s.savedCounts.estimate(s.hash(key)))/s.throughputPerKey))
+}
+
+// SaveState is not implemented
+func (s *SketchThroughput) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (s *SketchThroughput) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (s *SketchThroughput) SupportsState() bool {
+	return false
+}
+
+func (s *SketchThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(s.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. The keyspace size is an estimate of the number of keys
+// seen in the last interval.
+func (s *SketchThroughput) GetMetricsTyped(prefix string) map[string]Metric {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mets := map[string]Metric{
+		prefix + "request_count":  counter(s.requestCount),
+		prefix + "event_count":    counter(s.eventCount),
+		prefix + "interval_count": counter(s.intervalCount),
+		prefix + "keyspace_size":  gauge(s.savedKeys),
+		prefix + "events_per_sec": gauge(s.eventRate.perSec),
+	}
+	return mets
+}
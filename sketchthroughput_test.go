@@ -0,0 +1,120 @@
+package dynsampler
+
+import (
+	"hash/fnv"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountMinSketchNeverUnderestimates(t *testing.T) {
+	c := newCountMinSketch(64, 4)
+	want := make(map[string]int64)
+	for i := 0; i < 500; i++ {
+		key := "key" + strconv.Itoa(i)
+		want[key] = int64(i + 1)
+		c.add(keyHash(key), int64(i+1))
+	}
+	for key, n := range want {
+		assert.GreaterOrEqual(t, c.estimate(keyHash(key)), n, key)
+	}
+	c.reset()
+	assert.Equal(t, int64(0), c.estimate(keyHash("key1")))
+}
+
+// On a key space much smaller than the sketch, SketchThroughput should choose
+// nearly the same rates as TotalThroughput, which counts exactly.
+func TestSketchThroughputMatchesTotalThroughput(t *testing.T) {
+	exact := &TotalThroughput{
+		ClearFrequencyDuration: 30 * time.Second,
+		GoalThroughputPerSec:   50,
+		savedSampleRates:       make(map[string]int),
+		currentCounts:          make(map[string]int),
+	}
+	sketch := &SketchThroughput{
+		ClearFrequencyDuration: 30 * time.Second,
+		GoalThroughputPerSec:   50,
+		currentCounts:          newCountMinSketch(2048, 4),
+		savedCounts:            newCountMinSketch(2048, 4),
+	}
+
+	const numKeys = 500
+	counts := make(map[string]int, numKeys)
+	for i := 0; i < numKeys; i++ {
+		// a long tail of quiet keys and a few busy ones
+		counts["key"+strconv.Itoa(i)] = 10 + 100000/(i+1)
+	}
+	for key, n := range counts {
+		exact.GetSampleRateMulti(key, n)
+		sketch.GetSampleRateMulti(key, n)
+	}
+	exact.updateMaps()
+	sketch.updateMaps()
+
+	assert.InEpsilon(t, numKeys, sketch.GetMetrics("")["keyspace_size"], 0.05)
+
+	var near int
+	for key := range counts {
+		want := exact.GetSampleRateMulti(key, 1)
+		got := sketch.GetSampleRateMulti(key, 1)
+		// the sketch never undercounts, so rates are only lower when the
+		// number of keys is overestimated
+		assert.GreaterOrEqual(t, float64(got), float64(want)*0.95-1, key)
+		if float64(got) <= float64(want)*1.05+1 {
+			near++
+		}
+	}
+	assert.GreaterOrEqual(t, near, numKeys*95/100)
+}
+
+func TestSketchThroughputNoTraffic(t *testing.T) {
+	s := &SketchThroughput{
+		ClearFrequencyDuration: 30 * time.Second,
+		GoalThroughputPerSec:   1,
+		currentCounts:          newCountMinSketch(16, 2),
+		savedCounts:            newCountMinSketch(16, 2),
+	}
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+	s.GetSampleRateMulti("busy", 1000)
+	s.updateMaps()
+	assert.Equal(t, 33, s.PeekSampleRate("busy"))
+	assert.Equal(t, int64(33), s.GetMetrics("")["events_per_sec"])
+
+	// an interval without traffic puts every key back to a rate of 1
+	clock.advance(30 * time.Second)
+	s.updateMaps()
+	assert.Equal(t, 1, s.PeekSampleRate("busy"))
+	assert.Equal(t, int64(2), s.GetMetrics("")["interval_count"])
+	assert.Equal(t, int64(0), s.GetMetrics("")["events_per_sec"])
+}
+
+func TestSketchThroughputHashFunc(t *testing.T) {
+	// plain FNV-1a, whose high bits hardly change between keys that differ
+	// only at the end
+	plainFNV := func(key string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	estimateKeys := func(hash func(string) uint64) int64 {
+		s := &SketchThroughput{HashFunc: hash, NoBackgroundGoroutine: true}
+		assert.NoError(t, s.Start())
+		defer s.Stop()
+		// a skewed key set of sequential IDs
+		for i := 0; i < 1000; i++ {
+			s.GetSampleRate("user-" + strconv.Itoa(i))
+		}
+		s.Update()
+		return s.GetMetrics("")["keyspace_size"]
+	}
+
+	// the keys bunch up under the plain hash, and most are missed...
+	assert.Less(t, estimateKeys(plainFNV), int64(100))
+	// ...but a hash that spreads them out counts them properly
+	mixed := func(key string) uint64 { return mix64(plainFNV(key)) }
+	assert.InEpsilon(t, 1000, estimateKeys(mixed), 0.05)
+	assert.Equal(t, estimateKeys(mixed), estimateKeys(nil))
+}
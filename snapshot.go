@@ -0,0 +1,122 @@
+package dynsampler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Snapshot is the full internal state of an EMA sampler at one moment: the
+// rates it is serving, its moving average, the counts for the interval in
+// progress, and its counters. It is returned by Snapshot and accepted by
+// Restore on EMASampleRate and EMAThroughput, so that a standby can mirror an
+// active sampler closely enough to take over from it without a change in
+// behavior. Unlike SaveState, it includes the live counts, and it is a deep
+// copy, so it can be kept or encoded as JSON and sent elsewhere while the
+// sampler carries on.
+//
+// It holds everything that decides the rates the sampler serves and
+// calculates. It leaves out what only watches them for metrics and callbacks,
+// such as the detection of oscillating and converged keys, the rate histogram,
+// and the events_per_sec baseline, which start again from nothing on a
+// sampler that is restored, and the interval chosen by AdaptiveInterval,
+// which goes back to AdjustmentInterval.
+type Snapshot struct {
+	// Sampler is the kind of sampler the snapshot was taken from.
+	Sampler string `json:"sampler"`
+
+	SavedSampleRates map[string]int     `json:"saved_sample_rates"`
+	MovingAverage    map[string]float64 `json:"moving_average"`
+	CurrentCounts    map[string]float64 `json:"current_counts"`
+
+	// HaveData is whether rates had been calculated, or the sampler was
+	// still serving its cold start rate.
+	HaveData bool `json:"have_data"`
+
+	// IntervalCount and BurstThreshold drive burst detection.
+	IntervalCount  uint64  `json:"interval_count"`
+	BurstThreshold float64 `json:"burst_threshold"`
+
+	// AgeOutGrace is the number of intervals each key's average has been
+	// below AgeOutValue, for AgeOutGraceIntervals.
+	AgeOutGrace map[string]int `json:"age_out_grace,omitempty"`
+
+	// Decaying holds the rates of aged-out keys that are stepping down to 1,
+	// for EMASampleRate's DecayRateToOne.
+	Decaying map[string]SnapshotDecay `json:"decaying,omitempty"`
+
+	// LastIntervalEnd and IntervalRatio are when the last interval ended, and
+	// its length as a multiple of the nominal interval, for TimeWeightedEMA.
+	LastIntervalEnd time.Time `json:"last_interval_end"`
+	IntervalRatio   float64   `json:"interval_ratio,omitempty"`
+
+	RequestCount int64 `json:"request_count"`
+	EventCount   int64 `json:"event_count"`
+	BurstCount   int64 `json:"burst_count"`
+	KeptFraction int64 `json:"kept_fraction"`
+}
+
+// SnapshotDecay is the progress of one key's rate toward 1, in a Snapshot.
+type SnapshotDecay struct {
+	// From is the rate the key had when it aged out.
+	From int `json:"from"`
+
+	// Intervals is the number of intervals it has been decaying for.
+	Intervals int `json:"intervals"`
+}
+
+// validate checks that a snapshot came from the named kind of sampler and
+// holds possible values.
+func (s Snapshot) validate(sampler string) error {
+	if s.Sampler != sampler {
+		return fmt.Errorf("invalid snapshot: taken from %q, not %s", s.Sampler, sampler)
+	}
+	if s.SavedSampleRates == nil || s.MovingAverage == nil || s.CurrentCounts == nil {
+		return errors.New("invalid snapshot: a map is missing")
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+	if err := validateMovingAverage(s.MovingAverage); err != nil {
+		return err
+	}
+	for key, n := range s.AgeOutGrace {
+		if n < 0 {
+			return fmt.Errorf("invalid snapshot: age out grace %d for key %q is negative", n, key)
+		}
+	}
+	for key, d := range s.Decaying {
+		if d.From < 1 || d.Intervals < 0 {
+			return fmt.Errorf("invalid snapshot: decay from %d over %d intervals for key %q is impossible", d.From, d.Intervals, key)
+		}
+	}
+	if s.IntervalRatio < 0 || math.IsNaN(s.IntervalRatio) || math.IsInf(s.IntervalRatio, 0) {
+		return fmt.Errorf("invalid snapshot: interval ratio %v is not a non-negative number", s.IntervalRatio)
+	}
+	return validateMovingAverage(s.CurrentCounts)
+}
+
+// snapshotDecays copies the rates that are decaying for a Snapshot.
+func snapshotDecays(decaying map[string]*rateDecay) map[string]SnapshotDecay {
+	if len(decaying) == 0 {
+		return nil
+	}
+	s := make(map[string]SnapshotDecay, len(decaying))
+	for key, d := range decaying {
+		s[key] = SnapshotDecay{From: d.from, Intervals: d.intervals}
+	}
+	return s
+}
+
+// restoreDecays copies the rates that are decaying from a Snapshot.
+func restoreDecays(s map[string]SnapshotDecay) map[string]*rateDecay {
+	if len(s) == 0 {
+		return nil
+	}
+	decaying := make(map[string]*rateDecay, len(s))
+	for key, d := range s {
+		decaying[key] = &rateDecay{from: d.From, intervals: d.Intervals}
+	}
+	return decaying
+}
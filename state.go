@@ -0,0 +1,145 @@
+package dynsampler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// validateSavedSampleRates checks a sample rate map loaded from saved state. A
+// missing map or an impossible rate means the state was truncated or corrupted,
+// and loading it would silently sample everything at the wrong rate.
+func validateSavedSampleRates(rates map[string]int) error {
+	if rates == nil {
+		return fmt.Errorf("invalid state: saved_sample_rates is missing")
+	}
+	for key, rate := range rates {
+		if rate < 1 {
+			return fmt.Errorf("invalid state: sample rate %d for key %q is less than 1", rate, key)
+		}
+	}
+	return nil
+}
+
+// validateMovingAverage checks a moving average map loaded from saved state.
+// A missing map is allowed, but every average must be a non-negative number.
+func validateMovingAverage(averages map[string]float64) error {
+	for key, avg := range averages {
+		if avg < 0 || math.IsNaN(avg) || math.IsInf(avg, 0) {
+			return fmt.Errorf("invalid state: moving average %v for key %q is not a non-negative number", avg, key)
+		}
+	}
+	return nil
+}
+
+// State saved by one version of this package must load in later versions,
+// so that old and new binaries can run side by side during a rolling upgrade.
+// The state structs - avgSampleRateState, emaSampleRateState,
+// emaThroughputState, totalThroughputState and windowedThroughputState -
+// therefore only ever gain fields, and never rename a field or change what it
+// means. A field missing from older state loads as its zero value, and must
+// mean the same as it did before the field existed. A field unknown to an
+// older version is ignored when it loads newer state.
+//
+// The oldest form of state, from before any of this, holds only
+// saved_sample_rates, plus moving_average for the EMA samplers.
+
+// The names recorded in saved state to identify the kind of sampler that
+// saved it. State saved before these were recorded has no name.
+const (
+	stateSamplerAvgSampleRate      = "AvgSampleRate"
+	stateSamplerEMASampleRate      = "EMASampleRate"
+	stateSamplerEMAThroughput      = "EMAThroughput"
+	stateSamplerTotalThroughput    = "TotalThroughput"
+	stateSamplerWindowedThroughput = "WindowedThroughput"
+)
+
+// checkStateSampler compares the kind of sampler that saved a state with the
+// kind loading it. It returns true if the whole state can be loaded, because
+// it came from the same kind of sampler or doesn't say where it came from.
+//
+// State from a different kind of sampler is an error, unless lenient is set
+// and the two samplers are EMASampleRate and EMAThroughput, which keep their
+// moving averages the same way. Then it returns false, and only the moving
+// average should be loaded.
+func checkStateSampler(saved, loading string, lenient bool) (bool, error) {
+	if saved == "" || saved == loading {
+		return true, nil
+	}
+	if lenient && isEMAStateSampler(saved) && isEMAStateSampler(loading) {
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid state: saved by %s, which is not compatible with %s", saved, loading)
+}
+
+func isEMAStateSampler(name string) bool {
+	return name == stateSamplerEMASampleRate || name == stateSamplerEMAThroughput
+}
+
+// StateDiff describes how the sample rates in one saved state differ from
+// those in another. It is returned by DiffStates.
+type StateDiff struct {
+	// Added holds the keys found only in the second state, with their rates.
+	Added map[string]int
+	// Removed holds the keys found only in the first state, with their rates.
+	Removed map[string]int
+	// Changed holds the keys found in both states whose rates differ.
+	Changed map[string]RateChange
+}
+
+// RateChange is the sample rate of a key before and after a change.
+type RateChange struct {
+	Before int
+	After  int
+}
+
+// DiffStates compares two states saved by SaveState and reports which keys
+// were added, removed, or had their sample rate changed going from a to b. It
+// understands the state of any sampler that saves its sample rates, such as
+// AvgSampleRate, EMASampleRate, and EMAThroughput. It is meant for diagnosing
+// rate drift, for example across a restart, and doesn't touch any sampler.
+func DiffStates(a, b []byte) (StateDiff, error) {
+	before, err := unmarshalSavedSampleRates(a)
+	if err != nil {
+		return StateDiff{}, fmt.Errorf("first state: %w", err)
+	}
+	after, err := unmarshalSavedSampleRates(b)
+	if err != nil {
+		return StateDiff{}, fmt.Errorf("second state: %w", err)
+	}
+
+	diff := StateDiff{
+		Added:   make(map[string]int),
+		Removed: make(map[string]int),
+		Changed: make(map[string]RateChange),
+	}
+	for key, rate := range before {
+		newRate, found := after[key]
+		if !found {
+			diff.Removed[key] = rate
+		} else if newRate != rate {
+			diff.Changed[key] = RateChange{Before: rate, After: newRate}
+		}
+	}
+	for key, rate := range after {
+		if _, found := before[key]; !found {
+			diff.Added[key] = rate
+		}
+	}
+	return diff, nil
+}
+
+// unmarshalSavedSampleRates extracts and validates the sample rates from a
+// saved state.
+func unmarshalSavedSampleRates(state []byte) (map[string]int, error) {
+	var s struct {
+		SavedSampleRates map[string]int `json:"saved_sample_rates"`
+	}
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, err
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return nil, err
+	}
+	return s.SavedSampleRates, nil
+}
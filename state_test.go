@@ -0,0 +1,137 @@
+package dynsampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffStates(t *testing.T) {
+	a := &AvgSampleRate{savedSampleRates: map[string]int{"same": 2, "changed": 4, "gone": 8}}
+	before, err := a.SaveState()
+	assert.Nil(t, err)
+	e := &EMASampleRate{
+		savedSampleRates: map[string]int{"same": 2, "changed": 6, "new": 3},
+		movingAverage:    map[string]float64{"same": 10},
+	}
+	after, err := e.SaveState()
+	assert.Nil(t, err)
+
+	diff, err := DiffStates(before, after)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"new": 3}, diff.Added)
+	assert.Equal(t, map[string]int{"gone": 8}, diff.Removed)
+	assert.Equal(t, map[string]RateChange{"changed": {Before: 4, After: 6}}, diff.Changed)
+
+	diff, err = DiffStates(before, before)
+	assert.Nil(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Changed)
+
+	_, err = DiffStates(before, []byte(`{"saved_sample_rates":{"x":0}}`))
+	assert.Error(t, err)
+	_, err = DiffStates([]byte(`not json`), after)
+	assert.Error(t, err)
+}
+
+func TestLoadStateAcrossSamplers(t *testing.T) {
+	rates := &EMASampleRate{
+		savedSampleRates: map[string]int{"a": 5},
+		movingAverage:    map[string]float64{"a": 50},
+	}
+	fromRates, err := rates.SaveState()
+	assert.Nil(t, err)
+	avg := &AvgSampleRate{savedSampleRates: map[string]int{"a": 5}}
+	fromAvg, err := avg.SaveState()
+	assert.Nil(t, err)
+
+	// by default, state from another kind of sampler is rejected
+	strict := &EMAThroughput{}
+	assert.Error(t, strict.LoadState(fromRates))
+	assert.Nil(t, strict.movingAverage)
+	assert.Error(t, (&AvgSampleRate{}).LoadState(fromRates))
+	assert.Error(t, (&EMASampleRate{}).LoadState(fromAvg))
+
+	// lenient loads take only the moving average from the other EMA sampler
+	lenient := &EMAThroughput{LenientLoad: true, InitialSampleRate: 10}
+	assert.Nil(t, lenient.LoadState(fromRates))
+	assert.Equal(t, map[string]float64{"a": 50}, lenient.movingAverage)
+	assert.Nil(t, lenient.savedSampleRates)
+	assert.False(t, lenient.haveData)
+	assert.Nil(t, lenient.Start())
+	defer lenient.Stop()
+	assert.Equal(t, 10, lenient.GetSampleRate("a"))
+
+	throughput := &EMAThroughput{
+		savedSampleRates: map[string]int{"b": 7},
+		movingAverage:    map[string]float64{"b": 70},
+	}
+	fromThroughput, err := throughput.SaveState()
+	assert.Nil(t, err)
+	back := &EMASampleRate{LenientLoad: true}
+	assert.Nil(t, back.LoadState(fromThroughput))
+	assert.Equal(t, map[string]float64{"b": 70}, back.movingAverage)
+
+	// ApplyState keeps the sampler's own rates from another kind of state
+	running := &EMASampleRate{
+		LenientLoad:      true,
+		savedSampleRates: map[string]int{"c": 3},
+		movingAverage:    map[string]float64{},
+	}
+	assert.Nil(t, running.ApplyState(fromThroughput))
+	assert.Equal(t, map[string]int{"c": 3}, running.savedSampleRates)
+	assert.Equal(t, map[string]float64{"b": 70}, running.movingAverage)
+
+	// nothing is compatible with AvgSampleRate, even leniently
+	assert.Error(t, (&EMASampleRate{LenientLoad: true}).LoadState(fromAvg))
+
+	// state saved before samplers recorded their kind is still accepted
+	old := []byte(`{"saved_sample_rates":{"a":2},"moving_average":{"a":20}}`)
+	assert.Nil(t, (&EMAThroughput{}).LoadState(old))
+	assert.Nil(t, (&AvgSampleRate{}).LoadState(old))
+}
+
+// State saved by the first versions of this package, before anything was added
+// to it, still loads.
+func TestLoadStateV0(t *testing.T) {
+	a := &AvgSampleRate{}
+	assert.Nil(t, a.LoadState([]byte(`{"saved_sample_rates":{"foo":2,"bar":4}}`)))
+	assert.Nil(t, a.Start())
+	defer a.Stop()
+	assert.Equal(t, 2, a.GetSampleRate("foo"))
+	assert.Equal(t, 4, a.GetSampleRate("bar"))
+
+	e := &EMASampleRate{}
+	assert.Nil(t, e.LoadState([]byte(`{"saved_sample_rates":{"foo":2},"moving_average":{"foo":20}}`)))
+	assert.Nil(t, e.Start())
+	defer e.Stop()
+	assert.Equal(t, 2, e.GetSampleRate("foo"))
+	e.lock.Lock()
+	assert.Equal(t, map[string]float64{"foo": 20}, e.movingAverage)
+	e.lock.Unlock()
+
+	// without the moving average, the sampler starts a new one
+	e2 := &EMASampleRate{}
+	assert.Nil(t, e2.LoadState([]byte(`{"saved_sample_rates":{"foo":2}}`)))
+	assert.Nil(t, e2.Start())
+	defer e2.Stop()
+	assert.Equal(t, 2, e2.GetSampleRate("foo"))
+	e2.lock.Lock()
+	assert.NotNil(t, e2.movingAverage)
+	e2.lock.Unlock()
+}
+
+// State saved by a newer version, with fields this version doesn't know
+// about, still loads.
+func TestLoadStateUnknownFields(t *testing.T) {
+	state := []byte(`{"sampler":"AvgSampleRate","saved_sample_rates":{"foo":2},"from_the_future":{"x":1}}`)
+	a := &AvgSampleRate{}
+	assert.Nil(t, a.LoadState(state))
+	assert.Equal(t, map[string]int{"foo": 2}, a.savedSampleRates)
+
+	state = []byte(`{"saved_sample_rates":{"foo":2},"moving_average":{"foo":20},"version":7}`)
+	e := &EMASampleRate{}
+	assert.Nil(t, e.LoadState(state))
+	assert.Equal(t, map[string]int{"foo": 2}, e.savedSampleRates)
+}
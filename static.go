@@ -5,24 +5,61 @@ import "sync"
 // Static implements Sampler with a static mapping for sample rates. This is
 // useful if you have a known set of keys that you want to sample at specific
 // rates and apply a default to everything else.
+//
+// Rates and Default may be set directly before calling Start. Once the sampler
+// is in use, mutating them directly races with GetSampleRate; use SetRates and
+// SetDefault to swap them safely instead.
 type Static struct {
 	// Rates is the set of sample rates to use
 	Rates map[string]int
 	// Default is the value to use if the key is not whitelisted in Rates
 	Default int
 
-	lock sync.Mutex
+	// lock guards Rates and Default. Sampling and metrics only read them, so
+	// they only contend with SetRates and SetDefault.
+	lock sync.RWMutex
 
-	// metrics
-	requestCount int64
-	eventCount   int64
+	// counts holds request_count and event_count, which are counted without
+	// the lock
+	counts requestCounter
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*Static)(nil)
 
+// StaticFromSampler returns a Static that serves the sample rates s has
+// calculated, and defaultRate for every other key. This supports letting a
+// dynamic sampler learn rates from real traffic for a while and then pinning
+// them. s must have a GetAllSampleRates method, as the samplers in this
+// package that calculate rates do; for any other sampler the Static serves
+// defaultRate for every key. The Static has not been started.
+func StaticFromSampler(s Sampler, defaultRate int) *Static {
+	st := &Static{Default: defaultRate}
+	if r, ok := s.(interface{ GetAllSampleRates() map[string]int }); ok {
+		st.Rates = r.GetAllSampleRates()
+	}
+	return st
+}
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (s *Static) Validate() error {
+	if s.Default < 0 {
+		return newConfigError(ErrInvalidSampleRate, "the Default sample rate %d must not be negative", s.Default)
+	}
+	for key, rate := range s.Rates {
+		if rate < 0 {
+			return newConfigError(ErrInvalidSampleRate, "the sample rate %d for key %q must not be negative", rate, key)
+		}
+	}
+	return nil
+}
+
 // Start initializes the static dynsampler
 func (s *Static) Start() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
 	if s.Default == 0 {
 		s.Default = 1
 	}
@@ -33,6 +70,27 @@ func (s *Static) Stop() error {
 	return nil
 }
 
+// SetRates replaces the set of sample rates in use. It is safe to call while
+// the sampler is serving GetSampleRate calls. The sampler takes ownership of
+// the map; callers should not modify it after passing it in.
+func (s *Static) SetRates(rates map[string]int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Rates = rates
+}
+
+// SetDefault replaces the default sample rate used for keys not found in
+// Rates. It is safe to call while the sampler is serving GetSampleRate calls.
+// A value of 0 is treated as 1, as in Start.
+func (s *Static) SetDefault(rate int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rate == 0 {
+		rate = 1
+	}
+	s.Default = rate
+}
+
 // GetSampleRate takes a key and returns the appropriate sample rate for that
 // key.
 func (s *Static) GetSampleRate(key string) int {
@@ -42,14 +100,38 @@ func (s *Static) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (s *Static) GetSampleRateMulti(key string, count int) int {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	return s.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (s *Static) GetSampleRateMulti64(key string, count int64) int {
+	s.counts.add(count)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if rate, found := s.Rates[key]; found {
+		return rate
+	}
+	if s.Default == 0 {
+		// not started yet, and no default was set
+		return 1
+	}
+	return s.Default
+}
 
-	s.requestCount++
-	s.eventCount += int64(count)
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (s *Static) PeekSampleRate(key string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if rate, found := s.Rates[key]; found {
 		return rate
 	}
+	if s.Default == 0 {
+		return 1
+	}
 	return s.Default
 }
 
@@ -63,13 +145,43 @@ func (s *Static) LoadState(state []byte) error {
 	return nil
 }
 
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (s *Static) SupportsState() bool {
+	return false
+}
+
 func (s *Static) GetMetrics(prefix string) map[string]int64 {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": s.requestCount,
-		prefix + "event_count":   s.eventCount,
-		prefix + "keyspace_size": int64(len(s.Rates)),
+	return metricValues(s.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. Nothing it reads is written by sampling, so scraping
+// often doesn't hold sampling up. request_count and event_count always agree
+// with each other: a request in progress is counted in both or in neither.
+func (s *Static) GetMetricsTyped(prefix string) map[string]Metric {
+	requests, events := s.counts.read()
+	s.lock.RLock()
+	keyspaceSize := int64(len(s.Rates))
+	s.lock.RUnlock()
+	mets := map[string]Metric{
+		prefix + "request_count": counter(requests),
+		prefix + "event_count":   counter(events),
+		prefix + "keyspace_size": gauge(keyspaceSize),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (s *Static) GetMetricsSummary(prefix string) map[string]int64 {
+	_, events := s.counts.read()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return summarizeRates(prefix, s.Rates, events)
+}
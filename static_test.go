@@ -1,6 +1,8 @@
 package dynsampler
 
 import (
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,3 +21,84 @@ func TestStaticGetSampleRate(t *testing.T) {
 	assert.Equal(t, s.GetSampleRate("three"), 3)
 
 }
+
+func TestStaticSetRates(t *testing.T) {
+	s := &Static{
+		Rates: map[string]int{
+			"one": 5,
+		},
+		Default: 3,
+	}
+	err := s.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, s.GetSampleRate("one"))
+
+	s.SetRates(map[string]int{"two": 10})
+	s.SetDefault(7)
+	assert.Equal(t, 7, s.GetSampleRate("one"))
+	assert.Equal(t, 10, s.GetSampleRate("two"))
+
+	s.SetDefault(0)
+	assert.Equal(t, 1, s.GetSampleRate("one"))
+}
+
+func TestStaticSetRatesRace(t *testing.T) {
+	s := &Static{
+		Rates:   map[string]int{"key0": 1},
+		Default: 3,
+	}
+	err := s.Start()
+	assert.Nil(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				rate := s.GetSampleRate("key" + strconv.Itoa(j%10))
+				assert.NotEqual(t, rate <= 0, true, "rate should never be lte zero")
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 1000; j++ {
+			s.SetRates(map[string]int{"key" + strconv.Itoa(j%10): j + 1})
+			s.SetDefault(j%5 + 1)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestStaticFromSampler(t *testing.T) {
+	a := &AvgSampleRate{
+		GoalSampleRate:   10,
+		currentCounts:    map[string]float64{},
+		savedSampleRates: map[string]int{},
+	}
+	for i := 1; i <= 5; i++ {
+		a.GetSampleRateMulti("key"+strconv.Itoa(i), i*i*100)
+	}
+	a.updateMaps()
+	learned := a.GetAllSampleRates()
+	assert.Len(t, learned, 5)
+
+	s := StaticFromSampler(a, 7)
+	assert.NoError(t, s.Start())
+	for key, rate := range learned {
+		assert.Equal(t, rate, s.GetSampleRate(key), key)
+		assert.Equal(t, rate, a.GetSampleRate(key), key)
+	}
+	assert.Equal(t, 7, s.GetSampleRate("unseen"))
+
+	// the Static has its own copy of the rates
+	a.ResetKey("key5")
+	assert.Equal(t, learned["key5"], s.GetSampleRate("key5"))
+
+	// samplers that don't calculate rates give just the default
+	s = StaticFromSampler(&OnlyOnce{}, 3)
+	assert.Empty(t, s.Rates)
+	assert.Equal(t, 3, s.GetSampleRate("key1"))
+}
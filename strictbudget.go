@@ -0,0 +1,413 @@
+package dynsampler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StrictBudgetSampler implements Sampler and keeps no more than a fixed number
+// of events in each interval, however the traffic changes. TotalThroughput
+// aims for a goal and may overshoot it; this sampler treats the budget as a
+// hard ceiling, at the price of dropping everything once it is spent.
+//
+// At the end of each interval the budget for the next one is split between
+// the keys seen, as fairly as it can be: keys that need less than an equal
+// share get all they need, and what they don't use is shared equally between
+// the rest. Each key's sample rate is chosen so that the traffic it had last
+// interval fits in its share. What no key needed is left in a common pool,
+// which keys that are new, or busier than before, draw on once their own
+// share is spent. In the first interval, before anything has been counted,
+// the whole budget is in the pool, so the first events are kept until it runs
+// out.
+//
+// The guarantee holds for the decisions made by Decide, which chooses the
+// events to keep itself: every Nth event of a key with a sample rate of N is
+// kept while budget remains, and nothing is kept once it is gone. Callers that
+// use GetSampleRateMulti and make their own random decisions are charged the
+// expected number of events kept, count divided by the rate, so they keep
+// about the budget on average but can exceed it by chance.
+type StrictBudgetSampler struct {
+	// ClearFrequencyDuration is how often the budget is renewed and the sample
+	// rates recalculated. The default is 30s.
+	ClearFrequencyDuration time.Duration
+
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that renews the budget every ClearFrequencyDuration, for embedded use
+	// where background goroutines aren't welcome. The caller must call Update
+	// on its own schedule instead; without calls to Update, the budget is
+	// never renewed. Defaults to false.
+	NoBackgroundGoroutine bool
+
+	// BudgetPerInterval is the most events that will be kept in each
+	// ClearFrequencyDuration. The default is 3000, which is 100 events per
+	// second at the default interval.
+	BudgetPerInterval int
+
+	// MaxKeys, if greater than 0, limits the number of distinct keys that are
+	// given a share of the budget. Once MaxKeys is reached, new keys are not
+	// counted, and are kept only from the common pool.
+	MaxKeys int
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
+	savedSampleRates map[string]int
+	currentCounts    map[string]int
+
+	// shares holds how much of each key's share of the budget is left this
+	// interval, and pool how much of the budget no key was given
+	shares map[string]float64
+	pool   float64
+
+	done chan struct{}
+
+	lock sync.Mutex
+
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
+	// metrics
+	requestCount   int64
+	eventCount     int64
+	intervalCount  int64
+	exhaustedCount int64      // calls refused because the budget was spent
+	heavyKeys      *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+}
+
+// Ensure we implement the sampler interface
+var _ Sampler = (*StrictBudgetSampler)(nil)
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (s *StrictBudgetSampler) Validate() error {
+	if s.ClearFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the ClearFrequencyDuration %v must not be negative", s.ClearFrequencyDuration)
+	}
+	if s.BudgetPerInterval < 0 {
+		return newConfigError(ErrInvalidGoal, "the BudgetPerInterval %d must not be negative", s.BudgetPerInterval)
+	}
+	if s.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", s.HeavySampleThreshold)
+	}
+	return nil
+}
+
+func (s *StrictBudgetSampler) Start() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	// apply defaults
+	if s.ClearFrequencyDuration == 0 {
+		s.ClearFrequencyDuration = 30 * time.Second
+	}
+	if s.BudgetPerInterval == 0 {
+		s.BudgetPerInterval = 3000
+	}
+
+	if err := checkInterval("ClearFrequencyDuration", s.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
+	// initialize internal variables
+	s.savedSampleRates = make(map[string]int, s.ExpectedKeys)
+	s.currentCounts = make(map[string]int, s.ExpectedKeys)
+	s.shares = make(map[string]float64, s.ExpectedKeys)
+	s.pool = float64(s.BudgetPerInterval)
+	s.done = make(chan struct{})
+
+	if s.NoBackgroundGoroutine {
+		return nil
+	}
+
+	// spin up calculator
+	go func() {
+		ticker := newTicker(s.ClearFrequencyDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				s.updateMaps()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *StrictBudgetSampler) Stop() error {
+	close(s.done)
+	exportRates(s.ExportOnStop, &s.lock, &s.savedSampleRates)
+	return nil
+}
+
+// Update renews the budget and recalculates the sample rates from the counts
+// since the last update, as the goroutine launched by Start does every
+// ClearFrequencyDuration. It is for use with NoBackgroundGoroutine.
+func (s *StrictBudgetSampler) Update() {
+	s.updateMaps()
+}
+
+// updateMaps shares out the next interval's budget based on the counts from
+// this one, and starts counting again.
+func (s *StrictBudgetSampler) updateMaps() {
+	s.lock.Lock()
+	counts := s.currentCounts
+	s.keyspace.observe(len(counts))
+	s.currentCounts = make(map[string]int, s.ExpectedKeys)
+	s.intervalCount++
+	s.lock.Unlock()
+
+	shares, pool := allocateBudget(s.BudgetPerInterval, counts)
+	newSavedSampleRates := make(map[string]int, len(counts))
+	heavy := newHeavyKeys(s.HeavySampleThreshold)
+	newShares := make(map[string]float64, len(shares))
+	for key, count := range counts {
+		share := shares[key]
+		if share == 0 {
+			// no share, so the key is kept only from the pool, and then as
+			// rarely as possible
+			rate := count
+			if rate < 1 {
+				rate = 1
+			}
+			heavy.set(newSavedSampleRates, key, rate)
+			continue
+		}
+		// the smallest rate that fits last interval's traffic in the share
+		heavy.set(newSavedSampleRates, key, (count+share-1)/share)
+		newShares[key] = float64(share)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.savedSampleRates = newSavedSampleRates
+	s.heavyKeys = heavy
+	s.shares = newShares
+	s.pool = float64(pool)
+}
+
+// allocateBudget splits budget between the keys in counts by max-min
+// fairness: keys are served from the quietest up, and each gets its whole
+// count or an equal share of what is left, whichever is smaller. Shares are
+// rounded up, so when there isn't enough for every key to get one, the
+// quietest keys get one each and the busiest get none. It returns the share of
+// each key and the part of the budget no key needed.
+func allocateBudget(budget int, counts map[string]int) (map[string]int, int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] < counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	shares := make(map[string]int, len(keys))
+	for i, key := range keys {
+		left := len(keys) - i
+		share := (budget + left - 1) / left
+		if counts[key] < share {
+			share = counts[key]
+		}
+		shares[key] = share
+		budget -= share
+	}
+	return shares, budget
+}
+
+// charge takes amount from key's share of the budget, and then from the pool
+// if the share isn't enough, and reports whether there was enough between
+// them. Nothing is taken if there wasn't.
+func (s *StrictBudgetSampler) charge(key string, amount float64) bool {
+	share := s.shares[key]
+	if share >= amount {
+		s.shares[key] = share - amount
+		return true
+	}
+	if share+s.pool >= amount {
+		s.pool -= amount - share
+		if share > 0 {
+			s.shares[key] = 0
+		}
+		return true
+	}
+	s.exhaustedCount++
+	return false
+}
+
+// count records count events for key and returns the number of its events
+// seen before them this interval.
+func (s *StrictBudgetSampler) count(key string, count int64) int {
+	s.requestCount++
+	s.eventCount += count
+
+	seen, found := s.currentCounts[key]
+	if count <= 0 {
+		// nothing to count, and a key with no events mustn't get a rate
+		return seen
+	}
+	if found || s.MaxKeys <= 0 || len(s.currentCounts) < s.MaxKeys {
+		s.currentCounts[key] = seen + clampInt(count)
+	} else {
+		s.droppedKeys.add(key)
+	}
+	return seen
+}
+
+// rateFor returns the sample rate for key, or 1 if it has none.
+func (s *StrictBudgetSampler) rateFor(key string) int {
+	if rate, found := s.savedSampleRates[key]; found {
+		return rate
+	}
+	return 1
+}
+
+// Decide takes a key representing count events and decides whether to keep
+// them, without exceeding BudgetPerInterval. If they are kept, rate is the
+// sample rate to record with them, the number of events each one stands for.
+// Decisions are deterministic: of the events for a key with a rate of N, the
+// first and every Nth after it are kept while the budget lasts. A call whose
+// events span one of those is kept whole, and charged all count of them.
+func (s *StrictBudgetSampler) Decide(key string, count int) (keep bool, rate int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.currentCounts == nil {
+		// not started yet
+		return true, 1
+	}
+
+	seen := s.count(key, int64(count))
+	rate = s.rateFor(key)
+	// the first event at or after seen whose position is a multiple of rate
+	next := (seen + rate - 1) / rate * rate
+	if next >= seen+count {
+		return false, rate
+	}
+	return s.charge(key, float64(count)), rate
+}
+
+// GetSampleRate takes a key and returns the appropriate sample rate for that
+// key.
+func (s *StrictBudgetSampler) GetSampleRate(key string) int {
+	return s.GetSampleRateMulti(key, 1)
+}
+
+// GetSampleRateMulti takes a key representing count spans and returns the
+// appropriate sample rate for that key. Once the budget is spent, it returns a
+// rate of 1,000,000,000, which drops nearly everything, until the next
+// interval begins. Use Decide to stay strictly within the budget.
+func (s *StrictBudgetSampler) GetSampleRateMulti(key string, count int) int {
+	return s.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (s *StrictBudgetSampler) GetSampleRateMulti64(key string, count int64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+
+	s.count(key, count)
+	rate := s.rateFor(key)
+	if !s.charge(key, float64(count)/float64(rate)) {
+		return hardBudgetSampleRate
+	}
+	return rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+// It returns 1,000,000,000 if the budget left couldn't pay for an event.
+func (s *StrictBudgetSampler) PeekSampleRate(key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	rate := s.rateFor(key)
+	if s.shares[key]+s.pool < 1/float64(rate) {
+		return hardBudgetSampleRate
+	}
+	return rate
+}
+
+// SaveState is not implemented
+func (s *StrictBudgetSampler) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// LoadState is not implemented
+func (s *StrictBudgetSampler) LoadState(state []byte) error {
+	return nil
+}
+
+// SupportsState reports that SaveState is not implemented, so there is no
+// state to persist.
+func (s *StrictBudgetSampler) SupportsState() bool {
+	return false
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (s *StrictBudgetSampler) DroppedKeySamples() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.droppedKeys.drain()
+}
+
+func (s *StrictBudgetSampler) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(s.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. budget_remaining is the part of this interval's budget
+// that hasn't been spent, and exhausted_count the number of calls refused
+// because the budget had run out.
+func (s *StrictBudgetSampler) GetMetricsTyped(prefix string) map[string]Metric {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	remaining := s.pool
+	for _, share := range s.shares {
+		remaining += share
+	}
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(s.requestCount),
+		prefix + "event_count":          counter(s.eventCount),
+		prefix + "interval_count":       counter(s.intervalCount),
+		prefix + "exhausted_count":      counter(s.exhaustedCount),
+		prefix + "keyspace_size":        gauge(s.keyspace.report(s.SmoothKeyspaceMetric, int64(len(s.currentCounts)))),
+		prefix + "keys_above_threshold": gauge(s.heavyKeys.value()),
+		prefix + "budget_remaining":     gauge(int64(remaining)),
+	}
+	return mets
+}
@@ -0,0 +1,129 @@
+package dynsampler
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocateBudget(t *testing.T) {
+	tsts := []struct {
+		budget     int
+		counts     map[string]int
+		wantShares map[string]int
+		wantPool   int
+	}{
+		{100, map[string]int{}, map[string]int{}, 100},
+		{100, map[string]int{"a": 10, "b": 20}, map[string]int{"a": 10, "b": 20}, 70},
+		// the quiet key gets all it needs, and the rest is split equally
+		{100, map[string]int{"a": 10, "b": 500, "c": 1000}, map[string]int{"a": 10, "b": 45, "c": 45}, 0},
+		// rounding favors the quieter keys
+		{10, map[string]int{"a": 100, "b": 100, "c": 100}, map[string]int{"a": 4, "b": 3, "c": 3}, 0},
+		// not enough for every key
+		{2, map[string]int{"a": 5, "b": 10, "c": 20}, map[string]int{"a": 1, "b": 1, "c": 0}, 0},
+	}
+	for i, tst := range tsts {
+		shares, pool := allocateBudget(tst.budget, tst.counts)
+		assert.Equal(t, tst.wantShares, shares, "test %d", i)
+		assert.Equal(t, tst.wantPool, pool, "test %d", i)
+	}
+}
+
+func TestStrictBudgetSamplerNeverExceedsBudget(t *testing.T) {
+	const budget = 500
+	s := &StrictBudgetSampler{BudgetPerInterval: budget, NoBackgroundGoroutine: true}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	r := rand.New(rand.NewSource(1))
+	for interval := 0; interval < 50; interval++ {
+		// the traffic swings between quiet and very busy, with a changing mix
+		// of keys and batch sizes
+		numKeys := 1 + r.Intn(200)
+		calls := r.Intn(20000)
+		kept := 0
+		for i := 0; i < calls; i++ {
+			key := "key" + strconv.Itoa(int(r.ExpFloat64()*float64(numKeys))%numKeys)
+			count := 1
+			if r.Intn(10) == 0 {
+				count = 1 + r.Intn(20)
+			}
+			keep, rate := s.Decide(key, count)
+			assert.GreaterOrEqual(t, rate, 1)
+			if keep {
+				kept += count
+			}
+		}
+		assert.LessOrEqual(t, kept, budget, "interval %d", interval)
+		s.Update()
+	}
+}
+
+func TestStrictBudgetSamplerFairness(t *testing.T) {
+	s := &StrictBudgetSampler{BudgetPerInterval: 100, NoBackgroundGoroutine: true}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	traffic := map[string]int{"rare": 10, "busy": 1000, "busier": 5000}
+	run := func() map[string]int {
+		kept := map[string]int{}
+		for key, n := range traffic {
+			for i := 0; i < n; i++ {
+				if keep, _ := s.Decide(key, 1); keep {
+					kept[key]++
+				}
+			}
+		}
+		return kept
+	}
+	run()
+	s.Update()
+	// the rare key keeps everything, and the others split the rest equally,
+	// with rates rounded up to fit their shares
+	assert.Equal(t, map[string]int{"rare": 1, "busy": 23, "busier": 112}, s.savedSampleRates)
+	assert.Equal(t, map[string]int{"rare": 10, "busy": 44, "busier": 45}, run())
+	assert.Equal(t, int64(1), s.GetMetrics("")["budget_remaining"])
+	assert.Equal(t, int64(1), s.GetMetrics("")["keys_above_threshold"])
+}
+
+func TestStrictBudgetSamplerGetSampleRate(t *testing.T) {
+	s := &StrictBudgetSampler{BudgetPerInterval: 10, NoBackgroundGoroutine: true}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	// in the first interval the pool pays for everything
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, s.GetSampleRate("key"))
+	}
+	assert.Equal(t, hardBudgetSampleRate, s.GetSampleRate("key"))
+	assert.Equal(t, int64(1), s.GetMetrics("")["exhausted_count"])
+
+	// 11 events to fit in 10
+	s.Update()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 2, s.GetSampleRateMulti("key", 4))
+	}
+	assert.Equal(t, hardBudgetSampleRate, s.GetSampleRateMulti("key", 4))
+	assert.Equal(t, int64(17), s.GetMetrics("")["request_count"])
+}
+
+func TestStrictBudgetSamplerZeroCount(t *testing.T) {
+	s := &StrictBudgetSampler{BudgetPerInterval: 10, NoBackgroundGoroutine: true}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	keep, rate := s.Decide("zero", 0)
+	assert.False(t, keep)
+	assert.Equal(t, 1, rate)
+	s.GetSampleRateMulti("zero", 0)
+	s.Update()
+
+	// a key seen only with no events has no rate, rather than a rate of 0
+	assert.Empty(t, s.savedSampleRates)
+	keep, rate = s.Decide("zero", 1)
+	assert.True(t, keep)
+	assert.Equal(t, 1, rate)
+	assert.Equal(t, 1, s.GetSampleRate("zero"))
+}
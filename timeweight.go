@@ -0,0 +1,41 @@
+package dynsampler
+
+import (
+	"math"
+	"time"
+)
+
+// timeWeighting measures how long each interval of an EMA sampler actually
+// lasted, for TimeWeightedEMA. The zero value is ready to use, and adjusts
+// averages exactly as adjustAverage does until observe is called.
+type timeWeighting struct {
+	last time.Time
+
+	// ratio is the length of the last interval as a multiple of the nominal
+	// interval, or 0 if it hasn't been measured
+	ratio float64
+}
+
+// observe records that an interval meant to last interval ended at t. The
+// first interval observed is taken to have lasted exactly interval.
+func (w *timeWeighting) observe(t time.Time, interval time.Duration) {
+	w.ratio = 1
+	if !w.last.IsZero() && interval > 0 {
+		if r := float64(t.Sub(w.last)) / float64(interval); r > 0 {
+			w.ratio = r
+		}
+	}
+	w.last = t
+}
+
+// adjust is like adjustAverage, for a value counted over the last interval
+// observed. The value is scaled to what it would have been over the nominal
+// interval, and alpha is raised to the weight that many nominal intervals
+// would have had together, so that an interval twice as long moves the
+// average as far as two regular ones with the same rate of traffic.
+func (w *timeWeighting) adjust(oldAvg, value, alpha float64) float64 {
+	if w.ratio <= 0 {
+		return adjustAverage(oldAvg, value, alpha)
+	}
+	return adjustAverage(oldAvg, value/w.ratio, 1-math.Pow(1-alpha, w.ratio))
+}
@@ -1,7 +1,8 @@
 package dynsampler
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"math"
 	"sync"
 	"time"
@@ -30,37 +31,174 @@ type TotalThroughput struct {
 	// If neither one is set, the default is 30s.
 	ClearFrequencyDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine
+	// that recalculates sample rates every ClearFrequencyDuration, for
+	// embedded use where background goroutines aren't welcome. The caller must
+	// call Update on its own schedule instead; without calls to Update, the
+	// sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// GoalThroughputPerSec is the target number of events to send per second.
 	// Sample rates are generated to squash the total throughput down to match the
 	// goal throughput. Actual throughput may exceed goal throughput. default 100
 	GoalThroughputPerSec int
 
+	// CountUnit decides whether throughput is measured in events, the count
+	// passed to GetSampleRateMulti, or in calls. The rate returned applies to
+	// all the events a call stands for either way, and
+	// HardKeptBudgetPerInterval is counted in the same unit. See CountUnit for
+	// details. Defaults to CountUnitSpans.
+	CountUnit CountUnit
+
+	// GoalSchedule, if set, replaces GoalThroughputPerSec during the times of
+	// day its windows cover, so that, for example, the goal can be lower at
+	// night. The goal is chosen from the wall-clock time whenever sample rates
+	// are recalculated; the first window that contains the time wins, and
+	// GoalThroughputPerSec applies outside all of them.
+	GoalSchedule []GoalWindow
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
 	// the sample rate map within the interval defined by `ClearFrequencySec`. Once
 	// MaxKeys is reached, new keys will not be included in the sample rate map, but
 	// existing keys will continue to be be counted.
 	MaxKeys int
 
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// ExpectedKeys, if greater than 0, is a hint for how many distinct keys
+	// the sampler will see in an interval. It is used to size internal maps up
+	// front so they don't have to grow as keys arrive. Defaults to 0.
+	ExpectedKeys int
+
+	// HardKeptBudgetPerInterval, if greater than 0, is a hard ceiling on the
+	// number of events kept in each ClearFrequencyDuration, on top of the
+	// smooth GoalThroughputPerSec. The sampler keeps a running estimate of how
+	// many events the rates it has returned will keep, and once that exceeds
+	// the budget it returns a rate of 1,000,000,000 for every key, which drops
+	// nearly everything, until the next interval begins. This is a circuit
+	// breaker for sudden floods of traffic, not a way to meet a goal: rare keys
+	// are suppressed along with busy ones once it trips. Defaults to 0, which
+	// sets no ceiling.
+	HardKeptBudgetPerInterval int
+
+	// GuaranteeOnePerKey, if true, keeps every key's sample rate at or below
+	// the number of events it had in the last interval, so that each key can
+	// expect at least one event to be kept per ClearFrequencyDuration. Without
+	// it, when there are more keys than the goal allows for, every key gets a
+	// rate above its count and rare keys may never be kept. This can push
+	// throughput well past GoalThroughputPerSec with large key spaces.
+	// Defaults to false.
+	GuaranteeOnePerKey bool
+
+	// KeyTTL, if greater than 0, is how long a key keeps its last sample
+	// rate after it stops appearing. Rates are recalculated from each
+	// interval's traffic alone, so without it a key that is quiet for one
+	// interval loses its rate, and gets a rate of 1 when it comes back until
+	// the next recalculation, which can let a flood through. Defaults to 0.
+	KeyTTL time.Duration
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	currentCounts    map[string]int
 	done             chan struct{}
 
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// keyTTL remembers when keys were last seen, for KeyTTL
+	keyTTL keyTTL
+
+	// overshoot holds the last interval's counts, for OvershootContributors
+	overshoot overshoot[int]
+
+	// cardinality estimates the number of distinct keys seen since Start
+	cardinality cardinalityEstimate
+
+	// keptThisInterval estimates the events kept since the last interval, for
+	// HardKeptBudgetPerInterval
+	keptThisInterval float64
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
-	requestCount int64
-	eventCount   int64
+	requestCount  int64
+	eventCount    int64
+	intervalCount int64
+	keptFraction  int64      // parts per million, as of the last interval with traffic
+	heavyKeys     *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
 }
 
 // Ensure we implement the sampler interface
 var _ Sampler = (*TotalThroughput)(nil)
 
-func (t *TotalThroughput) Start() error {
-	// apply defaults
+// hardBudgetSampleRate is the rate returned once HardKeptBudgetPerInterval is
+// used up.
+const hardBudgetSampleRate = 1000000000
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (t *TotalThroughput) Validate() error {
 	if t.ClearFrequencyDuration != 0 && t.ClearFrequencySec != 0 {
-		return fmt.Errorf("the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+		return newConfigError(ErrConflictingIntervalConfig, "the ClearFrequencySec configuration value is deprecated; use only ClearFrequencyDuration")
+	}
+	if t.ClearFrequencyDuration < 0 || t.ClearFrequencySec < 0 {
+		return newConfigError(ErrInvalidInterval, "the clear frequency must not be negative")
+	}
+	if t.KeyTTL < 0 {
+		return newConfigError(ErrInvalidInterval, "the KeyTTL %v must not be negative", t.KeyTTL)
+	}
+	if t.GoalThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalThroughputPerSec %d must not be negative", t.GoalThroughputPerSec)
+	}
+	if err := validateGoalSchedule(t.GoalSchedule); err != nil {
+		return err
+	}
+	if t.HardKeptBudgetPerInterval < 0 {
+		return newConfigError(ErrInvalidGoal, "the HardKeptBudgetPerInterval %d must not be negative", t.HardKeptBudgetPerInterval)
+	}
+	if t.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", t.HeavySampleThreshold)
+	}
+	return nil
+}
+
+func (t *TotalThroughput) Start() error {
+	if err := t.Validate(); err != nil {
+		return err
 	}
 
+	// apply defaults
 	if t.ClearFrequencyDuration == 0 && t.ClearFrequencySec == 0 {
 		t.ClearFrequencyDuration = 30 * time.Second
 	} else if t.ClearFrequencySec != 0 {
@@ -71,11 +209,22 @@ func (t *TotalThroughput) Start() error {
 		t.GoalThroughputPerSec = 100
 	}
 
+	if err := checkInterval("ClearFrequencyDuration", t.ClearFrequencyDuration); err != nil {
+		return err
+	}
+
 	// initialize internal variables
-	t.savedSampleRates = make(map[string]int)
-	t.currentCounts = make(map[string]int)
+	// Create saved sample rate map if we're not loading from a previous state
+	if t.savedSampleRates == nil {
+		t.savedSampleRates = make(map[string]int, t.ExpectedKeys)
+	}
+	t.currentCounts = make(map[string]int, t.ExpectedKeys)
 	t.done = make(chan struct{})
 
+	if t.NoBackgroundGoroutine {
+		return nil
+	}
+
 	// spin up calculator
 	go func() {
 		ticker := time.NewTicker(t.ClearFrequencyDuration)
@@ -94,17 +243,32 @@ func (t *TotalThroughput) Start() error {
 
 func (t *TotalThroughput) Stop() error {
 	close(t.done)
+	exportRates(t.ExportOnStop, &t.lock, &t.savedSampleRates)
 	return nil
 }
 
+// Update recalculates the sample rates from the counts since the last update,
+// as the goroutine launched by Start does every ClearFrequencyDuration. It is for
+// use with NoBackgroundGoroutine.
+func (t *TotalThroughput) Update() {
+	t.updateMaps()
+}
+
 // updateMaps calculates a new saved rate map based on the contents of the
 // counter map
 func (t *TotalThroughput) updateMaps() {
 	// make a local copy of the sample counters for calculation
 	t.lock.Lock()
 	tmpCounts := t.currentCounts
-	t.currentCounts = make(map[string]int)
+	addKeys(&t.cardinality, tmpCounts)
+	t.keyspace.observe(len(tmpCounts))
+	oldRates := t.savedSampleRates
+	t.intervalCount++
+	t.currentCounts = make(map[string]int, t.ExpectedKeys)
+	t.keptThisInterval = 0
+	t.eventRate.update(t.eventCount, now(), t.ClearFrequencyDuration)
 	t.lock.Unlock()
+	goal := goalAt(t.GoalSchedule, now(), t.GoalThroughputPerSec)
 	// short circuit if no traffic
 	numKeys := len(tmpCounts)
 	if numKeys == 0 {
@@ -112,23 +276,37 @@ func (t *TotalThroughput) updateMaps() {
 		t.lock.Lock()
 		defer t.lock.Unlock()
 		t.savedSampleRates = make(map[string]int)
+		t.heavyKeys = newHeavyKeys(t.HeavySampleThreshold)
+		t.keyTTL.carry(t.KeyTTL, now(), tmpCounts, oldRates, t.savedSampleRates, t.heavyKeys)
+		t.overshoot.set(nil, 0)
 		return
 	}
 	// figure out our target throughput per key over ClearFrequencyDuration
-	totalGoalThroughput := float64(t.GoalThroughputPerSec) * t.ClearFrequencyDuration.Seconds()
+	totalGoalThroughput := float64(goal) * t.ClearFrequencyDuration.Seconds()
 	// split the total throughput equally across the number of keys.
 	throughputPerKey := float64(totalGoalThroughput) / float64(numKeys)
 	// for each key, calculate sample rate by dividing counted events by the
 	// desired number of events
-	newSavedSampleRates := make(map[string]int)
+	newSavedSampleRates := make(map[string]int, len(tmpCounts))
+	heavy := newHeavyKeys(t.HeavySampleThreshold)
+	var sumEvents, kept float64
 	for k, v := range tmpCounts {
 		rate := int(math.Max(1, (float64(v) / float64(throughputPerKey))))
-		newSavedSampleRates[k] = rate
+		if t.GuaranteeOnePerKey && rate > v {
+			rate = v
+		}
+		heavy.set(newSavedSampleRates, k, rate)
+		sumEvents += float64(v)
+		kept += float64(v) / float64(rate)
 	}
+	t.keyTTL.carry(t.KeyTTL, now(), tmpCounts, oldRates, newSavedSampleRates, heavy)
 	// save newly calculated sample rates
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	t.savedSampleRates = newSavedSampleRates
+	t.heavyKeys = heavy
+	t.keptFraction = keptFractionPPM(kept, sumEvents)
+	t.overshoot.set(tmpCounts, totalGoalThroughput)
 }
 
 // GetSampleRate takes a key and returns the appropriate sample rate for that
@@ -140,44 +318,214 @@ func (t *TotalThroughput) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (t *TotalThroughput) GetSampleRateMulti(key string, count int) int {
+	return t.GetSampleRateMulti64(key, int64(count))
+}
+
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (t *TotalThroughput) GetSampleRateMulti64(key string, count int64) int {
 	t.lock.Lock()
 	defer t.lock.Unlock()
+	if t.currentCounts == nil {
+		// not started yet
+		return 1
+	}
 
 	t.requestCount++
-	t.eventCount += int64(count)
+	t.eventCount += count
+	units := t.CountUnit.of(count)
 
-	// Enforce MaxKeys limit on the size of the map
-	if t.MaxKeys > 0 {
-		// If a key already exists, increment it. If not, but we're under the limit, store a new key
-		if _, found := t.currentCounts[key]; found || len(t.currentCounts) < t.MaxKeys {
-			t.currentCounts[key] += count
+	key, track := t.oversizeKeys.check(key, t.MaxKeyLength, t.OnOversizeKey)
+	if track {
+		// Enforce MaxKeys limit on the size of the map
+		if t.MaxKeys > 0 {
+			// If a key already exists, increment it. If not, but we're under the limit, store a new key
+			if _, found := t.currentCounts[key]; found || len(t.currentCounts) < t.MaxKeys {
+				t.currentCounts[key] += clampInt(units)
+			} else {
+				// dropped keys never reach currentCounts, so they're added
+				// to the estimate here instead of in updateMaps
+				t.cardinality.add(key)
+				t.droppedKeys.add(key)
+			}
+		} else {
+			t.currentCounts[key] += clampInt(units)
+		}
+	}
+	rate := 1
+	if savedRate, found := t.savedSampleRates[key]; found {
+		rate = savedRate
+	}
+	if t.HardKeptBudgetPerInterval > 0 {
+		if t.keptThisInterval >= float64(t.HardKeptBudgetPerInterval) {
+			return hardBudgetSampleRate
 		}
-	} else {
-		t.currentCounts[key] += count
+		t.keptThisInterval += float64(units) / float64(rate)
+	}
+	return rate
+}
+
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+func (t *TotalThroughput) PeekSampleRate(key string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.currentCounts == nil {
+		// not started yet
+		return 1
+	}
+	if t.HardKeptBudgetPerInterval > 0 && t.keptThisInterval >= float64(t.HardKeptBudgetPerInterval) {
+		return hardBudgetSampleRate
 	}
+	key, _ = (&oversizeKeys{}).check(key, t.MaxKeyLength, t.OnOversizeKey)
 	if rate, found := t.savedSampleRates[key]; found {
 		return rate
 	}
 	return 1
 }
 
-// SaveState is not implemented
+// totalThroughputState is what SaveState saves for a TotalThroughput.
+type totalThroughputState struct {
+	// These fields are exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	Sampler          string         `json:"sampler,omitempty"`
+	SavedSampleRates map[string]int `json:"saved_sample_rates"`
+}
+
+// SaveState returns a byte array with a JSON representation of the sampler
+// state. Only the sample rates are saved, not the counts for the current
+// interval.
 func (t *TotalThroughput) SaveState() ([]byte, error) {
-	return nil, nil
+	// the rates are copied under the lock and marshaled after it is released,
+	// so sampling is only held up for the copy
+	t.lock.Lock()
+	if t.savedSampleRates == nil {
+		t.lock.Unlock()
+		return nil, errors.New("saved sample rate map is nil")
+	}
+	s := &totalThroughputState{Sampler: stateSamplerTotalThroughput, SavedSampleRates: copyRates(t.savedSampleRates)}
+	t.lock.Unlock()
+	return json.Marshal(s)
 }
 
-// LoadState is not implemented
+// LoadState accepts a byte array with a JSON representation of a previous
+// instance's state. It should be called before Start. The loaded sample rates
+// are used from the moment the sampler starts until they are replaced at the
+// end of the first ClearFrequencyDuration. State that is truncated, contains
+// impossible values, or was saved by a different kind of sampler is rejected
+// with an error, leaving the sampler unchanged.
 func (t *TotalThroughput) LoadState(state []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := totalThroughputState{}
+	err := json.Unmarshal(state, &s)
+	if err != nil {
+		return err
+	}
+	if _, err := checkStateSampler(s.Sampler, stateSamplerTotalThroughput, false); err != nil {
+		return err
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+
+	t.savedSampleRates = s.SavedSampleRates
+	t.heavyKeys = countHeavyKeys(s.SavedSampleRates, t.HeavySampleThreshold)
 	return nil
 }
 
+// SupportsState reports that SaveState returns the sampler's state, so it is
+// worth persisting.
+func (t *TotalThroughput) SupportsState() bool {
+	return true
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (t *TotalThroughput) DroppedKeySamples() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.droppedKeys.drain()
+}
+
+// EstimateCardinality returns an estimate of the number of distinct keys the
+// sampler has seen since it started, including keys that weren't counted
+// because MaxKeys was reached. It is meant to help choose a value for MaxKeys.
+// The estimate is typically within a few percent of the true number, and
+// keeping it takes a fixed 4KiB however many keys there are. Keys that were
+// counted are added to it when the interval ends, so that neither sampling nor
+// reading the estimate has to hash them; keyspace_size reports the keys
+// counted so far in the current interval.
+func (t *TotalThroughput) EstimateCardinality() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return int(t.cardinality.estimate())
+}
+
+// OvershootContributors returns up to n of the keys that kept the most events
+// beyond an equal share of the goal in the last interval, largest first, to
+// show why throughput is over the goal: many rare keys at a rate of 1, or a
+// busy key that isn't sampled hard enough. Each key's kept events are
+// estimated from its count and rate. It doesn't change anything, and is safe
+// to call while the sampler is in use.
+func (t *TotalThroughput) OvershootContributors(n int) []KeyContribution {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.overshoot.top(n, t.savedSampleRates)
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (t *TotalThroughput) OversizeKeyError() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.oversizeKeys.takeErr()
+}
+
 func (t *TotalThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(t.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge.
+func (t *TotalThroughput) GetMetricsTyped(prefix string) map[string]Metric {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": t.requestCount,
-		prefix + "event_count":   t.eventCount,
-		prefix + "keyspace_size": int64(len(t.currentCounts)),
+	mets := map[string]Metric{
+		prefix + "request_count":         counter(t.requestCount),
+		prefix + "event_count":           counter(t.eventCount),
+		prefix + "interval_count":        counter(t.intervalCount),
+		prefix + "keyspace_size":         gauge(t.keyspace.report(t.SmoothKeyspaceMetric, int64(len(t.currentCounts)))),
+		prefix + "keys_above_threshold":  gauge(t.heavyKeys.value()),
+		prefix + "estimated_cardinality": gauge(t.cardinality.estimate()),
+		prefix + "oversize_key_count":    counter(t.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":         gauge(t.keptFraction),
+		prefix + "events_per_sec":        gauge(t.eventRate.perSec),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (t *TotalThroughput) GetMetricsSummary(prefix string) map[string]int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return summarizeRates(prefix, t.savedSampleRates, t.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (t *TotalThroughput) GetAllSampleRates() map[string]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return copyRates(t.savedSampleRates)
+}
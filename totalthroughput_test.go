@@ -1,6 +1,7 @@
 package dynsampler
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -224,6 +225,9 @@ func TestTotalThroughputMaxKeys(t *testing.T) {
 	tt.GetSampleRate("one")
 	assert.Equal(t, 3, len(tt.currentCounts))
 	assert.Equal(t, 2, tt.currentCounts["one"])
+	// The rejected key should be available as a sample, and reading clears it
+	assert.Equal(t, []string{"four"}, tt.DroppedKeySamples())
+	assert.Equal(t, []string{}, tt.DroppedKeySamples())
 }
 
 func TestTotalThroughput_Start(t *testing.T) {
@@ -249,6 +253,9 @@ func TestTotalThroughput_Start(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("TotalThroughput error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr && !errors.Is(err, ErrConflictingIntervalConfig) {
+				t.Errorf("TotalThroughput error = %v, want ErrConflictingIntervalConfig", err)
+			}
 			if err == nil {
 				defer a.Stop()
 				if tt.wantDuration != a.ClearFrequencyDuration {
@@ -258,3 +265,309 @@ func TestTotalThroughput_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestTotalThroughput_GetMetrics(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		GoalThroughputPerSec:   5,
+		HeavySampleThreshold:   3,
+	}
+	tt.currentCounts = map[string]int{}
+	tt.savedSampleRates = map[string]int{}
+	tt.GetSampleRateMulti("a", 10)
+	tt.GetSampleRateMulti("b", 10)
+	tt.updateMaps()
+
+	mets := tt.GetMetrics("tt_")
+	assert.Equal(t, int64(2), mets["tt_request_count"])
+	assert.Equal(t, int64(20), mets["tt_event_count"])
+	assert.Equal(t, int64(1), mets["tt_interval_count"])
+	// each key gets a rate of 4, so 5 of the 20 events are kept
+	assert.Equal(t, int64(250000), mets["tt_kept_fraction"])
+	assert.Equal(t, int64(2), mets["tt_keys_above_threshold"])
+	// the first interval is taken to be ClearFrequencyDuration long
+	assert.Equal(t, int64(20), mets["tt_events_per_sec"])
+
+	// later ones are measured, so an interval cut short is still accurate
+	clock.advance(500 * time.Millisecond)
+	tt.GetSampleRateMulti("a", 30)
+	tt.updateMaps()
+	mets = tt.GetMetrics("tt_")
+	assert.Equal(t, int64(60), mets["tt_events_per_sec"])
+	assert.Equal(t, int64(50), mets["tt_event_count"])
+}
+
+func TestTotalThroughputHardKeptBudgetPerInterval(t *testing.T) {
+	tt := &TotalThroughput{
+		HardKeptBudgetPerInterval: 100,
+		currentCounts:             map[string]int{},
+		savedSampleRates:          map[string]int{"busy": 10},
+	}
+	// a burst of busy traffic keeps 1 in 10, so the budget lasts 1000 events
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 10, tt.GetSampleRateMulti("busy", 10))
+	}
+	assert.Equal(t, 1000000000, tt.GetSampleRateMulti("busy", 10))
+	// once the budget is gone, every key is suppressed, even one we'd keep
+	assert.Equal(t, 1000000000, tt.GetSampleRate("rare"))
+	// the suppressed events are still counted toward the next rates
+	assert.Equal(t, 1010, tt.currentCounts["busy"])
+
+	tt.updateMaps()
+	assert.NotEqual(t, 1000000000, tt.GetSampleRate("rare"))
+}
+
+func TestTotalThroughputGuaranteeOnePerKey(t *testing.T) {
+	counts := map[string]int{"hot": 100000, "warm": 500}
+	for i := 0; i < 200; i++ {
+		counts["rare"+strconv.Itoa(i)] = i%5 + 1
+	}
+	newSampler := func(guarantee bool) *TotalThroughput {
+		s := &TotalThroughput{
+			ClearFrequencyDuration: 10 * time.Second,
+			GoalThroughputPerSec:   1,
+			GuaranteeOnePerKey:     guarantee,
+			currentCounts:          make(map[string]int),
+		}
+		for k, v := range counts {
+			s.currentCounts[k] = v
+		}
+		s.updateMaps()
+		return s
+	}
+
+	// with 10 events to share among 202 keys, rare keys get rates far above
+	// their counts
+	s := newSampler(false)
+	assert.Greater(t, s.savedSampleRates["rare4"], counts["rare4"])
+
+	s = newSampler(true)
+	for k, v := range counts {
+		assert.LessOrEqual(t, s.savedSampleRates[k], v, k)
+		assert.GreaterOrEqual(t, s.savedSampleRates[k], 1, k)
+	}
+	assert.Equal(t, 100000, s.savedSampleRates["hot"])
+}
+
+func TestTotalThroughputGoalSchedule(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 5, 59, 0, 0, time.UTC)}
+	defer SetClockForTesting(clock)()
+
+	s := &TotalThroughput{
+		ClearFrequencyDuration: 10 * time.Second,
+		GoalThroughputPerSec:   10,
+		GoalSchedule:           []GoalWindow{{From: 0, To: 6 * time.Hour, Goal: 1}},
+		currentCounts:          map[string]int{"a": 1000},
+	}
+	// before 6am the scheduled goal of 1/s allows 10 events per interval
+	s.updateMaps()
+	assert.Equal(t, 100, s.savedSampleRates["a"])
+
+	// from 6am the goal is back to 10/s
+	clock.advance(time.Minute)
+	s.currentCounts["a"] = 1000
+	s.updateMaps()
+	assert.Equal(t, 10, s.savedSampleRates["a"])
+}
+
+func TestTotalThroughputNoBackgroundGoroutine(t *testing.T) {
+	s := &TotalThroughput{
+		ClearFrequencyDuration: time.Millisecond * 100,
+		GoalThroughputPerSec:   10,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	for i := 0; i < 1000; i++ {
+		s.GetSampleRate("key")
+	}
+	// well past several intervals, but nothing has called Update
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, 1, s.GetSampleRate("key"))
+
+	s.Update()
+	assert.Equal(t, 1001, s.GetSampleRate("key"))
+}
+
+func TestTotalThroughputKeyTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	defer SetClockForTesting(clock)()
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		GoalThroughputPerSec:   5,
+		KeyTTL:                 3 * time.Second,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, tt.Start())
+	defer tt.Stop()
+
+	tt.GetSampleRateMulti("flood", 100)
+	tt.GetSampleRateMulti("steady", 10)
+	tt.Update()
+	assert.Equal(t, 40, tt.savedSampleRates["flood"])
+
+	// flood is quiet for less than its TTL, and keeps its rate
+	for i := 0; i < 2; i++ {
+		clock.advance(time.Second)
+		tt.GetSampleRateMulti("steady", 10)
+		tt.Update()
+		assert.Equal(t, 40, tt.savedSampleRates["flood"], "interval %d", i)
+	}
+	assert.Equal(t, 40, tt.PeekSampleRate("flood"))
+
+	// once the TTL is up, the rate is dropped
+	clock.advance(time.Second)
+	tt.Update()
+	clock.advance(time.Second)
+	tt.Update()
+	_, found := tt.savedSampleRates["flood"]
+	assert.False(t, found)
+}
+
+func TestTotalThroughputWithoutKeyTTL(t *testing.T) {
+	tt := &TotalThroughput{GoalThroughputPerSec: 5, ClearFrequencyDuration: time.Second, NoBackgroundGoroutine: true}
+	assert.NoError(t, tt.Start())
+	defer tt.Stop()
+	tt.GetSampleRateMulti("flood", 100)
+	tt.Update()
+	tt.Update()
+	assert.Equal(t, 1, tt.GetSampleRate("flood"))
+}
+
+func TestTotalThroughputCountUnit(t *testing.T) {
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		GoalThroughputPerSec:   10,
+		CountUnit:              CountUnitGroups,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, tt.Start())
+	defer tt.Stop()
+
+	// 10 traces of 100 spans and 100 traces of 1 span
+	for i := 0; i < 10; i++ {
+		tt.GetSampleRateMulti("big", 100)
+	}
+	for i := 0; i < 100; i++ {
+		tt.GetSampleRateMulti("small", 1)
+	}
+	tt.Update()
+	// the goal of 10 traces is split between the keys, 5 each
+	assert.Equal(t, map[string]int{"big": 2, "small": 20}, tt.savedSampleRates)
+	assert.Equal(t, int64(1100), tt.GetMetrics("")["event_count"])
+
+	// counting spans, the big traces are the ones sampled hardest
+	tt.CountUnit = CountUnitSpans
+	for i := 0; i < 10; i++ {
+		tt.GetSampleRateMulti("big", 100)
+	}
+	for i := 0; i < 100; i++ {
+		tt.GetSampleRateMulti("small", 1)
+	}
+	tt.Update()
+	assert.Equal(t, map[string]int{"big": 200, "small": 20}, tt.savedSampleRates)
+}
+
+func TestTotalThroughputExportOnStop(t *testing.T) {
+	var exported map[string]int
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		GoalThroughputPerSec:   10,
+		NoBackgroundGoroutine:  true,
+		ExportOnStop:           func(rates map[string]int) { exported = rates },
+	}
+	assert.NoError(t, tt.Start())
+
+	for i := 0; i < 100; i++ {
+		tt.GetSampleRate("busy")
+	}
+	tt.GetSampleRate("quiet")
+	tt.Update()
+	want := copyRates(tt.savedSampleRates)
+	assert.Equal(t, 1, want["quiet"])
+	assert.Greater(t, want["busy"], 1)
+
+	assert.Nil(t, exported)
+	assert.NoError(t, tt.Stop())
+	assert.Equal(t, want, exported)
+
+	// the callback gets a copy, not the sampler's own map
+	exported["busy"] = 1000
+	assert.Equal(t, want, tt.savedSampleRates)
+}
+
+func TestTotalThroughputOvershootContributors(t *testing.T) {
+	tt := &TotalThroughput{
+		ClearFrequencyDuration: time.Second,
+		GoalThroughputPerSec:   20,
+		GuaranteeOnePerKey:     true,
+		NoBackgroundGoroutine:  true,
+	}
+	assert.NoError(t, tt.Start())
+	defer tt.Stop()
+	assert.Empty(t, tt.OvershootContributors(5))
+
+	// a goal of 20 split between 40 keys is half an event each, but every key
+	// is guaranteed to keep one, so each keeps twice its share
+	tt.GetSampleRateMulti("busy", 1000)
+	for i := 0; i < 39; i++ {
+		tt.GetSampleRate(fmt.Sprintf("rare%02d", i))
+	}
+	tt.Update()
+
+	got := tt.OvershootContributors(3)
+	if assert.Len(t, got, 3) {
+		assert.Equal(t, KeyContribution{Key: "busy", Count: 1000, SampleRate: 1000, Kept: 1, FairShare: 0.5, Excess: 0.5}, got[0])
+		assert.Equal(t, KeyContribution{Key: "rare00", Count: 1, SampleRate: 1, Kept: 1, FairShare: 0.5, Excess: 0.5}, got[1])
+		assert.Equal(t, "rare01", got[2].Key)
+	}
+	assert.Len(t, tt.OvershootContributors(100), 40)
+	assert.Empty(t, tt.OvershootContributors(0))
+
+	// with a goal that covers every key, nothing is over its share
+	tt.GoalThroughputPerSec = 2000
+	tt.GetSampleRateMulti("busy", 1000)
+	for i := 0; i < 39; i++ {
+		tt.GetSampleRate(fmt.Sprintf("rare%02d", i))
+	}
+	tt.Update()
+	assert.Empty(t, tt.OvershootContributors(3))
+}
+
+func TestTotalThroughputSaveState(t *testing.T) {
+	var sampler Sampler
+	tt := &TotalThroughput{}
+	// ensure the interface is implemented
+	sampler = tt
+	err := sampler.Start()
+	assert.Nil(t, err)
+
+	tt.lock.Lock()
+	tt.savedSampleRates = map[string]int{"foo": 2, "bar": 4}
+	tt.lock.Unlock()
+
+	assert.Equal(t, 2, sampler.GetSampleRate("foo"))
+	assert.Equal(t, 4, sampler.GetSampleRate("bar"))
+
+	state, err := sampler.SaveState()
+	assert.Nil(t, err)
+
+	var newSampler Sampler = &TotalThroughput{}
+
+	err = newSampler.LoadState(state)
+	assert.Nil(t, err)
+	err = newSampler.Start()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, newSampler.GetSampleRate("foo"))
+	assert.Equal(t, 4, newSampler.GetSampleRate("bar"))
+	assert.Equal(t, 1, newSampler.GetSampleRate("baz"))
+
+	// state saved by another kind of sampler is rejected
+	assert.Error(t, (&TotalThroughput{}).LoadState([]byte(`{"sampler":"EMAThroughput","saved_sample_rates":{"foo":2}}`)))
+	// as is state with impossible rates
+	assert.Error(t, (&TotalThroughput{}).LoadState([]byte(`{"saved_sample_rates":{"foo":0}}`)))
+}
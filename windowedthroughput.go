@@ -1,8 +1,11 @@
 package dynsampler
 
 import (
+	"encoding/json"
+	"errors"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,6 +36,12 @@ type WindowedThroughput struct {
 	// UpdateFrequency is how often the sampling rate is recomputed, default is 1s.
 	UpdateFrequencyDuration time.Duration
 
+	// NoBackgroundGoroutine, if true, stops Start from launching the goroutine that recomputes
+	// the sample rates every UpdateFrequencyDuration, for embedded use where background
+	// goroutines aren't welcome. The caller must call Update on its own schedule instead;
+	// without calls to Update, the sample rates never change. Defaults to false.
+	NoBackgroundGoroutine bool
+
 	// LookbackFrequency is how far back in time we lookback to dynamically adjust our sampling
 	// rate. Default is 30 * UpdateFrequencyDuration. This will be 30s assuming the default
 	// configuration of UpdateFrequencyDuration. We enforce this to be an _integer multiple_ of
@@ -42,6 +51,11 @@ type WindowedThroughput struct {
 	// Target throughput per second.
 	GoalThroughputPerSec float64
 
+	// MinEventsPerSec, if greater than 0, is the per-key volume below which a key is not
+	// sampled at all. Any key whose average rate over the lookback window is less than this
+	// many events per second gets a sample rate of 1, regardless of its share of the goal.
+	MinEventsPerSec float64
+
 	// MaxKeys, if greater than 0, limits the number of distinct keys used to build
 	// the sample rate map within the interval defined by `LookbackFrequencyDuration`. Once
 	// MaxKeys is reached, new keys will not be included in the sample rate map, but
@@ -49,18 +63,70 @@ type WindowedThroughput struct {
 	// If MaxKeys is set to 0 (default), there is no upper bound on the number of distinct keys.
 	MaxKeys int
 
+	// MaxKeyLength, if greater than 0, limits the length in bytes of the keys
+	// this sampler will track, protecting it from callers that pass pathological
+	// keys. OnOversizeKey decides what happens to longer keys. Defaults to 0,
+	// which allows keys of any length.
+	MaxKeyLength int
+
+	// OnOversizeKey is the policy applied to keys longer than MaxKeyLength.
+	// Defaults to OversizeKeyTruncate.
+	OnOversizeKey OversizeKeyPolicy
+
+	// HoldKeyspaceSize, if true, makes the keyspace_size metric report the
+	// number of keys in the last lookback window that had traffic, rather than
+	// dropping to 0 whenever a window is empty. The window_empty metric still
+	// shows when that happens. Defaults to false.
+	HoldKeyspaceSize bool
+
+	// HeavySampleThreshold is the sample rate above which a key is counted in
+	// the keys_above_threshold metric. Defaults to 100.
+	HeavySampleThreshold int
+
+	// SmoothKeyspaceMetric, if true, reports the keyspace_size metric as a
+	// moving average of the size of the key space at the end of each
+	// interval, rather than its size when it is read, so that dashboards show
+	// a stable trend instead of jitter from one scrape to the next. The
+	// average lags real changes by a few intervals. Defaults to false.
+	SmoothKeyspaceMetric bool
+
+	// ExportOnStop, if set, is called by Stop with a copy of the sample rates
+	// from the last update. See the package documentation for details.
+	ExportOnStop func(rates map[string]int)
+
 	savedSampleRates map[string]int
 	done             chan struct{}
 	countList        BlockList
 
+	// restoredUntil is the index before which rates loaded by LoadState are
+	// kept, while the lookback window fills up again. It is 0 if none were
+	// loaded.
+	restoredUntil int64
+
 	indexGenerator IndexGenerator
 
 	lock sync.Mutex
 
+	// droppedKeys holds recent keys rejected because MaxKeys was reached
+	droppedKeys droppedKeys
+
+	// oversizeKeys applies MaxKeyLength and remembers what it rejected
+	oversizeKeys oversizeKeys
+
+	// eventRate measures events per second between updates
+	eventRate eventRate
+
+	// keyspace smooths keyspace_size, for SmoothKeyspaceMetric
+	keyspace smoothedKeyspace
+
 	// metrics
 	requestCount int64
 	eventCount   int64
-	numKeys      int
+	keptFraction int64      // parts per million, as of the last interval with traffic
+	heavyKeys    *heavyKeys // keys in savedSampleRates above HeavySampleThreshold
+	numKeys      int        // keys in the last window with traffic
+	windowEmpty  bool       // whether the last window had no traffic
+	hadTraffic   bool       // whether any window has had traffic
 }
 
 // Ensure we implement the sampler interface
@@ -76,21 +142,118 @@ type IndexGenerator interface {
 	DurationToIndexes(duration time.Duration) int64
 }
 
+// A TimeIndexGenerator is an IndexGenerator that can also turn an arbitrary
+// timestamp into an index. WindowedThroughput.GetSampleRateMultiAt uses it to
+// count replayed events in the window they actually belong to.
+type TimeIndexGenerator interface {
+	IndexGenerator
+
+	// Get the index corresponding to the given time.
+	GetIndexAt(t time.Time) int64
+}
+
 // The standard implementation of the index generator.
 type UnixSecondsIndexGenerator struct {
+	// DurationPerIndex is the duration represented by a single tick of the
+	// index. If it isn't positive, 1s is used.
 	DurationPerIndex time.Duration
 }
 
+// NewUnixSecondsIndexGenerator returns a UnixSecondsIndexGenerator whose
+// index ticks once every durationPerIndex, or an error wrapping
+// ErrInvalidInterval if durationPerIndex isn't positive.
+func NewUnixSecondsIndexGenerator(durationPerIndex time.Duration) (*UnixSecondsIndexGenerator, error) {
+	if durationPerIndex <= 0 {
+		return nil, newConfigError(ErrInvalidInterval, "the DurationPerIndex %v must be positive", durationPerIndex)
+	}
+	return &UnixSecondsIndexGenerator{DurationPerIndex: durationPerIndex}, nil
+}
+
 func (g *UnixSecondsIndexGenerator) GetCurrentIndex() int64 {
-	nsec := time.Now().UnixNano()
-	return nsec / g.DurationPerIndex.Nanoseconds()
+	return g.GetIndexAt(now())
+}
+
+func (g *UnixSecondsIndexGenerator) GetIndexAt(t time.Time) int64 {
+	return t.UnixNano() / indexDuration(g.DurationPerIndex).Nanoseconds()
 }
 
 func (g *UnixSecondsIndexGenerator) DurationToIndexes(duration time.Duration) int64 {
-	return duration.Nanoseconds() / g.DurationPerIndex.Nanoseconds()
+	return durationToIndexes(duration, g.DurationPerIndex)
+}
+
+// indexDuration returns perIndex, or 1s if it isn't positive, so that a
+// misconfigured index generator can't divide by zero.
+func indexDuration(perIndex time.Duration) time.Duration {
+	if perIndex <= 0 {
+		return time.Second
+	}
+	return perIndex
+}
+
+// durationToIndexes returns the number of ticks of perIndex in duration. Any
+// positive duration is at least one tick, so that a lookback window shorter
+// than an index is never empty.
+func durationToIndexes(duration, perIndex time.Duration) int64 {
+	n := duration.Nanoseconds() / indexDuration(perIndex).Nanoseconds()
+	if n < 1 && duration > 0 {
+		return 1
+	}
+	return n
+}
+
+// ManualIndexGenerator is an IndexGenerator whose current index only changes
+// when Advance is called. It lets tests outside this package drive a
+// WindowedThroughput sampler's window deterministically, without waiting for
+// real time to pass. It is safe for concurrent use.
+type ManualIndexGenerator struct {
+	// index is accessed atomically and is kept first for 64-bit alignment.
+	index int64
+
+	// DurationPerIndex is the duration represented by a single tick of the
+	// index. It should normally match the sampler's UpdateFrequencyDuration.
+	// Default is 1s.
+	DurationPerIndex time.Duration
+}
+
+func (g *ManualIndexGenerator) GetCurrentIndex() int64 {
+	return atomic.LoadInt64(&g.index)
+}
+
+func (g *ManualIndexGenerator) DurationToIndexes(duration time.Duration) int64 {
+	return durationToIndexes(duration, g.DurationPerIndex)
+}
+
+// Advance moves the current index forward by n ticks.
+func (g *ManualIndexGenerator) Advance(n int64) {
+	atomic.AddInt64(&g.index, n)
+}
+
+// Validate checks the sampler's configuration for errors without starting it.
+// Start calls Validate before applying defaults.
+func (t *WindowedThroughput) Validate() error {
+	if t.UpdateFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the UpdateFrequencyDuration %v must not be negative", t.UpdateFrequencyDuration)
+	}
+	if t.LookbackFrequencyDuration < 0 {
+		return newConfigError(ErrInvalidInterval, "the LookbackFrequencyDuration %v must not be negative", t.LookbackFrequencyDuration)
+	}
+	if t.GoalThroughputPerSec < 0 {
+		return newConfigError(ErrInvalidGoal, "the GoalThroughputPerSec %v must not be negative", t.GoalThroughputPerSec)
+	}
+	if t.MinEventsPerSec < 0 {
+		return newConfigError(ErrInvalidThreshold, "the MinEventsPerSec %v must not be negative", t.MinEventsPerSec)
+	}
+	if t.HeavySampleThreshold < 0 {
+		return newConfigError(ErrInvalidThreshold, "the HeavySampleThreshold %d must not be negative", t.HeavySampleThreshold)
+	}
+	return nil
 }
 
 func (t *WindowedThroughput) Start() error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
 	// apply defaults
 	if t.UpdateFrequencyDuration == 0 {
 		t.UpdateFrequencyDuration = time.Second
@@ -105,6 +268,12 @@ func (t *WindowedThroughput) Start() error {
 	if t.GoalThroughputPerSec == 0 {
 		t.GoalThroughputPerSec = 100
 	}
+	if err := checkInterval("UpdateFrequencyDuration", t.UpdateFrequencyDuration); err != nil {
+		return err
+	}
+	if err := checkInterval("LookbackFrequencyDuration", t.LookbackFrequencyDuration); err != nil {
+		return err
+	}
 
 	// Initialize countList.
 	if t.MaxKeys > 0 {
@@ -114,21 +283,37 @@ func (t *WindowedThroughput) Start() error {
 	}
 
 	// Initialize internal variables.
-	t.savedSampleRates = make(map[string]int)
 	t.done = make(chan struct{})
-	// Initialize the index generator. Each UpdateFrequencyDuration represents a single tick of the
-	// index.
-	t.indexGenerator = &UnixSecondsIndexGenerator{
-		DurationPerIndex: t.UpdateFrequencyDuration,
+	// Initialize the index generator, unless one was supplied with SetIndexGenerator. Each
+	// UpdateFrequencyDuration represents a single tick of the index.
+	if t.indexGenerator == nil {
+		g, err := NewUnixSecondsIndexGenerator(t.UpdateFrequencyDuration)
+		if err != nil {
+			return err
+		}
+		t.indexGenerator = g
+	}
+	// Create saved sample rate map if we're not loading from a previous state.
+	// Loaded rates cover the first lookback window, while the empty countList
+	// fills up.
+	if t.savedSampleRates == nil {
+		t.savedSampleRates = make(map[string]int)
+	} else {
+		t.restoredUntil = t.indexGenerator.GetCurrentIndex() +
+			t.indexGenerator.DurationToIndexes(t.LookbackFrequencyDuration)
+	}
+
+	if t.NoBackgroundGoroutine {
+		return nil
 	}
 
 	// Spin up calculator.
 	go func() {
-		ticker := time.NewTicker(t.UpdateFrequencyDuration)
+		ticker := newTicker(t.UpdateFrequencyDuration)
 		defer ticker.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.Chan():
 				t.updateMaps()
 			case <-t.done:
 				return
@@ -140,14 +325,43 @@ func (t *WindowedThroughput) Start() error {
 
 func (t *WindowedThroughput) Stop() error {
 	close(t.done)
+	exportRates(t.ExportOnStop, &t.lock, &t.savedSampleRates)
 	return nil
 }
 
+// SetIndexGenerator replaces the IndexGenerator used to assign events to blocks of the lookback
+// window. It must be called before Start, which otherwise installs a UnixSecondsIndexGenerator.
+// This is intended for tests that need to control the passage of time; see ManualIndexGenerator.
+func (t *WindowedThroughput) SetIndexGenerator(g IndexGenerator) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.indexGenerator = g
+}
+
+// Update recomputes the sample rates from the lookback window immediately. The goroutine
+// launched by Start calls it every UpdateFrequencyDuration; calling it directly is useful in
+// tests that drive the window with a ManualIndexGenerator, and required with
+// NoBackgroundGoroutine.
+func (t *WindowedThroughput) Update() {
+	t.updateMaps()
+}
+
 // updateMaps recomputes the sample rate based on the countList.
 func (t *WindowedThroughput) updateMaps() {
+	t.lock.Lock()
+	t.eventRate.update(t.eventCount, now(), t.UpdateFrequencyDuration)
+	// the index generator is read under the lock, as in getSampleRateMultiAt
 	currentIndex := t.indexGenerator.GetCurrentIndex()
 	lookbackIndexes := t.indexGenerator.DurationToIndexes(t.LookbackFrequencyDuration)
+	restoredUntil := t.restoredUntil
+	t.lock.Unlock()
+
 	aggregateCounts := t.countList.AggregateCounts(currentIndex, lookbackIndexes)
+	if currentIndex < restoredUntil {
+		// the window doesn't hold a full lookback's worth of counts yet, so
+		// keep serving the rates loaded from the previous state
+		return
+	}
 
 	// Apply the same aggregation algorithm as total throughput
 	// Short circuit if no traffic
@@ -156,26 +370,46 @@ func (t *WindowedThroughput) updateMaps() {
 		// no traffic during the last period.
 		t.lock.Lock()
 		defer t.lock.Unlock()
-		t.numKeys = 0
+		t.windowEmpty = true
 		t.savedSampleRates = make(map[string]int)
+		t.heavyKeys = nil
+		if t.HoldKeyspaceSize {
+			t.keyspace.observe(t.numKeys)
+		} else {
+			t.keyspace.observe(0)
+		}
 		return
 	}
 	// figure out our target throughput per key over the lookback window.
 	totalGoalThroughput := t.GoalThroughputPerSec * t.LookbackFrequencyDuration.Seconds()
 	// split the total throughput equally across the number of keys.
 	throughputPerKey := float64(totalGoalThroughput) / float64(numKeys)
+	// keys with fewer events than this over the lookback window are kept entirely.
+	minEventsPerKey := t.MinEventsPerSec * t.LookbackFrequencyDuration.Seconds()
 	// for each key, calculate sample rate by dividing counted events by the
 	// desired number of events
 	newSavedSampleRates := make(map[string]int)
+	heavy := newHeavyKeys(t.HeavySampleThreshold)
+	var sumEvents, kept float64
 	for k, v := range aggregateCounts {
 		rate := int(math.Max(1, (float64(v) / float64(throughputPerKey))))
-		newSavedSampleRates[k] = rate
+		if float64(v) < minEventsPerKey {
+			rate = 1
+		}
+		heavy.set(newSavedSampleRates, k, rate)
+		sumEvents += float64(v)
+		kept += float64(v) / float64(rate)
 	}
 	// save newly calculated sample rates
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	t.savedSampleRates = newSavedSampleRates
+	t.heavyKeys = heavy
+	t.keptFraction = keptFractionPPM(kept, sumEvents)
 	t.numKeys = numKeys
+	t.keyspace.observe(numKeys)
+	t.windowEmpty = false
+	t.hadTraffic = true
 }
 
 // GetSampleRate takes a key and returns the appropriate sample rate for that
@@ -187,43 +421,210 @@ func (t *WindowedThroughput) GetSampleRate(key string) int {
 // GetSampleRateMulti takes a key representing count spans and returns the
 // appropriate sample rate for that key.
 func (t *WindowedThroughput) GetSampleRateMulti(key string, count int) int {
-	t.requestCount++
-	t.eventCount += int64(count)
+	return t.GetSampleRateMulti64(key, int64(count))
+}
 
-	// Insert the new key into the map.
-	current := t.indexGenerator.GetCurrentIndex()
-	err := t.countList.IncrementKey(key, current, count)
+// GetSampleRateMulti64 is like GetSampleRateMulti, but takes count as an
+// int64, for callers whose counts come from systems that use 64-bit counts.
+func (t *WindowedThroughput) GetSampleRateMulti64(key string, count int64) int {
+	return t.getSampleRateMultiAt(key, count, nil)
+}
 
-	// We've reached MaxKeys, return 0.
-	if err != nil {
-		return 0
+// PeekSampleRate returns the sample rate GetSampleRate would return for key
+// right now, without counting the key or the call, so looking doesn't affect
+// the rates. It is for showing the rates in use, for example in logs or a UI.
+// Like GetSampleRate, it returns 0 for keys that have no rate yet.
+func (t *WindowedThroughput) PeekSampleRate(key string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.indexGenerator == nil {
+		// not started yet
+		return 1
+	}
+	key, _ = (&oversizeKeys{}).check(key, t.MaxKeyLength, t.OnOversizeKey)
+	if rate, found := t.savedSampleRates[key]; found {
+		return rate
 	}
+	return 0
+}
+
+// GetSampleRateMultiAt is like GetSampleRateMulti, but counts the spans as if
+// they had arrived at time ts rather than now. This lets historical events
+// that are being replayed or backfilled be counted in the window they belong
+// to, in any order. Events older than the lookback window are dropped the next
+// time rates are calculated, and events in the future are not counted until
+// their time comes. The rate returned is the one currently in effect.
+//
+// This requires an index generator that implements TimeIndexGenerator, as the
+// default one does. With any other generator, ts is ignored and the events are
+// counted as of now.
+func (t *WindowedThroughput) GetSampleRateMultiAt(key string, count int, ts time.Time) int {
+	return t.getSampleRateMultiAt(key, int64(count), &ts)
+}
 
+// getSampleRateMultiAt counts the spans as of ts, or as of now if ts is nil,
+// and returns key's rate. The index generator is only read under the lock,
+// here and in updateMaps, as SetIndexGenerator replaces it under the lock.
+func (t *WindowedThroughput) getSampleRateMultiAt(key string, count int64, ts *time.Time) int {
 	t.lock.Lock()
 	defer t.lock.Unlock()
+	if t.indexGenerator == nil {
+		// not started yet
+		return 1
+	}
+	index := t.indexGenerator.GetCurrentIndex()
+	if g, ok := t.indexGenerator.(TimeIndexGenerator); ok && ts != nil {
+		index = g.GetIndexAt(*ts)
+	}
+
+	t.requestCount++
+	t.eventCount += count
+
+	key, track := t.oversizeKeys.check(key, t.MaxKeyLength, t.OnOversizeKey)
+	if track {
+		// Insert the new key into the map.
+		err := t.countList.IncrementKey(key, index, clampInt(count))
+
+		// We've reached MaxKeys, return 0.
+		if err != nil {
+			t.droppedKeys.add(key)
+			return 0
+		}
+	}
+
 	if rate, found := t.savedSampleRates[key]; found {
 		return rate
 	}
 	return 0
 }
 
-// SaveState is not implemented
+// windowedThroughputState is what SaveState saves for a WindowedThroughput.
+type windowedThroughputState struct {
+	// These fields are exported for use by `JSON.Marshal` and `JSON.Unmarshal`
+	Sampler          string         `json:"sampler,omitempty"`
+	SavedSampleRates map[string]int `json:"saved_sample_rates"`
+}
+
+// SaveState returns a byte array with a JSON representation of the sampler
+// state. Only the sample rates are saved, not the counts in the lookback
+// window.
 func (t *WindowedThroughput) SaveState() ([]byte, error) {
-	return nil, nil
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.savedSampleRates == nil {
+		return nil, errors.New("saved sample rate map is nil")
+	}
+	s := &windowedThroughputState{Sampler: stateSamplerWindowedThroughput, SavedSampleRates: t.savedSampleRates}
+	return json.Marshal(s)
 }
 
-// LoadState is not implemented
+// LoadState accepts a byte array with a JSON representation of a previous
+// instance's state. It should be called before Start. The lookback window
+// starts out empty, so the loaded sample rates are used until a full
+// LookbackFrequencyDuration has passed, and rates are calculated from the
+// window after that. State that is truncated, contains impossible values, or
+// was saved by a different kind of sampler is rejected with an error, leaving
+// the sampler unchanged.
 func (t *WindowedThroughput) LoadState(state []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := windowedThroughputState{}
+	err := json.Unmarshal(state, &s)
+	if err != nil {
+		return err
+	}
+	if _, err := checkStateSampler(s.Sampler, stateSamplerWindowedThroughput, false); err != nil {
+		return err
+	}
+	if err := validateSavedSampleRates(s.SavedSampleRates); err != nil {
+		return err
+	}
+
+	t.savedSampleRates = s.SavedSampleRates
+	t.heavyKeys = countHeavyKeys(s.SavedSampleRates, t.HeavySampleThreshold)
 	return nil
 }
 
+// SupportsState reports that SaveState returns the sampler's state, so it is
+// worth persisting.
+func (t *WindowedThroughput) SupportsState() bool {
+	return true
+}
+
+// DroppedKeySamples returns up to the last 100 keys that were not counted
+// because MaxKeys had been reached, oldest first, and clears the list. This is
+// useful for finding out which keys are responsible for a cardinality problem.
+func (t *WindowedThroughput) DroppedKeySamples() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.droppedKeys.drain()
+}
+
+// OversizeKeyError returns the most recent error recorded because a key was
+// longer than MaxKeyLength and OnOversizeKey is OversizeKeyError, and clears
+// it. It returns nil if there is none.
+func (t *WindowedThroughput) OversizeKeyError() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.oversizeKeys.takeErr()
+}
+
 func (t *WindowedThroughput) GetMetrics(prefix string) map[string]int64 {
+	return metricValues(t.GetMetricsTyped(prefix))
+}
+
+// GetMetricsTyped returns the same metrics as GetMetrics, each marked as a
+// counter or a gauge. The window_empty gauge is 0 if the last lookback window
+// had traffic, 1 if it was empty but an earlier one was not, and 2 if no
+// window has had traffic yet.
+func (t *WindowedThroughput) GetMetricsTyped(prefix string) map[string]Metric {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	mets := map[string]int64{
-		prefix + "request_count": t.requestCount,
-		prefix + "event_count":   t.eventCount,
-		prefix + "keyspace_size": int64(t.numKeys),
+	keyspaceSize := int64(t.numKeys)
+	if t.windowEmpty && !t.HoldKeyspaceSize {
+		keyspaceSize = 0
+	}
+	keyspaceSize = t.keyspace.report(t.SmoothKeyspaceMetric, keyspaceSize)
+	var windowEmpty int64
+	switch {
+	case !t.hadTraffic:
+		windowEmpty = 2
+	case t.windowEmpty:
+		windowEmpty = 1
+	}
+	mets := map[string]Metric{
+		prefix + "request_count":        counter(t.requestCount),
+		prefix + "event_count":          counter(t.eventCount),
+		prefix + "keyspace_size":        gauge(keyspaceSize),
+		prefix + "keys_above_threshold": gauge(t.heavyKeys.value()),
+		prefix + "window_empty":         gauge(windowEmpty),
+		prefix + "oversize_key_count":   counter(t.oversizeKeys.count.Load()),
+		prefix + "kept_fraction":        gauge(t.keptFraction),
+		prefix + "events_per_sec":       gauge(t.eventRate.perSec),
 	}
 	return mets
 }
+
+// GetMetricsSummary returns a small, fixed set of aggregate metrics about the
+// sample rates currently in use: the number of keys, the lowest, highest, and
+// median rate, and the number of events seen. Every sampler reports the same
+// names, and the number of metrics doesn't grow with the key space, so it is
+// a good default for metrics systems that are sensitive to cardinality.
+// Computing the median sorts the rates, so this is more expensive than
+// GetMetrics for large key spaces.
+func (t *WindowedThroughput) GetMetricsSummary(prefix string) map[string]int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return summarizeRates(prefix, t.savedSampleRates, t.eventCount)
+}
+
+// GetAllSampleRates returns a copy of the sample rates calculated at the end
+// of the last interval, by key. Keys without a calculated rate are not
+// included.
+func (t *WindowedThroughput) GetAllSampleRates() map[string]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return copyRates(t.savedSampleRates)
+}
@@ -1,6 +1,7 @@
 package dynsampler
 
 import (
+	"errors"
 	"testing"
 
 	"time"
@@ -115,3 +116,208 @@ func TestSetsDefaultsCorrectly(t *testing.T) {
 	assert.Equal(t, 5*time.Second, sampler2.UpdateFrequencyDuration)
 	assert.Equal(t, 15*time.Second, sampler2.LookbackFrequencyDuration)
 }
+
+func TestManualIndexGenerator(t *testing.T) {
+	indexGenerator := &ManualIndexGenerator{DurationPerIndex: time.Second}
+	sampler := &WindowedThroughput{
+		UpdateFrequencyDuration:   1 * time.Second,
+		LookbackFrequencyDuration: 5 * time.Second,
+		GoalThroughputPerSec:      2,
+	}
+	sampler.SetIndexGenerator(indexGenerator)
+	err := sampler.Start()
+	assert.Nil(t, err)
+	defer sampler.Stop()
+	assert.Equal(t, int64(5), indexGenerator.DurationToIndexes(5*time.Second))
+
+	// Time 0: 20 traces seen.
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, 0, sampler.GetSampleRate("test_key"))
+	}
+	indexGenerator.Advance(1)
+	sampler.Update()
+
+	// Time 1: the window now covers time 0.
+	assert.Equal(t, 2, sampler.GetSampleRate("test_key"))
+
+	// Once the window has moved past all traffic, there are no rates.
+	indexGenerator.Advance(7)
+	sampler.Update()
+	assert.Equal(t, 0, sampler.GetSampleRate("test_key"))
+}
+
+func TestWindowedThroughputMinEventsPerSec(t *testing.T) {
+	indexGenerator := &TestIndexGenerator{}
+	sampler := WindowedThroughput{
+		UpdateFrequencyDuration:   1 * time.Second,
+		LookbackFrequencyDuration: 5 * time.Second,
+		GoalThroughputPerSec:      1,
+		MinEventsPerSec:           4,
+		indexGenerator:            indexGenerator,
+		countList:                 NewUnboundedBlockList(),
+	}
+
+	// 15 events over the 5s window is 3/sec, below the minimum; 100 is well above it.
+	sampler.GetSampleRateMulti("quiet", 15)
+	sampler.GetSampleRateMulti("loud", 100)
+	indexGenerator.CurrentIndex += 1
+	sampler.updateMaps()
+
+	// Without the minimum, "quiet" would get a rate of 6 (15 events / 2.5 per key).
+	assert.Equal(t, 1, sampler.GetSampleRate("quiet"))
+	assert.Equal(t, 40, sampler.GetSampleRate("loud"))
+}
+
+func TestWindowedThroughputGetSampleRateMultiAt(t *testing.T) {
+	indexGenerator := &UnixSecondsIndexGenerator{DurationPerIndex: time.Second}
+	sampler := WindowedThroughput{
+		UpdateFrequencyDuration:   1 * time.Second,
+		LookbackFrequencyDuration: 30 * time.Second,
+		GoalThroughputPerSec:      1,
+		indexGenerator:            indexGenerator,
+		countList:                 NewUnboundedBlockList(),
+	}
+
+	// replay events out of order, all within the lookback window...
+	now := time.Now()
+	for _, ago := range []int{5, 20, 2, 12, 20} {
+		sampler.GetSampleRateMultiAt("replayed", 12, now.Add(-time.Duration(ago)*time.Second))
+	}
+	// ...and some from long before it
+	sampler.GetSampleRateMultiAt("ancient", 1000, now.Add(-time.Hour))
+	sampler.updateMaps()
+
+	aggregate := sampler.countList.AggregateCounts(indexGenerator.GetCurrentIndex(), 30)
+	assert.Equal(t, map[string]int{"replayed": 60}, aggregate)
+	// 60 events over 30s against a goal of 1/sec is a rate of 2
+	assert.Equal(t, 2, sampler.GetSampleRate("replayed"))
+}
+
+func TestWindowedThroughputSaveState(t *testing.T) {
+	first := &WindowedThroughput{
+		UpdateFrequencyDuration:   time.Second,
+		LookbackFrequencyDuration: 5 * time.Second,
+		GoalThroughputPerSec:      2,
+	}
+	first.SetIndexGenerator(&ManualIndexGenerator{DurationPerIndex: time.Second})
+	first.savedSampleRates = map[string]int{"busy": 7, "quiet": 1}
+	state, err := first.SaveState()
+	assert.Nil(t, err)
+
+	indexGenerator := &ManualIndexGenerator{DurationPerIndex: time.Second}
+	second := &WindowedThroughput{
+		UpdateFrequencyDuration:   time.Second,
+		LookbackFrequencyDuration: 5 * time.Second,
+		GoalThroughputPerSec:      2,
+	}
+	second.SetIndexGenerator(indexGenerator)
+	assert.Nil(t, second.LoadState(state))
+	assert.Nil(t, second.Start())
+	defer second.Stop()
+
+	// the loaded rates are served while the empty window fills up
+	assert.Equal(t, 7, second.GetSampleRate("busy"))
+	indexGenerator.Advance(4)
+	second.Update()
+	assert.Equal(t, 7, second.GetSampleRate("busy"))
+	assert.Equal(t, 1, second.GetSampleRate("quiet"))
+
+	// after a full lookback, rates come from the window again
+	indexGenerator.Advance(1)
+	second.Update()
+	assert.Equal(t, map[string]int{"busy": 1, "quiet": 1}, second.savedSampleRates)
+
+	assert.Error(t, second.LoadState([]byte(`{"saved_sample_rates":{"busy":0}}`)))
+	assert.Error(t, second.LoadState([]byte(`{"sampler":"AvgSampleRate","saved_sample_rates":{"busy":2}}`)))
+}
+
+func TestUnixSecondsIndexGeneratorZeroDuration(t *testing.T) {
+	g, err := NewUnixSecondsIndexGenerator(0)
+	assert.Nil(t, g)
+	assert.True(t, errors.Is(err, ErrInvalidInterval), err)
+	_, err = NewUnixSecondsIndexGenerator(-time.Second)
+	assert.True(t, errors.Is(err, ErrInvalidInterval), err)
+
+	// a generator built without the constructor falls back to 1s rather than
+	// dividing by zero
+	zero := &UnixSecondsIndexGenerator{}
+	assert.NotPanics(t, func() { zero.GetCurrentIndex() })
+	assert.Equal(t, int64(30), zero.DurationToIndexes(30*time.Second))
+
+	// a positive duration shorter than an index is still one index
+	g, err = NewUnixSecondsIndexGenerator(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), g.DurationToIndexes(time.Millisecond))
+	assert.Equal(t, int64(0), g.DurationToIndexes(0))
+}
+
+func TestWindowedThroughput_GetMetrics(t *testing.T) {
+	indexGenerator := &ManualIndexGenerator{DurationPerIndex: time.Second}
+	sampler := &WindowedThroughput{
+		UpdateFrequencyDuration:   2 * time.Second,
+		LookbackFrequencyDuration: 10 * time.Second,
+		GoalThroughputPerSec:      1,
+		HeavySampleThreshold:      5,
+		indexGenerator:            indexGenerator,
+		countList:                 NewUnboundedBlockList(),
+	}
+	sampler.GetSampleRateMulti("a", 30)
+	sampler.GetSampleRateMulti("b", 10)
+	indexGenerator.Advance(2)
+	sampler.updateMaps()
+
+	mets := sampler.GetMetrics("w_")
+	assert.Equal(t, int64(2), mets["w_request_count"])
+	assert.Equal(t, int64(40), mets["w_event_count"])
+	assert.Equal(t, int64(20), mets["w_events_per_sec"])
+	// "a" gets a rate of 6, and "b" a rate of 2
+	assert.Equal(t, int64(1), mets["w_keys_above_threshold"])
+}
+
+func TestWindowedThroughputEmptyWindowMetrics(t *testing.T) {
+	for _, hold := range []bool{false, true} {
+		indexGenerator := &ManualIndexGenerator{DurationPerIndex: time.Second}
+		sampler := &WindowedThroughput{
+			UpdateFrequencyDuration:   time.Second,
+			LookbackFrequencyDuration: 5 * time.Second,
+			GoalThroughputPerSec:      1,
+			HoldKeyspaceSize:          hold,
+			indexGenerator:            indexGenerator,
+			countList:                 NewUnboundedBlockList(),
+		}
+
+		// before any window has traffic
+		mets := sampler.GetMetrics("")
+		assert.Equal(t, int64(2), mets["window_empty"])
+		assert.Equal(t, int64(0), mets["keyspace_size"])
+
+		sampler.GetSampleRateMulti("a", 10)
+		sampler.GetSampleRateMulti("b", 10)
+		sampler.GetSampleRateMulti("c", 10)
+		indexGenerator.Advance(1)
+		sampler.updateMaps()
+		mets = sampler.GetMetrics("")
+		assert.Equal(t, int64(0), mets["window_empty"])
+		assert.Equal(t, int64(3), mets["keyspace_size"])
+
+		// the traffic falls out of the lookback window, leaving it empty
+		indexGenerator.Advance(10)
+		sampler.updateMaps()
+		mets = sampler.GetMetrics("")
+		assert.Equal(t, int64(1), mets["window_empty"])
+		assert.Equal(t, int64(30), mets["event_count"])
+		if hold {
+			assert.Equal(t, int64(3), mets["keyspace_size"])
+		} else {
+			assert.Equal(t, int64(0), mets["keyspace_size"])
+		}
+
+		// traffic resumes
+		sampler.GetSampleRateMulti("d", 10)
+		indexGenerator.Advance(1)
+		sampler.updateMaps()
+		mets = sampler.GetMetrics("")
+		assert.Equal(t, int64(0), mets["window_empty"])
+		assert.Equal(t, int64(1), mets["keyspace_size"])
+	}
+}